@@ -8,13 +8,14 @@ import (
 	"os/signal"
 	"syscall"
 
-	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 
 	"github.com/codyonesock/backend_learning/ch-1/internal/appinit"
 	"github.com/codyonesock/backend_learning/ch-1/internal/consumer"
+	"github.com/codyonesock/backend_learning/ch-1/internal/dedup"
 	"github.com/codyonesock/backend_learning/ch-1/internal/metrics"
-	"github.com/codyonesock/backend_learning/ch-1/internal/stats"
+	"github.com/codyonesock/backend_learning/ch-1/internal/redpanda"
 	"github.com/codyonesock/backend_learning/ch-1/internal/storage"
 )
 
@@ -27,17 +28,36 @@ func main() {
 			fmt.Fprintf(os.Stderr, "Failed to flush logger: %v\n", err)
 		}
 	}()
-	logger.Info("Config loaded", zap.String("stream_url", config.StreamURL))
+	logger.Info("Config loaded",
+		zap.Strings("brokers", config.RedpandaBrokers),
+		zap.String("topic", config.RedpandaTopic),
+		zap.String("group", config.ConsumerGroup),
+		zap.Int("workers", config.ConsumerWorkers),
+	)
 
-	cm := metrics.NewConsumerMetrics()
+	cm := metrics.NewConsumerMetrics(prometheus.DefaultRegisterer)
 	metrics.StartServer(":2113")
 
 	storageBackend := appinit.MustInitStorage(config, logger)
-	if scyllaStorage, ok := storageBackend.(*storage.ScyllaStorage); ok {
-		defer scyllaStorage.Session.Close()
+	if closer, ok := storageBackend.(storage.Closer); ok {
+		defer closer.Close()
+	}
+
+	statsService := appinit.MustInitStats(config, logger, storageBackend)
+	defer func() {
+		if err := statsService.Close(); err != nil {
+			logger.Error("Failed to close stats service", zap.Error(err))
+		}
+	}()
+
+	// Resume this replica's counts so its next save does not take the stored stats backwards.
+	if config.Storage() != "memory" {
+		if err := statsService.LoadStats(); err != nil {
+			logger.Warn("Failed to load stats", zap.Error(err))
+		}
 	}
 
-	statsService := stats.NewStatsService(logger, storageBackend)
+	updater := dedup.NewUpdater(statsService, appinit.InitDedup(config, logger))
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -46,17 +66,19 @@ func main() {
 
 	logger.Info("Consumer started, waiting for messages...")
 
-	// Note: Just for the basic example, only run two.
-	for i := 0; i < 2; i++ {
+	for i := range config.ConsumerWorkers {
 		go func(consumerID int) {
-			cl, err := setupKafkaClient()
+			cl, err := redpanda.NewConsumerClient(
+				config,
+				consumer.RebalanceHooks(logger, statsService, cm, consumerID)...,
+			)
 			if err != nil {
 				logger.Fatal("failed to create Redpanda client", zap.Error(err))
 			}
 			defer cl.Close()
 
 			logger.Info("Consumer goroutine started", zap.Int("id", consumerID))
-			consumer.ProcessMessages(ctx, cl, logger, statsService, cm)
+			consumer.ProcessMessages(ctx, cl, logger, updater, cm)
 			logger.Info("Consumer goroutine exited", zap.Int("id", consumerID))
 		}(i)
 	}
@@ -65,21 +87,6 @@ func main() {
 	logger.Info("Consumer exited cleanly")
 }
 
-func setupKafkaClient() (*kgo.Client, error) {
-	cl, err := kgo.NewClient(
-		kgo.SeedBrokers("redpanda:9092"),
-		kgo.ConsumerGroup("wikimedia-consumer-group"),
-		kgo.ConsumeTopics("wikimedia-changes-proto"),
-		kgo.DisableAutoCommit(),
-	)
-
-	if err != nil {
-		return cl, fmt.Errorf("error setting up redpanda client: %w", err)
-	}
-
-	return cl, nil
-}
-
 func handleShutdown(logger *zap.Logger, cancel context.CancelFunc) {
 	go func() {
 		sigCh := make(chan os.Signal, 1)
@@ -0,0 +1,67 @@
+// Package main runs a fake Wikimedia EventStreams server for local development.
+//
+// Point STREAM_URL at http://localhost:8090/v2/stream/recentchange to use it.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/fakestream"
+)
+
+const readHeaderTimeout = 10 * time.Second
+
+func main() {
+	cfg := fakestream.DefaultConfig()
+
+	addr := flag.String("addr", ":8090", "address to listen on")
+	wikis := flag.String("wikis", "", "comma separated name=server_url pairs, most active first")
+	flag.Float64Var(&cfg.Rate, "rate", cfg.Rate, "events per second, 0 for as fast as possible")
+	flag.Float64Var(&cfg.BotRatio, "bot-ratio", cfg.BotRatio, "share of events from bots")
+	flag.IntVar(&cfg.Users, "users", cfg.Users, "number of distinct human users")
+	flag.IntVar(&cfg.Bots, "bots", cfg.Bots, "number of distinct bot users")
+	flag.Float64Var(&cfg.Skew, "skew", cfg.Skew, "zipf exponent for wikis and users, above 1")
+	flag.Float64Var(&cfg.MalformedRatio, "malformed", cfg.MalformedRatio, "share of events sent as broken JSON")
+	flag.IntVar(&cfg.DisconnectAfter, "disconnect-after", cfg.DisconnectAfter, "drop connections after N events")
+	flag.Int64Var(&cfg.Limit, "limit", cfg.Limit, "end the stream after this event ID")
+	flag.Uint64Var(&cfg.Seed, "seed", cfg.Seed, "seed for reproducible events")
+	flag.Parse()
+
+	if *wikis != "" {
+		cfg.Wikis = parseWikis(*wikis)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/v2/stream/recentchange", fakestream.New(cfg))
+
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           mux,
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+
+	log.Printf("fake stream listening on %s (%.1f events/s)", *addr, cfg.Rate)
+
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatalf("fake stream server error: %v", err)
+	}
+}
+
+func parseWikis(s string) []fakestream.Wiki {
+	var wikis []fakestream.Wiki
+
+	for _, pair := range strings.Split(s, ",") {
+		name, serverURL, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			log.Fatalf("invalid wiki %q, expected name=server_url", pair)
+		}
+
+		wikis = append(wikis, fakestream.Wiki{Name: name, ServerURL: serverURL})
+	}
+
+	return wikis
+}
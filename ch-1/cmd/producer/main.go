@@ -7,15 +7,24 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/twmb/franz-go/pkg/kadm"
 	"github.com/twmb/franz-go/pkg/kgo"
 	"go.uber.org/zap"
 
 	"github.com/codyonesock/backend_learning/ch-1/internal/appinit"
+	"github.com/codyonesock/backend_learning/ch-1/internal/config"
 	"github.com/codyonesock/backend_learning/ch-1/internal/metrics"
+	"github.com/codyonesock/backend_learning/ch-1/internal/recording"
+	"github.com/codyonesock/backend_learning/ch-1/internal/redpanda"
 	"github.com/codyonesock/backend_learning/ch-1/internal/status"
+	"github.com/codyonesock/backend_learning/ch-1/internal/topics"
 )
 
+const ensureTimeout = 30 * time.Second
+
 func main() {
 	config := appinit.MustLoadConfig()
 	logger := appinit.MustInitLogger(config)
@@ -26,18 +35,20 @@ func main() {
 		}
 	}()
 
-	m := metrics.NewProducerMetrics()
+	m := metrics.NewProducerMetrics(prometheus.DefaultRegisterer)
 	metrics.StartServer(":2112")
 
 	logger.Info("Config loaded",
 		zap.String("stream_url", config.StreamURL),
+		zap.Strings("brokers", config.RedpandaBrokers),
+		zap.String("topic", config.RedpandaTopic),
+		zap.String("acks", config.ProducerAcks),
+		zap.Bool("idempotent", config.ProducerIdempotent),
+		zap.String("compression", config.ProducerCompression),
+		zap.Int("max_in_flight", config.ProducerMaxInFlight),
 	)
 
-	cl, err := kgo.NewClient(
-		kgo.SeedBrokers("redpanda:9092"),
-		kgo.DefaultProduceTopic("wikimedia-changes-proto"),
-	)
-
+	cl, err := redpanda.NewProducerClient(config)
 	if err != nil {
 		logger.Fatal("failed to create Redpanda client", zap.Error(err))
 	}
@@ -47,6 +58,10 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	if config.TopicsEnsureOnStart {
+		ensureTopics(ctx, cl, logger, config)
+	}
+
 	go func() {
 		sigCh := make(chan os.Signal, 1)
 		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
@@ -55,10 +70,55 @@ func main() {
 		cancel()
 	}()
 
-	err = status.StreamAndProduce(ctx, config.StreamURL, cl, logger, m)
+	opts := status.ProduceOptions{
+		MaxInFlight: config.ProducerMaxInFlight,
+		Recorder:    nil,
+		ReplaySpeed: appinit.MustParseReplaySpeed(config, logger),
+		Filter:      appinit.MustInitFilter(config, logger),
+	}
+
+	if recorder := appinit.MustInitRecorder(config, logger); recorder != nil {
+		opts.Recorder = recorder
+		defer closeRecorder(recorder, logger)
+	}
+
+	err = status.StreamAndProduce(ctx, config.StreamURL, cl, logger, m, opts)
+
+	flushProducer(cl, logger, config)
+
 	if err != nil && ctx.Err() == nil {
 		logger.Fatal("producer error", zap.Error(err))
 	}
 
 	logger.Info("Producer exited cleanly")
 }
+
+// ensureTopics provisions the topics before producing. Failures are only logged
+// so brokers with auto-create or locked down admin ACLs still work.
+func ensureTopics(ctx context.Context, cl *kgo.Client, logger *zap.Logger, cfg *config.Config) {
+	ctx, cancel := context.WithTimeout(ctx, ensureTimeout)
+	defer cancel()
+
+	if _, err := topics.Ensure(ctx, kadm.NewClient(cl), topics.Specs(cfg), logger); err != nil {
+		logger.Warn("failed to ensure topics", zap.Error(err))
+	}
+}
+
+// closeRecorder flushes the last recording file.
+func closeRecorder(recorder *recording.Recorder, logger *zap.Logger) {
+	if err := recorder.Close(); err != nil {
+		logger.Error("Failed to close stream recorder", zap.Error(err))
+	}
+}
+
+// flushProducer waits for buffered records to be acked before the client closes.
+func flushProducer(cl *kgo.Client, logger *zap.Logger, cfg *config.Config) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ProducerFlushTimeout)
+	defer cancel()
+
+	logger.Info("Flushing buffered records", zap.Int64("buffered", cl.BufferedProduceRecords()))
+
+	if err := cl.Flush(ctx); err != nil {
+		logger.Warn("failed to flush buffered records", zap.Error(err))
+	}
+}
@@ -0,0 +1,230 @@
+// Package main replays a range of the Redpanda topic into a fresh stats service,
+// so stats can be rebuilt from history after the aggregation logic changes.
+//
+// Usage:
+//
+//	replay [-from-offset N | -from-time RFC3339] [-to-offset N | -to-time RFC3339] [-group NAME] [-storage memory|scylla|file]
+//
+// Without -group the partitions are read directly and no offsets are committed.
+// With -group the replay joins that consumer group and commits as it goes;
+// the start bound only applies the first time a group is used.
+//
+// Stats are saved once, after every range is read. An interrupted replay saves nothing,
+// so rerun it, with a fresh -group if one was used since its offsets are already committed.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/appinit"
+	"github.com/codyonesock/backend_learning/ch-1/internal/config"
+	"github.com/codyonesock/backend_learning/ch-1/internal/consumer"
+	"github.com/codyonesock/backend_learning/ch-1/internal/redpanda"
+	"github.com/codyonesock/backend_learning/ch-1/internal/stats"
+	"github.com/codyonesock/backend_learning/ch-1/internal/storage"
+)
+
+const (
+	planTimeout   = 30 * time.Second
+	progressEvery = 5 * time.Second
+	idleTimeout   = 30 * time.Second
+)
+
+type flags struct {
+	fromOffset int64
+	fromTime   string
+	toOffset   int64
+	toTime     string
+	group      string
+	storage    string
+}
+
+func main() {
+	var f flags
+
+	flag.Int64Var(&f.fromOffset, "from-offset", -1, "first offset to replay in every partition")
+	flag.StringVar(&f.fromTime, "from-time", "", "replay records at or after this RFC3339 time")
+	flag.Int64Var(&f.toOffset, "to-offset", -1, "stop before this offset in every partition")
+	flag.StringVar(&f.toTime, "to-time", "", "stop at the first record after this RFC3339 time")
+	flag.StringVar(&f.group, "group", "", "consumer group to replay as, instead of reading partitions directly")
+	flag.StringVar(&f.storage, "storage", "memory", "storage backend for the rebuilt stats: memory, scylla or file")
+	flag.Parse()
+
+	config := appinit.MustLoadConfig()
+	config.StorageBackend = f.storage
+	logger := appinit.MustInitLogger(config)
+
+	defer func() {
+		if err := logger.Sync(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to flush logger: %v\n", err)
+		}
+	}()
+
+	bounds, err := parseBounds(f)
+	if err != nil {
+		logger.Fatal("invalid replay bounds", zap.Error(err))
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	ranges := mustPlan(ctx, config, logger, bounds)
+
+	storageBackend := appinit.MustInitStorage(config, logger)
+	if closer, ok := storageBackend.(storage.Closer); ok {
+		defer closer.Close()
+	}
+
+	// Nothing is persisted until the replay finishes, so an interrupted one never
+	// overwrites the stats already in storage.
+	opts := stats.DefaultOptions()
+	opts.PersistInterval = 0
+
+	statsService, err := stats.NewStatsServiceWithOptions(logger, storageBackend, opts)
+	if err != nil {
+		logger.Fatal("failed to create stats service", zap.Error(err))
+	}
+
+	cl, err := replayClient(config, f.group, ranges)
+	if err != nil {
+		logger.Fatal("failed to create Redpanda client", zap.Error(err))
+	}
+	defer cl.Close()
+
+	replayOpts := consumer.ReplayOptions{
+		Commit:        f.group != "",
+		ProgressEvery: progressEvery,
+		EndOffsets:    nil,
+		Topic:         config.RedpandaTopic,
+		IdleTimeout:   idleTimeout,
+	}
+	// A group member can sit idle waiting for its assignment, so only direct reads check for gaps.
+	if f.group == "" {
+		replayOpts.EndOffsets = kadm.NewClient(cl)
+	}
+
+	progress, err := consumer.Replay(ctx, cl, logger, statsService, ranges, replayOpts)
+	if err != nil {
+		logger.Fatal("Replay did not finish, nothing was saved",
+			zap.Int64("applied", progress.Applied),
+			zap.Error(err),
+		)
+	}
+
+	if err := statsService.SaveStats(); err != nil {
+		logger.Fatal("failed to save replayed stats", zap.Error(err))
+	}
+
+	logger.Info("Replayed stats saved",
+		zap.String("storage", f.storage),
+		zap.Int64("applied", progress.Applied),
+		zap.Int("messages_consumed", statsService.Stats.MessagesConsumed),
+	)
+}
+
+func parseBounds(f flags) (consumer.ReplayBounds, error) {
+	bounds := consumer.ReplayBounds{
+		FromOffset: f.fromOffset,
+		FromTime:   time.Time{},
+		ToOffset:   f.toOffset,
+		ToTime:     time.Time{},
+	}
+
+	var err error
+
+	if f.fromTime != "" {
+		if bounds.FromTime, err = time.Parse(time.RFC3339, f.fromTime); err != nil {
+			return bounds, fmt.Errorf("bad -from-time: %w", err)
+		}
+	}
+
+	if f.toTime != "" {
+		if bounds.ToTime, err = time.Parse(time.RFC3339, f.toTime); err != nil {
+			return bounds, fmt.Errorf("bad -to-time: %w", err)
+		}
+	}
+
+	return bounds, nil
+}
+
+// mustPlan resolves the bounds against the topic's current offsets or exits.
+func mustPlan(
+	ctx context.Context,
+	cfg *config.Config,
+	logger *zap.Logger,
+	bounds consumer.ReplayBounds,
+) map[int32]consumer.ReplayRange {
+	cl, err := redpanda.NewAdminClient(cfg)
+	if err != nil {
+		logger.Fatal("failed to create Redpanda client", zap.Error(err))
+	}
+
+	adm := kadm.NewClient(cl)
+	defer adm.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, planTimeout)
+	defer cancel()
+
+	ranges, err := consumer.PlanReplay(ctx, adm, cfg.RedpandaTopic, bounds)
+	if err != nil {
+		logger.Fatal("failed to plan replay", zap.Error(err))
+	}
+
+	logger.Info("Replay planned", zap.String("topic", cfg.RedpandaTopic), zap.Any("ranges", ranges))
+
+	return ranges
+}
+
+// replayClient reads the planned partitions directly, or joins a dedicated group when one is given.
+// Control records are kept so Replay can see transaction markers at the end of a range.
+func replayClient(cfg *config.Config, group string, ranges map[int32]consumer.ReplayRange) (*kgo.Client, error) {
+	if group != "" {
+		groupCfg := *cfg
+		groupCfg.ConsumerGroup = group
+
+		first := int64(-1)
+		for _, r := range ranges {
+			if first < 0 || r.Start < first {
+				first = r.Start
+			}
+		}
+
+		return redpanda.NewConsumerClient(
+			&groupCfg,
+			kgo.ConsumeResetOffset(kgo.NewOffset().At(first)),
+			kgo.KeepControlRecords(),
+		)
+	}
+
+	opts, err := redpanda.ClientOpts(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up redpanda replay client: %w", err)
+	}
+
+	partitions := make(map[int32]kgo.Offset, len(ranges))
+	for partition, r := range ranges {
+		partitions[partition] = kgo.NewOffset().At(r.Start)
+	}
+
+	opts = append(opts,
+		kgo.ConsumePartitions(map[string]map[int32]kgo.Offset{cfg.RedpandaTopic: partitions}),
+		kgo.KeepControlRecords(),
+	)
+
+	cl, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up redpanda replay client: %w", err)
+	}
+
+	return cl, nil
+}
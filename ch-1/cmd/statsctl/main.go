@@ -0,0 +1,197 @@
+// Package main exports the stats from the configured storage to a file, or imports them back.
+//
+// Usage:
+//
+//	statsctl export [-format json|csv|proto] [-storage memory|scylla|file] FILE
+//	statsctl import [-format json|csv|proto] [-mode merge|replace] [-storage memory|scylla|file] FILE
+//
+// The format defaults to the file's extension: .json, .csv or .pb. Import with -mode merge adds
+// the file's counts to the stored stats, -mode replace overwrites them. With SCYLLA_MODE=shards,
+// export writes the sum of every replica's shard and import merges into the REPLICA_ID shard.
+// Replace is refused there, since the other shards would still count towards the total.
+//
+// Import loads, changes and saves the stats without any lock, so stop the consumers writing to
+// the storage first, or their next save overwrites the import.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/appinit"
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+	"github.com/codyonesock/backend_learning/ch-1/internal/statsfile"
+	"github.com/codyonesock/backend_learning/ch-1/internal/storage"
+)
+
+const usage = "usage: statsctl export|import [flags] FILE"
+
+var (
+	errInvalidMode   = errors.New("mode must be merge or replace")
+	errReplaceShards = errors.New("replace can't overwrite every replica's shard, use merge or a non sharded backend")
+)
+
+type flags struct {
+	format  string
+	mode    string
+	storage string
+	path    string
+}
+
+func main() {
+	if len(os.Args) < 2 || (os.Args[1] != "export" && os.Args[1] != "import") {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	cmd := os.Args[1]
+
+	var f flags
+
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	fs.StringVar(&f.format, "format", "", "file format: json, csv or proto, defaults to the file extension")
+	fs.StringVar(&f.storage, "storage", "", "storage backend: memory, scylla or file, defaults to STORAGE_BACKEND")
+
+	if cmd == "import" {
+		fs.StringVar(&f.mode, "mode", "merge", "merge adds to the stored stats, replace overwrites them")
+	}
+
+	_ = fs.Parse(os.Args[2:])
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	f.path = fs.Arg(0)
+
+	config := appinit.MustLoadConfig()
+	if f.storage != "" {
+		config.StorageBackend = f.storage
+	}
+
+	logger := appinit.MustInitLogger(config)
+
+	defer func() {
+		if err := logger.Sync(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to flush logger: %v\n", err)
+		}
+	}()
+
+	format, err := resolveFormat(f)
+	if err != nil {
+		logger.Fatal("invalid format", zap.Error(err))
+	}
+
+	storageBackend := appinit.MustInitStorage(config, logger)
+	if closer, ok := storageBackend.(storage.Closer); ok {
+		defer closer.Close()
+	}
+
+	var stats *shared.Stats
+
+	if cmd == "export" {
+		stats, err = export(storageBackend, f.path, format)
+	} else {
+		stats, err = importStats(storageBackend, f.path, format, f.mode)
+	}
+
+	if err != nil {
+		logger.Fatal("failed to "+cmd+" stats", zap.Error(err))
+	}
+
+	logger.Info("Stats "+cmd+"ed",
+		zap.String("file", f.path),
+		zap.String("format", string(format)),
+		zap.Int("messages_consumed", stats.MessagesConsumed),
+		zap.Int("distinct_users", len(stats.DistinctUsers)),
+		zap.Int("distinct_server_urls", len(stats.DistinctServerURLs)),
+	)
+}
+
+func resolveFormat(f flags) (statsfile.Format, error) {
+	if f.format != "" {
+		return statsfile.ParseFormat(f.format)
+	}
+
+	return statsfile.FormatFor(f.path)
+}
+
+// export writes the stored stats to path, summing shards for a sharded backend.
+func export(backend storage.Storage, path string, format statsfile.Format) (*shared.Stats, error) {
+	var (
+		stats *shared.Stats
+		err   error
+	)
+
+	if ss, ok := backend.(storage.ShardStorage); ok {
+		var shards shared.Shards
+		if shards, err = ss.LoadShards(); err == nil {
+			stats = shards.Total()
+		}
+	} else {
+		stats, err = backend.LoadStats()
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to load stats: %w", err)
+	}
+
+	out, err := os.Create(path) // #nosec G304 -- path is the command's argument
+	if err != nil {
+		return nil, fmt.Errorf("failed to create export file: %w", err)
+	}
+
+	if err := statsfile.Write(out, stats, format); err != nil {
+		_ = out.Close()
+		return nil, err
+	}
+
+	if err := out.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close export file: %w", err)
+	}
+
+	return stats, nil
+}
+
+// importStats reads path and merges it into, or replaces, the stored stats. It returns what was saved.
+func importStats(backend storage.Storage, path string, format statsfile.Format, mode string) (*shared.Stats, error) {
+	if mode != "merge" && mode != "replace" {
+		return nil, fmt.Errorf("%w: got %q", errInvalidMode, mode)
+	}
+
+	if _, sharded := backend.(storage.ShardStorage); sharded && mode == "replace" {
+		return nil, errReplaceShards
+	}
+
+	in, err := os.Open(path) // #nosec G304 -- path is the command's argument
+	if err != nil {
+		return nil, fmt.Errorf("failed to open import file: %w", err)
+	}
+	defer in.Close()
+
+	imported, err := statsfile.Read(in, format)
+	if err != nil {
+		return nil, err
+	}
+
+	if mode == "merge" {
+		current, err := backend.LoadStats()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load stats: %w", err)
+		}
+
+		current.Add(imported)
+		imported = current
+	}
+
+	if err := backend.SaveStats(imported); err != nil {
+		return nil, fmt.Errorf("failed to save stats: %w", err)
+	}
+
+	return imported, nil
+}
@@ -3,16 +3,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 
 	"github.com/codyonesock/backend_learning/ch-1/internal/appinit"
 	"github.com/codyonesock/backend_learning/ch-1/internal/config"
+	"github.com/codyonesock/backend_learning/ch-1/internal/recording"
 	"github.com/codyonesock/backend_learning/ch-1/internal/routes"
 	"github.com/codyonesock/backend_learning/ch-1/internal/stats"
 	"github.com/codyonesock/backend_learning/ch-1/internal/status"
@@ -27,7 +33,7 @@ const (
 	sleepTimeout        = 5 * time.Second
 	contextTimeout      = 15 * time.Minute
 	authTokenExpiration = 24 * time.Hour
-	saveInterval        = 1 * time.Minute
+	shutdownTimeout     = 10 * time.Second
 )
 
 func main() {
@@ -44,40 +50,56 @@ func main() {
 		zap.String("port", config.Port),
 		zap.String("stream_url", config.StreamURL),
 		zap.String("log_level", config.LogLevel),
-		zap.Bool("use_scylla", config.UseScylla),
+		zap.String("storage", config.Storage()),
 	)
 
 	storageBackend := appinit.MustInitStorage(config, logger)
-	if scyllaStorage, ok := storageBackend.(*storage.ScyllaStorage); ok {
-		defer scyllaStorage.Session.Close()
+	if closer, ok := storageBackend.(storage.Closer); ok {
+		defer closer.Close()
 	}
 
-	statsService := stats.NewStatsService(logger, storageBackend)
+	statsService := appinit.MustInitStats(config, logger, storageBackend)
+	defer closeStats(statsService, logger)
 	statusService := status.NewStatusService(logger, statsService, sleepTimeout, contextTimeout)
+	statusService.ReplaySpeed = appinit.MustParseReplaySpeed(config, logger)
+	statusService.Filter = appinit.MustInitFilter(config, logger)
+	statusService.Dedup = appinit.InitDedup(config, logger)
+	statusService.Tail = appinit.InitTail(config, logger)
+
+	if recorder := appinit.MustInitRecorder(config, logger); recorder != nil {
+		statusService.Recorder = recorder
+		defer closeRecorder(recorder, logger)
+	}
+
 	usersService := users.NewUserService(logger, config.JwtSecret, authTokenExpiration)
 
-	setupStatsPersistence(statsService, logger, config.UseScylla, saveInterval)
+	setupStatsPersistence(statsService, logger, config.Storage() != "memory")
 	startServer(config, logger, statsService, statusService, usersService)
 }
 
-// setupStatsPersistence will start saving stats data based on interval
-// and if using scylla it will preload data.
+// setupStatsPersistence preloads data when using a durable backend. Saving is scheduled by the
+// stats service itself, see STATS_PERSIST_INTERVAL.
 func setupStatsPersistence(
 	statsService *stats.Service,
 	logger *zap.Logger,
-	useScylla bool,
-	saveInterval time.Duration,
+	durable bool,
 ) {
-	statsService.StartPeriodicSave(saveInterval)
-
-	if useScylla {
+	if durable {
 		if err := statsService.LoadStats(); err != nil {
-			logger.Warn("Failed to load stats from Scylla", zap.Error(err))
+			logger.Warn("Failed to load stats", zap.Error(err))
 		}
 	}
 }
 
-// startServer starts the HTTP server with the provided services.
+// closeRecorder flushes the last recording file.
+func closeRecorder(recorder *recording.Recorder, logger *zap.Logger) {
+	if err := recorder.Close(); err != nil {
+		logger.Error("Failed to close stream recorder", zap.Error(err))
+	}
+}
+
+// startServer serves until SIGINT or SIGTERM, then shuts down and returns so the deferred
+// closes in main still flush the recorder, stats WAL and storage.
 func startServer(
 	config *config.Config,
 	logger *zap.Logger,
@@ -87,6 +109,7 @@ func startServer(
 ) {
 	r := chi.NewRouter()
 	routes.RegisterRoutes(r, config.StreamURL, statsService, statusService, usersService)
+	r.Handle("/metrics", promhttp.Handler())
 
 	logger.Info("Server running", zap.String("port", config.Port))
 	server := &http.Server{
@@ -97,7 +120,39 @@ func startServer(
 		IdleTimeout:  idleTimeout,
 	}
 
-	if err := server.ListenAndServe(); err != nil {
-		logger.Fatal("Error starting server", zap.Error(err))
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		logger.Error("Error starting server", zap.Error(err))
+		return
+	case <-ctx.Done():
+	}
+
+	logger.Info("Shutting down server...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Error("Failed to shut down server cleanly", zap.Error(err))
+	}
+
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("Server stopped with an error", zap.Error(err))
+	}
+}
+
+// closeStats closes the stats WAL so its last appends are synced.
+func closeStats(statsService *stats.Service, logger *zap.Logger) {
+	if err := statsService.Close(); err != nil {
+		logger.Error("Failed to close stats service", zap.Error(err))
 	}
 }
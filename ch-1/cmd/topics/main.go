@@ -0,0 +1,59 @@
+// Package main provisions the Redpanda topics used by the producer and consumer.
+//
+// Usage:
+//
+//	topics ensure
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/appinit"
+	"github.com/codyonesock/backend_learning/ch-1/internal/redpanda"
+	"github.com/codyonesock/backend_learning/ch-1/internal/topics"
+)
+
+const ensureTimeout = 30 * time.Second
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "ensure" {
+		fmt.Fprintln(os.Stderr, "usage: topics ensure")
+		os.Exit(2)
+	}
+
+	config := appinit.MustLoadConfig()
+	logger := appinit.MustInitLogger(config)
+
+	defer func() {
+		if err := logger.Sync(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to flush logger: %v\n", err)
+		}
+	}()
+
+	cl, err := redpanda.NewAdminClient(config)
+	if err != nil {
+		logger.Fatal("failed to create Redpanda client", zap.Error(err))
+	}
+
+	adm := kadm.NewClient(cl)
+	defer adm.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), ensureTimeout)
+	defer cancel()
+
+	result, err := topics.Ensure(ctx, adm, topics.Specs(config), logger)
+	if err != nil {
+		logger.Fatal("failed to ensure topics", zap.Error(err))
+	}
+
+	logger.Info("Topics ensured",
+		zap.Strings("created", result.Created),
+		zap.Int("drifted_settings", len(result.Drift)),
+	)
+}
@@ -0,0 +1,367 @@
+// Package anomaly flags wikis whose edit rate or bot ratio suddenly jumps above their own
+// recent baseline, e.g. vandalism or a bot run gone wrong.
+package anomaly
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+)
+
+// Kinds of anomaly.
+const (
+	KindRate     = "rate"
+	KindBotRatio = "bot_ratio"
+)
+
+// States an alert can be in.
+const (
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+const (
+	// maxGapBuckets caps how many empty buckets are replayed after a quiet spell.
+	maxGapBuckets = 60
+	// minRatioStdDev keeps a wiki with a perfectly steady bot ratio from alerting on noise.
+	minRatioStdDev = 0.05
+	// alertQueue is how many alerts can wait for slow notifiers before new ones are dropped.
+	alertQueue    = 64
+	notifyTimeout = 10 * time.Second
+)
+
+var errInvalidThresholds = errors.New("wiki thresholds must look like url=rate_z or url=rate_z:bot_ratio_z")
+
+// Thresholds are how many standard deviations above its baseline a wiki has to be to alert.
+// Zero disables that check.
+type Thresholds struct {
+	RateZ     float64
+	BotRatioZ float64
+}
+
+// Config tunes the detector.
+type Config struct {
+	// Interval is the bucket events are counted in. Every bucket is compared to the baseline.
+	Interval time.Duration
+	// Alpha is the EWMA weight of the newest bucket in the baseline mean and variance.
+	Alpha float64
+	// Default applies to every wiki without an entry in PerWiki.
+	Default Thresholds
+	// PerWiki overrides Default by server URL.
+	PerWiki map[string]Thresholds
+	// MinEvents is the fewest events in a bucket that can alert, so tiny wikis stay quiet.
+	MinEvents int
+	// Warmup is how many buckets a wiki needs before its baseline is trusted.
+	Warmup int
+	// Clock is the time source, time.Now when nil.
+	Clock func() time.Time
+}
+
+// Anomaly is one wiki out of line with its baseline.
+type Anomaly struct {
+	ServerURL string  `json:"server_url"`
+	Kind      string  `json:"kind"`
+	State     string  `json:"state"`
+	Value     float64 `json:"value"`
+	Mean      float64 `json:"mean"`
+	StdDev    float64 `json:"stddev"`
+	ZScore    float64 `json:"z_score"`
+	Threshold float64 `json:"threshold"`
+	// Since is when the anomaly started, Updated when it was last checked.
+	Since      time.Time  `json:"since"`
+	Updated    time.Time  `json:"updated"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+// baseline is an exponentially weighted mean and variance.
+type baseline struct {
+	mean     float64
+	variance float64
+	n        int
+}
+
+func (b *baseline) update(x, alpha float64) {
+	if b.n == 0 {
+		b.mean = x
+	} else {
+		diff := x - b.mean
+		incr := alpha * diff
+		b.mean += incr
+		b.variance = (1 - alpha) * (b.variance + diff*incr)
+	}
+
+	b.n++
+}
+
+type wikiState struct {
+	events   int
+	bots     int
+	rate     baseline
+	botRatio baseline
+}
+
+type alertKey struct {
+	serverURL string
+	kind      string
+}
+
+// Detector counts events per server URL and checks every finished bucket against the
+// baseline built from the ones before it. Alerts go to the notifier from a background
+// goroutine, so Observe never waits on a webhook.
+type Detector struct {
+	mu       sync.Mutex
+	cfg      Config
+	notifier Notifier
+	logger   *zap.Logger
+	start    time.Time
+	wikis    map[string]*wikiState
+	active   map[alertKey]*Anomaly
+	alerts   chan Anomaly
+	closed   bool
+	done     chan struct{}
+}
+
+// New creates a Detector. notifier may be nil to only track active anomalies.
+func New(cfg Config, notifier Notifier, logger *zap.Logger) *Detector {
+	if cfg.Clock == nil {
+		cfg.Clock = time.Now
+	}
+
+	d := &Detector{
+		mu:       sync.Mutex{},
+		cfg:      cfg,
+		notifier: notifier,
+		logger:   logger,
+		start:    cfg.Clock(),
+		wikis:    map[string]*wikiState{},
+		active:   map[alertKey]*Anomaly{},
+		alerts:   make(chan Anomaly, alertQueue),
+		closed:   false,
+		done:     make(chan struct{}),
+	}
+
+	go d.notifyLoop()
+
+	return d
+}
+
+// Observe counts a batch of events. A nil *Detector ignores them.
+func (d *Detector) Observe(batch []shared.RecentChange) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.advance()
+
+	for _, rc := range batch {
+		w, ok := d.wikis[rc.ServerURL]
+		if !ok {
+			w = &wikiState{events: 0, bots: 0, rate: baseline{}, botRatio: baseline{}}
+			d.wikis[rc.ServerURL] = w
+		}
+
+		w.events++
+		if rc.Bot {
+			w.bots++
+		}
+	}
+}
+
+// Active returns the firing anomalies, most severe first.
+func (d *Detector) Active() []Anomaly {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.advance()
+
+	out := make([]Anomaly, 0, len(d.active))
+	for _, a := range d.active {
+		out = append(out, *a)
+	}
+
+	slices.SortFunc(out, func(a, b Anomaly) int {
+		switch {
+		case a.ZScore > b.ZScore:
+			return -1
+		case a.ZScore < b.ZScore:
+			return 1
+		default:
+			return strings.Compare(a.ServerURL+a.Kind, b.ServerURL+b.Kind)
+		}
+	})
+
+	return out
+}
+
+// Close stops sending alerts once the queued ones are delivered.
+func (d *Detector) Close() {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.alerts)
+	}
+	d.mu.Unlock()
+
+	<-d.done
+}
+
+// advance checks every bucket that has ended. A quiet spell replays empty buckets, up to
+// maxGapBuckets. Callers hold mu.
+func (d *Detector) advance() {
+	now := d.cfg.Clock()
+
+	buckets := int(now.Sub(d.start) / d.cfg.Interval)
+	if buckets <= 0 {
+		return
+	}
+
+	for i := range min(buckets, maxGapBuckets) {
+		d.closeBucket(d.start.Add(time.Duration(i+1) * d.cfg.Interval))
+	}
+
+	d.start = d.start.Add(time.Duration(buckets) * d.cfg.Interval)
+}
+
+func (d *Detector) closeBucket(at time.Time) {
+	for url, w := range d.wikis {
+		th := d.thresholds(url)
+		rate := float64(w.events) / d.cfg.Interval.Seconds()
+		minStdDev := 1 / d.cfg.Interval.Seconds()
+
+		d.check(url, KindRate, rate, &w.rate, th.RateZ, minStdDev, w.events, at)
+
+		if w.events > 0 {
+			ratio := float64(w.bots) / float64(w.events)
+			d.check(url, KindBotRatio, ratio, &w.botRatio, th.BotRatioZ, minRatioStdDev, w.events, at)
+		}
+
+		w.events, w.bots = 0, 0
+	}
+}
+
+// check compares x to the baseline, fires or resolves the alert, then folds x into the baseline.
+func (d *Detector) check(url, kind string, x float64, b *baseline, threshold, minStdDev float64, events int, at time.Time) {
+	std := max(math.Sqrt(b.variance), minStdDev)
+	z := (x - b.mean) / std
+	key := alertKey{serverURL: url, kind: kind}
+	firing := threshold > 0 && b.n >= d.cfg.Warmup && events >= d.cfg.MinEvents && z >= threshold
+
+	switch a, ok := d.active[key]; {
+	case firing && ok:
+		a.Value, a.Mean, a.StdDev, a.ZScore, a.Updated = x, b.mean, std, z, at
+	case firing:
+		a := &Anomaly{
+			ServerURL:  url,
+			Kind:       kind,
+			State:      StateFiring,
+			Value:      x,
+			Mean:       b.mean,
+			StdDev:     std,
+			ZScore:     z,
+			Threshold:  threshold,
+			Since:      at,
+			Updated:    at,
+			ResolvedAt: nil,
+		}
+		d.active[key] = a
+		d.send(*a)
+	case ok:
+		delete(d.active, key)
+
+		a.State, a.Value, a.ZScore, a.Updated = StateResolved, x, z, at
+		a.ResolvedAt = &at
+		d.send(*a)
+	}
+
+	b.update(x, d.cfg.Alpha)
+}
+
+func (d *Detector) thresholds(url string) Thresholds {
+	if th, ok := d.cfg.PerWiki[url]; ok {
+		return th
+	}
+
+	return d.cfg.Default
+}
+
+// send queues an alert without blocking. Callers hold mu.
+func (d *Detector) send(a Anomaly) {
+	if d.closed || d.notifier == nil {
+		return
+	}
+
+	select {
+	case d.alerts <- a:
+	default:
+		d.logger.Warn("Anomaly alert queue full, dropping alert",
+			zap.String("server_url", a.ServerURL), zap.String("kind", a.Kind), zap.String("state", a.State))
+	}
+}
+
+func (d *Detector) notifyLoop() {
+	defer close(d.done)
+
+	for a := range d.alerts {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+
+		if err := d.notifier.Notify(ctx, a); err != nil {
+			d.logger.Error("Failed to send anomaly alert", zap.String("server_url", a.ServerURL), zap.Error(err))
+		}
+
+		cancel()
+	}
+}
+
+// ParseThresholds reads per-wiki overrides like
+// "https://en.wikipedia.org=6,https://de.wikipedia.org=5:3", rate z-score then bot ratio
+// z-score. A missing bot ratio z-score uses def's.
+func ParseThresholds(s string, def Thresholds) (map[string]Thresholds, error) {
+	out := map[string]Thresholds{}
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("%w: got %q", errInvalidThresholds, entry)
+		}
+
+		rateZ, botZ, hasBot := strings.Cut(entry[i+1:], ":")
+		th := Thresholds{RateZ: 0, BotRatioZ: def.BotRatioZ}
+
+		var err error
+		if th.RateZ, err = strconv.ParseFloat(rateZ, 64); err != nil {
+			return nil, fmt.Errorf("%w: got %q", errInvalidThresholds, entry)
+		}
+
+		if hasBot {
+			if th.BotRatioZ, err = strconv.ParseFloat(botZ, 64); err != nil {
+				return nil, fmt.Errorf("%w: got %q", errInvalidThresholds, entry)
+			}
+		}
+
+		out[entry[:i]] = th
+	}
+
+	return out, nil
+}
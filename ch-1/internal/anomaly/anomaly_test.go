@@ -0,0 +1,247 @@
+package anomaly_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/anomaly"
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// recorder keeps every alert it is sent.
+type recorder struct {
+	mu     sync.Mutex
+	alerts []anomaly.Anomaly
+}
+
+func (r *recorder) Notify(_ context.Context, a anomaly.Anomaly) error {
+	r.mu.Lock()
+	r.alerts = append(r.alerts, a)
+	r.mu.Unlock()
+
+	return nil
+}
+
+func newDetector(t *testing.T, perWiki map[string]anomaly.Thresholds) (*anomaly.Detector, *fakeClock, *recorder) {
+	t.Helper()
+
+	clock := &fakeClock{mu: sync.Mutex{}, now: time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)}
+	rec := &recorder{mu: sync.Mutex{}, alerts: nil}
+
+	d := anomaly.New(anomaly.Config{
+		Interval:  time.Minute,
+		Alpha:     0.2,
+		Default:   anomaly.Thresholds{RateZ: 3, BotRatioZ: 3},
+		PerWiki:   perWiki,
+		MinEvents: 10,
+		Warmup:    5,
+		Clock:     clock.Now,
+	}, rec, zap.NewNop())
+
+	return d, clock, rec
+}
+
+// bucket feeds one interval of events for a wiki, then moves the clock past it.
+func bucket(d *anomaly.Detector, clock *fakeClock, url string, bots, nonBots int) {
+	batch := make([]shared.RecentChange, 0, bots+nonBots)
+	for range bots {
+		batch = append(batch, shared.RecentChange{User: "bot", Bot: true, ServerURL: url})
+	}
+
+	for range nonBots {
+		batch = append(batch, shared.RecentChange{User: "human", ServerURL: url})
+	}
+
+	d.Observe(batch)
+	clock.Advance(time.Minute)
+}
+
+// TestRateSpike verifies a wiki editing ten times faster than usual fires, then resolves
+// once it calms down.
+func TestRateSpike(t *testing.T) {
+	t.Parallel()
+
+	d, clock, rec := newDetector(t, nil)
+
+	for i := range 10 {
+		bucket(d, clock, "https://en.wiki.org", 0, 58+i%5)
+	}
+
+	bucket(d, clock, "https://en.wiki.org", 0, 600)
+
+	active := d.Active()
+	if len(active) != 1 || active[0].Kind != anomaly.KindRate || active[0].ServerURL != "https://en.wiki.org" {
+		t.Fatalf("expected a rate anomaly on en, got %+v", active)
+	}
+
+	if active[0].Value != 10 || active[0].ZScore < 3 {
+		t.Errorf("expected 10/s well above the baseline, got %+v", active[0])
+	}
+
+	bucket(d, clock, "https://en.wiki.org", 0, 60)
+
+	if active := d.Active(); len(active) != 0 {
+		t.Errorf("expected the anomaly to resolve, got %+v", active)
+	}
+
+	d.Close()
+
+	if len(rec.alerts) != 2 || rec.alerts[0].State != anomaly.StateFiring ||
+		rec.alerts[1].State != anomaly.StateResolved || rec.alerts[1].ResolvedAt == nil {
+		t.Errorf("expected a firing then a resolved alert, got %+v", rec.alerts)
+	}
+}
+
+// TestBotRatioSpike verifies a jump in the share of bot edits fires on its own.
+func TestBotRatioSpike(t *testing.T) {
+	t.Parallel()
+
+	d, clock, _ := newDetector(t, nil)
+	defer d.Close()
+
+	for range 10 {
+		bucket(d, clock, "https://de.wiki.org", 10, 90)
+	}
+
+	bucket(d, clock, "https://de.wiki.org", 90, 10)
+
+	active := d.Active()
+	if len(active) != 1 || active[0].Kind != anomaly.KindBotRatio {
+		t.Fatalf("expected only a bot ratio anomaly, got %+v", active)
+	}
+
+	if active[0].Value != 0.9 {
+		t.Errorf("expected a 0.9 bot ratio, got %v", active[0].Value)
+	}
+}
+
+// TestQuietCases verifies per-wiki overrides, the warmup and the event minimum keep alerts off.
+func TestQuietCases(t *testing.T) {
+	t.Parallel()
+
+	d, clock, rec := newDetector(t, map[string]anomaly.Thresholds{
+		"https://fr.wiki.org": {RateZ: 0, BotRatioZ: 0},
+	})
+
+	for range 10 {
+		bucket(d, clock, "https://fr.wiki.org", 0, 60)
+		bucket(d, clock, "https://tiny.wiki.org", 0, 1)
+	}
+
+	// A new wiki spiking in its second bucket hasn't got a baseline yet.
+	bucket(d, clock, "https://new.wiki.org", 0, 60)
+	d.Observe([]shared.RecentChange{{User: "a", ServerURL: "https://new.wiki.org"}})
+
+	batch := make([]shared.RecentChange, 0, 609)
+	for range 600 {
+		batch = append(batch, shared.RecentChange{User: "a", ServerURL: "https://fr.wiki.org"})
+	}
+
+	for range 8 {
+		batch = append(batch, shared.RecentChange{User: "a", ServerURL: "https://tiny.wiki.org"})
+	}
+
+	for range 600 {
+		batch = append(batch, shared.RecentChange{User: "a", ServerURL: "https://new.wiki.org"})
+	}
+
+	d.Observe(batch)
+	clock.Advance(time.Minute)
+
+	if active := d.Active(); len(active) != 0 {
+		t.Errorf("expected no anomalies, got %+v", active)
+	}
+
+	d.Close()
+
+	if len(rec.alerts) != 0 {
+		t.Errorf("expected no alerts, got %+v", rec.alerts)
+	}
+}
+
+// TestParseThresholds verifies overrides parse, with the bot ratio z-score optional.
+func TestParseThresholds(t *testing.T) {
+	t.Parallel()
+
+	def := anomaly.Thresholds{RateZ: 4, BotRatioZ: 4}
+
+	got, err := anomaly.ParseThresholds("https://en.wiki.org=6, https://de.wiki.org=5:2.5,", def)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(got) != 2 || got["https://en.wiki.org"] != (anomaly.Thresholds{RateZ: 6, BotRatioZ: 4}) ||
+		got["https://de.wiki.org"] != (anomaly.Thresholds{RateZ: 5, BotRatioZ: 2.5}) {
+		t.Errorf("unexpected thresholds: %+v", got)
+	}
+
+	for _, bad := range []string{"https://en.wiki.org", "=4", "https://en.wiki.org=x", "https://en.wiki.org=4:y"} {
+		if _, err := anomaly.ParseThresholds(bad, def); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+// TestWebhookNotifier verifies the alert is posted as JSON and non-2xx answers fail.
+func TestWebhookNotifier(t *testing.T) {
+	t.Parallel()
+
+	got := make(chan anomaly.Anomaly, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a anomaly.Anomaly
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" ||
+			json.NewDecoder(r.Body).Decode(&a) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		got <- a
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+
+	//nolint:exhaustruct
+	alert := anomaly.Anomaly{ServerURL: "https://en.wiki.org", Kind: anomaly.KindRate, State: anomaly.StateFiring, ZScore: 7}
+
+	if err := anomaly.NewWebhookNotifier(srv.URL, time.Second).Notify(context.Background(), alert); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if a := <-got; a.ServerURL != alert.ServerURL || a.ZScore != 7 {
+		t.Errorf("webhook got %+v", a)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(failing.Close)
+
+	if err := anomaly.NewWebhookNotifier(failing.URL, time.Second).Notify(context.Background(), alert); err == nil {
+		t.Error("expected an error on a 500")
+	}
+}
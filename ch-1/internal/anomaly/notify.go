@@ -0,0 +1,99 @@
+package anomaly
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var errWebhookStatus = errors.New("webhook answered with a non-2xx status")
+
+// Notifier delivers alerts when an anomaly starts firing and when it resolves.
+type Notifier interface {
+	Notify(ctx context.Context, a Anomaly) error
+}
+
+// Notifiers sends every alert to each notifier in turn.
+type Notifiers []Notifier
+
+// Notify tries every notifier and joins their errors.
+func (ns Notifiers) Notify(ctx context.Context, a Anomaly) error {
+	errs := make([]error, 0, len(ns))
+	for _, n := range ns {
+		errs = append(errs, n.Notify(ctx, a))
+	}
+
+	return errors.Join(errs...)
+}
+
+// LogNotifier writes alerts to the log.
+type LogNotifier struct {
+	Logger *zap.Logger
+}
+
+// Notify logs a firing anomaly as a warning and a resolved one as info.
+func (n LogNotifier) Notify(_ context.Context, a Anomaly) error {
+	fields := []zap.Field{
+		zap.String("server_url", a.ServerURL),
+		zap.String("kind", a.Kind),
+		zap.Float64("value", a.Value),
+		zap.Float64("mean", a.Mean),
+		zap.Float64("z_score", a.ZScore),
+		zap.Time("since", a.Since),
+	}
+
+	if a.State == StateResolved {
+		n.Logger.Info("Anomaly resolved", fields...)
+	} else {
+		n.Logger.Warn("Anomaly detected", fields...)
+	}
+
+	return nil
+}
+
+// WebhookNotifier POSTs each alert as JSON to a URL, for chat or paging integrations.
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewWebhookNotifier creates a WebhookNotifier whose requests time out after timeout.
+func NewWebhookNotifier(url string, timeout time.Duration) *WebhookNotifier {
+	//nolint:exhaustruct
+	client := &http.Client{Timeout: timeout}
+
+	return &WebhookNotifier{URL: url, Client: client}
+}
+
+// Notify posts the alert and fails on anything but a 2xx answer.
+func (n *WebhookNotifier) Notify(ctx context.Context, a Anomaly) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("failed to marshal anomaly: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := n.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call webhook: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%w: %d", errWebhookStatus, res.StatusCode)
+	}
+
+	return nil
+}
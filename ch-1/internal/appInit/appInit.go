@@ -4,12 +4,23 @@ package appinit
 import (
 	"fmt"
 	"os"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 
+	"github.com/codyonesock/backend_learning/ch-1/internal/anomaly"
 	"github.com/codyonesock/backend_learning/ch-1/internal/config"
+	"github.com/codyonesock/backend_learning/ch-1/internal/dedup"
+	"github.com/codyonesock/backend_learning/ch-1/internal/filter"
 	"github.com/codyonesock/backend_learning/ch-1/internal/logger"
+	"github.com/codyonesock/backend_learning/ch-1/internal/metrics"
+	"github.com/codyonesock/backend_learning/ch-1/internal/profiles"
+	"github.com/codyonesock/backend_learning/ch-1/internal/recording"
+	"github.com/codyonesock/backend_learning/ch-1/internal/stats"
 	"github.com/codyonesock/backend_learning/ch-1/internal/storage"
+	"github.com/codyonesock/backend_learning/ch-1/internal/tail"
+	"github.com/codyonesock/backend_learning/ch-1/internal/wal"
 )
 
 // MustLoadConfig loads config or exits.
@@ -34,11 +45,53 @@ func MustInitLogger(cfg *config.Config) *zap.Logger {
 	return log
 }
 
-// MustInitStorage initializes storage backend or uses in memory.
+// MustInitStorage initializes the storage backend from STORAGE_BACKEND or USE_SCYLLA.
 //
 //nolint:ireturn
 func MustInitStorage(cfg *config.Config, log *zap.Logger) storage.Storage {
-	if cfg.UseScylla {
+	switch cfg.Storage() {
+	case "file":
+		fileStorage, err := storage.NewFileStorage(cfg.StorageFileDir, cfg.StorageFileGzip, cfg.StorageFileKeep, log)
+		if err != nil {
+			log.Fatal("Failed to initialize file storage", zap.Error(err))
+		}
+
+		log.Info("Using file storage", zap.String("dir", cfg.StorageFileDir), zap.Int("keep", cfg.StorageFileKeep))
+
+		return fileStorage
+	case "scylla":
+		return mustInitScylla(cfg, log)
+	default:
+		log.Info("Using in-memory storage")
+
+		return storage.NewMemoryStorage()
+	}
+}
+
+// mustInitScylla connects to Scylla in the configured SCYLLA_MODE.
+//
+//nolint:ireturn
+func mustInitScylla(cfg *config.Config, log *zap.Logger) storage.Storage {
+	switch cfg.ScyllaMode {
+	case "shards":
+		replica := mustReplicaID(cfg, log)
+
+		shardStorage, err := storage.NewScyllaShardStorage([]string{"scylla:9042"}, "stats_data", replica, log)
+		if err != nil {
+			log.Fatal("Failed to initialize Scylla shard storage", zap.Error(err))
+		}
+
+		log.Info("Using Scylla shard storage", zap.String("replica_id", replica))
+
+		return shardStorage
+	case "counters":
+		counterStorage, err := storage.NewScyllaCounterStorage([]string{"scylla:9042"}, "stats_data", log)
+		if err != nil {
+			log.Fatal("Failed to initialize Scylla counter storage", zap.Error(err))
+		}
+
+		return counterStorage
+	default:
 		scyllaStorage, err := storage.NewScyllaStorage([]string{"scylla:9042"}, "stats_data", log)
 		if err != nil {
 			log.Fatal("Failed to initialize Scylla storage", zap.Error(err))
@@ -46,8 +99,234 @@ func MustInitStorage(cfg *config.Config, log *zap.Logger) storage.Storage {
 
 		return scyllaStorage
 	}
+}
+
+// mustReplicaID returns REPLICA_ID or the hostname, which is the pod name in Kubernetes.
+func mustReplicaID(cfg *config.Config, log *zap.Logger) string {
+	if cfg.ReplicaID != "" {
+		return cfg.ReplicaID
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		log.Fatal("REPLICA_ID is unset and the hostname is unavailable", zap.Error(err))
+	}
+
+	return host
+}
+
+// MustInitRecorder creates the stream recorder, or returns nil when STREAM_RECORD_DIR is unset.
+func MustInitRecorder(cfg *config.Config, log *zap.Logger) *recording.Recorder {
+	if cfg.StreamRecordDir == "" {
+		return nil
+	}
+
+	rec, err := recording.NewRecorder(
+		cfg.StreamRecordDir,
+		cfg.StreamRecordGzip,
+		cfg.StreamRecordMaxBytes,
+		cfg.StreamRecordRotateEvery,
+	)
+	if err != nil {
+		log.Fatal("Failed to initialize stream recorder", zap.Error(err))
+	}
+
+	log.Info("Recording stream", zap.String("dir", cfg.StreamRecordDir), zap.Bool("gzip", cfg.StreamRecordGzip))
+
+	return rec
+}
+
+// MustParseReplaySpeed parses STREAM_REPLAY_SPEED or exits.
+func MustParseReplaySpeed(cfg *config.Config, log *zap.Logger) float64 {
+	speed, err := recording.ParseSpeed(cfg.StreamReplaySpeed)
+	if err != nil {
+		log.Fatal("Invalid STREAM_REPLAY_SPEED", zap.Error(err))
+	}
+
+	return speed
+}
+
+// MustInitFilter builds the ingestion filter from FILTER_RULES_FILE and FILTER_RULES,
+// or returns nil when neither is set.
+func MustInitFilter(cfg *config.Config, log *zap.Logger) *filter.Filter {
+	rules, err := filter.Load(cfg.FilterRulesFile, cfg.FilterRules)
+	if err != nil {
+		log.Fatal("Failed to load filter rules", zap.Error(err))
+	}
+
+	if rules == nil {
+		return nil
+	}
+
+	f, err := filter.New(*rules, metrics.NewFilterMetrics(prometheus.DefaultRegisterer))
+	if err != nil {
+		log.Fatal("Invalid filter rules", zap.Error(err))
+	}
+
+	log.Info("Filtering stream", zap.Int("rules", len(rules.Rules)), zap.String("default", string(rules.Default)))
+
+	return f
+}
+
+// InitDedup creates the duplicate event cache, or returns nil when DEDUP_ENABLED is false.
+func InitDedup(cfg *config.Config, log *zap.Logger) *dedup.Cache {
+	if !cfg.DedupEnabled {
+		return nil
+	}
+
+	log.Info("Deduplicating events",
+		zap.Duration("ttl", cfg.DedupTTL),
+		zap.Int("max_entries", cfg.DedupMaxEntries),
+		zap.Uint64("bloom_bits", cfg.DedupBloomBits),
+	)
+
+	return dedup.New(dedup.Config{
+		TTL:         cfg.DedupTTL,
+		MaxEntries:  cfg.DedupMaxEntries,
+		BloomBits:   cfg.DedupBloomBits,
+		BloomHashes: cfg.DedupBloomHashes,
+	}, metrics.NewDedupMetrics(prometheus.DefaultRegisterer))
+}
+
+// InitTail creates the /events/tail hub, or returns nil when EVENTS_TAIL_BUFFER is 0.
+func InitTail(cfg *config.Config, log *zap.Logger) *tail.Hub {
+	if cfg.EventsTailBuffer <= 0 {
+		return nil
+	}
+
+	return tail.NewHub(cfg.EventsTailBuffer, cfg.EventsTailMaxSubscribers, log)
+}
+
+// MustInitStats creates the stats service with the queue settings from config or exits.
+func MustInitStats(cfg *config.Config, log *zap.Logger, backend storage.Storage) *stats.Service {
+	policy, err := stats.ParseOverflowPolicy(cfg.StatsOverflowPolicy)
+	if err != nil {
+		log.Fatal("Invalid STATS_OVERFLOW_POLICY", zap.Error(err))
+	}
+
+	svc, err := stats.NewStatsServiceWithOptions(log, backend, stats.Options{
+		QueueSize:       cfg.StatsQueueSize,
+		BatchSize:       cfg.StatsBatchSize,
+		FlushPeriod:     cfg.StatsFlushPeriod,
+		PersistInterval: cfg.StatsPersistInterval,
+		Overflow:        policy,
+		BlockTimeout:    cfg.StatsBlockTimeout,
+		SpillDir:        cfg.StatsSpillDir,
+		Metrics:         metrics.NewStatsMetrics(prometheus.DefaultRegisterer),
+		WAL:             mustInitWAL(cfg, log),
+
+		Snapshots:        initSnapshots(cfg, log, backend),
+		SnapshotInterval: cfg.StatsSnapshotInterval,
+		StreamInterval:   cfg.StatsStreamInterval,
+		Anomalies:        mustInitAnomalies(cfg, log),
+		Profiles:         initProfiles(cfg),
+		WikiMaxUsers:     cfg.StatsWikiMaxUsers,
+	})
+	if err != nil {
+		log.Fatal("Failed to initialize stats service", zap.Error(err))
+	}
+
+	return svc
+}
+
+// initProfiles creates the user profile store, or returns nil when PROFILES_MAX_USERS is 0.
+func initProfiles(cfg *config.Config) *profiles.Store {
+	if cfg.ProfilesMaxUsers == 0 {
+		return nil
+	}
+
+	return profiles.New(cfg.ProfilesMaxUsers, nil)
+}
+
+// mustInitAnomalies creates the anomaly detector, or returns nil when ANOMALY_INTERVAL is 0.
+// Alerts are logged and, with ANOMALY_WEBHOOK_URL, posted to the webhook too.
+func mustInitAnomalies(cfg *config.Config, log *zap.Logger) *anomaly.Detector {
+	if cfg.AnomalyInterval == 0 {
+		return nil
+	}
+
+	def := anomaly.Thresholds{RateZ: cfg.AnomalyRateZ, BotRatioZ: cfg.AnomalyBotRatioZ}
+
+	perWiki, err := anomaly.ParseThresholds(cfg.AnomalyWikiThresholds, def)
+	if err != nil {
+		log.Fatal("Invalid ANOMALY_WIKI_THRESHOLDS", zap.Error(err))
+	}
+
+	notifiers := anomaly.Notifiers{anomaly.LogNotifier{Logger: log}}
+	if cfg.AnomalyWebhookURL != "" {
+		notifiers = append(notifiers, anomaly.NewWebhookNotifier(cfg.AnomalyWebhookURL, 10*time.Second))
+	}
+
+	log.Info("Anomaly detection enabled",
+		zap.Duration("interval", cfg.AnomalyInterval),
+		zap.Int("wiki_overrides", len(perWiki)),
+		zap.Bool("webhook", cfg.AnomalyWebhookURL != ""),
+	)
+
+	return anomaly.New(anomaly.Config{
+		Interval:  cfg.AnomalyInterval,
+		Alpha:     cfg.AnomalyAlpha,
+		Default:   def,
+		PerWiki:   perWiki,
+		MinEvents: cfg.AnomalyMinEvents,
+		Warmup:    cfg.AnomalyWarmup,
+		Clock:     nil,
+	}, notifiers, log)
+}
+
+// initSnapshots picks where the stats history goes. Memory and file storage keep it themselves,
+// Scylla modes share a history table that expires rows once they'd fall out of the history.
+//
+//nolint:ireturn
+func initSnapshots(cfg *config.Config, log *zap.Logger, backend storage.Storage) storage.SnapshotStorage {
+	if cfg.StatsSnapshotInterval == 0 {
+		return nil
+	}
+
+	ttl := cfg.StatsSnapshotInterval * time.Duration(cfg.StatsSnapshotKeep)
+
+	switch b := backend.(type) {
+	case *storage.MemoryStorage:
+		b.HistoryKeep = cfg.StatsSnapshotKeep
+		return b
+	case *storage.FileStorage:
+		b.HistoryKeep = cfg.StatsSnapshotKeep
+		return b
+	case *storage.ScyllaStorage:
+		return storage.NewScyllaSnapshotStorage(b.Session, ttl, log)
+	case *storage.ScyllaCounterStorage:
+		return storage.NewScyllaSnapshotStorage(b.Session, ttl, log)
+	case *storage.ScyllaShardStorage:
+		return storage.NewScyllaSnapshotStorage(b.Session, ttl, log)
+	default:
+		log.Warn("Stats snapshots are not supported by this storage backend")
+		return nil
+	}
+}
+
+// mustInitWAL opens the stats WAL when STATS_WAL_DIR is set. It is skipped with memory
+// storage, where there is no snapshot to replay it on top of.
+func mustInitWAL(cfg *config.Config, log *zap.Logger) *wal.Log {
+	if cfg.StatsWALDir == "" {
+		return nil
+	}
+
+	if cfg.Storage() == "memory" {
+		log.Warn("STATS_WAL_DIR is ignored with memory storage")
+		return nil
+	}
+
+	policy, err := wal.ParseSyncPolicy(cfg.StatsWALSync)
+	if err != nil {
+		log.Fatal("Invalid STATS_WAL_SYNC", zap.Error(err))
+	}
+
+	l, err := wal.Open(cfg.StatsWALDir, policy, cfg.StatsWALSyncInterval)
+	if err != nil {
+		log.Fatal("Failed to open stats wal", zap.Error(err))
+	}
 
-	log.Info("Using in-memory storage")
+	log.Info("Stats wal enabled", zap.String("dir", cfg.StatsWALDir), zap.String("sync", string(policy)))
 
-	return storage.NewMemoryStorage()
+	return l
 }
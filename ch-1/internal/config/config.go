@@ -4,11 +4,35 @@ package config
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/kelseyhightower/envconfig"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/stats"
 )
 
-var errInvalidStreamURL = errors.New("STREAM_URL is required but not set")
+var (
+	errInvalidStreamURL       = errors.New("STREAM_URL is required but not set")
+	errInvalidProducerAcks    = errors.New("PRODUCER_ACKS must be one of all, leader or none")
+	errIdempotentRequiresAcks = errors.New("PRODUCER_IDEMPOTENT requires PRODUCER_ACKS=all")
+	errInvalidCompression     = errors.New("PRODUCER_COMPRESSION must be one of none, gzip, snappy, lz4 or zstd")
+	errNoBrokers              = errors.New("REDPANDA_BROKERS must list at least one broker")
+	errInvalidSASLMechanism   = errors.New("REDPANDA_SASL_MECHANISM must be empty, PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512")
+	errSASLCredentials        = errors.New("REDPANDA_SASL_USER and REDPANDA_SASL_PASSWORD are required with SASL")
+	errInvalidWorkers         = errors.New("CONSUMER_WORKERS must be at least 1")
+	errInvalidTopicLayout     = errors.New("TOPIC_PARTITIONS and TOPIC_REPLICATION_FACTOR must be at least 1")
+	errInvalidTopicCompress   = errors.New("TOPIC_COMPRESSION must be one of none, gzip, snappy, lz4, zstd or producer")
+	errInvalidStatsQueue      = errors.New("STATS_QUEUE_SIZE, STATS_BATCH_SIZE, STATS_FLUSH_PERIOD and STATS_PERSIST_INTERVAL must be positive")
+	errSpillDirRequired       = errors.New("STATS_SPILL_DIR is required with STATS_OVERFLOW_POLICY=spill")
+	errInvalidScyllaMode      = errors.New("SCYLLA_MODE must be snapshot, counters or shards")
+	errInvalidStorageBackend  = errors.New("STORAGE_BACKEND must be memory, scylla or file")
+	errInvalidWALSync         = errors.New("STATS_WAL_SYNC must be always, interval or never")
+	errInvalidSnapshots       = errors.New("STATS_SNAPSHOT_INTERVAL can't be negative and STATS_SNAPSHOT_KEEP must be positive")
+	errInvalidStreamInterval  = errors.New("STATS_STREAM_INTERVAL can't be negative")
+	errInvalidProfiles        = errors.New("PROFILES_MAX_USERS can't be negative")
+	errInvalidWikiMaxUsers    = errors.New("STATS_WIKI_MAX_USERS can't be negative")
+	errInvalidAnomaly         = errors.New("ANOMALY_INTERVAL and ANOMALY_WARMUP can't be negative and ANOMALY_ALPHA must be in (0, 1]")
+)
 
 // Config is your config.
 type Config struct {
@@ -17,6 +41,106 @@ type Config struct {
 	LogLevel  string `default:"INFO"         envconfig:"LOG_LEVEL"`
 	JwtSecret string `envconfig:"JWT_SECRET" required:"true"`
 	UseScylla bool   `default:"false"        envconfig:"USE_SCYLLA"`
+
+	// ScyllaMode is snapshot (one row of maps), counters (counter tables shared by replicas)
+	// or shards (one mergeable row per replica).
+	ScyllaMode string `default:"snapshot" envconfig:"SCYLLA_MODE"`
+	// ReplicaID names this process's shard, defaults to the hostname.
+	ReplicaID string `envconfig:"REPLICA_ID"`
+
+	// StorageBackend is memory, scylla or file. Empty keeps the USE_SCYLLA behaviour.
+	StorageBackend  string `envconfig:"STORAGE_BACKEND"`
+	StorageFileDir  string `default:"./data" envconfig:"STORAGE_FILE_DIR"`
+	StorageFileGzip bool   `default:"false"  envconfig:"STORAGE_FILE_GZIP"`
+	StorageFileKeep int    `default:"5"      envconfig:"STORAGE_FILE_KEEP"`
+
+	StreamRecordDir         string        `envconfig:"STREAM_RECORD_DIR"`
+	StreamRecordGzip        bool          `default:"false"     envconfig:"STREAM_RECORD_GZIP"`
+	StreamRecordMaxBytes    int64         `default:"104857600" envconfig:"STREAM_RECORD_MAX_BYTES"`
+	StreamRecordRotateEvery time.Duration `default:"1h"        envconfig:"STREAM_RECORD_ROTATE_EVERY"`
+	StreamReplaySpeed       string        `default:"original"  envconfig:"STREAM_REPLAY_SPEED"`
+
+	FilterRulesFile string `envconfig:"FILTER_RULES_FILE"`
+	FilterRules     string `envconfig:"FILTER_RULES"`
+
+	DedupEnabled     bool          `default:"true"   envconfig:"DEDUP_ENABLED"`
+	DedupTTL         time.Duration `default:"10m"    envconfig:"DEDUP_TTL"`
+	DedupMaxEntries  int           `default:"100000" envconfig:"DEDUP_MAX_ENTRIES"`
+	DedupBloomBits   uint64        `default:"0"      envconfig:"DEDUP_BLOOM_BITS"`
+	DedupBloomHashes int           `default:"5"      envconfig:"DEDUP_BLOOM_HASHES"`
+
+	// EventsTailBuffer is how many events a /events/tail client can fall behind before it is
+	// dropped, zero disables the endpoint.
+	EventsTailBuffer         int `default:"256" envconfig:"EVENTS_TAIL_BUFFER"`
+	EventsTailMaxSubscribers int `default:"20"  envconfig:"EVENTS_TAIL_MAX_SUBSCRIBERS"`
+
+	StatsQueueSize       int           `default:"1000"  envconfig:"STATS_QUEUE_SIZE"`
+	StatsBatchSize       int           `default:"100"   envconfig:"STATS_BATCH_SIZE"`
+	StatsFlushPeriod     time.Duration `default:"1s"    envconfig:"STATS_FLUSH_PERIOD"`
+	StatsPersistInterval time.Duration `default:"10s"   envconfig:"STATS_PERSIST_INTERVAL"`
+	StatsOverflowPolicy  string        `default:"block" envconfig:"STATS_OVERFLOW_POLICY"`
+	StatsBlockTimeout    time.Duration `default:"1s"    envconfig:"STATS_BLOCK_TIMEOUT"`
+	StatsSpillDir        string        `envconfig:"STATS_SPILL_DIR"`
+
+	// StatsWALDir enables the stats write-ahead log. It only applies with a durable storage backend.
+	StatsWALDir          string        `envconfig:"STATS_WAL_DIR"`
+	StatsWALSync         string        `default:"interval" envconfig:"STATS_WAL_SYNC"`
+	StatsWALSyncInterval time.Duration `default:"1s"       envconfig:"STATS_WAL_SYNC_INTERVAL"`
+
+	// StatsSnapshotInterval is how often the stats history gets a snapshot, zero disables it.
+	StatsSnapshotInterval time.Duration `default:"5m"  envconfig:"STATS_SNAPSHOT_INTERVAL"`
+	StatsSnapshotKeep     int           `default:"288" envconfig:"STATS_SNAPSHOT_KEEP"`
+
+	// StatsStreamInterval is how often /stats/stream pushes changed stats, zero disables the stream.
+	StatsStreamInterval time.Duration `default:"1s" envconfig:"STATS_STREAM_INTERVAL"`
+	// StatsWikiMaxUsers caps the distinct users tracked per wiki, zero for no cap.
+	StatsWikiMaxUsers int `default:"10000" envconfig:"STATS_WIKI_MAX_USERS"`
+
+	// AnomalyInterval is the bucket each wiki's edit rate is checked over, zero disables detection.
+	AnomalyInterval  time.Duration `default:"1m"  envconfig:"ANOMALY_INTERVAL"`
+	AnomalyAlpha     float64       `default:"0.1" envconfig:"ANOMALY_ALPHA"`
+	AnomalyRateZ     float64       `default:"4"   envconfig:"ANOMALY_RATE_Z"`
+	AnomalyBotRatioZ float64       `default:"4"   envconfig:"ANOMALY_BOT_RATIO_Z"`
+	AnomalyMinEvents int           `default:"30"  envconfig:"ANOMALY_MIN_EVENTS"`
+	AnomalyWarmup    int           `default:"10"  envconfig:"ANOMALY_WARMUP"`
+	// AnomalyWikiThresholds overrides the z-scores per wiki, e.g. "https://en.wikipedia.org=6:5".
+	AnomalyWikiThresholds string `envconfig:"ANOMALY_WIKI_THRESHOLDS"`
+	AnomalyWebhookURL     string `envconfig:"ANOMALY_WEBHOOK_URL"`
+
+	// ProfilesMaxUsers is how many user profiles /stats/users keeps, zero disables them.
+	ProfilesMaxUsers int `default:"100000" envconfig:"PROFILES_MAX_USERS"`
+
+	ProducerAcks          string        `default:"all"     envconfig:"PRODUCER_ACKS"`
+	ProducerIdempotent    bool          `default:"true"    envconfig:"PRODUCER_IDEMPOTENT"`
+	ProducerLinger        time.Duration `default:"10ms"    envconfig:"PRODUCER_LINGER"`
+	ProducerBatchMaxBytes int32         `default:"1000000" envconfig:"PRODUCER_BATCH_MAX_BYTES"`
+	ProducerCompression   string        `default:"lz4"     envconfig:"PRODUCER_COMPRESSION"`
+	ProducerMaxInFlight   int           `default:"10000"   envconfig:"PRODUCER_MAX_IN_FLIGHT"`
+	ProducerFlushTimeout  time.Duration `default:"10s"     envconfig:"PRODUCER_FLUSH_TIMEOUT"`
+
+	RedpandaBrokers        []string `default:"redpanda:9092"           envconfig:"REDPANDA_BROKERS"`
+	RedpandaTopic          string   `default:"wikimedia-changes-proto" envconfig:"REDPANDA_TOPIC"`
+	RedpandaDLQTopic       string   `default:"wikimedia-changes-dlq"   envconfig:"REDPANDA_DLQ_TOPIC"`
+	RedpandaSnapshotTopics []string `envconfig:"REDPANDA_SNAPSHOT_TOPICS"`
+	RedpandaClientID       string   `default:"backend-learning"        envconfig:"REDPANDA_CLIENT_ID"`
+	RedpandaSASLMechanism  string   `envconfig:"REDPANDA_SASL_MECHANISM"`
+	RedpandaSASLUser       string   `envconfig:"REDPANDA_SASL_USER"`
+	RedpandaSASLPassword   string   `envconfig:"REDPANDA_SASL_PASSWORD"`
+	RedpandaTLS            bool     `default:"false"                   envconfig:"REDPANDA_TLS"`
+	RedpandaTLSCAFile      string   `envconfig:"REDPANDA_TLS_CA_FILE"`
+	RedpandaTLSCertFile    string   `envconfig:"REDPANDA_TLS_CERT_FILE"`
+	RedpandaTLSKeyFile     string   `envconfig:"REDPANDA_TLS_KEY_FILE"`
+
+	TopicsEnsureOnStart    bool          `default:"true" envconfig:"TOPICS_ENSURE_ON_START"`
+	TopicPartitions        int32         `default:"3"    envconfig:"TOPIC_PARTITIONS"`
+	TopicReplicationFactor int16         `default:"1"    envconfig:"TOPIC_REPLICATION_FACTOR"`
+	TopicCompression       string        `default:"lz4"  envconfig:"TOPIC_COMPRESSION"`
+	TopicRetention         time.Duration `default:"168h" envconfig:"TOPIC_RETENTION"`
+
+	ConsumerGroup                  string `default:"wikimedia-consumer-group" envconfig:"CONSUMER_GROUP"`
+	ConsumerWorkers                int    `default:"2"                        envconfig:"CONSUMER_WORKERS"`
+	ConsumerFetchMaxBytes          int32  `default:"52428800"                 envconfig:"CONSUMER_FETCH_MAX_BYTES"`
+	ConsumerFetchMaxPartitionBytes int32  `default:"1048576"                  envconfig:"CONSUMER_FETCH_MAX_PARTITION_BYTES"`
 }
 
 // LoadConfig loads the application config.
@@ -30,5 +154,145 @@ func LoadConfig() (*Config, error) {
 		return nil, fmt.Errorf("%w", errInvalidStreamURL)
 	}
 
+	if err := validateProducer(&cfg); err != nil {
+		return nil, err
+	}
+
+	if err := validateRedpanda(&cfg); err != nil {
+		return nil, err
+	}
+
+	if err := validateStats(&cfg); err != nil {
+		return nil, err
+	}
+
+	switch cfg.ScyllaMode {
+	case "snapshot", "counters", "shards":
+	default:
+		return nil, fmt.Errorf("%w: got %q", errInvalidScyllaMode, cfg.ScyllaMode)
+	}
+
+	switch cfg.StorageBackend {
+	case "", "memory", "scylla", "file":
+	default:
+		return nil, fmt.Errorf("%w: got %q", errInvalidStorageBackend, cfg.StorageBackend)
+	}
+
 	return &cfg, nil
 }
+
+// validateProducer checks the producer settings that kgo would otherwise reject at runtime.
+func validateProducer(cfg *Config) error {
+	switch cfg.ProducerAcks {
+	case "all", "leader", "none":
+	default:
+		return fmt.Errorf("%w: got %q", errInvalidProducerAcks, cfg.ProducerAcks)
+	}
+
+	if cfg.ProducerIdempotent && cfg.ProducerAcks != "all" {
+		return fmt.Errorf("%w", errIdempotentRequiresAcks)
+	}
+
+	switch cfg.ProducerCompression {
+	case "none", "gzip", "snappy", "lz4", "zstd":
+	default:
+		return fmt.Errorf("%w: got %q", errInvalidCompression, cfg.ProducerCompression)
+	}
+
+	return nil
+}
+
+// validateRedpanda checks the broker connection and consumer settings.
+func validateRedpanda(cfg *Config) error {
+	if len(cfg.RedpandaBrokers) == 0 {
+		return fmt.Errorf("%w", errNoBrokers)
+	}
+
+	switch cfg.RedpandaSASLMechanism {
+	case "":
+	case "PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512":
+		if cfg.RedpandaSASLUser == "" || cfg.RedpandaSASLPassword == "" {
+			return fmt.Errorf("%w", errSASLCredentials)
+		}
+	default:
+		return fmt.Errorf("%w: got %q", errInvalidSASLMechanism, cfg.RedpandaSASLMechanism)
+	}
+
+	if cfg.ConsumerWorkers < 1 {
+		return fmt.Errorf("%w: got %d", errInvalidWorkers, cfg.ConsumerWorkers)
+	}
+
+	if cfg.TopicPartitions < 1 || cfg.TopicReplicationFactor < 1 {
+		return fmt.Errorf("%w", errInvalidTopicLayout)
+	}
+
+	switch cfg.TopicCompression {
+	case "none", "gzip", "snappy", "lz4", "zstd", "producer":
+	default:
+		return fmt.Errorf("%w: got %q", errInvalidTopicCompress, cfg.TopicCompression)
+	}
+
+	return nil
+}
+
+// validateStats checks the stats update queue settings.
+func validateStats(cfg *Config) error {
+	if cfg.StatsQueueSize < 1 || cfg.StatsBatchSize < 1 ||
+		cfg.StatsFlushPeriod <= 0 || cfg.StatsPersistInterval <= 0 {
+		return fmt.Errorf("%w", errInvalidStatsQueue)
+	}
+
+	policy, err := stats.ParseOverflowPolicy(cfg.StatsOverflowPolicy)
+	if err != nil {
+		return fmt.Errorf("invalid STATS_OVERFLOW_POLICY: %w", err)
+	}
+
+	if policy == stats.OverflowSpill && cfg.StatsSpillDir == "" {
+		return fmt.Errorf("%w", errSpillDirRequired)
+	}
+
+	if cfg.StatsSnapshotInterval < 0 || cfg.StatsSnapshotKeep < 1 {
+		return fmt.Errorf("%w", errInvalidSnapshots)
+	}
+
+	if cfg.StatsStreamInterval < 0 {
+		return fmt.Errorf("%w: got %s", errInvalidStreamInterval, cfg.StatsStreamInterval)
+	}
+
+	if cfg.StatsWikiMaxUsers < 0 {
+		return fmt.Errorf("%w: got %d", errInvalidWikiMaxUsers, cfg.StatsWikiMaxUsers)
+	}
+
+	if cfg.AnomalyInterval < 0 || cfg.AnomalyWarmup < 0 || cfg.AnomalyAlpha <= 0 || cfg.AnomalyAlpha > 1 {
+		return fmt.Errorf("%w", errInvalidAnomaly)
+	}
+
+	if cfg.ProfilesMaxUsers < 0 {
+		return fmt.Errorf("%w: got %d", errInvalidProfiles, cfg.ProfilesMaxUsers)
+	}
+
+	switch cfg.StatsWALSync {
+	case "always", "never":
+	case "interval":
+		if cfg.StatsWALSyncInterval <= 0 {
+			return fmt.Errorf("%w: STATS_WAL_SYNC_INTERVAL must be positive", errInvalidWALSync)
+		}
+	default:
+		return fmt.Errorf("%w: got %q", errInvalidWALSync, cfg.StatsWALSync)
+	}
+
+	return nil
+}
+
+// Storage returns the storage backend to use, falling back to USE_SCYLLA when
+// STORAGE_BACKEND is unset.
+func (c *Config) Storage() string {
+	switch {
+	case c.StorageBackend != "":
+		return c.StorageBackend
+	case c.UseScylla:
+		return "scylla"
+	default:
+		return "memory"
+	}
+}
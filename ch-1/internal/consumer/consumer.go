@@ -3,6 +3,7 @@ package consumer
 
 import (
 	"context"
+	"strconv"
 	"time"
 
 	"github.com/twmb/franz-go/pkg/kgo"
@@ -51,7 +52,10 @@ func ProcessMessages(
 		default:
 		}
 
+		pollStart := time.Now()
 		fetches := cl.PollFetches(ctx)
+		metrics.PollLatency.Observe(time.Since(pollStart).Seconds())
+
 		if errs := fetches.Errors(); len(errs) > 0 {
 			logFetchErrors(logger, errs)
 			metrics.EventsProcessedFailed.Add(float64(len(errs)))
@@ -65,6 +69,7 @@ func ProcessMessages(
 		}
 
 		metrics.EventsConsumed.Add(float64(len(records)))
+		recordPartitionProgress(fetches, metrics)
 
 		batch := unmarshalRecords(records, logger)
 
@@ -78,10 +83,43 @@ func ProcessMessages(
 			nextUpdate = now.Add(updateInterval)
 		}
 
-		if err := cl.CommitRecords(ctx, records...); err != nil {
+		commitStart := time.Now()
+		err := cl.CommitRecords(ctx, records...)
+		metrics.CommitLatency.Observe(time.Since(commitStart).Seconds())
+
+		if err != nil {
 			logger.Warn("failed to commit offsets", zap.Error(err))
 			metrics.EventsProcessedFailed.Inc()
+
+			continue
+		}
+
+		recordCommittedOffsets(records, metrics)
+	}
+}
+
+// recordPartitionProgress exports the high watermark and lag of every partition in the fetch.
+// Lag is measured from the last record we received, so it reads 0 when we are caught up.
+func recordPartitionProgress(fetches kgo.Fetches, metrics *metrics.ConsumerMetrics) {
+	fetches.EachPartition(func(p kgo.FetchTopicPartition) {
+		partition := strconv.Itoa(int(p.Partition))
+		metrics.HighWatermark.WithLabelValues(p.Topic, partition).Set(float64(p.HighWatermark))
+
+		if len(p.Records) == 0 {
+			return
 		}
+
+		next := p.Records[len(p.Records)-1].Offset + 1
+		metrics.PartitionLag.WithLabelValues(p.Topic, partition).Set(float64(p.HighWatermark - next))
+	})
+}
+
+// recordCommittedOffsets exports the offset committed for each partition, which is the next offset to consume.
+func recordCommittedOffsets(records []*kgo.Record, metrics *metrics.ConsumerMetrics) {
+	for _, r := range records {
+		metrics.CommittedOffset.
+			WithLabelValues(r.Topic, strconv.Itoa(int(r.Partition))).
+			Set(float64(r.Offset + 1))
 	}
 }
 
@@ -91,6 +129,16 @@ func logFetchErrors(logger *zap.Logger, errs []kgo.FetchError) {
 	}
 }
 
+// recordID is the event ID used for dedup. Producers key records by meta.id, older records
+// without a key fall back to their position, which still catches redeliveries.
+func recordID(record *kgo.Record) string {
+	if len(record.Key) > 0 {
+		return string(record.Key)
+	}
+
+	return record.Topic + "/" + strconv.Itoa(int(record.Partition)) + "/" + strconv.FormatInt(record.Offset, 10)
+}
+
 func unmarshalRecords(records []*kgo.Record, logger *zap.Logger) []shared.RecentChange {
 	batch := make([]shared.RecentChange, 0, len(records))
 
@@ -105,6 +153,10 @@ func unmarshalRecords(records []*kgo.Record, logger *zap.Logger) []shared.Recent
 			User:      pb.GetUser(),
 			Bot:       pb.GetBot(),
 			ServerURL: pb.GetServerUrl(),
+			Wiki:      "",
+			Namespace: 0,
+			Type:      "",
+			Meta:      shared.Meta{ID: recordID(record)},
 		}
 		batch = append(batch, rc)
 	}
@@ -6,10 +6,13 @@ import (
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"go.uber.org/zap/zaptest"
 	"google.golang.org/protobuf/proto"
 
 	"github.com/codyonesock/backend_learning/ch-1/internal/consumer"
+	"github.com/codyonesock/backend_learning/ch-1/internal/dedup"
 	"github.com/codyonesock/backend_learning/ch-1/internal/metrics"
 	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
 	wikimedia "github.com/codyonesock/backend_learning/ch-6/proto"
@@ -18,6 +21,11 @@ import (
 
 type ctxKey string
 
+// testMetrics creates ConsumerMetrics on a fresh registry, so each test reads its own counts.
+func testMetrics() *metrics.ConsumerMetrics {
+	return metrics.NewConsumerMetrics(prometheus.NewRegistry())
+}
+
 // mockKafkaClient is a simple mock KafkaClient.
 type mockKafkaClient struct {
 	records   []*kgo.Record
@@ -74,7 +82,7 @@ func TestProcessMessages(t *testing.T) {
 	stats := &mockStatsUpdater{calls: []shared.RecentChange{}}
 	logger := zaptest.NewLogger(t)
 
-	cm := metrics.NewConsumerMetrics()
+	cm := testMetrics()
 
 	go func() {
 		consumer.ProcessMessages(ctx, client, logger, stats, cm)
@@ -99,3 +107,128 @@ func TestProcessMessages(t *testing.T) {
 	// 	t.Errorf("expected user 'blubuser', got '%s'", stats.calls[0].User)
 	// }
 }
+
+// scriptedKafkaClient returns one fetch, then cancels the context on the next poll.
+type scriptedKafkaClient struct {
+	fetches kgo.Fetches
+	cancel  context.CancelFunc
+	polled  bool
+}
+
+func (c *scriptedKafkaClient) PollFetches(_ context.Context) kgo.Fetches {
+	if c.polled {
+		c.cancel()
+		return kgo.Fetches{}
+	}
+
+	c.polled = true
+
+	return c.fetches
+}
+
+func (c *scriptedKafkaClient) CommitRecords(_ context.Context, _ ...*kgo.Record) error {
+	return nil
+}
+
+// TestProcessMessagesPartitionMetrics verifies lag, high watermark and committed offsets are exported per partition.
+//
+//nolint:exhaustruct
+func TestProcessMessagesPartitionMetrics(t *testing.T) {
+	t.Parallel()
+
+	const topic = "lag-test"
+
+	val, err := proto.Marshal(&wikimedia.RecentChange{User: "blub", Bot: false, ServerUrl: "https://blub.com"})
+	if err != nil {
+		t.Fatalf("failed to marshal rc: %v", err)
+	}
+
+	records := []*kgo.Record{
+		{Topic: topic, Partition: 1, Offset: 40, Value: val},
+		{Topic: topic, Partition: 1, Offset: 41, Value: val},
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	client := &scriptedKafkaClient{
+		fetches: kgo.Fetches{{Topics: []kgo.FetchTopic{{
+			Topic:      topic,
+			Partitions: []kgo.FetchPartition{{Partition: 1, HighWatermark: 50, Records: records}},
+		}}}},
+		cancel: cancel,
+		polled: false,
+	}
+
+	cm := testMetrics()
+	consumer.ProcessMessages(ctx, client, zaptest.NewLogger(t), &mockStatsUpdater{}, cm)
+
+	checks := map[string]struct {
+		gauge interface {
+			Write(out *dto.Metric) error
+		}
+		want float64
+	}{
+		"high watermark":   {cm.HighWatermark.WithLabelValues(topic, "1"), 50},
+		"lag":              {cm.PartitionLag.WithLabelValues(topic, "1"), 8},
+		"committed offset": {cm.CommittedOffset.WithLabelValues(topic, "1"), 42},
+	}
+
+	for name, c := range checks {
+		var out dto.Metric
+		if err := c.gauge.Write(&out); err != nil {
+			t.Fatalf("failed to read %s: %v", name, err)
+		}
+
+		if got := out.GetGauge().GetValue(); got != c.want {
+			t.Errorf("expected %s to be %v, got %v", name, c.want, got)
+		}
+	}
+}
+
+// TestProcessMessagesDedup verifies a record produced twice with the same key and a redelivered
+// unkeyed record are only counted once each.
+//
+//nolint:exhaustruct
+func TestProcessMessagesDedup(t *testing.T) {
+	t.Parallel()
+
+	const topic = "dedup-test"
+
+	val, err := proto.Marshal(&wikimedia.RecentChange{User: "blub", Bot: false, ServerUrl: "https://blub.com"})
+	if err != nil {
+		t.Fatalf("failed to marshal rc: %v", err)
+	}
+
+	records := []*kgo.Record{
+		{Topic: topic, Partition: 0, Offset: 1, Key: []byte("meta-1"), Value: val},
+		{Topic: topic, Partition: 0, Offset: 2, Key: []byte("meta-1"), Value: val},
+		{Topic: topic, Partition: 0, Offset: 3, Value: val},
+		{Topic: topic, Partition: 0, Offset: 3, Value: val},
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	client := &scriptedKafkaClient{
+		fetches: kgo.Fetches{{Topics: []kgo.FetchTopic{{
+			Topic:      topic,
+			Partitions: []kgo.FetchPartition{{Partition: 0, HighWatermark: 4, Records: records}},
+		}}}},
+		cancel: cancel,
+		polled: false,
+	}
+
+	stats := &mockStatsUpdater{}
+	cache := dedup.New(dedup.Config{TTL: time.Minute, MaxEntries: 100}, nil)
+
+	consumer.ProcessMessages(ctx, client, zaptest.NewLogger(t), dedup.NewUpdater(stats, cache), testMetrics())
+
+	if len(stats.calls) != 2 {
+		t.Fatalf("expected 2 unique updates, got %d", len(stats.calls))
+	}
+
+	if stats.calls[0].Meta.ID != "meta-1" || stats.calls[1].Meta.ID != topic+"/0/3" {
+		t.Errorf("expected the record key then the record position as IDs, got %+v", stats.calls)
+	}
+}
@@ -0,0 +1,75 @@
+// Package consumer - partition assignment hooks.
+package consumer
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/metrics"
+)
+
+// StatsFlusher persists any stats that are still queued.
+type StatsFlusher interface {
+	Flush() error
+}
+
+// RebalanceHooks returns kgo options that log assignment changes and keep the assignment metrics current.
+// Before partitions are revoked the stats are flushed and offsets committed, so whoever picks the
+// partitions up next starts from offsets that match what was saved.
+func RebalanceHooks(
+	logger *zap.Logger,
+	statsService StatsFlusher,
+	metrics *metrics.ConsumerMetrics,
+	consumerID int,
+) []kgo.Opt {
+	logger = logger.With(zap.Int("id", consumerID))
+
+	return []kgo.Opt{
+		kgo.OnPartitionsAssigned(func(_ context.Context, _ *kgo.Client, assigned map[string][]int32) {
+			logger.Info("Partitions assigned", zap.Any("partitions", assigned))
+			metrics.Rebalances.WithLabelValues("assigned").Inc()
+
+			for topic, partitions := range assigned {
+				metrics.AssignedPartitions.WithLabelValues(topic).Add(float64(len(partitions)))
+			}
+		}),
+		kgo.OnPartitionsRevoked(func(ctx context.Context, cl *kgo.Client, revoked map[string][]int32) {
+			logger.Info("Partitions revoked", zap.Any("partitions", revoked))
+			metrics.Rebalances.WithLabelValues("revoked").Inc()
+
+			if err := statsService.Flush(); err != nil {
+				logger.Error("Failed to flush stats on revoke", zap.Error(err))
+			}
+
+			if err := cl.CommitUncommittedOffsets(ctx); err != nil {
+				logger.Warn("failed to commit offsets on revoke", zap.Error(err))
+			}
+
+			forgetPartitions(revoked, metrics)
+		}),
+		kgo.OnPartitionsLost(func(_ context.Context, _ *kgo.Client, lost map[string][]int32) {
+			logger.Warn("Partitions lost", zap.Any("partitions", lost))
+			metrics.Rebalances.WithLabelValues("lost").Inc()
+
+			forgetPartitions(lost, metrics)
+		}),
+	}
+}
+
+// forgetPartitions drops the per-partition series for partitions we no longer own,
+// so another consumer's numbers aren't shadowed by stale ones from us.
+func forgetPartitions(partitions map[string][]int32, metrics *metrics.ConsumerMetrics) {
+	for topic, ps := range partitions {
+		metrics.AssignedPartitions.WithLabelValues(topic).Sub(float64(len(ps)))
+
+		for _, p := range ps {
+			partition := strconv.Itoa(int(p))
+			metrics.PartitionLag.DeleteLabelValues(topic, partition)
+			metrics.CommittedOffset.DeleteLabelValues(topic, partition)
+			metrics.HighWatermark.DeleteLabelValues(topic, partition)
+		}
+	}
+}
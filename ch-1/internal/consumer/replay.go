@@ -0,0 +1,326 @@
+// Package consumer - replaying a topic range into a fresh stats service.
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+)
+
+var errEmptyReplay = errors.New("nothing to replay in the requested range")
+
+// BatchApplier applies a batch of changes to stats right away.
+type BatchApplier interface {
+	ApplyBatch(batch []shared.RecentChange)
+}
+
+// OffsetLister is the subset of kadm.Client used to plan a replay.
+type OffsetLister interface {
+	ListStartOffsets(ctx context.Context, topics ...string) (kadm.ListedOffsets, error)
+	ListEndOffsets(ctx context.Context, topics ...string) (kadm.ListedOffsets, error)
+	ListOffsetsAfterMilli(ctx context.Context, millisecond int64, topics ...string) (kadm.ListedOffsets, error)
+}
+
+// ReplayBounds selects where a replay starts and stops. An offset wins over a time when both are set.
+// Leaving everything unset replays from the earliest offset up to the end offsets seen when planning.
+type ReplayBounds struct {
+	FromOffset int64 // -1 when unset.
+	FromTime   time.Time
+	ToOffset   int64 // -1 when unset, exclusive.
+	ToTime     time.Time
+}
+
+// ReplayRange is the half-open offset range [Start, End) to replay for one partition.
+type ReplayRange struct {
+	Start int64
+	End   int64
+}
+
+// ReplayOptions controls how Replay reads and reports.
+type ReplayOptions struct {
+	Commit        bool // Commit offsets, for replays that run as a consumer group.
+	ProgressEvery time.Duration
+	// EndOffsets, when set, is asked for Topic's end offsets once a poll has returned nothing for
+	// IdleTimeout. Partitions whose end offset has reached their range end then finish, since
+	// all they have left are gaps that will never be fetched. Without it Replay waits for them.
+	EndOffsets  OffsetLister
+	Topic       string
+	IdleTimeout time.Duration
+}
+
+// ReplayProgress counts what a replay has done so far.
+type ReplayProgress struct {
+	Records   int64
+	Applied   int64
+	Remaining int64
+}
+
+// PlanReplay resolves bounds into a range per partition, dropping partitions with nothing to read.
+func PlanReplay(
+	ctx context.Context,
+	admin OffsetLister,
+	topic string,
+	bounds ReplayBounds,
+) (map[int32]ReplayRange, error) {
+	earliest, err := admin.ListStartOffsets(ctx, topic)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list start offsets: %w", err)
+	}
+
+	latest, err := admin.ListEndOffsets(ctx, topic)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list end offsets: %w", err)
+	}
+
+	starts, err := boundOffsets(ctx, admin, topic, bounds.FromOffset, bounds.FromTime, earliest)
+	if err != nil {
+		return nil, err
+	}
+
+	ends, err := boundOffsets(ctx, admin, topic, bounds.ToOffset, bounds.ToTime, latest)
+	if err != nil {
+		return nil, err
+	}
+
+	ranges := map[int32]ReplayRange{}
+
+	for partition, hw := range offsetsFor(latest, topic) {
+		start := max(starts[partition], offsetsFor(earliest, topic)[partition])
+		end := min(ends[partition], hw)
+
+		if start < end {
+			ranges[partition] = ReplayRange{Start: start, End: end}
+		}
+	}
+
+	if len(ranges) == 0 {
+		return nil, errEmptyReplay
+	}
+
+	return ranges, nil
+}
+
+// boundOffsets resolves one side of the bounds, falling back to the given offsets when unset.
+func boundOffsets(
+	ctx context.Context,
+	admin OffsetLister,
+	topic string,
+	offset int64,
+	at time.Time,
+	fallback kadm.ListedOffsets,
+) (map[int32]int64, error) {
+	resolved := offsetsFor(fallback, topic)
+
+	switch {
+	case offset >= 0:
+		for partition := range resolved {
+			resolved[partition] = offset
+		}
+	case !at.IsZero():
+		listed, err := admin.ListOffsetsAfterMilli(ctx, at.UnixMilli(), topic)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list offsets after %s: %w", at, err)
+		}
+
+		for partition, o := range offsetsFor(listed, topic) {
+			// -1 means no record at or after the time, so the partition is read to its end.
+			if o >= 0 {
+				resolved[partition] = o
+			}
+		}
+	}
+
+	return resolved, nil
+}
+
+func offsetsFor(listed kadm.ListedOffsets, topic string) map[int32]int64 {
+	out := map[int32]int64{}
+
+	for partition, o := range listed[topic] {
+		if o.Err == nil {
+			out[partition] = o.Offset
+		}
+	}
+
+	return out
+}
+
+// Replay polls records until every partition reaches the end of its range, applying each batch to stats.
+// Records outside the ranges, e.g. ones fetched past the end, are skipped.
+// The client must already be positioned at the range starts, and should keep control records
+// (kgo.KeepControlRecords) so a range ending on a transaction marker still finishes.
+func Replay(
+	ctx context.Context,
+	cl KafkaClient,
+	logger *zap.Logger,
+	statsService BatchApplier,
+	ranges map[int32]ReplayRange,
+	opts ReplayOptions,
+) (ReplayProgress, error) {
+	var progress ReplayProgress
+
+	pending := make(map[int32]ReplayRange, len(ranges))
+	for partition, r := range ranges {
+		pending[partition] = r
+		progress.Remaining += r.End - r.Start
+	}
+
+	nextReport := time.Now().Add(opts.ProgressEvery)
+
+	for len(pending) > 0 {
+		if err := ctx.Err(); err != nil {
+			return progress, fmt.Errorf("replay stopped early: %w", err)
+		}
+
+		fetches, idle := poll(ctx, cl, opts)
+		if idle {
+			if err := finishIdle(ctx, opts, pending, &progress, logger); err != nil {
+				logger.Warn("failed to check idle replay partitions", zap.Error(err))
+			}
+
+			continue
+		}
+
+		records := inRange(fetches, pending, &progress, logger)
+		if len(records) == 0 {
+			continue
+		}
+
+		batch := unmarshalRecords(records, logger)
+		statsService.ApplyBatch(batch)
+		progress.Applied += int64(len(batch))
+
+		if opts.Commit {
+			if err := cl.CommitRecords(ctx, records...); err != nil {
+				logger.Warn("failed to commit replay offsets", zap.Error(err))
+			}
+		}
+
+		if now := time.Now(); opts.ProgressEvery > 0 && now.After(nextReport) {
+			logReplayProgress(logger, "Replay progress", progress, len(pending))
+			nextReport = now.Add(opts.ProgressEvery)
+		}
+	}
+
+	logReplayProgress(logger, "Replay finished", progress, 0)
+
+	return progress, nil
+}
+
+// poll waits for the next fetches, for at most IdleTimeout when idle partitions can be checked.
+// idle reports that nothing arrived in that time.
+func poll(ctx context.Context, cl KafkaClient, opts ReplayOptions) (kgo.Fetches, bool) {
+	if opts.EndOffsets == nil || opts.IdleTimeout <= 0 {
+		return cl.PollFetches(ctx), false
+	}
+
+	pollCtx, cancel := context.WithTimeout(ctx, opts.IdleTimeout)
+	defer cancel()
+
+	fetches := cl.PollFetches(pollCtx)
+
+	return fetches, fetches.NumRecords() == 0 && pollCtx.Err() != nil && ctx.Err() == nil
+}
+
+// finishIdle finishes the pending partitions whose end offset has reached their range end. After
+// an idle poll nothing is left to fetch below it, so the rest of their range is gaps, e.g. compacted
+// away or a transaction marker, and kgo won't return them on their own.
+func finishIdle(
+	ctx context.Context,
+	opts ReplayOptions,
+	pending map[int32]ReplayRange,
+	progress *ReplayProgress,
+	logger *zap.Logger,
+) error {
+	listed, err := opts.EndOffsets.ListEndOffsets(ctx, opts.Topic)
+	if err != nil {
+		return fmt.Errorf("failed to list end offsets: %w", err)
+	}
+
+	ends := offsetsFor(listed, opts.Topic)
+
+	for partition, rng := range pending {
+		if end, ok := ends[partition]; ok && end >= rng.End {
+			logger.Info("Replay partition idle at a gap, finishing it",
+				zap.Int32("partition", partition),
+				zap.Int64("skipped_from", rng.Start),
+				zap.Int64("skipped_to", rng.End),
+			)
+
+			progress.Remaining -= rng.End - rng.Start
+			delete(pending, partition)
+		}
+	}
+
+	return nil
+}
+
+// inRange keeps the data records that fall inside their partition's range, moving each pending
+// range's start past what was polled. A partition is done once an offset at or past its last one
+// is polled, or once it comes back empty with its high watermark or last stable offset at the end
+// of the range: whatever offsets are left are gaps, e.g. compacted away, that will never be returned.
+// Errors are logged per partition, so one failing partition doesn't drop the others' records.
+func inRange(
+	fetches kgo.Fetches,
+	pending map[int32]ReplayRange,
+	progress *ReplayProgress,
+	logger *zap.Logger,
+) []*kgo.Record {
+	var kept []*kgo.Record
+
+	fetches.EachPartition(func(p kgo.FetchTopicPartition) {
+		if p.Err != nil {
+			logger.Warn("fetch error", zap.Int32("partition", p.Partition), zap.Error(p.Err))
+		}
+
+		rng, ok := pending[p.Partition]
+		if !ok {
+			return
+		}
+
+		next := rng.Start
+		if p.Err == nil && len(p.Records) == 0 && max(p.HighWatermark, p.LastStableOffset) >= rng.End {
+			next = rng.End
+		}
+
+		for _, r := range p.Records {
+			if r.Offset < next || r.Offset >= rng.End {
+				next = max(next, min(r.Offset+1, rng.End))
+				continue
+			}
+
+			if !r.Attrs.IsControl() {
+				kept = append(kept, r)
+				progress.Records++
+			}
+
+			next = r.Offset + 1
+		}
+
+		progress.Remaining -= next - rng.Start
+
+		if next >= rng.End {
+			delete(pending, p.Partition)
+		} else {
+			pending[p.Partition] = ReplayRange{Start: next, End: rng.End}
+		}
+	})
+
+	return kept
+}
+
+func logReplayProgress(logger *zap.Logger, msg string, progress ReplayProgress, partitionsLeft int) {
+	logger.Info(msg,
+		zap.Int64("records", progress.Records),
+		zap.Int64("applied", progress.Applied),
+		zap.Int64("remaining", max(progress.Remaining, 0)),
+		zap.Int("partitions_left", partitionsLeft),
+	)
+}
@@ -0,0 +1,333 @@
+package consumer_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/consumer"
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+	wikimedia "github.com/codyonesock/backend_learning/ch-6/proto"
+)
+
+// mockOffsetLister serves fixed start, end and by-time offsets for two partitions.
+type mockOffsetLister struct {
+	start, end, afterMilli map[int32]int64
+}
+
+func listed(topic string, offsets map[int32]int64) kadm.ListedOffsets {
+	out := kadm.ListedOffsets{topic: {}}
+	for p, o := range offsets {
+		//nolint:exhaustruct
+		out[topic][p] = kadm.ListedOffset{Topic: topic, Partition: p, Offset: o}
+	}
+
+	return out
+}
+
+func (m *mockOffsetLister) ListStartOffsets(_ context.Context, topics ...string) (kadm.ListedOffsets, error) {
+	return listed(topics[0], m.start), nil
+}
+
+func (m *mockOffsetLister) ListEndOffsets(_ context.Context, topics ...string) (kadm.ListedOffsets, error) {
+	return listed(topics[0], m.end), nil
+}
+
+func (m *mockOffsetLister) ListOffsetsAfterMilli(
+	_ context.Context,
+	_ int64,
+	topics ...string,
+) (kadm.ListedOffsets, error) {
+	return listed(topics[0], m.afterMilli), nil
+}
+
+// TestPlanReplay verifies bounds are clamped to what the topic holds and empty partitions are dropped.
+func TestPlanReplay(t *testing.T) {
+	t.Parallel()
+
+	lister := &mockOffsetLister{
+		start:      map[int32]int64{0: 5, 1: 0},
+		end:        map[int32]int64{0: 100, 1: 3},
+		afterMilli: map[int32]int64{0: 60, 1: -1},
+	}
+
+	ranges, err := consumer.PlanReplay(t.Context(), lister, "t", consumer.ReplayBounds{
+		FromOffset: 0,
+		FromTime:   time.Time{},
+		ToOffset:   -1,
+		ToTime:     time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := map[int32]consumer.ReplayRange{
+		0: {Start: 5, End: 60},
+		1: {Start: 0, End: 3},
+	}
+
+	if len(ranges) != len(want) {
+		t.Fatalf("expected %v, got %v", want, ranges)
+	}
+
+	for p, r := range want {
+		if ranges[p] != r {
+			t.Errorf("partition %d: expected %+v, got %+v", p, r, ranges[p])
+		}
+	}
+
+	if _, err := consumer.PlanReplay(t.Context(), lister, "t", consumer.ReplayBounds{
+		FromOffset: 200,
+		FromTime:   time.Time{},
+		ToOffset:   -1,
+		ToTime:     time.Time{},
+	}); err == nil {
+		t.Error("expected an error for a range past the end of the topic")
+	}
+}
+
+// batchRecorder collects applied batches.
+type batchRecorder struct {
+	applied []shared.RecentChange
+}
+
+func (b *batchRecorder) ApplyBatch(batch []shared.RecentChange) {
+	b.applied = append(b.applied, batch...)
+}
+
+// queuedKafkaClient hands out one queued fetch per poll.
+type queuedKafkaClient struct {
+	queue     []kgo.Fetches
+	committed int
+}
+
+func (c *queuedKafkaClient) PollFetches(ctx context.Context) kgo.Fetches {
+	if len(c.queue) == 0 {
+		<-ctx.Done()
+		return kgo.NewErrFetch(ctx.Err())
+	}
+
+	f := c.queue[0]
+	c.queue = c.queue[1:]
+
+	return f
+}
+
+func (c *queuedKafkaClient) CommitRecords(_ context.Context, records ...*kgo.Record) error {
+	c.committed += len(records)
+	return nil
+}
+
+// TestReplay verifies only in-range records are applied and the replay stops once every range is read.
+//
+//nolint:exhaustruct
+func TestReplay(t *testing.T) {
+	t.Parallel()
+
+	record := func(partition int32, offset int64, user string) *kgo.Record {
+		val, err := proto.Marshal(&wikimedia.RecentChange{User: user, Bot: false, ServerUrl: "https://blub.com"})
+		if err != nil {
+			t.Fatalf("failed to marshal rc: %v", err)
+		}
+
+		return &kgo.Record{Topic: "t", Partition: partition, Offset: offset, Value: val}
+	}
+
+	fetch := func(partition int32, records ...*kgo.Record) kgo.Fetches {
+		return kgo.Fetches{{Topics: []kgo.FetchTopic{{
+			Topic:      "t",
+			Partitions: []kgo.FetchPartition{{Partition: partition, Records: records}},
+		}}}}
+	}
+
+	client := &queuedKafkaClient{
+		queue: []kgo.Fetches{
+			fetch(0, record(0, 10, "a"), record(0, 11, "b")),
+			fetch(1, record(1, 0, "c")),
+			fetch(0, record(0, 12, "d"), record(0, 13, "past-the-end")),
+		},
+		committed: 0,
+	}
+
+	ranges := map[int32]consumer.ReplayRange{
+		0: {Start: 10, End: 13},
+		1: {Start: 0, End: 1},
+	}
+
+	applier := &batchRecorder{}
+
+	progress, err := consumer.Replay(t.Context(), client, zap.NewNop(), applier, ranges, consumer.ReplayOptions{
+		Commit:        true,
+		ProgressEvery: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if progress.Applied != 4 || len(applier.applied) != 4 {
+		t.Fatalf("expected 4 applied changes, got %d (%v)", progress.Applied, applier.applied)
+	}
+
+	for _, rc := range applier.applied {
+		if rc.User == "past-the-end" {
+			t.Errorf("applied a record outside the replay range")
+		}
+	}
+
+	if client.committed != 4 {
+		t.Errorf("expected 4 committed records, got %d", client.committed)
+	}
+}
+
+// TestReplayGapAtEnd verifies a partition whose last offsets never arrive, e.g. compacted away or
+// taken by a transaction marker, still finishes instead of hanging the replay.
+//
+//nolint:exhaustruct
+func TestReplayGapAtEnd(t *testing.T) {
+	t.Parallel()
+
+	record := func(partition int32, offset int64, user string) *kgo.Record {
+		val, err := proto.Marshal(&wikimedia.RecentChange{User: user, Bot: false, ServerUrl: "https://blub.com"})
+		if err != nil {
+			t.Fatalf("failed to marshal rc: %v", err)
+		}
+
+		return &kgo.Record{Topic: "t", Partition: partition, Offset: offset, Value: val}
+	}
+
+	partitions := func(parts ...kgo.FetchPartition) kgo.Fetches {
+		return kgo.Fetches{{Topics: []kgo.FetchTopic{{Topic: "t", Partitions: parts}}}}
+	}
+
+	client := &queuedKafkaClient{
+		queue: []kgo.Fetches{
+			partitions(
+				kgo.FetchPartition{Partition: 0, HighWatermark: 13, Records: []*kgo.Record{record(0, 10, "a"), record(0, 11, "b")}},
+				kgo.FetchPartition{Partition: 1, HighWatermark: 4, Records: []*kgo.Record{record(1, 3, "c")}},
+			),
+			partitions(
+				kgo.FetchPartition{Partition: 0, HighWatermark: 13},
+				kgo.FetchPartition{Partition: 1, HighWatermark: 6, LastStableOffset: 5},
+				kgo.FetchPartition{Partition: 2, HighWatermark: 9, Records: []*kgo.Record{record(2, 8, "past-the-gap")}},
+			),
+		},
+		committed: 0,
+	}
+
+	ranges := map[int32]consumer.ReplayRange{
+		0: {Start: 10, End: 13},
+		1: {Start: 3, End: 5},
+		2: {Start: 5, End: 7},
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+
+	applier := &batchRecorder{}
+
+	progress, err := consumer.Replay(ctx, client, zap.NewNop(), applier, ranges, consumer.ReplayOptions{})
+	if err != nil {
+		t.Fatalf("expected the replay to finish, got %v", err)
+	}
+
+	if progress.Applied != 3 || progress.Remaining != 0 {
+		t.Errorf("expected 3 applied and nothing remaining, got %+v (%v)", progress, applier.applied)
+	}
+}
+
+// TestReplayPartitionError verifies a failing partition doesn't drop the records fetched for
+// the others alongside it.
+//
+//nolint:exhaustruct
+func TestReplayPartitionError(t *testing.T) {
+	t.Parallel()
+
+	val, err := proto.Marshal(&wikimedia.RecentChange{User: "a", Bot: false, ServerUrl: "https://blub.com"})
+	if err != nil {
+		t.Fatalf("failed to marshal rc: %v", err)
+	}
+
+	client := &queuedKafkaClient{
+		queue: []kgo.Fetches{
+			{{Topics: []kgo.FetchTopic{{Topic: "t", Partitions: []kgo.FetchPartition{
+				{Partition: 0, Records: []*kgo.Record{{Topic: "t", Partition: 0, Offset: 0, Value: val}}},
+				{Partition: 1, Err: kerr.NotLeaderForPartition},
+			}}}}},
+			{{Topics: []kgo.FetchTopic{{Topic: "t", Partitions: []kgo.FetchPartition{
+				{Partition: 1, Records: []*kgo.Record{{Topic: "t", Partition: 1, Offset: 0, Value: val}}},
+			}}}}},
+		},
+		committed: 0,
+	}
+
+	ranges := map[int32]consumer.ReplayRange{
+		0: {Start: 0, End: 1},
+		1: {Start: 0, End: 1},
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+
+	applier := &batchRecorder{}
+
+	progress, err := consumer.Replay(ctx, client, zap.NewNop(), applier, ranges, consumer.ReplayOptions{})
+	if err != nil {
+		t.Fatalf("expected the replay to finish, got %v", err)
+	}
+
+	if progress.Applied != 2 {
+		t.Errorf("expected both partitions applied, got %+v", progress)
+	}
+}
+
+// TestReplayIdleGap verifies a lone partition whose range ends in a gap finishes once its end
+// offset shows nothing is left to fetch, since no later fetch would carry a high watermark for it.
+//
+//nolint:exhaustruct
+func TestReplayIdleGap(t *testing.T) {
+	t.Parallel()
+
+	val, err := proto.Marshal(&wikimedia.RecentChange{User: "a", Bot: false, ServerUrl: "https://blub.com"})
+	if err != nil {
+		t.Fatalf("failed to marshal rc: %v", err)
+	}
+
+	client := &queuedKafkaClient{
+		queue: []kgo.Fetches{
+			{{Topics: []kgo.FetchTopic{{Topic: "t", Partitions: []kgo.FetchPartition{{
+				Partition: 0,
+				Records: []*kgo.Record{
+					{Topic: "t", Partition: 0, Offset: 10, Value: val},
+					{Topic: "t", Partition: 0, Offset: 11, Value: val},
+				},
+			}}}}}},
+		},
+		committed: 0,
+	}
+
+	ranges := map[int32]consumer.ReplayRange{0: {Start: 10, End: 13}}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+
+	applier := &batchRecorder{}
+
+	progress, err := consumer.Replay(ctx, client, zap.NewNop(), applier, ranges, consumer.ReplayOptions{
+		EndOffsets:  &mockOffsetLister{end: map[int32]int64{0: 13}},
+		Topic:       "t",
+		IdleTimeout: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("expected the replay to finish, got %v", err)
+	}
+
+	if progress.Applied != 2 || progress.Remaining != 0 {
+		t.Errorf("expected 2 applied and nothing remaining, got %+v", progress)
+	}
+}
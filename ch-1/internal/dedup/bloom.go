@@ -0,0 +1,77 @@
+package dedup
+
+import (
+	"hash/fnv"
+	"time"
+)
+
+// bloom is a pair of Bloom filters rotated every ttl, so a key is remembered for
+// between one and two ttls without the filter filling up forever.
+type bloom struct {
+	bits    uint64
+	hashes  int
+	ttl     time.Duration
+	current []uint64
+	prev    []uint64
+	rotated time.Time
+}
+
+func newBloom(bits uint64, hashes int, ttl time.Duration, now time.Time) *bloom {
+	if hashes < 1 {
+		hashes = 1
+	}
+
+	words := (bits + 63) / 64
+
+	return &bloom{
+		bits:    words * 64,
+		hashes:  hashes,
+		ttl:     ttl,
+		current: make([]uint64, words),
+		prev:    make([]uint64, words),
+		rotated: now,
+	}
+}
+
+// testAndAdd reports whether key may have been added before and adds it to the current generation.
+func (b *bloom) testAndAdd(key string, now time.Time) bool {
+	if b.ttl > 0 && now.Sub(b.rotated) >= b.ttl {
+		b.prev, b.current = b.current, b.prev
+		clear(b.current)
+		b.rotated = now
+	}
+
+	positions := b.positions(key)
+	found := contains(b.current, positions) || contains(b.prev, positions)
+
+	for _, p := range positions {
+		b.current[p/64] |= 1 << (p % 64)
+	}
+
+	return found
+}
+
+// positions uses double hashing (h1 + i*h2) to derive the bit indexes from one 64 bit hash.
+func (b *bloom) positions(key string) []uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+
+	out := make([]uint64, b.hashes)
+	for i := range out {
+		out[i] = (h1 + uint64(i)*h2) % b.bits
+	}
+
+	return out
+}
+
+func contains(set []uint64, positions []uint64) bool {
+	for _, p := range positions {
+		if set[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
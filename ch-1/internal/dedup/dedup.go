@@ -0,0 +1,177 @@
+// Package dedup drops events that were already counted, keyed by meta.id.
+package dedup
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/metrics"
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+)
+
+// Config sizes the cache.
+type Config struct {
+	// TTL is how long a key is remembered.
+	TTL time.Duration
+	// MaxEntries caps the exact cache, the oldest keys are evicted first.
+	MaxEntries int
+	// BloomBits enables a Bloom filter behind the exact cache when > 0. It keeps catching
+	// duplicates after a key was evicted for size, at the cost of rare false positives.
+	BloomBits uint64
+	// BloomHashes is the number of hash functions used by the Bloom filter.
+	BloomHashes int
+}
+
+type entry struct {
+	key  string
+	seen time.Time
+}
+
+// Cache remembers recently seen keys. A nil *Cache never reports duplicates.
+type Cache struct {
+	mu      sync.Mutex
+	cfg     Config
+	order   *list.List
+	entries map[string]*list.Element
+	bloom   *bloom
+	metrics *metrics.DedupMetrics
+	now     func() time.Time
+}
+
+// New creates a Cache.
+func New(cfg Config, m *metrics.DedupMetrics) *Cache {
+	c := &Cache{
+		mu:      sync.Mutex{},
+		cfg:     cfg,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+		bloom:   nil,
+		metrics: m,
+		now:     time.Now,
+	}
+
+	if cfg.BloomBits > 0 {
+		c.bloom = newBloom(cfg.BloomBits, cfg.BloomHashes, cfg.TTL, c.now())
+	}
+
+	return c
+}
+
+// Key returns the event's meta.id, or a hash of the raw event when it has none.
+func Key(rc shared.RecentChange, raw []byte) string {
+	if rc.Meta.ID != "" {
+		return rc.Meta.ID
+	}
+
+	return ContentKey(raw)
+}
+
+// ContentKey hashes a raw event for sources without an ID.
+func ContentKey(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Seen records key and reports whether it was already seen within the TTL.
+// Empty keys are never duplicates.
+func (c *Cache) Seen(key string) bool {
+	if c == nil || key == "" {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	c.evict(now)
+
+	if _, ok := c.entries[key]; ok {
+		c.countDuplicate("cache")
+		return true
+	}
+
+	if c.bloom != nil && c.bloom.testAndAdd(key, now) {
+		c.countDuplicate("bloom")
+		return true
+	}
+
+	c.entries[key] = c.order.PushBack(entry{key: key, seen: now})
+
+	for c.cfg.MaxEntries > 0 && c.order.Len() > c.cfg.MaxEntries {
+		c.remove(c.order.Front())
+	}
+
+	c.setEntries()
+
+	return false
+}
+
+// Len returns the number of keys in the exact cache.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+// evict drops keys older than the TTL. Keys are appended in time order so only the front is checked.
+func (c *Cache) evict(now time.Time) {
+	if c.cfg.TTL <= 0 {
+		return
+	}
+
+	for front := c.order.Front(); front != nil; front = c.order.Front() {
+		e, _ := front.Value.(entry)
+		if now.Sub(e.seen) < c.cfg.TTL {
+			return
+		}
+
+		c.remove(front)
+	}
+}
+
+func (c *Cache) remove(el *list.Element) {
+	e, _ := c.order.Remove(el).(entry)
+	delete(c.entries, e.key)
+}
+
+func (c *Cache) countDuplicate(source string) {
+	if c.metrics != nil {
+		c.metrics.Duplicates.WithLabelValues(source).Inc()
+	}
+}
+
+func (c *Cache) setEntries() {
+	if c.metrics != nil {
+		c.metrics.CacheEntries.Set(float64(c.order.Len()))
+	}
+}
+
+// StatsUpdater is the next stage after dedup.
+type StatsUpdater interface {
+	UpdateStats(rc shared.RecentChange)
+}
+
+// Updater drops duplicate changes before they reach the next StatsUpdater.
+// Changes must carry meta.id, consumers fill it from the record key or a content hash.
+type Updater struct {
+	next  StatsUpdater
+	cache *Cache
+}
+
+// NewUpdater wraps next with the cache.
+func NewUpdater(next StatsUpdater, cache *Cache) *Updater {
+	return &Updater{next: next, cache: cache}
+}
+
+// UpdateStats forwards rc unless it was already seen.
+func (u *Updater) UpdateStats(rc shared.RecentChange) {
+	if u.cache.Seen(rc.Meta.ID) {
+		return
+	}
+
+	u.next.UpdateStats(rc)
+}
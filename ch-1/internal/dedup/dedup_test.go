@@ -0,0 +1,164 @@
+package dedup_test
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/dedup"
+	"github.com/codyonesock/backend_learning/ch-1/internal/metrics"
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+)
+
+// TestSeen verifies duplicates are caught and counted.
+func TestSeen(t *testing.T) {
+	t.Parallel()
+
+	m := metrics.NewDedupMetrics(prometheus.NewRegistry())
+	c := dedup.New(dedup.Config{TTL: time.Minute, MaxEntries: 10, BloomBits: 0, BloomHashes: 0}, m)
+
+	if c.Seen("a") {
+		t.Error("expected the first sighting to be new")
+	}
+
+	if !c.Seen("a") {
+		t.Error("expected the second sighting to be a duplicate")
+	}
+
+	if c.Seen("") || c.Seen("") {
+		t.Error("expected empty keys to never be duplicates")
+	}
+
+	if got := testutil.ToFloat64(m.Duplicates.WithLabelValues("cache")); got != 1 {
+		t.Errorf("expected 1 duplicate counted, got %v", got)
+	}
+
+	if got := testutil.ToFloat64(m.CacheEntries); got != 1 {
+		t.Errorf("expected 1 cache entry, got %v", got)
+	}
+}
+
+// TestEviction verifies keys are forgotten after the TTL and beyond MaxEntries.
+func TestEviction(t *testing.T) {
+	t.Parallel()
+
+	c := dedup.New(dedup.Config{TTL: 20 * time.Millisecond, MaxEntries: 2, BloomBits: 0, BloomHashes: 0}, nil)
+
+	c.Seen("a")
+	c.Seen("b")
+	c.Seen("c")
+
+	if c.Len() != 2 {
+		t.Fatalf("expected the cache to hold 2 keys, got %d", c.Len())
+	}
+
+	if c.Seen("a") {
+		t.Error("expected the oldest key to be evicted for size")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if c.Seen("c") {
+		t.Error("expected the key to expire after the TTL")
+	}
+}
+
+// TestBloomBacksEvictedKeys verifies the Bloom filter still catches keys evicted for size.
+func TestBloomBacksEvictedKeys(t *testing.T) {
+	t.Parallel()
+
+	m := metrics.NewDedupMetrics(prometheus.NewRegistry())
+	c := dedup.New(dedup.Config{TTL: time.Minute, MaxEntries: 1, BloomBits: 1 << 16, BloomHashes: 4}, m)
+
+	c.Seen("a")
+	c.Seen("b")
+
+	if !c.Seen("a") {
+		t.Error("expected the Bloom filter to remember the evicted key")
+	}
+
+	if got := testutil.ToFloat64(m.Duplicates.WithLabelValues("bloom")); got != 1 {
+		t.Errorf("expected 1 Bloom duplicate counted, got %v", got)
+	}
+
+	var falsePositives int
+
+	for i := range 1000 {
+		if c.Seen("new-" + strconv.Itoa(i)) {
+			falsePositives++
+		}
+	}
+
+	if falsePositives > 5 {
+		t.Errorf("expected few false positives, got %d", falsePositives)
+	}
+}
+
+// TestKey verifies meta.id is preferred over the content hash.
+func TestKey(t *testing.T) {
+	t.Parallel()
+
+	withID := shared.RecentChange{User: "blub", Meta: shared.Meta{ID: "id-1"}}
+	if got := dedup.Key(withID, []byte("raw")); got != "id-1" {
+		t.Errorf("expected meta.id, got %q", got)
+	}
+
+	noID := shared.RecentChange{User: "blub"}
+	if dedup.Key(noID, []byte("a")) == dedup.Key(noID, []byte("b")) {
+		t.Error("expected different content to hash differently")
+	}
+
+	if dedup.Key(noID, []byte("a")) != dedup.ContentKey([]byte("a")) {
+		t.Error("expected the content hash fallback")
+	}
+}
+
+type countingUpdater struct {
+	mu      sync.Mutex
+	updates int
+}
+
+func (c *countingUpdater) UpdateStats(_ shared.RecentChange) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.updates++
+}
+
+// TestUpdater verifies concurrent workers only forward each ID once.
+func TestUpdater(t *testing.T) {
+	t.Parallel()
+
+	next := &countingUpdater{mu: sync.Mutex{}, updates: 0}
+	u := dedup.NewUpdater(next, dedup.New(dedup.Config{TTL: time.Minute, MaxEntries: 100, BloomBits: 0, BloomHashes: 0}, nil))
+
+	var wg sync.WaitGroup
+
+	for range 4 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := range 50 {
+				u.UpdateStats(shared.RecentChange{Meta: shared.Meta{ID: strconv.Itoa(i)}})
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if next.updates != 50 {
+		t.Errorf("expected 50 unique updates, got %d", next.updates)
+	}
+
+	passthrough := dedup.NewUpdater(next, nil)
+	passthrough.UpdateStats(shared.RecentChange{Meta: shared.Meta{ID: "0"}})
+
+	if next.updates != 51 {
+		t.Error("expected a nil cache to forward everything")
+	}
+}
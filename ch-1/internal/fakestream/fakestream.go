@@ -0,0 +1,264 @@
+// Package fakestream serves a fake Wikimedia EventStreams recentchange feed over SSE,
+// so the pipeline can run end to end without stream.wikimedia.org.
+package fakestream
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Wiki is one wiki the fake stream emits edits for.
+type Wiki struct {
+	Name      string
+	ServerURL string
+}
+
+// DefaultWikis is a small mix of busy wikis, most active first.
+//
+//nolint:gochecknoglobals
+var DefaultWikis = []Wiki{
+	{Name: "wikidatawiki", ServerURL: "https://www.wikidata.org"},
+	{Name: "commonswiki", ServerURL: "https://commons.wikimedia.org"},
+	{Name: "enwiki", ServerURL: "https://en.wikipedia.org"},
+	{Name: "dewiki", ServerURL: "https://de.wikipedia.org"},
+	{Name: "frwiki", ServerURL: "https://fr.wikipedia.org"},
+	{Name: "jawiki", ServerURL: "https://ja.wikipedia.org"},
+}
+
+// Config controls what the fake stream sends.
+type Config struct {
+	// Rate is events per second. Zero sends as fast as the client reads.
+	Rate float64
+	// BotRatio is the share of events from bots, 0 to 1.
+	BotRatio float64
+	// Wikis are picked with a Zipf distribution, so earlier entries get most of the edits.
+	Wikis []Wiki
+	// Users is how many distinct human users exist, also picked with a Zipf distribution.
+	Users int
+	// Bots is how many distinct bot users exist.
+	Bots int
+	// Skew is the Zipf exponent, it must be above 1. Higher values concentrate edits on fewer wikis and users.
+	Skew float64
+	// MalformedRatio is the share of events sent as broken JSON, 0 to 1.
+	MalformedRatio float64
+	// DisconnectAfter closes the connection after this many events. Zero keeps it open.
+	DisconnectAfter int
+	// Limit ends the stream after the event with this ID. Zero streams forever.
+	Limit int64
+	// Seed makes the stream reproducible. The same seed and ID always produce the same event.
+	Seed uint64
+}
+
+// DefaultConfig is a laptop friendly stream: 20 events/s, a quarter of them from bots.
+func DefaultConfig() Config {
+	return Config{
+		Rate:            20,
+		BotRatio:        0.25,
+		Wikis:           DefaultWikis,
+		Users:           500,
+		Bots:            20,
+		Skew:            1.2,
+		MalformedRatio:  0,
+		DisconnectAfter: 0,
+		Limit:           0,
+		Seed:            1,
+	}
+}
+
+// Meta mirrors the meta block of a real recentchange event.
+type Meta struct {
+	ID     string `json:"id"`
+	Domain string `json:"domain"`
+	DT     string `json:"dt"`
+	Stream string `json:"stream"`
+}
+
+// Event mirrors the fields of a real recentchange event that the pipeline reads.
+type Event struct {
+	Meta      Meta   `json:"meta"`
+	ID        int64  `json:"id"`
+	Type      string `json:"type"`
+	Namespace int    `json:"namespace"`
+	Title     string `json:"title"`
+	User      string `json:"user"`
+	Bot       bool   `json:"bot"`
+	ServerURL string `json:"server_url"`
+	Wiki      string `json:"wiki"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// Server is an http.Handler that streams events. It works with httptest.NewServer.
+type Server struct {
+	cfg Config
+	now func() time.Time
+}
+
+// New creates a Server, filling unset fields from DefaultConfig.
+func New(cfg Config) *Server {
+	def := DefaultConfig()
+
+	if len(cfg.Wikis) == 0 {
+		cfg.Wikis = def.Wikis
+	}
+
+	if cfg.Users <= 0 {
+		cfg.Users = def.Users
+	}
+
+	if cfg.Bots <= 0 {
+		cfg.Bots = def.Bots
+	}
+
+	if cfg.Skew <= 1 {
+		cfg.Skew = def.Skew
+	}
+
+	return &Server{cfg: cfg, now: time.Now}
+}
+
+// ServeHTTP streams events starting after the Last-Event-ID header, or from the first event.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	next := int64(1)
+
+	if last := r.Header.Get("Last-Event-ID"); last != "" {
+		id, err := strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+
+		next = id + 1
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+
+	var tick <-chan time.Time
+
+	if s.cfg.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / s.cfg.Rate))
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
+
+	for sent := 0; s.cfg.Limit == 0 || next <= s.cfg.Limit; sent++ {
+		if s.cfg.DisconnectAfter > 0 && sent >= s.cfg.DisconnectAfter {
+			return
+		}
+
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-r.Context().Done():
+				return
+			}
+		} else if r.Context().Err() != nil {
+			return
+		}
+
+		if _, err := fmt.Fprintf(w, "event: message\nid: %d\ndata: %s\n\n", next, s.payload(next)); err != nil {
+			return
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		next++
+	}
+}
+
+// payload renders event id, or a malformed version of it.
+func (s *Server) payload(id int64) string {
+	rng := s.rng(id)
+	ev := s.Event(id)
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return "{}"
+	}
+
+	if rng.Float64() < s.cfg.MalformedRatio {
+		// Cut the JSON off mid-object, like a truncated upstream write.
+		return string(data[:len(data)/2])
+	}
+
+	return string(data)
+}
+
+// Event builds the event with the given ID. The result only depends on the seed and ID,
+// so a resumed stream repeats exactly what an uninterrupted one would have sent.
+func (s *Server) Event(id int64) Event {
+	rng := s.rng(id)
+	// Use the second value onwards, the first decides whether the payload is malformed.
+	_ = rng.Float64()
+
+	wiki := s.cfg.Wikis[zipf(rng, s.cfg.Skew, len(s.cfg.Wikis))]
+	bot := rng.Float64() < s.cfg.BotRatio
+
+	user := fmt.Sprintf("User%d", zipf(rng, s.cfg.Skew, s.cfg.Users)+1)
+	if bot {
+		user = fmt.Sprintf("ExampleBot%d", zipf(rng, s.cfg.Skew, s.cfg.Bots)+1)
+	}
+
+	at := s.now().UTC()
+
+	return Event{
+		Meta: Meta{
+			ID:     metaID(s.cfg.Seed, id),
+			Domain: strings.TrimPrefix(wiki.ServerURL, "https://"),
+			DT:     at.Format(time.RFC3339),
+			Stream: "mediawiki.recentchange",
+		},
+		ID:        id,
+		Type:      pick(rng, []string{"edit", "edit", "edit", "edit", "edit", "edit", "new", "log", "categorize"}),
+		Namespace: pick(rng, []int{0, 0, 0, 0, 1, 2, 4, 6, 14}),
+		Title:     fmt.Sprintf("Page %d", rng.IntN(100000)),
+		User:      user,
+		Bot:       bot,
+		ServerURL: wiki.ServerURL,
+		Wiki:      wiki.Name,
+		Timestamp: at.Unix(),
+	}
+}
+
+func (s *Server) rng(id int64) *rand.Rand {
+	//nolint:gosec // Reproducible test data, not security sensitive.
+	return rand.New(rand.NewPCG(s.cfg.Seed, uint64(id)))
+}
+
+// zipf returns an index in [0, n) where lower indexes are much more likely.
+func zipf(rng *rand.Rand, skew float64, n int) int {
+	if n <= 1 {
+		return 0
+	}
+
+	return int(rand.NewZipf(rng, skew, 1, uint64(n-1)).Uint64())
+}
+
+func pick[T any](rng *rand.Rand, from []T) T {
+	return from[rng.IntN(len(from))]
+}
+
+// metaID derives a stable UUID shaped ID for an event.
+func metaID(seed uint64, id int64) string {
+	var buf [16]byte
+
+	binary.BigEndian.PutUint64(buf[:8], seed)
+	binary.BigEndian.PutUint64(buf[8:], uint64(id))
+
+	sum := sha256.Sum256(buf[:])
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
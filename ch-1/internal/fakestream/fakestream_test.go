@@ -0,0 +1,199 @@
+package fakestream_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/fakestream"
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+	"github.com/codyonesock/backend_learning/ch-1/internal/status"
+)
+
+type sseEvent struct {
+	id   int64
+	data string
+}
+
+// readStream reads SSE events until the server closes the connection.
+func readStream(t *testing.T, url, lastEventID string) []sseEvent {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer res.Body.Close()
+
+	var (
+		events []sseEvent
+		cur    sseEvent
+	)
+
+	sc := bufio.NewScanner(res.Body)
+	for sc.Scan() {
+		line := sc.Text()
+
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			cur.id, _ = strconv.ParseInt(strings.TrimPrefix(line, "id: "), 10, 64)
+		case strings.HasPrefix(line, "data: "):
+			cur.data = strings.TrimPrefix(line, "data: ")
+		case line == "":
+			events = append(events, cur)
+			cur = sseEvent{id: 0, data: ""}
+		}
+	}
+
+	return events
+}
+
+func newServer(t *testing.T, mutate func(*fakestream.Config)) *httptest.Server {
+	t.Helper()
+
+	cfg := fakestream.DefaultConfig()
+	cfg.Rate = 0
+	mutate(&cfg)
+
+	ts := httptest.NewServer(fakestream.New(cfg))
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+// TestLastEventIDResume verifies a reconnect picks up after the last seen event with identical events.
+func TestLastEventIDResume(t *testing.T) {
+	t.Parallel()
+
+	ts := newServer(t, func(c *fakestream.Config) { c.Limit = 30 })
+
+	full := readStream(t, ts.URL, "")
+	if len(full) != 30 || full[0].id != 1 {
+		t.Fatalf("expected events 1..30, got %d starting at %d", len(full), full[0].id)
+	}
+
+	resumed := readStream(t, ts.URL, "20")
+	if len(resumed) != 10 || resumed[0].id != 21 {
+		t.Fatalf("expected events 21..30, got %d starting at %d", len(resumed), resumed[0].id)
+	}
+
+	var a, b fakestream.Event
+	if err := json.Unmarshal([]byte(full[20].data), &a); err != nil {
+		t.Fatalf("bad event: %v", err)
+	}
+
+	if err := json.Unmarshal([]byte(resumed[0].data), &b); err != nil {
+		t.Fatalf("bad event: %v", err)
+	}
+
+	if a.Meta.ID != b.Meta.ID || a.User != b.User || a.ServerURL != b.ServerURL {
+		t.Errorf("expected the resumed event to match the original, got %+v and %+v", a, b)
+	}
+}
+
+// TestDistribution verifies the bot ratio and that the first wiki is the busiest.
+func TestDistribution(t *testing.T) {
+	t.Parallel()
+
+	ts := newServer(t, func(c *fakestream.Config) { c.Limit = 2000 })
+
+	var bots int
+
+	perWiki := map[string]int{}
+
+	for _, e := range readStream(t, ts.URL, "") {
+		var ev fakestream.Event
+		if err := json.Unmarshal([]byte(e.data), &ev); err != nil {
+			t.Fatalf("bad event: %v", err)
+		}
+
+		if ev.Bot {
+			bots++
+		}
+
+		perWiki[ev.Wiki]++
+	}
+
+	if ratio := float64(bots) / 2000; ratio < 0.2 || ratio > 0.3 {
+		t.Errorf("expected a bot ratio near 0.25, got %.3f", ratio)
+	}
+
+	top := fakestream.DefaultWikis[0].Name
+	for wiki, n := range perWiki {
+		if n > perWiki[top] {
+			t.Errorf("expected %s to be the busiest wiki, %s had %d vs %d", top, wiki, n, perWiki[top])
+		}
+	}
+}
+
+// TestFaultInjection verifies malformed events and disconnects.
+func TestFaultInjection(t *testing.T) {
+	t.Parallel()
+
+	t.Run("malformed", func(t *testing.T) {
+		t.Parallel()
+
+		ts := newServer(t, func(c *fakestream.Config) {
+			c.Limit = 10
+			c.MalformedRatio = 1
+		})
+
+		for _, e := range readStream(t, ts.URL, "") {
+			if json.Valid([]byte(e.data)) {
+				t.Errorf("expected malformed data, got %s", e.data)
+			}
+		}
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		t.Parallel()
+
+		ts := newServer(t, func(c *fakestream.Config) { c.DisconnectAfter = 5 })
+
+		if got := readStream(t, ts.URL, ""); len(got) != 5 {
+			t.Errorf("expected the server to hang up after 5 events, got %d", len(got))
+		}
+	})
+}
+
+type countingStats struct {
+	updates int
+}
+
+func (c *countingStats) UpdateStats(_ shared.RecentChange) { c.updates++ }
+
+func (c *countingStats) GetStats(_ http.ResponseWriter) error { return nil }
+
+// TestStatusPipeline runs the status stream path against the fake server.
+func TestStatusPipeline(t *testing.T) {
+	t.Parallel()
+
+	ts := newServer(t, func(c *fakestream.Config) { c.Limit = 25 })
+
+	stats := &countingStats{updates: 0}
+	service := status.NewStatusService(zap.NewNop(), stats, 0, 5*time.Second)
+
+	if err := service.ProcessStream(t.Context(), ts.URL); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if stats.updates != 25 {
+		t.Errorf("expected 25 updates, got %d", stats.updates)
+	}
+}
@@ -0,0 +1,222 @@
+// Package filter decides which stream events are ingested.
+package filter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/metrics"
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+)
+
+// Action is what happens to an event a rule matches.
+type Action string
+
+const (
+	// Allow keeps the event.
+	Allow Action = "allow"
+	// Deny drops the event.
+	Deny Action = "deny"
+)
+
+// defaultRule labels events no rule matched in the match counters.
+const defaultRule = "default"
+
+var (
+	errInvalidAction = errors.New("action must be allow or deny")
+	errMissingName   = errors.New("every rule needs a name")
+	errDuplicateName = errors.New("rule names must be unique")
+)
+
+// Rule matches events on every field that is set. Empty fields match anything.
+type Rule struct {
+	Name       string   `json:"name"`
+	Action     Action   `json:"action"`
+	ServerURLs []string `json:"server_urls"`
+	Wikis      []string `json:"wikis"`
+	Namespaces []int    `json:"namespaces"`
+	Types      []string `json:"types"`
+	Bot        *bool    `json:"bot"`
+	// UserPattern is a glob like "*Bot", see path.Match.
+	UserPattern string `json:"user_pattern"`
+	// UserRegex is a regular expression matched against the username.
+	UserRegex string `json:"user_regex"`
+}
+
+// Rules is the filter config. Rules are checked in order and the first match wins,
+// events no rule matches get Default.
+type Rules struct {
+	Default Action `json:"default"`
+	Rules   []Rule `json:"rules"`
+}
+
+type compiledRule struct {
+	Rule
+
+	userRegex *regexp.Regexp
+}
+
+// Filter evaluates Rules against events. A nil *Filter allows everything.
+type Filter struct {
+	rules   []compiledRule
+	def     Action
+	metrics *metrics.FilterMetrics
+}
+
+// Load reads rules from a JSON file and/or an inline JSON string. File rules are
+// checked before inline ones and the inline default wins when both set one.
+// It returns nil when neither is set.
+func Load(file, inline string) (*Rules, error) {
+	if file == "" && inline == "" {
+		return nil, nil //nolint:nilnil // no rules configured means no filter
+	}
+
+	rules := &Rules{Default: "", Rules: nil}
+
+	if file != "" {
+		data, err := os.ReadFile(file) // #nosec G304 -- path comes from operator config
+		if err != nil {
+			return nil, fmt.Errorf("failed to read filter rules: %w", err)
+		}
+
+		if err := merge(rules, data); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", file, err)
+		}
+	}
+
+	if inline != "" {
+		if err := merge(rules, []byte(inline)); err != nil {
+			return nil, fmt.Errorf("failed to parse inline filter rules: %w", err)
+		}
+	}
+
+	return rules, nil
+}
+
+func merge(into *Rules, data []byte) error {
+	var r Rules
+	if err := json.Unmarshal(data, &r); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	if r.Default != "" {
+		into.Default = r.Default
+	}
+
+	into.Rules = append(into.Rules, r.Rules...)
+
+	return nil
+}
+
+// New validates and compiles the rules. The default action is allow if unset.
+func New(rules Rules, m *metrics.FilterMetrics) (*Filter, error) {
+	def := rules.Default
+	if def == "" {
+		def = Allow
+	}
+
+	if def != Allow && def != Deny {
+		return nil, fmt.Errorf("default %q: %w", def, errInvalidAction)
+	}
+
+	seen := make(map[string]bool, len(rules.Rules))
+	compiled := make([]compiledRule, 0, len(rules.Rules))
+
+	for _, r := range rules.Rules {
+		if r.Name == "" {
+			return nil, errMissingName
+		}
+
+		if seen[r.Name] || r.Name == defaultRule {
+			return nil, fmt.Errorf("rule %q: %w", r.Name, errDuplicateName)
+		}
+
+		seen[r.Name] = true
+
+		if r.Action != Allow && r.Action != Deny {
+			return nil, fmt.Errorf("rule %q action %q: %w", r.Name, r.Action, errInvalidAction)
+		}
+
+		if r.UserPattern != "" {
+			if _, err := path.Match(r.UserPattern, ""); err != nil {
+				return nil, fmt.Errorf("rule %q user_pattern: %w", r.Name, err)
+			}
+		}
+
+		cr := compiledRule{Rule: r, userRegex: nil}
+
+		if r.UserRegex != "" {
+			re, err := regexp.Compile(r.UserRegex)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q user_regex: %w", r.Name, err)
+			}
+
+			cr.userRegex = re
+		}
+
+		compiled = append(compiled, cr)
+	}
+
+	return &Filter{rules: compiled, def: def, metrics: m}, nil
+}
+
+// Allow reports whether the event should be ingested and counts which rule decided.
+func (f *Filter) Allow(rc shared.RecentChange) bool {
+	if f == nil {
+		return true
+	}
+
+	name, action := defaultRule, f.def
+
+	for _, r := range f.rules {
+		if r.matches(rc) {
+			name, action = r.Name, r.Action
+			break
+		}
+	}
+
+	if f.metrics != nil {
+		f.metrics.RuleMatches.WithLabelValues(name, string(action)).Inc()
+	}
+
+	return action == Allow
+}
+
+func (r compiledRule) matches(rc shared.RecentChange) bool {
+	if len(r.ServerURLs) > 0 && !slices.Contains(r.ServerURLs, rc.ServerURL) {
+		return false
+	}
+
+	if len(r.Wikis) > 0 && !slices.Contains(r.Wikis, rc.Wiki) {
+		return false
+	}
+
+	if len(r.Namespaces) > 0 && !slices.Contains(r.Namespaces, rc.Namespace) {
+		return false
+	}
+
+	if len(r.Types) > 0 && !slices.Contains(r.Types, rc.Type) {
+		return false
+	}
+
+	if r.Bot != nil && *r.Bot != rc.Bot {
+		return false
+	}
+
+	if r.UserPattern != "" {
+		if ok, _ := path.Match(r.UserPattern, rc.User); !ok {
+			return false
+		}
+	}
+
+	if r.userRegex != nil && !r.userRegex.MatchString(rc.User) {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,146 @@
+package filter_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/filter"
+	"github.com/codyonesock/backend_learning/ch-1/internal/metrics"
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+)
+
+func change(user string, bot bool, wiki string, namespace int, typ string) shared.RecentChange {
+	return shared.RecentChange{
+		User:      user,
+		Bot:       bot,
+		ServerURL: "https://" + wiki + ".org",
+		Wiki:      wiki,
+		Namespace: namespace,
+		Type:      typ,
+	}
+}
+
+// TestAllow walks a rule set through first-match-wins evaluation.
+func TestAllow(t *testing.T) {
+	t.Parallel()
+
+	yes := true
+	rules := filter.Rules{
+		Default: filter.Deny,
+		Rules: []filter.Rule{
+			{Name: "no-bots", Action: filter.Deny, Bot: &yes},
+			{Name: "no-ip-users", Action: filter.Deny, UserRegex: `^\d+\.\d+\.\d+\.\d+$`},
+			{Name: "no-testers", Action: filter.Deny, UserPattern: "Test*"},
+			{Name: "enwiki-articles", Action: filter.Allow, Wikis: []string{"enwiki"}, Namespaces: []int{0}},
+			{Name: "wikidata-edits", Action: filter.Allow, ServerURLs: []string{"https://wikidatawiki.org"}, Types: []string{"edit"}},
+		},
+	}
+
+	m := metrics.NewFilterMetrics(prometheus.NewRegistry())
+
+	f, err := filter.New(rules, m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		rc   shared.RecentChange
+		want bool
+		rule string
+	}{
+		{"bot", change("Blub", true, "enwiki", 0, "edit"), false, "no-bots"},
+		{"ip", change("10.0.0.1", false, "enwiki", 0, "edit"), false, "no-ip-users"},
+		{"pattern", change("TestUser", false, "enwiki", 0, "edit"), false, "no-testers"},
+		{"article", change("Blub", false, "enwiki", 0, "edit"), true, "enwiki-articles"},
+		{"talk page", change("Blub", false, "enwiki", 1, "edit"), false, "default"},
+		{"wikidata edit", change("Blub", false, "wikidatawiki", 120, "edit"), true, "wikidata-edits"},
+		{"wikidata log", change("Blub", false, "wikidatawiki", 120, "log"), false, "default"},
+	}
+
+	for _, tt := range tests {
+		before := testutil.ToFloat64(m.RuleMatches.WithLabelValues(tt.rule, actionFor(tt.want)))
+
+		if got := f.Allow(tt.rc); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+
+		after := testutil.ToFloat64(m.RuleMatches.WithLabelValues(tt.rule, actionFor(tt.want)))
+		if after != before+1 {
+			t.Errorf("%s: expected rule %q to be counted", tt.name, tt.rule)
+		}
+	}
+}
+
+func actionFor(allowed bool) string {
+	if allowed {
+		return string(filter.Allow)
+	}
+
+	return string(filter.Deny)
+}
+
+// TestNilFilterAllows verifies an unconfigured filter lets everything through.
+func TestNilFilterAllows(t *testing.T) {
+	t.Parallel()
+
+	var f *filter.Filter
+	if !f.Allow(change("Blub", true, "enwiki", 0, "edit")) {
+		t.Error("expected a nil filter to allow events")
+	}
+}
+
+// TestNewRejectsBadRules verifies rule validation.
+func TestNewRejectsBadRules(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]filter.Rules{
+		"bad default": {Default: "maybe", Rules: nil},
+		"no name":     {Default: "", Rules: []filter.Rule{{Action: filter.Deny}}},
+		"bad action":  {Default: "", Rules: []filter.Rule{{Name: "a", Action: "drop"}}},
+		"duplicate":   {Default: "", Rules: []filter.Rule{{Name: "a", Action: filter.Deny}, {Name: "a", Action: filter.Deny}}},
+		"bad regex":   {Default: "", Rules: []filter.Rule{{Name: "a", Action: filter.Deny, UserRegex: "("}}},
+		"bad pattern": {Default: "", Rules: []filter.Rule{{Name: "a", Action: filter.Deny, UserPattern: "["}}},
+	}
+
+	for name, rules := range tests {
+		if _, err := filter.New(rules, nil); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// TestLoad verifies file rules come before inline rules and inline overrides the default.
+func TestLoad(t *testing.T) {
+	t.Parallel()
+
+	if rules, err := filter.Load("", ""); err != nil || rules != nil {
+		t.Fatalf("expected no rules, got %v, %v", rules, err)
+	}
+
+	file := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(file, []byte(`{"default":"deny","rules":[{"name":"file","action":"allow","wikis":["enwiki"]}]}`), 0o600); err != nil {
+		t.Fatalf("failed to write rules: %v", err)
+	}
+
+	rules, err := filter.Load(file, `{"default":"allow","rules":[{"name":"inline","action":"deny","bot":true}]}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if rules.Default != filter.Allow {
+		t.Errorf("expected inline default to win, got %q", rules.Default)
+	}
+
+	if len(rules.Rules) != 2 || rules.Rules[0].Name != "file" || rules.Rules[1].Name != "inline" {
+		t.Errorf("expected file then inline rules, got %+v", rules.Rules)
+	}
+
+	if _, err := filter.Load(file, "{"); err == nil {
+		t.Error("expected an error for invalid inline JSON")
+	}
+}
@@ -11,12 +11,16 @@ import (
 
 // ProducerMetrics captures producer events.
 type ProducerMetrics struct {
-	EventsConsumed  prometheus.Counter
-	EventsPersisted prometheus.Counter
+	EventsConsumed     prometheus.Counter
+	EventsPersisted    prometheus.Counter
+	EventsFailed       prometheus.Counter
+	RecordsInFlight    prometheus.Gauge
+	BackpressurePauses prometheus.Counter
+	ProduceLatency     prometheus.Histogram
 }
 
-// NewProducerMetrics creates metrics events.
-func NewProducerMetrics() *ProducerMetrics {
+// NewProducerMetrics creates producer metrics and registers them with reg.
+func NewProducerMetrics(reg prometheus.Registerer) *ProducerMetrics {
 	m := &ProducerMetrics{
 		EventsConsumed: prometheus.NewCounter(prometheus.CounterOpts{
 			Namespace:   "",
@@ -32,8 +36,44 @@ func NewProducerMetrics() *ProducerMetrics {
 			Help:        "Number of events persisted to Redpanda",
 			ConstLabels: nil,
 		}),
+		EventsFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "producer_events_failed_total",
+			Help:        "Number of events Redpanda failed to acknowledge",
+			ConstLabels: nil,
+		}),
+		RecordsInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "producer_records_in_flight",
+			Help:        "Number of records produced but not yet acknowledged",
+			ConstLabels: nil,
+		}),
+		BackpressurePauses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "producer_backpressure_pauses_total",
+			Help:        "Number of times stream reading paused because too many records were in flight",
+			ConstLabels: nil,
+		}),
+		ProduceLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "producer_produce_latency_seconds",
+			Help:        "Time from producing a record until Redpanda acknowledges it",
+			ConstLabels: nil,
+			Buckets:     prometheus.ExponentialBuckets(0.001, 2, 14),
+		}),
 	}
-	prometheus.MustRegister(m.EventsConsumed, m.EventsPersisted)
+	reg.MustRegister(
+		m.EventsConsumed,
+		m.EventsPersisted,
+		m.EventsFailed,
+		m.RecordsInFlight,
+		m.BackpressurePauses,
+		m.ProduceLatency,
+	)
 
 	return m
 }
@@ -43,10 +83,17 @@ type ConsumerMetrics struct {
 	EventsConsumed         prometheus.Counter
 	EventsProcessedSuccess prometheus.Counter
 	EventsProcessedFailed  prometheus.Counter
+	PartitionLag           *prometheus.GaugeVec
+	CommittedOffset        *prometheus.GaugeVec
+	HighWatermark          *prometheus.GaugeVec
+	AssignedPartitions     *prometheus.GaugeVec
+	Rebalances             *prometheus.CounterVec
+	PollLatency            prometheus.Histogram
+	CommitLatency          prometheus.Histogram
 }
 
-// NewConsumerMetrics creates metrics events.
-func NewConsumerMetrics() *ConsumerMetrics {
+// NewConsumerMetrics creates consumer metrics and registers them with reg.
+func NewConsumerMetrics(reg prometheus.Registerer) *ConsumerMetrics {
 	m := &ConsumerMetrics{
 		EventsConsumed: prometheus.NewCounter(prometheus.CounterOpts{
 			Namespace:   "",
@@ -69,11 +116,191 @@ func NewConsumerMetrics() *ConsumerMetrics {
 			Help:        "Number of events that failed to be processed",
 			ConstLabels: nil,
 		}),
+		PartitionLag: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "consumer_partition_lag",
+			Help:        "Records between the last consumed offset and the high watermark",
+			ConstLabels: nil,
+		}, []string{"topic", "partition"}),
+		CommittedOffset: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "consumer_committed_offset",
+			Help:        "Last offset committed for the partition",
+			ConstLabels: nil,
+		}, []string{"topic", "partition"}),
+		HighWatermark: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "consumer_high_watermark",
+			Help:        "High watermark reported by the broker for the partition",
+			ConstLabels: nil,
+		}, []string{"topic", "partition"}),
+		AssignedPartitions: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "consumer_assigned_partitions",
+			Help:        "Number of partitions currently assigned to this consumer",
+			ConstLabels: nil,
+		}, []string{"topic"}),
+		Rebalances: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "consumer_rebalances_total",
+			Help:        "Number of partition assignment changes by event (assigned, revoked, lost)",
+			ConstLabels: nil,
+		}, []string{"event"}),
+		PollLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "consumer_poll_latency_seconds",
+			Help:        "Time spent waiting in PollFetches",
+			ConstLabels: nil,
+			Buckets:     prometheus.ExponentialBuckets(0.001, 2, 14),
+		}),
+		CommitLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "consumer_commit_latency_seconds",
+			Help:        "Time spent committing offsets",
+			ConstLabels: nil,
+			Buckets:     prometheus.ExponentialBuckets(0.001, 2, 14),
+		}),
 	}
-	prometheus.MustRegister(
+	reg.MustRegister(
 		m.EventsConsumed,
 		m.EventsProcessedSuccess,
 		m.EventsProcessedFailed,
+		m.PartitionLag,
+		m.CommittedOffset,
+		m.HighWatermark,
+		m.AssignedPartitions,
+		m.Rebalances,
+		m.PollLatency,
+		m.CommitLatency,
+	)
+
+	return m
+}
+
+// FilterMetrics captures ingestion filter decisions.
+type FilterMetrics struct {
+	RuleMatches *prometheus.CounterVec
+}
+
+// NewFilterMetrics creates filter metrics and registers them with reg.
+func NewFilterMetrics(reg prometheus.Registerer) *FilterMetrics {
+	m := &FilterMetrics{
+		RuleMatches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "filter_rule_matches_total",
+			Help:        "Number of events each filter rule decided, by rule and action",
+			ConstLabels: nil,
+		}, []string{"rule", "action"}),
+	}
+	reg.MustRegister(m.RuleMatches)
+
+	return m
+}
+
+// DedupMetrics captures duplicate events dropped before stats.
+type DedupMetrics struct {
+	Duplicates   *prometheus.CounterVec
+	CacheEntries prometheus.Gauge
+}
+
+// NewDedupMetrics creates dedup metrics and registers them with reg.
+func NewDedupMetrics(reg prometheus.Registerer) *DedupMetrics {
+	m := &DedupMetrics{
+		Duplicates: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "dedup_duplicates_dropped_total",
+			Help:        "Number of duplicate events dropped, by where they were caught (cache, bloom)",
+			ConstLabels: nil,
+		}, []string{"source"}),
+		CacheEntries: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "dedup_cache_entries",
+			Help:        "Number of event IDs held in the dedup cache",
+			ConstLabels: nil,
+		}),
+	}
+	reg.MustRegister(m.Duplicates, m.CacheEntries)
+
+	return m
+}
+
+// StatsMetrics captures the stats update queue.
+type StatsMetrics struct {
+	QueueDepth     prometheus.Gauge
+	DroppedUpdates *prometheus.CounterVec
+	SpilledUpdates prometheus.Counter
+	Persists       *prometheus.CounterVec
+	EventRate      *prometheus.GaugeVec
+	BotRatio       *prometheus.GaugeVec
+	PeakEventRate  prometheus.Gauge
+}
+
+// NewStatsMetrics creates stats queue metrics and registers them with reg.
+func NewStatsMetrics(reg prometheus.Registerer) *StatsMetrics {
+	m := &StatsMetrics{
+		QueueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "stats_update_queue_depth",
+			Help:        "Number of stats updates waiting to be applied",
+			ConstLabels: nil,
+		}),
+		DroppedUpdates: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "stats_updates_dropped_total",
+			Help:        "Number of stats updates dropped because the queue was full, by reason",
+			ConstLabels: nil,
+		}, []string{"reason"}),
+		SpilledUpdates: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "stats_updates_spilled_total",
+			Help:        "Number of stats updates spilled to disk because the queue was full",
+			ConstLabels: nil,
+		}),
+		Persists: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "stats_persists_total",
+			Help:        "Number of stats persistence runs by kind (increments, delta, full, skipped when nothing changed)",
+			ConstLabels: nil,
+		}, []string{"kind"}),
+		EventRate: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "stats_events_per_second",
+			Help:        "Moving average of events applied per second by kind (all, bot, non_bot) and window (1m, 5m, 15m)",
+			ConstLabels: nil,
+		}, []string{"kind", "window"}),
+		BotRatio: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "stats_bot_ratio",
+			Help:        "Share of events from bots over each moving average window",
+			ConstLabels: nil,
+		}, []string{"window"}),
+		PeakEventRate: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   "",
+			Subsystem:   "",
+			Name:        "stats_peak_events_per_second",
+			Help:        "Highest 1m moving average of events per second since startup",
+			ConstLabels: nil,
+		}),
+	}
+	reg.MustRegister(
+		m.QueueDepth, m.DroppedUpdates, m.SpilledUpdates, m.Persists,
+		m.EventRate, m.BotRatio, m.PeakEventRate,
 	)
 
 	return m
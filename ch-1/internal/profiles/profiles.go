@@ -0,0 +1,148 @@
+// Package profiles keeps an activity profile for the most recently active users. Profiles live in
+// memory only: each replica builds its own from the events it consumes, and they start over on
+// restart.
+package profiles
+
+import (
+	"container/list"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+)
+
+// MaxWikis is how many wikis a profile counts edits for. Edits on further wikis still count
+// towards Edits and BotEdits.
+const MaxWikis = 100
+
+// Profile is what one user has been up to since they were first seen, or since they were
+// last evicted.
+type Profile struct {
+	User     string `json:"user"`
+	Edits    int    `json:"edits"`
+	BotEdits int    `json:"bot_edits"`
+	// Bot is whether their latest edit was flagged as a bot edit.
+	Bot bool `json:"bot"`
+	// Wikis counts their edits per server URL, for up to MaxWikis wikis.
+	Wikis     map[string]int `json:"wikis"`
+	FirstSeen time.Time      `json:"first_seen"`
+	LastSeen  time.Time      `json:"last_seen"`
+}
+
+// Store holds up to a fixed number of profiles, evicting whoever has been quiet the longest.
+// A nil *Store ignores events and has no profiles.
+type Store struct {
+	mu       sync.Mutex
+	maxUsers int
+	// order has the least recently active user at the front.
+	order   *list.List
+	entries map[string]*list.Element
+	now     func() time.Time
+}
+
+// New creates a Store for up to maxUsers profiles. clock is time.Now when nil.
+func New(maxUsers int, clock func() time.Time) *Store {
+	if clock == nil {
+		clock = time.Now
+	}
+
+	return &Store{
+		mu:       sync.Mutex{},
+		maxUsers: max(maxUsers, 1),
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+		now:      clock,
+	}
+}
+
+// Observe adds a batch of events to their users' profiles.
+func (s *Store) Observe(batch []shared.RecentChange) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+
+	for _, rc := range batch {
+		p := s.profile(rc.User, now)
+
+		p.Edits++
+
+		if _, ok := p.Wikis[rc.ServerURL]; ok || len(p.Wikis) < MaxWikis {
+			p.Wikis[rc.ServerURL]++
+		}
+		p.Bot = rc.Bot
+		p.LastSeen = now
+
+		if rc.Bot {
+			p.BotEdits++
+		}
+	}
+}
+
+// profile returns user's profile, marked as the most recently active, creating it and
+// evicting the quietest user if needed. Callers hold mu.
+func (s *Store) profile(user string, now time.Time) *Profile {
+	if el, ok := s.entries[user]; ok {
+		s.order.MoveToBack(el)
+
+		p, _ := el.Value.(*Profile)
+
+		return p
+	}
+
+	p := &Profile{
+		User:      user,
+		Edits:     0,
+		BotEdits:  0,
+		Bot:       false,
+		Wikis:     map[string]int{},
+		FirstSeen: now,
+		LastSeen:  now,
+	}
+	s.entries[user] = s.order.PushBack(p)
+
+	for s.order.Len() > s.maxUsers {
+		evicted, _ := s.order.Remove(s.order.Front()).(*Profile)
+		delete(s.entries, evicted.User)
+	}
+
+	return p
+}
+
+// Get returns a copy of user's profile.
+func (s *Store) Get(user string) (Profile, bool) {
+	if s == nil {
+		return Profile{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.entries[user]
+	if !ok {
+		return Profile{}, false
+	}
+
+	p, _ := el.Value.(*Profile)
+	out := *p
+	out.Wikis = maps.Clone(p.Wikis)
+
+	return out, true
+}
+
+// Len returns how many profiles are held.
+func (s *Store) Len() int {
+	if s == nil {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.order.Len()
+}
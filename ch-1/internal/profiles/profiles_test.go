@@ -0,0 +1,118 @@
+package profiles_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/profiles"
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// TestProfiles verifies edits, wikis, the bot flag and first/last seen add up per user.
+func TestProfiles(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	clock := &fakeClock{mu: sync.Mutex{}, now: start}
+	store := profiles.New(10, clock.Now)
+
+	store.Observe([]shared.RecentChange{
+		{User: "alice", ServerURL: "https://en.wikipedia.org"},
+		{User: "alice", ServerURL: "https://de.wikipedia.org"},
+	})
+	clock.Advance(time.Hour)
+	store.Observe([]shared.RecentChange{{User: "alice", Bot: true, ServerURL: "https://en.wikipedia.org"}})
+
+	p, ok := store.Get("alice")
+	if !ok {
+		t.Fatal("expected alice's profile")
+	}
+
+	if p.Edits != 3 || p.BotEdits != 1 || !p.Bot || p.Wikis["https://en.wikipedia.org"] != 2 || p.Wikis["https://de.wikipedia.org"] != 1 {
+		t.Errorf("unexpected profile: %+v", p)
+	}
+
+	if !p.FirstSeen.Equal(start) || !p.LastSeen.Equal(start.Add(time.Hour)) {
+		t.Errorf("expected first seen %v and last seen an hour later, got %v and %v", start, p.FirstSeen, p.LastSeen)
+	}
+
+	p.Wikis["https://en.wikipedia.org"] = 99
+
+	if again, _ := store.Get("alice"); again.Wikis["https://en.wikipedia.org"] != 2 {
+		t.Error("expected Get to return a copy")
+	}
+
+	if _, ok := store.Get("bob"); ok {
+		t.Error("expected no profile for a user never seen")
+	}
+}
+
+// TestProfilesEviction verifies the store keeps the most recently active users.
+func TestProfilesEviction(t *testing.T) {
+	t.Parallel()
+
+	store := profiles.New(2, nil)
+
+	store.Observe([]shared.RecentChange{{User: "a"}, {User: "b"}})
+	store.Observe([]shared.RecentChange{{User: "a"}, {User: "c"}})
+
+	if store.Len() != 2 {
+		t.Errorf("expected 2 profiles, got %d", store.Len())
+	}
+
+	if _, ok := store.Get("b"); ok {
+		t.Error("expected b, the quietest user, to be evicted")
+	}
+
+	if p, ok := store.Get("a"); !ok || p.Edits != 2 {
+		t.Errorf("expected a to be kept with 2 edits, got %+v", p)
+	}
+
+	var nilStore *profiles.Store
+
+	nilStore.Observe([]shared.RecentChange{{User: "a"}})
+
+	if _, ok := nilStore.Get("a"); ok || nilStore.Len() != 0 {
+		t.Error("expected a nil store to hold nothing")
+	}
+}
+
+// TestProfilesWikiCap verifies a profile stops adding wikis at MaxWikis but keeps counting edits.
+func TestProfilesWikiCap(t *testing.T) {
+	t.Parallel()
+
+	store := profiles.New(1, nil)
+
+	batch := make([]shared.RecentChange, 0, profiles.MaxWikis+2)
+	for i := range profiles.MaxWikis + 1 {
+		batch = append(batch, shared.RecentChange{User: "a", ServerURL: fmt.Sprintf("https://%d.wiki.org", i)})
+	}
+
+	batch = append(batch, shared.RecentChange{User: "a", ServerURL: "https://0.wiki.org"})
+	store.Observe(batch)
+
+	p, _ := store.Get("a")
+	if len(p.Wikis) != profiles.MaxWikis || p.Edits != profiles.MaxWikis+2 || p.Wikis["https://0.wiki.org"] != 2 {
+		t.Errorf("expected %d wikis and %d edits, got %d and %d", profiles.MaxWikis, profiles.MaxWikis+2, len(p.Wikis), p.Edits)
+	}
+}
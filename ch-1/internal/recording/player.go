@@ -0,0 +1,222 @@
+// Package recording - playing recorded files back as an SSE stream.
+package recording
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxSpeed plays events back as fast as they can be read.
+const MaxSpeed = 0
+
+var (
+	errInvalidSpeed = errors.New("replay speed must be original, max or a positive multiplier like 10x")
+	errNoRecordings = errors.New("no recordings found")
+)
+
+// ParseSpeed reads a STREAM_REPLAY_SPEED value: "original" (1), "max" (MaxSpeed) or a multiplier such as "10x".
+func ParseSpeed(s string) (float64, error) {
+	switch strings.ToLower(s) {
+	case "", "original":
+		return 1, nil
+	case "max":
+		return MaxSpeed, nil
+	}
+
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(s), "x"), 64)
+	if err != nil || speed <= 0 {
+		return 0, fmt.Errorf("%w: got %q", errInvalidSpeed, s)
+	}
+
+	return speed, nil
+}
+
+// IsFileURL reports whether the stream URL points at recordings instead of a live stream.
+func IsFileURL(streamURL string) bool {
+	return strings.HasPrefix(streamURL, "file://")
+}
+
+// Open plays back a file:// URL, which may name a single recording or a directory of them,
+// as "data:" lines in the same shape the live stream sends. Events are spaced out by their
+// original arrival times divided by speed; MaxSpeed skips the waiting.
+func Open(ctx context.Context, streamURL string, speed float64) (io.ReadCloser, error) {
+	u, err := url.Parse(streamURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recording URL: %w", err)
+	}
+
+	files, err := recordingFiles(u.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.CloseWithError(play(ctx, files, speed, pw))
+	}()
+
+	return &player{PipeReader: pr, cancel: cancel}, nil
+}
+
+type player struct {
+	*io.PipeReader
+
+	cancel context.CancelFunc
+}
+
+func (p *player) Close() error {
+	p.cancel()
+
+	if err := p.PipeReader.Close(); err != nil {
+		return fmt.Errorf("failed to close recording player: %w", err)
+	}
+
+	return nil
+}
+
+// recordingFiles lists the recordings under path in the order they were written.
+func recordingFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list recordings: %w", err)
+	}
+
+	var files []string
+
+	for _, e := range entries {
+		if !e.IsDir() && (strings.HasSuffix(e.Name(), ".ndjson") || strings.HasSuffix(e.Name(), ".ndjson.gz")) {
+			files = append(files, filepath.Join(path, e.Name()))
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%w in %s", errNoRecordings, path)
+	}
+
+	sort.Strings(files)
+
+	return files, nil
+}
+
+func play(ctx context.Context, files []string, speed float64, w io.Writer) error {
+	var (
+		first   time.Time
+		started = time.Now()
+	)
+
+	for _, name := range files {
+		err := eachEntry(name, func(e Entry) error {
+			if first.IsZero() {
+				first = e.ReceivedAt
+			}
+
+			if speed != MaxSpeed {
+				due := time.Duration(float64(e.ReceivedAt.Sub(first)) / speed)
+				if err := sleepUntil(ctx, started.Add(due)); err != nil {
+					return err
+				}
+			}
+
+			if _, err := io.WriteString(w, "data: "+e.Data+"\n\n"); err != nil {
+				return fmt.Errorf("failed to write replayed event: %w", err)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func eachEntry(name string, fn func(Entry) error) error {
+	//nolint:gosec // The path comes from our own config.
+	f, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("failed to open recording: %w", err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("failed to open compressed recording %s: %w", name, err)
+		}
+		defer gz.Close()
+
+		r = gz
+	}
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+
+	// A recorder that crashed mid-write leaves a torn last line, so a bad line only fails
+	// the playback when more follow it.
+	var torn error
+
+	for sc.Scan() {
+		if torn != nil {
+			return torn
+		}
+
+		var e Entry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			torn = fmt.Errorf("bad entry in %s: %w", name, err)
+			continue
+		}
+
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+
+	if err := sc.Err(); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("failed to read recording %s: %w", name, err)
+	}
+
+	return nil
+}
+
+func sleepUntil(ctx context.Context, t time.Time) error {
+	wait := time.Until(t)
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("replay stopped: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,187 @@
+// Package recording captures the raw Wikimedia stream to NDJSON files and plays them back.
+package recording
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fileTimeFormat = "20060102T150405.000000"
+
+var errClosed = errors.New("recorder is closed")
+
+// Entry is one recorded event: the payload of an SSE data line exactly as received, and when it arrived.
+type Entry struct {
+	ReceivedAt time.Time `json:"received_at"`
+	Data       string    `json:"data"`
+}
+
+// Recorder appends stream events to NDJSON files in a directory, starting a new file once
+// the current one passes maxBytes or has been open for rotateEvery.
+type Recorder struct {
+	mu          sync.Mutex
+	dir         string
+	compress    bool
+	maxBytes    int64
+	rotateEvery time.Duration
+	file        *os.File
+	gz          *gzip.Writer
+	w           *bufio.Writer
+	written     int64
+	openedAt    time.Time
+	// seq numbers the files this recorder opens, so rotations within the same instant
+	// still get distinct names that sort in order.
+	seq    int
+	closed bool
+}
+
+// NewRecorder creates the directory if needed. A zero maxBytes or rotateEvery disables that rotation trigger.
+func NewRecorder(dir string, compress bool, maxBytes int64, rotateEvery time.Duration) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create recording dir: %w", err)
+	}
+
+	return &Recorder{
+		mu:          sync.Mutex{},
+		dir:         dir,
+		compress:    compress,
+		maxBytes:    maxBytes,
+		rotateEvery: rotateEvery,
+		file:        nil,
+		gz:          nil,
+		w:           nil,
+		written:     0,
+		openedAt:    time.Time{},
+		seq:         0,
+		closed:      false,
+	}, nil
+}
+
+// Record writes one SSE data line. The "data:" prefix is stripped, everything else is kept as is.
+func (r *Recorder) Record(line string) error {
+	payload := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(line, "data:"), "\n"), "\r")
+
+	entry, err := json.Marshal(Entry{ReceivedAt: time.Now().UTC(), Data: strings.TrimPrefix(payload, " ")})
+	if err != nil {
+		return fmt.Errorf("failed to encode recorded event: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return errClosed
+	}
+
+	if err := r.rotateIfNeeded(); err != nil {
+		return err
+	}
+
+	n, err := r.w.Write(append(entry, '\n'))
+	r.written += int64(n)
+
+	if err != nil {
+		return fmt.Errorf("failed to write recorded event: %w", err)
+	}
+
+	if err := r.w.Flush(); err != nil {
+		return fmt.Errorf("failed to flush recorded event: %w", err)
+	}
+
+	// Flush the compressor too, so a crash only loses the gzip trailer and never recorded events.
+	if r.gz != nil {
+		if err := r.gz.Flush(); err != nil {
+			return fmt.Errorf("failed to flush recorded event: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Close flushes and closes the current file.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+
+	return r.closeFile()
+}
+
+func (r *Recorder) rotateIfNeeded() error {
+	if r.file != nil {
+		full := r.maxBytes > 0 && r.written >= r.maxBytes
+		stale := r.rotateEvery > 0 && time.Since(r.openedAt) >= r.rotateEvery
+
+		if !full && !stale {
+			return nil
+		}
+
+		if err := r.closeFile(); err != nil {
+			return err
+		}
+	}
+
+	return r.openFile()
+}
+
+func (r *Recorder) openFile() error {
+	now := time.Now().UTC()
+
+	r.seq++
+
+	name := fmt.Sprintf("stream-%s-%06d.ndjson", now.Format(fileTimeFormat), r.seq)
+	if r.compress {
+		name += ".gz"
+	}
+
+	f, err := os.OpenFile(filepath.Join(r.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open recording file: %w", err)
+	}
+
+	r.file = f
+	r.written = 0
+	r.openedAt = now
+
+	if r.compress {
+		r.gz = gzip.NewWriter(f)
+		r.w = bufio.NewWriter(r.gz)
+	} else {
+		r.w = bufio.NewWriter(f)
+	}
+
+	return nil
+}
+
+func (r *Recorder) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+
+	var errs []error
+
+	errs = append(errs, r.w.Flush())
+
+	if r.gz != nil {
+		errs = append(errs, r.gz.Close())
+	}
+
+	errs = append(errs, r.file.Close())
+
+	r.file, r.gz, r.w = nil, nil, nil
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("failed to close recording file: %w", err)
+	}
+
+	return nil
+}
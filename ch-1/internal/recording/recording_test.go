@@ -0,0 +1,227 @@
+package recording_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/recording"
+)
+
+// readAll drains a playback into its data lines.
+func readAll(t *testing.T, streamURL string, speed float64) []string {
+	t.Helper()
+
+	body, err := recording.Open(t.Context(), streamURL, speed)
+	if err != nil {
+		t.Fatalf("failed to open recording: %v", err)
+	}
+	defer body.Close()
+
+	var lines []string
+
+	sc := bufio.NewScanner(body)
+	for sc.Scan() {
+		if strings.HasPrefix(sc.Text(), "data:") {
+			lines = append(lines, sc.Text())
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		t.Fatalf("failed to read playback: %v", err)
+	}
+
+	return lines
+}
+
+// TestRecordAndReplay verifies events come back exactly as received, across rotated and gzipped files.
+func TestRecordAndReplay(t *testing.T) {
+	t.Parallel()
+
+	for _, compress := range []bool{false, true} {
+		t.Run(map[bool]string{false: "plain", true: "gzip"}[compress], func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+
+			// A tiny max size forces a new file for every event.
+			rec, err := recording.NewRecorder(dir, compress, 1, 0)
+			if err != nil {
+				t.Fatalf("failed to create recorder: %v", err)
+			}
+
+			in := []string{
+				"data: {\"user\":\"blub\",\"bot\":false,\"server_url\":\"https://blub.com\"}\n",
+				"data: {not json, kept as is}\n",
+				"data:{\"user\":\"bot\",\"bot\":true}\r\n",
+			}
+
+			for _, line := range in {
+				if err := rec.Record(line); err != nil {
+					t.Fatalf("failed to record: %v", err)
+				}
+			}
+
+			if err := rec.Close(); err != nil {
+				t.Fatalf("failed to close recorder: %v", err)
+			}
+
+			files, _ := filepath.Glob(filepath.Join(dir, "stream-*"))
+			if len(files) != len(in) {
+				t.Errorf("expected %d rotated files, got %d", len(in), len(files))
+			}
+
+			want := []string{
+				"data: {\"user\":\"blub\",\"bot\":false,\"server_url\":\"https://blub.com\"}",
+				"data: {not json, kept as is}",
+				"data: {\"user\":\"bot\",\"bot\":true}",
+			}
+
+			got := readAll(t, "file://"+dir, recording.MaxSpeed)
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("expected %q, got %q", want, got)
+			}
+		})
+	}
+}
+
+// TestReplayPacing verifies events are spaced by their original gaps divided by the speed.
+func TestReplayPacing(t *testing.T) {
+	t.Parallel()
+
+	name := filepath.Join(t.TempDir(), "stream.ndjson")
+	content := `{"received_at":"2025-01-01T00:00:00Z","data":"{}"}
+{"received_at":"2025-01-01T00:00:01Z","data":"{}"}
+`
+
+	if err := os.WriteFile(name, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write recording: %v", err)
+	}
+
+	start := time.Now()
+	if got := readAll(t, "file://"+name, 10); len(got) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(got))
+	}
+
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected roughly 100ms at 10x, took %s", elapsed)
+	}
+}
+
+// TestReplayStopsOnCancel verifies a paced playback doesn't outlive its context.
+func TestReplayStopsOnCancel(t *testing.T) {
+	t.Parallel()
+
+	name := filepath.Join(t.TempDir(), "stream.ndjson")
+	content := `{"received_at":"2025-01-01T00:00:00Z","data":"{}"}
+{"received_at":"2025-01-01T01:00:00Z","data":"{}"}
+`
+
+	if err := os.WriteFile(name, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write recording: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+
+	body, err := recording.Open(ctx, "file://"+name, 1)
+	if err != nil {
+		t.Fatalf("failed to open recording: %v", err)
+	}
+	defer body.Close()
+
+	if _, err := io.Copy(io.Discard, body); err == nil {
+		t.Error("expected playback to stop with an error once the context ended")
+	}
+}
+
+// TestReplayUnclosedRecording verifies a recording whose writer never closed, e.g. after a crash,
+// plays back every event that was recorded, even with a torn line at the end.
+func TestReplayUnclosedRecording(t *testing.T) {
+	t.Parallel()
+
+	t.Run("gzip", func(t *testing.T) {
+		t.Parallel()
+
+		dir := t.TempDir()
+
+		rec, err := recording.NewRecorder(dir, true, 0, 0)
+		if err != nil {
+			t.Fatalf("failed to create recorder: %v", err)
+		}
+		defer rec.Close()
+
+		for _, line := range []string{"data: {\"a\":1}\n", "data: {\"b\":2}\n"} {
+			if err := rec.Record(line); err != nil {
+				t.Fatalf("failed to record: %v", err)
+			}
+		}
+
+		if got := readAll(t, "file://"+dir, recording.MaxSpeed); len(got) != 2 {
+			t.Errorf("expected 2 events before the recorder closed, got %q", got)
+		}
+	})
+
+	t.Run("torn line", func(t *testing.T) {
+		t.Parallel()
+
+		name := filepath.Join(t.TempDir(), "stream.ndjson")
+		content := `{"received_at":"2025-01-01T00:00:00Z","data":"{}"}
+{"received_at":"2025-01-01T00:00:01Z","da`
+
+		if err := os.WriteFile(name, []byte(content), 0o600); err != nil {
+			t.Fatalf("failed to write recording: %v", err)
+		}
+
+		if got := readAll(t, "file://"+name, recording.MaxSpeed); len(got) != 1 {
+			t.Errorf("expected the event before the torn line, got %q", got)
+		}
+	})
+
+	t.Run("bad line in the middle", func(t *testing.T) {
+		t.Parallel()
+
+		name := filepath.Join(t.TempDir(), "stream.ndjson")
+		content := `{"received_at":"2025-01-01T00:00:00Z","da
+{"received_at":"2025-01-01T00:00:01Z","data":"{}"}
+`
+
+		if err := os.WriteFile(name, []byte(content), 0o600); err != nil {
+			t.Fatalf("failed to write recording: %v", err)
+		}
+
+		body, err := recording.Open(t.Context(), "file://"+name, recording.MaxSpeed)
+		if err != nil {
+			t.Fatalf("failed to open recording: %v", err)
+		}
+		defer body.Close()
+
+		if _, err := io.Copy(io.Discard, body); err == nil {
+			t.Error("expected a bad line followed by more entries to fail the playback")
+		}
+	})
+}
+
+// TestParseSpeed covers the accepted STREAM_REPLAY_SPEED values.
+func TestParseSpeed(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]float64{"original": 1, "": 1, "max": recording.MaxSpeed, "10x": 10, "2.5": 2.5}
+	for in, want := range cases {
+		got, err := recording.ParseSpeed(in)
+		if err != nil || got != want {
+			t.Errorf("ParseSpeed(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+
+	for _, in := range []string{"0", "-1x", "fast"} {
+		if _, err := recording.ParseSpeed(in); err == nil {
+			t.Errorf("ParseSpeed(%q) expected an error", in)
+		}
+	}
+}
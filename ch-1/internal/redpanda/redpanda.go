@@ -0,0 +1,215 @@
+// Package redpanda builds kgo clients from the shared config.
+package redpanda
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/config"
+)
+
+var errInvalidCAFile = errors.New("no certificates found in CA file")
+
+// NewProducerClient creates a client that produces to the configured topic.
+func NewProducerClient(cfg *config.Config) (*kgo.Client, error) {
+	opts, err := ProducerOpts(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	cl, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up redpanda producer client: %w", err)
+	}
+
+	return cl, nil
+}
+
+// NewConsumerClient creates a client that consumes the configured topic as part of the group.
+func NewConsumerClient(cfg *config.Config, extra ...kgo.Opt) (*kgo.Client, error) {
+	opts, err := ConsumerOpts(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	cl, err := kgo.NewClient(append(opts, extra...)...)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up redpanda consumer client: %w", err)
+	}
+
+	return cl, nil
+}
+
+// NewAdminClient creates a plain client for admin requests such as topic provisioning.
+func NewAdminClient(cfg *config.Config) (*kgo.Client, error) {
+	opts, err := ClientOpts(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	cl, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up redpanda admin client: %w", err)
+	}
+
+	return cl, nil
+}
+
+// ClientOpts returns the connection options shared by every client: brokers, client ID, SASL and TLS.
+func ClientOpts(cfg *config.Config) ([]kgo.Opt, error) {
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(cfg.RedpandaBrokers...),
+		kgo.ClientID(cfg.RedpandaClientID),
+	}
+
+	if mechanism := saslMechanism(cfg); mechanism != nil {
+		opts = append(opts, kgo.SASL(mechanism))
+	}
+
+	if cfg.RedpandaTLS {
+		tlsCfg, err := tlsConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, kgo.DialTLSConfig(tlsCfg))
+	}
+
+	return opts, nil
+}
+
+// ProducerOpts returns the client options plus the producer delivery settings.
+func ProducerOpts(cfg *config.Config) ([]kgo.Opt, error) {
+	opts, err := ClientOpts(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append(opts,
+		kgo.DefaultProduceTopic(cfg.RedpandaTopic),
+		kgo.RequiredAcks(producerAcks(cfg.ProducerAcks)),
+		kgo.ProducerLinger(cfg.ProducerLinger),
+		kgo.ProducerBatchMaxBytes(cfg.ProducerBatchMaxBytes),
+		kgo.ProducerBatchCompression(producerCompression(cfg.ProducerCompression)),
+	)
+
+	if !cfg.ProducerIdempotent {
+		opts = append(opts, kgo.DisableIdempotentWrite())
+	}
+
+	if cfg.ProducerMaxInFlight > 0 {
+		opts = append(opts, kgo.MaxBufferedRecords(cfg.ProducerMaxInFlight))
+	}
+
+	return opts, nil
+}
+
+// ConsumerOpts returns the client options plus the group consumer settings.
+// Offsets are committed manually after stats are updated.
+func ConsumerOpts(cfg *config.Config) ([]kgo.Opt, error) {
+	opts, err := ClientOpts(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(opts,
+		kgo.ConsumerGroup(cfg.ConsumerGroup),
+		kgo.ConsumeTopics(cfg.RedpandaTopic),
+		kgo.DisableAutoCommit(),
+		kgo.FetchMaxBytes(cfg.ConsumerFetchMaxBytes),
+		kgo.FetchMaxPartitionBytes(cfg.ConsumerFetchMaxPartitionBytes),
+	), nil
+}
+
+// producerAcks converts a validated PRODUCER_ACKS value.
+func producerAcks(acks string) kgo.Acks {
+	switch acks {
+	case "leader":
+		return kgo.LeaderAck()
+	case "none":
+		return kgo.NoAck()
+	default:
+		return kgo.AllISRAcks()
+	}
+}
+
+// producerCompression converts a validated PRODUCER_COMPRESSION value.
+func producerCompression(codec string) kgo.CompressionCodec {
+	switch codec {
+	case "gzip":
+		return kgo.GzipCompression()
+	case "snappy":
+		return kgo.SnappyCompression()
+	case "zstd":
+		return kgo.ZstdCompression()
+	case "none":
+		return kgo.NoCompression()
+	default:
+		return kgo.Lz4Compression()
+	}
+}
+
+// saslMechanism converts a validated REDPANDA_SASL_MECHANISM, or returns nil when SASL is off.
+//
+//nolint:ireturn
+func saslMechanism(cfg *config.Config) sasl.Mechanism {
+	switch cfg.RedpandaSASLMechanism {
+	case "PLAIN":
+		return plain.Auth{Zid: "", User: cfg.RedpandaSASLUser, Pass: cfg.RedpandaSASLPassword}.AsMechanism()
+	case "SCRAM-SHA-256":
+		return scramAuth(cfg).AsSha256Mechanism()
+	case "SCRAM-SHA-512":
+		return scramAuth(cfg).AsSha512Mechanism()
+	default:
+		return nil
+	}
+}
+
+func scramAuth(cfg *config.Config) scram.Auth {
+	return scram.Auth{
+		Zid:     "",
+		User:    cfg.RedpandaSASLUser,
+		Pass:    cfg.RedpandaSASLPassword,
+		Nonce:   nil,
+		IsToken: false,
+	}
+}
+
+// tlsConfig loads the optional CA and client certificate files.
+func tlsConfig(cfg *config.Config) (*tls.Config, error) {
+	//nolint:exhaustruct
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cfg.RedpandaTLSCAFile != "" {
+		ca, err := os.ReadFile(cfg.RedpandaTLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("%w: %s", errInvalidCAFile, cfg.RedpandaTLSCAFile)
+		}
+
+		tlsCfg.RootCAs = pool
+	}
+
+	if cfg.RedpandaTLSCertFile != "" || cfg.RedpandaTLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.RedpandaTLSCertFile, cfg.RedpandaTLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsCfg, nil
+}
@@ -0,0 +1,95 @@
+package redpanda_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/config"
+	"github.com/codyonesock/backend_learning/ch-1/internal/redpanda"
+)
+
+//nolint:exhaustruct
+func testConfig() *config.Config {
+	return &config.Config{
+		RedpandaBrokers:                []string{"localhost:9092"},
+		RedpandaTopic:                  "wikimedia-changes-proto",
+		RedpandaClientID:               "test",
+		ProducerAcks:                   "all",
+		ProducerIdempotent:             true,
+		ProducerCompression:            "lz4",
+		ProducerBatchMaxBytes:          1000000,
+		ProducerMaxInFlight:            100,
+		ConsumerGroup:                  "test-group",
+		ConsumerWorkers:                1,
+		ConsumerFetchMaxBytes:          1048576,
+		ConsumerFetchMaxPartitionBytes: 1048576,
+	}
+}
+
+// TestNewClients verifies that clients build from a plain config without dialing the brokers.
+func TestNewClients(t *testing.T) {
+	t.Parallel()
+
+	cfg := testConfig()
+	cfg.RedpandaSASLMechanism = "SCRAM-SHA-512"
+	cfg.RedpandaSASLUser = "blub"
+	cfg.RedpandaSASLPassword = "pw123"
+
+	pcl, err := redpanda.NewProducerClient(cfg)
+	if err != nil {
+		t.Fatalf("unexpected producer error: %v", err)
+	}
+	defer pcl.Close()
+
+	ccl, err := redpanda.NewConsumerClient(cfg)
+	if err != nil {
+		t.Fatalf("unexpected consumer error: %v", err)
+	}
+	defer ccl.Close()
+}
+
+// TestClientOptsTLS verifies the TLS files are checked up front.
+func TestClientOptsTLS(t *testing.T) {
+	t.Parallel()
+
+	t.Run("missing CA file", func(t *testing.T) {
+		t.Parallel()
+
+		cfg := testConfig()
+		cfg.RedpandaTLS = true
+		cfg.RedpandaTLSCAFile = filepath.Join(t.TempDir(), "missing.pem")
+
+		if _, err := redpanda.ClientOpts(cfg); err == nil {
+			t.Error("expected an error for a missing CA file")
+		}
+	})
+
+	t.Run("CA file without certificates", func(t *testing.T) {
+		t.Parallel()
+
+		caFile := filepath.Join(t.TempDir(), "ca.pem")
+		if err := os.WriteFile(caFile, []byte("not a cert"), 0o600); err != nil {
+			t.Fatalf("failed to write CA file: %v", err)
+		}
+
+		cfg := testConfig()
+		cfg.RedpandaTLS = true
+		cfg.RedpandaTLSCAFile = caFile
+
+		if _, err := redpanda.ClientOpts(cfg); err == nil {
+			t.Error("expected an error for an empty CA file")
+		}
+	})
+
+	t.Run("system roots", func(t *testing.T) {
+		t.Parallel()
+
+		cfg := testConfig()
+		cfg.RedpandaTLS = true
+
+		if _, err := redpanda.ClientOpts(cfg); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
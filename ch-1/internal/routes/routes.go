@@ -21,9 +21,16 @@ func RegisterRoutes(
 
 	r.Route("/stats", func(r chi.Router) {
 		r.Use(userService.AuthMiddleware)
-		r.Get("/", statsService.Handler(statsService).ServeHTTP)
+		r.Mount("/", statsService.Handler(statsService))
 	})
 
+	if statusService.Tail != nil {
+		r.Route("/events", func(r chi.Router) {
+			r.Use(userService.AuthMiddleware)
+			r.Get("/tail", statusService.Tail.ServeHTTP)
+		})
+	}
+
 	r.Route("/users", func(r chi.Router) {
 		r.Post("/register", userService.RegisterHandler)
 		r.Post("/login", userService.LoginHandler)
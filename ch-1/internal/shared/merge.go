@@ -0,0 +1,94 @@
+package shared
+
+import "maps"
+
+// NewStats returns empty stats.
+func NewStats() *Stats {
+	return &Stats{
+		MessagesConsumed:   0,
+		DistinctUsers:      map[string]int{},
+		BotsCount:          0,
+		NonBotsCount:       0,
+		DistinctServerURLs: map[string]int{},
+		WikiBots:           map[string]int{},
+		WikiUsers:          map[string]int{},
+	}
+}
+
+// Clone returns a deep copy of the stats.
+func (s *Stats) Clone() *Stats {
+	return &Stats{
+		MessagesConsumed:   s.MessagesConsumed,
+		DistinctUsers:      maps.Clone(s.DistinctUsers),
+		BotsCount:          s.BotsCount,
+		NonBotsCount:       s.NonBotsCount,
+		DistinctServerURLs: maps.Clone(s.DistinctServerURLs),
+		WikiBots:           maps.Clone(s.WikiBots),
+		WikiUsers:          maps.Clone(s.WikiUsers),
+	}
+}
+
+// Shards holds each replica's stats keyed by replica ID. A replica only ever grows its own
+// shard, so shards behave like G-counters: two copies of a shard merge by taking the max of
+// every count, and the global stats are the sum over replicas.
+type Shards map[string]*Stats
+
+// Merge folds other into s. It is commutative and idempotent, so shards can be merged
+// in any order and any number of times.
+func (s Shards) Merge(other Shards) {
+	for replica, theirs := range other {
+		ours, ok := s[replica]
+		if !ok {
+			s[replica] = theirs.Clone()
+			continue
+		}
+
+		ours.MessagesConsumed = max(ours.MessagesConsumed, theirs.MessagesConsumed)
+		ours.BotsCount = max(ours.BotsCount, theirs.BotsCount)
+		ours.NonBotsCount = max(ours.NonBotsCount, theirs.NonBotsCount)
+		mergeMax(ours.DistinctUsers, theirs.DistinctUsers)
+		mergeMax(ours.DistinctServerURLs, theirs.DistinctServerURLs)
+		mergeMax(ours.WikiBots, theirs.WikiBots)
+		mergeMax(ours.WikiUsers, theirs.WikiUsers)
+	}
+}
+
+// Total sums every replica's shard into the global stats.
+func (s Shards) Total() *Stats {
+	total := NewStats()
+
+	for _, shard := range s {
+		total.Add(shard)
+	}
+
+	return total
+}
+
+// Add sums other's counts into s.
+func (s *Stats) Add(other *Stats) {
+	s.MessagesConsumed += other.MessagesConsumed
+	s.BotsCount += other.BotsCount
+	s.NonBotsCount += other.NonBotsCount
+
+	for k, v := range other.DistinctUsers {
+		s.DistinctUsers[k] += v
+	}
+
+	for k, v := range other.DistinctServerURLs {
+		s.DistinctServerURLs[k] += v
+	}
+
+	for k, v := range other.WikiBots {
+		s.WikiBots[k] += v
+	}
+
+	for k, v := range other.WikiUsers {
+		s.WikiUsers[k] += v
+	}
+}
+
+func mergeMax(dst, src map[string]int) {
+	for k, v := range src {
+		dst[k] = max(dst[k], v)
+	}
+}
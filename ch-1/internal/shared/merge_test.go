@@ -0,0 +1,57 @@
+package shared_test
+
+import (
+	"testing"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+)
+
+func shard(messages int, users map[string]int) *shared.Stats {
+	s := shared.NewStats()
+	s.MessagesConsumed = messages
+	s.NonBotsCount = messages
+	s.DistinctUsers = users
+	s.DistinctServerURLs = map[string]int{"https://blub.com": messages}
+
+	return s
+}
+
+// TestShardsMerge verifies merging is idempotent and order independent, and totals sum replicas.
+func TestShardsMerge(t *testing.T) {
+	t.Parallel()
+
+	stale := shared.Shards{"a": shard(2, map[string]int{"x": 2})}
+	fresh := shared.Shards{
+		"a": shard(5, map[string]int{"x": 3, "y": 2}),
+		"b": shard(1, map[string]int{"x": 1}),
+	}
+
+	left := shared.Shards{}
+	left.Merge(stale)
+	left.Merge(fresh)
+	left.Merge(fresh)
+
+	right := shared.Shards{}
+	right.Merge(fresh)
+	right.Merge(stale)
+
+	for name, merged := range map[string]shared.Shards{"left": left, "right": right} {
+		total := merged.Total()
+
+		if total.MessagesConsumed != 6 || total.NonBotsCount != 6 {
+			t.Errorf("%s: expected 6 messages, got %+v", name, total)
+		}
+
+		if total.DistinctUsers["x"] != 4 || total.DistinctUsers["y"] != 2 || len(total.DistinctUsers) != 2 {
+			t.Errorf("%s: expected x=4 y=2, got %v", name, total.DistinctUsers)
+		}
+
+		if total.DistinctServerURLs["https://blub.com"] != 6 {
+			t.Errorf("%s: expected 6 server url edits, got %v", name, total.DistinctServerURLs)
+		}
+	}
+
+	if fresh["a"].MessagesConsumed != 5 || stale["a"].MessagesConsumed != 2 {
+		t.Error("expected merging to leave its inputs alone")
+	}
+}
@@ -1,11 +1,23 @@
 // Package shared is for shared stuff.
 package shared
 
+import "strings"
+
 // RecentChange is based on event data from Wikimedia.
 type RecentChange struct {
 	User      string `json:"user"`
 	Bot       bool   `json:"bot"`
 	ServerURL string `json:"server_url"`
+	Wiki      string `json:"wiki"`
+	Namespace int    `json:"namespace"`
+	Type      string `json:"type"`
+	Meta      Meta   `json:"meta"`
+}
+
+// Meta is the subset of the event meta block we use.
+type Meta struct {
+	// ID uniquely identifies the event, see dedup.
+	ID string `json:"id"`
 }
 
 // Stats holds the core data that comes from Wikimedia.
@@ -15,4 +27,22 @@ type Stats struct {
 	BotsCount          int            `json:"bots_count"`
 	NonBotsCount       int            `json:"non_bots_count"`
 	DistinctServerURLs map[string]int `json:"-"`
+	// WikiBots counts bot edits per server URL.
+	WikiBots map[string]int `json:"-"`
+	// WikiUsers counts edits per server URL and user, keyed by WikiUserKey.
+	WikiUsers map[string]int `json:"-"`
+}
+
+// wikiUserSep can't appear in a MediaWiki username or a server URL.
+const wikiUserSep = "|"
+
+// WikiUserKey is the Stats.WikiUsers key for a user on a wiki.
+func WikiUserKey(serverURL, user string) string {
+	return serverURL + wikiUserSep + user
+}
+
+// SplitWikiUserKey reverses WikiUserKey.
+func SplitWikiUserKey(key string) (serverURL, user string) {
+	serverURL, user, _ = strings.Cut(key, wikiUserSep)
+	return serverURL, user
 }
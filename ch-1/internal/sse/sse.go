@@ -0,0 +1,72 @@
+// Package sse writes Server-Sent Events.
+package sse
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// WriteTimeout drops a client that can't take an event this fast.
+	WriteTimeout = 10 * time.Second
+	// KeepAlive is how long a quiet stream waits before a keepalive, so proxies keep it open.
+	KeepAlive = 15 * time.Second
+)
+
+// Writer sends events to one client.
+type Writer struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+// NewWriter sets the event stream headers on w and returns a Writer for it.
+func NewWriter(w http.ResponseWriter) *Writer {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	return &Writer{w: w, rc: http.NewResponseController(w)}
+}
+
+// Event sends v as JSON data, named kind unless kind is empty.
+func (sw *Writer) Event(kind string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	msg := "data: " + string(data) + "\n\n"
+	if kind != "" {
+		msg = "event: " + kind + "\n" + msg
+	}
+
+	return sw.write(msg)
+}
+
+// Comment sends a comment line, which clients ignore.
+func (sw *Writer) Comment(text string) error {
+	return sw.write(": " + text + "\n\n")
+}
+
+// KeepAlive sends a keepalive comment.
+func (sw *Writer) KeepAlive() error {
+	return sw.Comment("keepalive")
+}
+
+// write pushes one message. The deadline replaces the server's WriteTimeout, which would
+// otherwise end every stream, and drops a client that stops reading.
+func (sw *Writer) write(msg string) error {
+	_ = sw.rc.SetWriteDeadline(time.Now().Add(WriteTimeout))
+
+	if _, err := sw.w.Write([]byte(msg)); err != nil {
+		return fmt.Errorf("failed to write event: %w", err)
+	}
+
+	if err := sw.rc.Flush(); err != nil {
+		return fmt.Errorf("failed to flush event: %w", err)
+	}
+
+	return nil
+}
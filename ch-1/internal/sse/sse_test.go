@@ -0,0 +1,37 @@
+package sse_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/sse"
+)
+
+// TestWriter verifies the headers and the wire format of events and comments.
+func TestWriter(t *testing.T) {
+	t.Parallel()
+
+	rec := httptest.NewRecorder()
+	sw := sse.NewWriter(rec)
+
+	if err := sw.Event("snapshot", map[string]int{"n": 1}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := sw.Event("", "plain"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := sw.KeepAlive(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected an event stream, got %q", ct)
+	}
+
+	want := "event: snapshot\ndata: {\"n\":1}\n\ndata: \"plain\"\n\n: keepalive\n\n"
+	if got := rec.Body.String(); got != want || !rec.Flushed {
+		t.Errorf("expected %q flushed, got %q", want, got)
+	}
+}
@@ -0,0 +1,67 @@
+package stats_test
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/anomaly"
+	"github.com/codyonesock/backend_learning/ch-1/internal/metrics"
+	"github.com/codyonesock/backend_learning/ch-1/internal/stats"
+	"github.com/codyonesock/backend_learning/ch-1/internal/storage"
+)
+
+// TestAnomaliesRoute verifies applied batches reach the detector and /anomalies lists what fires.
+func TestAnomaliesRoute(t *testing.T) {
+	t.Parallel()
+
+	clock := &fakeClock{mu: sync.Mutex{}, now: time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)}
+
+	service, _ := newPersistService(t, storage.NewMemoryStorage())
+	if rec := get(t, service.Handler(service), "/anomalies"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without a detector, got %d", rec.Code)
+	}
+
+	opts := stats.DefaultOptions()
+	opts.Metrics = metrics.NewStatsMetrics(prometheus.NewRegistry())
+	opts.Clock = clock.Now
+	opts.Anomalies = anomaly.New(anomaly.Config{
+		Interval:  time.Minute,
+		Alpha:     0.2,
+		Default:   anomaly.Thresholds{RateZ: 3, BotRatioZ: 0},
+		PerWiki:   nil,
+		MinEvents: 10,
+		Warmup:    5,
+		Clock:     clock.Now,
+	}, nil, zap.NewNop())
+
+	service, err := stats.NewStatsServiceWithOptions(zap.NewNop(), storage.NewMemoryStorage(), opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	t.Cleanup(func() { _ = service.Close() })
+
+	h := service.Handler(service)
+
+	for range 10 {
+		service.ApplyBatch(batchOf(0, 60))
+		clock.Advance(time.Minute)
+	}
+
+	if got := decode[[]anomaly.Anomaly](t, get(t, h, "/anomalies")); got == nil || len(got) != 0 {
+		t.Errorf("expected an empty list, got %+v", got)
+	}
+
+	service.ApplyBatch(batchOf(0, 600))
+	clock.Advance(time.Minute)
+
+	got := decode[[]anomaly.Anomaly](t, get(t, h, "/anomalies"))
+	if len(got) != 1 || got[0].ServerURL != "https://en.wiki.org" || got[0].Kind != anomaly.KindRate {
+		t.Errorf("expected a rate anomaly on en, got %+v", got)
+	}
+}
@@ -0,0 +1,337 @@
+package stats
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	wikimedia "github.com/codyonesock/backend_learning/ch-6/proto"
+)
+
+// Format is a GET /stats response encoding.
+type Format string
+
+const (
+	// FormatJSON is the default.
+	FormatJSON Format = "json"
+	// FormatCSV is a header row and one row of counts, followed by the rates when set.
+	FormatCSV Format = "csv"
+	// FormatProto is a wikimedia.StatsResponse message.
+	FormatProto Format = "proto"
+	// FormatPrometheus is the Prometheus text exposition format.
+	FormatPrometheus Format = "prometheus"
+	// FormatOpenMetrics is the OpenMetrics text format.
+	FormatOpenMetrics Format = "openmetrics"
+)
+
+const (
+	contentTypeCSV         = "text/csv; charset=utf-8"
+	contentTypeProto       = "application/x-protobuf"
+	contentTypePrometheus  = "text/plain; version=0.0.4; charset=utf-8"
+	contentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+var (
+	errUnknownFormat = errors.New("format must be json, csv, proto, prometheus or openmetrics")
+	errNotAcceptable = errors.New("no acceptable stats format, use json, csv, protobuf, text/plain or openmetrics")
+)
+
+// formatAliases maps ?format= values to formats.
+var formatAliases = map[string]Format{
+	"json":        FormatJSON,
+	"csv":         FormatCSV,
+	"proto":       FormatProto,
+	"protobuf":    FormatProto,
+	"prometheus":  FormatPrometheus,
+	"text":        FormatPrometheus,
+	"openmetrics": FormatOpenMetrics,
+}
+
+// mediaTypes maps Accept media types to formats.
+var mediaTypes = map[string]Format{
+	"*/*":                             FormatJSON,
+	"application/*":                   FormatJSON,
+	"application/json":                FormatJSON,
+	"text/csv":                        FormatCSV,
+	"application/x-protobuf":          FormatProto,
+	"application/protobuf":            FormatProto,
+	"application/vnd.google.protobuf": FormatProto,
+	"text/plain":                      FormatPrometheus,
+	"application/openmetrics-text":    FormatOpenMetrics,
+}
+
+// NegotiateFormat picks the response format. A ?format= query wins, then the Accept media
+// type with the highest q value, earlier ones breaking ties. No Accept header means JSON.
+func NegotiateFormat(r *http.Request) (Format, error) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		f, ok := formatAliases[strings.ToLower(name)]
+		if !ok {
+			return "", fmt.Errorf("%w: got %q", errUnknownFormat, name)
+		}
+
+		return f, nil
+	}
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return FormatJSON, nil
+	}
+
+	best, bestQ := Format(""), 0.0
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		f, ok := mediaTypes[mediaType]
+		if !ok {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		if q > bestQ {
+			best, bestQ = f, q
+		}
+	}
+
+	if best == "" {
+		return "", errNotAcceptable
+	}
+
+	return best, nil
+}
+
+// writeResponse encodes resp in format. Like writeJSON it only fails before anything is written.
+func (s *Service) writeResponse(w http.ResponseWriter, resp Response, format Format) error {
+	switch format {
+	case FormatCSV:
+		w.Header().Set("Content-Type", contentTypeCSV)
+		return s.logWriteError(writeCSV(w, resp))
+	case FormatProto:
+		body, err := proto.Marshal(resp.Proto())
+		if err != nil {
+			s.Logger.Error("Failed to marshal response", zap.Error(err))
+			return fmt.Errorf("failed to marshal response %w", err)
+		}
+
+		w.Header().Set("Content-Type", contentTypeProto)
+
+		_, err = w.Write(body)
+
+		return s.logWriteError(err)
+	case FormatPrometheus, FormatOpenMetrics:
+		contentType := contentTypePrometheus
+		if format == FormatOpenMetrics {
+			contentType = contentTypeOpenMetrics
+		}
+
+		w.Header().Set("Content-Type", contentType)
+
+		return s.logWriteError(writeMetrics(w, resp, format == FormatOpenMetrics))
+	default:
+		return s.writeJSON(w, resp)
+	}
+}
+
+// logWriteError logs a failed write. The response has started by then so it isn't returned.
+func (s *Service) logWriteError(err error) error {
+	if err != nil {
+		s.Logger.Error("Failed to write stats response", zap.Error(err))
+	}
+
+	return nil
+}
+
+// Proto converts the response to its protobuf message.
+func (r Response) Proto() *wikimedia.StatsResponse {
+	msg := &wikimedia.StatsResponse{
+		MessagesConsumed:   int64(r.MessagesConsumed),
+		DistinctUsers:      int64(r.DistinctUsersCount),
+		BotsCount:          int64(r.BotsCount),
+		NonBotsCount:       int64(r.NonBotsCount),
+		DistinctServerUrls: int64(r.DistinctServerURLCount),
+		Rates:              nil,
+	}
+
+	if r.Rates != nil {
+		msg.Rates = r.Rates.Proto()
+	}
+
+	return msg
+}
+
+// Proto converts the rates to their protobuf message.
+func (r Rates) Proto() *wikimedia.Rates {
+	var peakAt int64
+	if r.PeakAt != nil {
+		peakAt = r.PeakAt.UnixMilli()
+	}
+
+	return &wikimedia.Rates{
+		EventsPerSec:     r.EventsPerSec.proto(),
+		BotsPerSec:       r.BotsPerSec.proto(),
+		NonBotsPerSec:    r.NonBotsPerSec.proto(),
+		BotRatio:         r.BotRatio.proto(),
+		BotRatioTrend:    r.BotRatioTrend,
+		PeakEventsPerSec: r.PeakPerSec,
+		PeakAtUnixMs:     peakAt,
+	}
+}
+
+func (w RateWindows) proto() *wikimedia.RateWindows {
+	return &wikimedia.RateWindows{M1: w.M1, M5: w.M5, M15: w.M15}
+}
+
+// windowValue is one window of a RateWindows, labelled like its JSON field.
+type windowValue struct {
+	window string
+	value  float64
+}
+
+func (w RateWindows) values() []windowValue {
+	return []windowValue{{"1m", w.M1}, {"5m", w.M5}, {"15m", w.M15}}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeCSV(w io.Writer, resp Response) error {
+	cw := csv.NewWriter(w)
+
+	header := []string{"messages_consumed", "distinct_users", "bots_count", "non_bots_count", "distinct_server_urls"}
+	row := []string{
+		strconv.Itoa(resp.MessagesConsumed),
+		strconv.Itoa(resp.DistinctUsersCount),
+		strconv.Itoa(resp.BotsCount),
+		strconv.Itoa(resp.NonBotsCount),
+		strconv.Itoa(resp.DistinctServerURLCount),
+	}
+
+	if r := resp.Rates; r != nil {
+		// Columns are named after the JSON fields, with the window appended.
+		for _, rate := range []struct {
+			name    string
+			windows RateWindows
+		}{
+			{"events_per_sec", r.EventsPerSec},
+			{"bots_per_sec", r.BotsPerSec},
+			{"non_bots_per_sec", r.NonBotsPerSec},
+			{"bot_ratio", r.BotRatio},
+		} {
+			for _, v := range rate.windows.values() {
+				header = append(header, rate.name+"_"+v.window)
+				row = append(row, formatFloat(v.value))
+			}
+		}
+
+		peakAt := ""
+		if r.PeakAt != nil {
+			peakAt = r.PeakAt.UTC().Format(time.RFC3339)
+		}
+
+		header = append(header, "bot_ratio_trend", "peak_events_per_sec", "peak_at")
+		row = append(row, formatFloat(r.BotRatioTrend), formatFloat(r.PeakPerSec), peakAt)
+	}
+
+	if err := cw.WriteAll([][]string{header, row}); err != nil {
+		return fmt.Errorf("failed to write csv response: %w", err)
+	}
+
+	return nil
+}
+
+type metric struct {
+	name    string
+	help    string
+	counter bool
+	value   int
+}
+
+// writeMetrics renders the counts as metrics, followed by the rates when set. Counters get the
+// _total suffix on their samples, which OpenMetrics leaves off the family name and the
+// Prometheus text format keeps.
+func writeMetrics(w io.Writer, resp Response, openMetrics bool) error {
+	metrics := []metric{
+		{"stats_messages_consumed", "Messages consumed from the stream.", true, resp.MessagesConsumed},
+		{"stats_distinct_users", "Distinct users seen.", false, resp.DistinctUsersCount},
+		{"stats_bot_edits", "Edits made by bots.", true, resp.BotsCount},
+		{"stats_non_bot_edits", "Edits made by people.", true, resp.NonBotsCount},
+		{"stats_distinct_server_urls", "Distinct server URLs seen.", false, resp.DistinctServerURLCount},
+	}
+
+	var b strings.Builder
+
+	for _, m := range metrics {
+		family, sample, kind := m.name, m.name, "gauge"
+		if m.counter {
+			kind, sample = "counter", m.name+"_total"
+			if !openMetrics {
+				family = sample
+			}
+		}
+
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", family, m.help, family, kind, sample, m.value)
+	}
+
+	if resp.Rates != nil {
+		writeRateMetrics(&b, *resp.Rates)
+	}
+
+	if openMetrics {
+		b.WriteString("# EOF\n")
+	}
+
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return fmt.Errorf("failed to write metrics response: %w", err)
+	}
+
+	return nil
+}
+
+// writeRateMetrics renders the rates as the gauges the stats metrics register, plus the trend.
+func writeRateMetrics(b *strings.Builder, r Rates) {
+	gauge := func(name, help string) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+
+	gauge("stats_events_per_second", "Moving average of events per second by kind (all, bot, non_bot) and window.")
+
+	for _, kind := range []struct {
+		name    string
+		windows RateWindows
+	}{{"all", r.EventsPerSec}, {"bot", r.BotsPerSec}, {"non_bot", r.NonBotsPerSec}} {
+		for _, v := range kind.windows.values() {
+			fmt.Fprintf(b, "stats_events_per_second{kind=%q,window=%q} %s\n", kind.name, v.window, formatFloat(v.value))
+		}
+	}
+
+	gauge("stats_bot_ratio", "Share of events from bots over each moving average window.")
+
+	for _, v := range r.BotRatio.values() {
+		fmt.Fprintf(b, "stats_bot_ratio{window=%q} %s\n", v.window, formatFloat(v.value))
+	}
+
+	gauge("stats_bot_ratio_trend", "The 1m bot ratio minus the 15m one.")
+	fmt.Fprintf(b, "stats_bot_ratio_trend %s\n", formatFloat(r.BotRatioTrend))
+
+	gauge("stats_peak_events_per_second", "Highest 1m moving average of events per second since startup.")
+	fmt.Fprintf(b, "stats_peak_events_per_second %s\n", formatFloat(r.PeakPerSec))
+}
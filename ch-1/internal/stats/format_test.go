@@ -0,0 +1,173 @@
+package stats_test
+
+import (
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/metrics"
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+	"github.com/codyonesock/backend_learning/ch-1/internal/stats"
+	"github.com/codyonesock/backend_learning/ch-1/internal/storage"
+	wikimedia "github.com/codyonesock/backend_learning/ch-6/proto"
+)
+
+// TestNegotiateFormat verifies ?format= wins over Accept, and Accept honours q values.
+func TestNegotiateFormat(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		target string
+		accept string
+		want   stats.Format
+	}{
+		{"/", "", stats.FormatJSON},
+		{"/", "*/*", stats.FormatJSON},
+		{"/", "text/csv", stats.FormatCSV},
+		{"/", "application/x-protobuf", stats.FormatProto},
+		{"/", "text/plain;version=0.0.4", stats.FormatPrometheus},
+		{"/", "application/json;q=0.5, text/csv;q=0.9", stats.FormatCSV},
+		{"/", "text/html, application/protobuf", stats.FormatProto},
+		// What Prometheus sends when scraping.
+		{
+			"/",
+			"application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75," +
+				"text/plain;version=0.0.4;q=0.5,*/*;q=0.1",
+			stats.FormatOpenMetrics,
+		},
+		{"/?format=csv", "application/json", stats.FormatCSV},
+		{"/?format=protobuf", "", stats.FormatProto},
+	}
+
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+		r.Header.Set("Accept", tc.accept)
+
+		got, err := stats.NegotiateFormat(r)
+		if err != nil || got != tc.want {
+			t.Errorf("%s with Accept %q: got %q, %v, want %q", tc.target, tc.accept, got, err, tc.want)
+		}
+	}
+}
+
+// TestStatsFormats verifies each format carries the same counts, and bad requests are refused.
+func TestStatsFormats(t *testing.T) {
+	t.Parallel()
+
+	service, _ := newPersistService(t, storage.NewMemoryStorage())
+	service.ApplyBatch([]shared.RecentChange{
+		{User: "a", Bot: true, ServerURL: "https://en.wiki.org"},
+		{User: "b", ServerURL: "https://en.wiki.org"},
+		{User: "b", ServerURL: "https://de.wiki.org"},
+	})
+
+	h := service.Handler(service)
+
+	rec := get(t, h, "/?format=csv")
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Errorf("csv: got content type %q", ct)
+	}
+
+	rows, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil || len(rows) != 2 || strings.Join(rows[1][:5], ",") != "3,2,1,2,2" {
+		t.Errorf("csv: got %v, %v", rows, err)
+	}
+
+	rec = get(t, h, "/?format=proto")
+
+	var msg wikimedia.StatsResponse
+	if err := proto.Unmarshal(rec.Body.Bytes(), &msg); err != nil {
+		t.Fatalf("proto: %v", err)
+	}
+
+	if msg.GetMessagesConsumed() != 3 || msg.GetDistinctUsers() != 2 || msg.GetBotsCount() != 1 {
+		t.Errorf("proto: got %v", &msg)
+	}
+
+	rec = get(t, h, "/?format=prometheus")
+	if body := rec.Body.String(); !strings.Contains(body, "stats_messages_consumed_total 3\n") ||
+		!strings.Contains(body, "# TYPE stats_distinct_users gauge\nstats_distinct_users 2\n") {
+		t.Errorf("prometheus: got %q", body)
+	}
+
+	rec = get(t, h, "/?format=openmetrics")
+	if body := rec.Body.String(); !strings.Contains(body, "# TYPE stats_messages_consumed counter\n") ||
+		!strings.HasSuffix(body, "# EOF\n") {
+		t.Errorf("openmetrics: got %q", body)
+	}
+
+	if rec := get(t, h, "/?format=xml"); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown format: expected 400, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "text/html")
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNotAcceptable {
+		t.Errorf("text/html: expected 406, got %d", rec.Code)
+	}
+}
+
+// TestStatsFormatsRates verifies the rates reach every format, not just the JSON.
+func TestStatsFormatsRates(t *testing.T) {
+	t.Parallel()
+
+	clock := &fakeClock{mu: sync.Mutex{}, now: time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)}
+
+	opts := stats.DefaultOptions()
+	opts.Metrics = metrics.NewStatsMetrics(prometheus.NewRegistry())
+	opts.Clock = clock.Now
+
+	service, err := stats.NewStatsServiceWithOptions(zap.NewNop(), storage.NewMemoryStorage(), opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 8 events/sec, a quarter of them bots.
+	service.ApplyBatch(batchOf(10, 30))
+	clock.Advance(5 * time.Second)
+
+	h := service.Handler(service)
+
+	rows, err := csv.NewReader(get(t, h, "/?format=csv").Body).ReadAll()
+	if err != nil || len(rows) != 2 {
+		t.Fatalf("csv: got %v, %v", rows, err)
+	}
+
+	events := slices.Index(rows[0], "events_per_sec_1m")
+	if events < 0 || rows[1][events] == "0" || !slices.Contains(rows[0], "bot_ratio_15m") {
+		t.Errorf("csv: expected the rate columns, got %v", rows)
+	}
+
+	var msg wikimedia.StatsResponse
+	if err := proto.Unmarshal(get(t, h, "/?format=proto").Body.Bytes(), &msg); err != nil {
+		t.Fatalf("proto: %v", err)
+	}
+
+	rates := msg.GetRates()
+	if rates.GetEventsPerSec().GetM1() <= 0 || rates.GetBotRatio().GetM1() != 0.25 || rates.GetPeakAtUnixMs() == 0 {
+		t.Errorf("proto: expected the rates, got %v", rates)
+	}
+
+	for _, format := range []string{"prometheus", "openmetrics"} {
+		body := get(t, h, "/?format="+format).Body.String()
+		if !strings.Contains(body, "# TYPE stats_events_per_second gauge\n") ||
+			!strings.Contains(body, "stats_events_per_second{kind=\"all\",window=\"1m\"} ") ||
+			!strings.Contains(body, "stats_bot_ratio{window=\"15m\"} 0.25\n") ||
+			!strings.Contains(body, "# TYPE stats_peak_events_per_second gauge\n") {
+			t.Errorf("%s: expected the rate gauges, got %q", format, body)
+		}
+	}
+}
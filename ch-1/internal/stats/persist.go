@@ -0,0 +1,269 @@
+package stats
+
+import (
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+	"github.com/codyonesock/backend_learning/ch-1/internal/storage"
+)
+
+// dirtySet tracks what changed since the last successful save, as increments. Guarded by Service.Mu.
+type dirtySet struct {
+	messages   int
+	bots       int
+	nonBots    int
+	users      map[string]int
+	serverURLs map[string]int
+	wikiBots   map[string]int
+	wikiUsers  map[string]int
+}
+
+func newDirtySet() dirtySet {
+	return dirtySet{
+		messages:   0,
+		bots:       0,
+		nonBots:    0,
+		users:      map[string]int{},
+		serverURLs: map[string]int{},
+		wikiBots:   map[string]int{},
+		wikiUsers:  map[string]int{},
+	}
+}
+
+// mark records rc's increments. wikiUser is whether its user on its wiki was counted.
+func (d *dirtySet) mark(rc shared.RecentChange, wikiUser bool) {
+	d.messages++
+
+	if rc.Bot {
+		d.bots++
+		d.wikiBots[rc.ServerURL]++
+	} else {
+		d.nonBots++
+	}
+
+	d.users[rc.User]++
+	d.serverURLs[rc.ServerURL]++
+
+	if wikiUser {
+		d.wikiUsers[shared.WikiUserKey(rc.ServerURL, rc.User)]++
+	}
+}
+
+// merge puts increments back after a failed save, alongside anything marked since.
+func (d *dirtySet) merge(other dirtySet) {
+	d.messages += other.messages
+	d.bots += other.bots
+	d.nonBots += other.nonBots
+
+	for k, v := range other.users {
+		d.users[k] += v
+	}
+
+	for k, v := range other.serverURLs {
+		d.serverURLs[k] += v
+	}
+
+	for k, v := range other.wikiBots {
+		d.wikiBots[k] += v
+	}
+
+	for k, v := range other.wikiUsers {
+		d.wikiUsers[k] += v
+	}
+}
+
+// empty reports whether nothing is left to save. The counts can reach zero while keys are left
+// over from a partly saved write.
+func (d *dirtySet) empty() bool {
+	return d.messages == 0 && len(d.users) == 0 && len(d.serverURLs) == 0 &&
+		len(d.wikiBots) == 0 && len(d.wikiUsers) == 0
+}
+
+// subtract takes out increments that were already saved.
+func (d *dirtySet) subtract(saved *storage.Increments) {
+	d.messages -= saved.MessagesConsumed
+	d.bots -= saved.BotsCount
+	d.nonBots -= saved.NonBotsCount
+
+	for _, m := range [][2]map[string]int{
+		{d.users, saved.DistinctUsers},
+		{d.serverURLs, saved.DistinctServerURLs},
+		{d.wikiBots, saved.WikiBots},
+		{d.wikiUsers, saved.WikiUsers},
+	} {
+		for k, v := range m[1] {
+			if m[0][k] -= v; m[0][k] == 0 {
+				delete(m[0], k)
+			}
+		}
+	}
+}
+
+func (d *dirtySet) increments() *storage.Increments {
+	return &storage.Increments{
+		MessagesConsumed:   d.messages,
+		BotsCount:          d.bots,
+		NonBotsCount:       d.nonBots,
+		DistinctUsers:      d.users,
+		DistinctServerURLs: d.serverURLs,
+		WikiBots:           d.wikiBots,
+		WikiUsers:          d.wikiUsers,
+	}
+}
+
+// Persist saves what changed since the last save. Nothing is written when nothing changed.
+// Backends implementing storage.IncrementStorage get the increments, storage.DeltaStorage
+// gets the current values of the changed keys, and anything else gets the full stats.
+func (s *Service) Persist() error {
+	s.persistMu.Lock()
+	defer s.persistMu.Unlock()
+
+	s.Mu.Lock()
+
+	if s.dirty.empty() {
+		s.Mu.Unlock()
+		s.countPersist("skipped")
+
+		return nil
+	}
+
+	// The WAL is sealed along with what gets saved, and only released once the save succeeds.
+	seq, sealed := s.checkpoint()
+
+	if is, ok := s.Storage.(storage.IncrementStorage); ok {
+		pending := s.dirty
+		s.dirty = newDirtySet()
+		s.Mu.Unlock()
+
+		if err := s.saveIncrements(is, pending); err != nil {
+			return err
+		}
+
+		s.release(seq, sealed)
+
+		return nil
+	}
+
+	ds, ok := s.Storage.(storage.DeltaStorage)
+	if !ok {
+		defer s.Mu.Unlock()
+
+		if err := s.Storage.SaveStats(s.Stats); err != nil {
+			return fmt.Errorf("failed to save stats: %w", err)
+		}
+
+		s.dirty = newDirtySet()
+		s.release(seq, sealed)
+		s.countPersist("full")
+
+		return nil
+	}
+
+	delta := s.buildDelta()
+	pending := s.dirty
+	s.dirty = newDirtySet()
+	s.Mu.Unlock()
+
+	// Write outside the lock so ingestion is not blocked on the database.
+	if err := ds.SaveDelta(delta); err != nil {
+		s.Mu.Lock()
+		s.dirty.merge(pending)
+		s.Mu.Unlock()
+
+		return fmt.Errorf("failed to save stats delta: %w", err)
+	}
+
+	s.release(seq, sealed)
+	s.countPersist("delta")
+
+	return nil
+}
+
+// saveIncrements writes outside the lock. A failed write is retried with the next persist,
+// minus whatever the storage reports it saved before failing.
+func (s *Service) saveIncrements(is storage.IncrementStorage, pending dirtySet) error {
+	if err := is.SaveIncrements(pending.increments()); err != nil {
+		var partial *storage.PartialIncrementsError
+		if errors.As(err, &partial) {
+			pending.subtract(partial.Applied)
+		}
+
+		s.Mu.Lock()
+		s.dirty.merge(pending)
+		s.Mu.Unlock()
+
+		return fmt.Errorf("failed to save stats increments: %w", err)
+	}
+
+	s.countPersist("increments")
+
+	return nil
+}
+
+// checkpoint seals the WAL segment holding everything applied so far. Callers hold Mu.
+// sealed is false without a WAL or when sealing failed, the segments then stay until a
+// later persist releases them.
+func (s *Service) checkpoint() (seq uint64, sealed bool) {
+	if s.opts.WAL == nil {
+		return 0, false
+	}
+
+	seq, err := s.opts.WAL.Checkpoint()
+	if err != nil {
+		s.Logger.Warn("Failed to checkpoint the stats wal", zap.Error(err))
+		return 0, false
+	}
+
+	return seq, true
+}
+
+// release drops the WAL segments covered by a saved snapshot.
+func (s *Service) release(seq uint64, sealed bool) {
+	if !sealed {
+		return
+	}
+
+	if err := s.opts.WAL.Release(seq); err != nil {
+		s.Logger.Warn("Failed to truncate the stats wal", zap.Error(err))
+	}
+}
+
+// buildDelta copies the current values of the dirty keys. Callers hold Mu.
+func (s *Service) buildDelta() *storage.Delta {
+	delta := &storage.Delta{
+		MessagesConsumed:   s.Stats.MessagesConsumed,
+		BotsCount:          s.Stats.BotsCount,
+		NonBotsCount:       s.Stats.NonBotsCount,
+		DistinctUsers:      make(map[string]int, len(s.dirty.users)),
+		DistinctServerURLs: make(map[string]int, len(s.dirty.serverURLs)),
+		WikiBots:           make(map[string]int, len(s.dirty.wikiBots)),
+		WikiUsers:          make(map[string]int, len(s.dirty.wikiUsers)),
+	}
+
+	for user := range s.dirty.users {
+		delta.DistinctUsers[user] = s.Stats.DistinctUsers[user]
+	}
+
+	for url := range s.dirty.serverURLs {
+		delta.DistinctServerURLs[url] = s.Stats.DistinctServerURLs[url]
+	}
+
+	for url := range s.dirty.wikiBots {
+		delta.WikiBots[url] = s.Stats.WikiBots[url]
+	}
+
+	for key := range s.dirty.wikiUsers {
+		delta.WikiUsers[key] = s.Stats.WikiUsers[key]
+	}
+
+	return delta
+}
+
+func (s *Service) countPersist(kind string) {
+	if m := s.opts.Metrics; m != nil {
+		m.Persists.WithLabelValues(kind).Inc()
+	}
+}
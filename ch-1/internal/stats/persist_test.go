@@ -0,0 +1,410 @@
+package stats_test
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/metrics"
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+	"github.com/codyonesock/backend_learning/ch-1/internal/stats"
+	"github.com/codyonesock/backend_learning/ch-1/internal/storage"
+	"github.com/codyonesock/backend_learning/ch-1/internal/wal"
+)
+
+var errSaveFailed = errors.New("save failed")
+
+// deltaStorage records the deltas it is given.
+type deltaStorage struct {
+	MockStorage
+
+	mu     sync.Mutex
+	deltas []*storage.Delta
+	fail   bool
+}
+
+func (d *deltaStorage) SaveDelta(delta *storage.Delta) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.fail {
+		return errSaveFailed
+	}
+
+	d.deltas = append(d.deltas, delta)
+
+	return nil
+}
+
+func (d *deltaStorage) last(t *testing.T, want int) *storage.Delta {
+	t.Helper()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.deltas) != want {
+		t.Fatalf("expected %d deltas, got %d", want, len(d.deltas))
+	}
+
+	return d.deltas[len(d.deltas)-1]
+}
+
+func newPersistService(t *testing.T, backend storage.Storage) (*stats.Service, stats.Options) {
+	t.Helper()
+
+	opts := stats.DefaultOptions()
+	opts.Metrics = metrics.NewStatsMetrics(prometheus.NewRegistry())
+
+	service, err := stats.NewStatsServiceWithOptions(zap.NewNop(), backend, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := service.LoadStats(); err != nil {
+		t.Fatalf("failed to load stats: %v", err)
+	}
+
+	return service, opts
+}
+
+// TestPersistDeltas verifies only changed keys are written and clean stats are not written at all.
+func TestPersistDeltas(t *testing.T) {
+	t.Parallel()
+
+	backend := &deltaStorage{}
+	backend.SaveStatsFunc = func(_ *shared.Stats) error {
+		t.Error("expected no full saves")
+		return nil
+	}
+	service, opts := newPersistService(t, backend)
+
+	service.ApplyBatch([]shared.RecentChange{
+		{User: "a", ServerURL: "https://a.org"},
+		{User: "b", Bot: true, ServerURL: "https://a.org"},
+	})
+
+	if err := service.Persist(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	first := backend.last(t, 1)
+	if first.MessagesConsumed != 2 || len(first.DistinctUsers) != 2 || first.DistinctServerURLs["https://a.org"] != 2 {
+		t.Errorf("unexpected first delta %+v", first)
+	}
+
+	if err := service.Persist(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	backend.last(t, 1)
+
+	if n := testutil.ToFloat64(opts.Metrics.Persists.WithLabelValues("skipped")); n != 1 {
+		t.Errorf("expected the clean persist to be skipped, got %v", n)
+	}
+
+	service.ApplyBatch([]shared.RecentChange{{User: "a", ServerURL: "https://b.org"}})
+
+	if err := service.Persist(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	second := backend.last(t, 2)
+	if second.MessagesConsumed != 3 || len(second.DistinctUsers) != 1 || second.DistinctUsers["a"] != 2 {
+		t.Errorf("expected only user a with its total, got %+v", second)
+	}
+
+	if _, ok := second.DistinctServerURLs["https://a.org"]; ok || second.DistinctServerURLs["https://b.org"] != 1 {
+		t.Errorf("expected only the changed server url, got %+v", second.DistinctServerURLs)
+	}
+}
+
+// TestPersistRetriesFailedDelta verifies keys from a failed save go out with the next one.
+func TestPersistRetriesFailedDelta(t *testing.T) {
+	t.Parallel()
+
+	backend := &deltaStorage{fail: true}
+	service, _ := newPersistService(t, backend)
+
+	service.ApplyBatch([]shared.RecentChange{{User: "a", ServerURL: "https://a.org"}})
+
+	if err := service.Persist(); err == nil {
+		t.Fatal("expected the save to fail")
+	}
+
+	service.ApplyBatch([]shared.RecentChange{{User: "b", ServerURL: "https://a.org"}})
+
+	backend.mu.Lock()
+	backend.fail = false
+	backend.mu.Unlock()
+
+	if err := service.Persist(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	delta := backend.last(t, 1)
+	if delta.DistinctUsers["a"] != 1 || delta.DistinctUsers["b"] != 1 || delta.MessagesConsumed != 2 {
+		t.Errorf("expected both users in the retried delta, got %+v", delta)
+	}
+}
+
+// TestPersistFullFallback verifies storages without deltas get full saves, only when dirty.
+func TestPersistFullFallback(t *testing.T) {
+	t.Parallel()
+
+	var saves int
+
+	backend := &MockStorage{
+		SaveStatsFunc: func(_ *shared.Stats) error {
+			saves++
+			return nil
+		},
+	}
+	service, _ := newPersistService(t, backend)
+
+	service.ApplyBatch([]shared.RecentChange{{User: "a"}})
+
+	for range 3 {
+		if err := service.Persist(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if saves != 1 {
+		t.Errorf("expected 1 full save, got %d", saves)
+	}
+}
+
+// incrementStorage sums the increments it is given, like counter tables would.
+type incrementStorage struct {
+	MockStorage
+
+	mu     sync.Mutex
+	totals storage.Increments
+	writes int
+}
+
+func (s *incrementStorage) SaveIncrements(inc *storage.Increments) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.writes++
+	s.totals.MessagesConsumed += inc.MessagesConsumed
+	s.totals.BotsCount += inc.BotsCount
+
+	if s.totals.DistinctUsers == nil {
+		s.totals.DistinctUsers = map[string]int{}
+	}
+
+	for k, v := range inc.DistinctUsers {
+		s.totals.DistinctUsers[k] += v
+	}
+
+	return nil
+}
+
+// TestPersistIncrementsFromReplicas verifies two services sharing counter storage add up
+// instead of overwriting each other.
+func TestPersistIncrementsFromReplicas(t *testing.T) {
+	t.Parallel()
+
+	backend := &incrementStorage{}
+	a, _ := newPersistService(t, backend)
+	b, _ := newPersistService(t, backend)
+
+	a.ApplyBatch([]shared.RecentChange{{User: "x"}, {User: "y", Bot: true}})
+	b.ApplyBatch([]shared.RecentChange{{User: "x"}})
+
+	for _, svc := range []*stats.Service{a, b, a} {
+		if err := svc.Persist(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	if backend.writes != 2 {
+		t.Errorf("expected 2 writes, got %d", backend.writes)
+	}
+
+	if backend.totals.MessagesConsumed != 3 || backend.totals.BotsCount != 1 || backend.totals.DistinctUsers["x"] != 2 {
+		t.Errorf("expected the replicas to add up, got %+v", backend.totals)
+	}
+}
+
+// partialStorage saves only the totals on its first write and fails the rest, like a counter
+// write whose first batch landed.
+type partialStorage struct {
+	incrementStorage
+
+	failed bool
+}
+
+func (s *partialStorage) SaveIncrements(inc *storage.Increments) error {
+	if s.failed {
+		return s.incrementStorage.SaveIncrements(inc)
+	}
+
+	s.failed = true
+
+	applied := storage.NewIncrements()
+	applied.MessagesConsumed = inc.MessagesConsumed
+	applied.BotsCount = inc.BotsCount
+
+	if err := s.incrementStorage.SaveIncrements(applied); err != nil {
+		return err
+	}
+
+	return &storage.PartialIncrementsError{Applied: applied, Err: errors.New("timed out")}
+}
+
+// TestPersistPartialIncrements verifies a retry after a partly saved write only adds what
+// didn't land the first time.
+func TestPersistPartialIncrements(t *testing.T) {
+	t.Parallel()
+
+	backend := &partialStorage{}
+	service, _ := newPersistService(t, backend)
+
+	service.ApplyBatch([]shared.RecentChange{{User: "x"}, {User: "y", Bot: true}})
+
+	if err := service.Persist(); err == nil {
+		t.Fatal("expected the partial write to fail")
+	}
+
+	for range 2 {
+		if err := service.Persist(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	if backend.writes != 2 {
+		t.Errorf("expected the retry and nothing after it, got %d writes", backend.writes)
+	}
+
+	if backend.totals.MessagesConsumed != 2 || backend.totals.BotsCount != 1 || backend.totals.DistinctUsers["x"] != 1 {
+		t.Errorf("expected every increment saved once, got %+v", backend.totals)
+	}
+}
+
+// shardStorage serves fixed shards for the other replicas.
+type shardStorage struct {
+	MockStorage
+
+	shards shared.Shards
+}
+
+func (s *shardStorage) ReplicaID() string { return "me" }
+
+func (s *shardStorage) LoadShards() (shared.Shards, error) {
+	out := shared.Shards{}
+	out.Merge(s.shards)
+
+	return out, nil
+}
+
+// TestGlobalStatsMergesShards verifies the read path sums every replica, using this replica's
+// live counts rather than its stale stored shard.
+func TestGlobalStatsMergesShards(t *testing.T) {
+	t.Parallel()
+
+	staleMe := shared.NewStats()
+	staleMe.MessagesConsumed = 1
+	staleMe.DistinctUsers["a"] = 1
+
+	other := shared.NewStats()
+	other.MessagesConsumed = 10
+	other.DistinctUsers["b"] = 10
+
+	backend := &shardStorage{shards: shared.Shards{"me": staleMe, "other": other}}
+	service, _ := newPersistService(t, backend)
+
+	service.ApplyBatch([]shared.RecentChange{{User: "a"}, {User: "a"}, {User: "c"}})
+
+	global, err := service.GlobalStats()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if global.MessagesConsumed != 13 || len(global.DistinctUsers) != 3 || global.DistinctUsers["a"] != 2 {
+		t.Errorf("expected the live shard plus the other replica, got %+v", global)
+	}
+}
+
+// TestWALReplaysUnsavedUpdates verifies updates applied after the last save come back from the
+// WAL after a crash, and that a save truncates the WAL so nothing is replayed twice.
+func TestWALReplaysUnsavedUpdates(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	backend, err := storage.NewFileStorage(filepath.Join(dir, "snapshots"), false, 2, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	start := func() *stats.Service {
+		log, err := wal.Open(filepath.Join(dir, "wal"), wal.SyncAlways, 0)
+		if err != nil {
+			t.Fatalf("failed to open wal: %v", err)
+		}
+
+		opts := stats.DefaultOptions()
+		opts.Metrics = metrics.NewStatsMetrics(prometheus.NewRegistry())
+		opts.WAL = log
+
+		service, err := stats.NewStatsServiceWithOptions(zap.NewNop(), backend, opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		t.Cleanup(func() { _ = service.Close() })
+
+		if err := service.LoadStats(); err != nil {
+			t.Fatalf("failed to load stats: %v", err)
+		}
+
+		return service
+	}
+
+	messages := func(service *stats.Service) int {
+		global, err := service.GlobalStats()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		return global.MessagesConsumed
+	}
+
+	first := start()
+	first.ApplyBatch([]shared.RecentChange{{User: "a"}, {User: "b"}, {User: "c", Bot: true}})
+
+	if err := first.Persist(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Applied but never saved, the process dies here.
+	first.ApplyBatch([]shared.RecentChange{{User: "a"}, {User: "d"}})
+
+	second := start()
+	if got := messages(second); got != 5 {
+		t.Fatalf("expected the snapshot plus the wal, 5 messages, got %d", got)
+	}
+
+	if err := second.Persist(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	third := start()
+	if got := messages(third); got != 5 {
+		t.Errorf("expected the saved wal updates not to be replayed again, got %d messages", got)
+	}
+}
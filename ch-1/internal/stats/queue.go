@@ -0,0 +1,320 @@
+package stats
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/anomaly"
+	"github.com/codyonesock/backend_learning/ch-1/internal/metrics"
+	"github.com/codyonesock/backend_learning/ch-1/internal/profiles"
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+	"github.com/codyonesock/backend_learning/ch-1/internal/storage"
+	"github.com/codyonesock/backend_learning/ch-1/internal/wal"
+)
+
+// OverflowPolicy decides what UpdateStats does when the update queue is full.
+type OverflowPolicy string
+
+const (
+	// OverflowBlock waits up to BlockTimeout for room, then drops the update.
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowDropNewest drops the incoming update right away.
+	OverflowDropNewest OverflowPolicy = "drop-newest"
+	// OverflowDropOldest evicts the oldest queued update to make room.
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+	// OverflowSpill appends the update to a file in SpillDir, applied on the next flush.
+	OverflowSpill OverflowPolicy = "spill"
+)
+
+const spillFile = "stats-spill.ndjson"
+
+var (
+	errInvalidOverflowPolicy = errors.New("overflow policy must be block, drop-newest, drop-oldest or spill")
+	errSpillDirRequired      = errors.New("the spill overflow policy needs a spill dir")
+)
+
+// ParseOverflowPolicy validates a policy name.
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch p := OverflowPolicy(s); p {
+	case OverflowBlock, OverflowDropNewest, OverflowDropOldest, OverflowSpill:
+		return p, nil
+	default:
+		return "", fmt.Errorf("%w: got %q", errInvalidOverflowPolicy, s)
+	}
+}
+
+// Options tunes the update queue and batching.
+type Options struct {
+	// QueueSize is the number of updates buffered before the overflow policy applies.
+	QueueSize int
+	// BatchSize applies once this many updates are queued.
+	BatchSize int
+	// FlushPeriod applies whatever is queued at least this often.
+	FlushPeriod time.Duration
+	// PersistInterval is how often changed stats are written to storage, zero leaves it to
+	// Flush and SaveStats.
+	PersistInterval time.Duration
+	// Overflow is what happens when the queue is full.
+	Overflow OverflowPolicy
+	// BlockTimeout is how long OverflowBlock waits.
+	BlockTimeout time.Duration
+	// SpillDir holds spilled updates for OverflowSpill.
+	SpillDir string
+	// Metrics is optional.
+	Metrics *metrics.StatsMetrics
+	// WAL logs every applied batch until the snapshot covering it is saved. Optional.
+	WAL *wal.Log
+	// Snapshots keeps a history of the stats for time-travel reads. Optional.
+	Snapshots storage.SnapshotStorage
+	// SnapshotInterval is how often a history snapshot is taken, zero disables it.
+	SnapshotInterval time.Duration
+	// StreamInterval is how often /stream subscribers get changed stats, zero disables the stream.
+	StreamInterval time.Duration
+	// Clock is the time source for the event rates, time.Now when nil.
+	Clock func() time.Time
+	// Anomalies watches every applied batch for wikis spiking. Optional.
+	Anomalies *anomaly.Detector
+	// Profiles keeps per-user activity for /users/{name}. Optional.
+	Profiles *profiles.Store
+	// WikiMaxUsers caps the distinct users tracked per wiki, zero for no cap.
+	WikiMaxUsers int
+}
+
+// DefaultOptions matches the previous hardcoded queue, but blocks briefly instead of dropping.
+func DefaultOptions() Options {
+	return Options{
+		QueueSize:       1000,
+		BatchSize:       100,
+		FlushPeriod:     time.Second,
+		PersistInterval: 10 * time.Second,
+		Overflow:        OverflowBlock,
+		BlockTimeout:    time.Second,
+		SpillDir:        "",
+		Metrics:         nil,
+		WAL:             nil,
+
+		Snapshots:        nil,
+		SnapshotInterval: 0,
+		StreamInterval:   0,
+		Clock:            nil,
+		Anomalies:        nil,
+		Profiles:         nil,
+		WikiMaxUsers:     10000,
+	}
+}
+
+// enqueue applies the overflow policy when the queue is full.
+func (s *Service) enqueue(rc shared.RecentChange) {
+	select {
+	case s.updateCh <- rc:
+		return
+	default:
+	}
+
+	switch s.opts.Overflow {
+	case OverflowBlock:
+		timer := time.NewTimer(s.opts.BlockTimeout)
+		defer timer.Stop()
+
+		select {
+		case s.updateCh <- rc:
+		case <-timer.C:
+			s.dropped("timeout")
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case s.updateCh <- rc:
+				return
+			default:
+			}
+
+			select {
+			case <-s.updateCh:
+				s.dropped("oldest")
+			default:
+			}
+		}
+	case OverflowSpill:
+		if err := s.spill.append(rc); err != nil {
+			s.Logger.Warn("Failed to spill stats update, dropping it", zap.Error(err))
+			s.dropped("spill_error")
+
+			return
+		}
+
+		if m := s.opts.Metrics; m != nil {
+			m.SpilledUpdates.Inc()
+		}
+	default:
+		s.dropped("full")
+	}
+}
+
+// dropLogInterval is how often dropped updates are logged. DroppedUpdates counts every one.
+const dropLogInterval = 10 * time.Second
+
+// dropLog rate limits the dropped update warning, which would otherwise log every update
+// while the queue is full.
+type dropLog struct {
+	mu sync.Mutex
+	// last is when the warning was last logged.
+	last time.Time
+	// count is the updates dropped since then.
+	count int
+}
+
+// due counts a drop and reports whether to log, with the drops since the last log.
+func (d *dropLog) due(now time.Time) (int, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.count++
+
+	if !d.last.IsZero() && now.Sub(d.last) < dropLogInterval {
+		return 0, false
+	}
+
+	n := d.count
+	d.last, d.count = now, 0
+
+	return n, true
+}
+
+func (s *Service) dropped(reason string) {
+	if m := s.opts.Metrics; m != nil {
+		m.DroppedUpdates.WithLabelValues(reason).Inc()
+	}
+
+	if n, ok := s.drops.due(s.opts.Clock()); ok {
+		s.Logger.Warn("Stats update queue full, dropping updates", zap.String("reason", reason), zap.Int("dropped", n))
+	}
+}
+
+func (s *Service) setQueueDepth() {
+	if m := s.opts.Metrics; m != nil {
+		m.QueueDepth.Set(float64(len(s.updateCh)))
+	}
+}
+
+// applySpilled moves spilled updates into the batch.
+func (s *Service) applySpilled(batch []shared.RecentChange) []shared.RecentChange {
+	if s.spill == nil {
+		return batch
+	}
+
+	spilled, err := s.spill.drain()
+	if err != nil {
+		s.Logger.Error("Failed to read spilled stats updates", zap.Error(err))
+	}
+
+	return append(batch, spilled...)
+}
+
+// spiller is an append only NDJSON file of updates that did not fit in the queue.
+type spiller struct {
+	mu      sync.Mutex
+	path    string
+	pending int
+}
+
+func newSpiller(dir string) (*spiller, error) {
+	if dir == "" {
+		return nil, errSpillDirRequired
+	}
+
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create spill dir: %w", err)
+	}
+
+	sp := &spiller{mu: sync.Mutex{}, path: filepath.Join(dir, spillFile), pending: 0}
+
+	// Updates spilled before a crash are still on disk, count them so they get applied.
+	if f, err := os.Open(sp.path); err == nil {
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			sp.pending++
+		}
+
+		_ = f.Close()
+	}
+
+	return sp, nil
+}
+
+func (sp *spiller) append(rc shared.RecentChange) error {
+	line, err := json.Marshal(rc)
+	if err != nil {
+		return fmt.Errorf("failed to marshal update: %w", err)
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	f, err := os.OpenFile(sp.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open spill file: %w", err)
+	}
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write spill file: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close spill file: %w", err)
+	}
+
+	sp.pending++
+
+	return nil
+}
+
+// drain reads and removes every spilled update.
+func (sp *spiller) drain() ([]shared.RecentChange, error) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if sp.pending == 0 {
+		return nil, nil
+	}
+
+	f, err := os.Open(sp.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spill file: %w", err)
+	}
+	defer f.Close()
+
+	out := make([]shared.RecentChange, 0, sp.pending)
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rc shared.RecentChange
+		if err := json.Unmarshal(sc.Bytes(), &rc); err != nil {
+			continue
+		}
+
+		out = append(out, rc)
+	}
+
+	// Keep the file on errors so nothing is applied twice, the next flush retries.
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read spill file: %w", err)
+	}
+
+	if err := os.Remove(sp.path); err != nil {
+		return nil, fmt.Errorf("failed to remove spill file: %w", err)
+	}
+
+	sp.pending = 0
+
+	return out, nil
+}
@@ -0,0 +1,302 @@
+package stats_test
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/metrics"
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+	"github.com/codyonesock/backend_learning/ch-1/internal/stats"
+)
+
+// newStalledService returns a service whose batch updater is stuck in a flush of the first update
+// and whose queue of 2 is full, so the next update overflows. Closing release unblocks it.
+func newStalledService(t *testing.T, opts stats.Options) (*stats.Service, chan struct{}) {
+	t.Helper()
+
+	return newStalledServiceWithLogger(t, zap.NewNop(), opts)
+}
+
+func newStalledServiceWithLogger(t *testing.T, l *zap.Logger, opts stats.Options) (*stats.Service, chan struct{}) {
+	t.Helper()
+
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+
+	storage := &MockStorage{
+		SaveStatsFunc: func(_ *shared.Stats) error {
+			select {
+			case entered <- struct{}{}:
+			default:
+			}
+			<-release
+
+			return nil
+		},
+		LoadStatsFunc: nil,
+		Stats:         nil,
+	}
+
+	opts.QueueSize = 2
+	opts.FlushPeriod = time.Hour
+	opts.PersistInterval = time.Hour
+
+	service, err := stats.NewStatsServiceWithOptions(l, storage, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	service.UpdateStats(shared.RecentChange{User: "user-0"})
+
+	go func() {
+		_ = service.Flush()
+	}()
+
+	<-entered
+
+	for i := 1; i <= 2; i++ {
+		service.UpdateStats(shared.RecentChange{User: "user-" + strconv.Itoa(i)})
+	}
+
+	return service, release
+}
+
+func consumed(t *testing.T, service *stats.Service, release chan struct{}) *shared.Stats {
+	t.Helper()
+
+	close(release)
+
+	if err := service.Flush(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	service.Mu.Lock()
+	defer service.Mu.Unlock()
+
+	return service.Stats
+}
+
+// TestOverflowPolicies verifies what each policy does with the update that does not fit.
+func TestOverflowPolicies(t *testing.T) {
+	t.Parallel()
+
+	t.Run("drop-newest", func(t *testing.T) {
+		t.Parallel()
+
+		opts := stats.DefaultOptions()
+		opts.Overflow = stats.OverflowDropNewest
+		opts.Metrics = metrics.NewStatsMetrics(prometheus.NewRegistry())
+
+		service, release := newStalledService(t, opts)
+		service.UpdateStats(shared.RecentChange{User: "user-3"})
+
+		got := consumed(t, service, release)
+		if got.MessagesConsumed != 3 || got.DistinctUsers["user-3"] != 0 {
+			t.Errorf("expected the newest update to be dropped, got %+v", got)
+		}
+
+		if n := testutil.ToFloat64(opts.Metrics.DroppedUpdates.WithLabelValues("full")); n != 1 {
+			t.Errorf("expected 1 dropped update, got %v", n)
+		}
+	})
+
+	t.Run("drop-oldest", func(t *testing.T) {
+		t.Parallel()
+
+		opts := stats.DefaultOptions()
+		opts.Overflow = stats.OverflowDropOldest
+		opts.Metrics = metrics.NewStatsMetrics(prometheus.NewRegistry())
+
+		service, release := newStalledService(t, opts)
+		service.UpdateStats(shared.RecentChange{User: "user-3"})
+
+		got := consumed(t, service, release)
+		if got.MessagesConsumed != 3 || got.DistinctUsers["user-1"] != 0 || got.DistinctUsers["user-3"] != 1 {
+			t.Errorf("expected the oldest queued update to be dropped, got %+v", got)
+		}
+
+		if n := testutil.ToFloat64(opts.Metrics.DroppedUpdates.WithLabelValues("oldest")); n != 1 {
+			t.Errorf("expected 1 dropped update, got %v", n)
+		}
+	})
+
+	t.Run("block timeout", func(t *testing.T) {
+		t.Parallel()
+
+		opts := stats.DefaultOptions()
+		opts.Overflow = stats.OverflowBlock
+		opts.BlockTimeout = 20 * time.Millisecond
+		opts.Metrics = metrics.NewStatsMetrics(prometheus.NewRegistry())
+
+		service, release := newStalledService(t, opts)
+
+		start := time.Now()
+		service.UpdateStats(shared.RecentChange{User: "user-3"})
+
+		if waited := time.Since(start); waited < opts.BlockTimeout {
+			t.Errorf("expected UpdateStats to block for the timeout, waited %v", waited)
+		}
+
+		if got := consumed(t, service, release); got.MessagesConsumed != 3 {
+			t.Errorf("expected the timed out update to be dropped, got %+v", got)
+		}
+
+		if n := testutil.ToFloat64(opts.Metrics.DroppedUpdates.WithLabelValues("timeout")); n != 1 {
+			t.Errorf("expected 1 dropped update, got %v", n)
+		}
+	})
+
+	t.Run("block until room", func(t *testing.T) {
+		t.Parallel()
+
+		opts := stats.DefaultOptions()
+		opts.Overflow = stats.OverflowBlock
+		opts.BlockTimeout = time.Minute
+
+		service, release := newStalledService(t, opts)
+
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			close(release)
+		}()
+
+		service.UpdateStats(shared.RecentChange{User: "user-3"})
+
+		if err := service.Flush(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		service.Mu.Lock()
+		defer service.Mu.Unlock()
+
+		if service.Stats.MessagesConsumed != 4 {
+			t.Errorf("expected every update once the queue drained, got %+v", service.Stats)
+		}
+	})
+
+	t.Run("spill", func(t *testing.T) {
+		t.Parallel()
+
+		opts := stats.DefaultOptions()
+		opts.Overflow = stats.OverflowSpill
+		opts.SpillDir = t.TempDir()
+		opts.Metrics = metrics.NewStatsMetrics(prometheus.NewRegistry())
+
+		service, release := newStalledService(t, opts)
+		service.UpdateStats(shared.RecentChange{User: "user-3"})
+		service.UpdateStats(shared.RecentChange{User: "user-4"})
+
+		if n := testutil.ToFloat64(opts.Metrics.SpilledUpdates); n != 2 {
+			t.Errorf("expected 2 spilled updates, got %v", n)
+		}
+
+		got := consumed(t, service, release)
+		if got.MessagesConsumed != 5 || got.DistinctUsers["user-4"] != 1 {
+			t.Errorf("expected spilled updates to be applied on flush, got %+v", got)
+		}
+
+		if _, err := os.Stat(filepath.Join(opts.SpillDir, "stats-spill.ndjson")); !os.IsNotExist(err) {
+			t.Errorf("expected the spill file to be removed, got %v", err)
+		}
+	})
+}
+
+// TestSpillRequiresDir verifies the spill policy fails fast without a dir.
+func TestSpillRequiresDir(t *testing.T) {
+	t.Parallel()
+
+	opts := stats.DefaultOptions()
+	opts.Overflow = stats.OverflowSpill
+
+	if _, err := stats.NewStatsServiceWithOptions(zap.NewNop(), &MockStorage{}, opts); err == nil {
+		t.Error("expected an error without a spill dir")
+	}
+
+	if _, err := stats.ParseOverflowPolicy("maybe"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
+
+// TestNoPeriodicPersist verifies a zero PersistInterval only saves on Flush.
+func TestNoPeriodicPersist(t *testing.T) {
+	t.Parallel()
+
+	saves := make(chan struct{}, 10)
+	storage := &MockStorage{
+		SaveStatsFunc: func(_ *shared.Stats) error {
+			saves <- struct{}{}
+			return nil
+		},
+		LoadStatsFunc: nil,
+		Stats:         nil,
+	}
+
+	opts := stats.DefaultOptions()
+	opts.FlushPeriod = time.Millisecond
+	opts.PersistInterval = 0
+
+	service, err := stats.NewStatsServiceWithOptions(zap.NewNop(), storage, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	service.ApplyBatch([]shared.RecentChange{{User: "a"}})
+	time.Sleep(50 * time.Millisecond)
+
+	if len(saves) != 0 {
+		t.Fatalf("expected no save before Flush, got %d", len(saves))
+	}
+
+	if err := service.Flush(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(saves) != 1 {
+		t.Errorf("expected one save on Flush, got %d", len(saves))
+	}
+}
+
+// TestDroppedUpdatesLogSampled verifies a full queue logs one warning per interval, not one per update.
+func TestDroppedUpdatesLogSampled(t *testing.T) {
+	t.Parallel()
+
+	core, logs := observer.New(zap.WarnLevel)
+
+	now := time.Now()
+
+	opts := stats.DefaultOptions()
+	opts.Overflow = stats.OverflowDropNewest
+	opts.Metrics = metrics.NewStatsMetrics(prometheus.NewRegistry())
+	opts.Clock = func() time.Time { return now }
+
+	service, release := newStalledServiceWithLogger(t, zap.New(core), opts)
+	defer consumed(t, service, release)
+
+	for range 10 {
+		service.UpdateStats(shared.RecentChange{User: "dropped"})
+	}
+
+	if n := testutil.ToFloat64(opts.Metrics.DroppedUpdates.WithLabelValues("full")); n != 10 {
+		t.Errorf("expected 10 dropped updates, got %v", n)
+	}
+
+	if n := logs.Len(); n != 1 {
+		t.Fatalf("expected 1 warning for the first drop, got %d", n)
+	}
+
+	now = now.Add(time.Minute)
+	service.UpdateStats(shared.RecentChange{User: "dropped"})
+
+	entries := logs.All()
+	if len(entries) != 2 || entries[1].ContextMap()["dropped"] != int64(10) {
+		t.Errorf("expected a second warning counting the 10 drops since the first, got %v", entries)
+	}
+}
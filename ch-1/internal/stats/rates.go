@@ -0,0 +1,175 @@
+package stats
+
+import (
+	"math"
+	"time"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/metrics"
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+)
+
+// rateTick is how often the moving averages are updated, the same as the Unix load average.
+const rateTick = 5 * time.Second
+
+// rateWindows are the moving average windows, in the order RateWindows lists them.
+var rateWindows = [3]time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// RateWindows holds one value per moving average window.
+type RateWindows struct {
+	M1  float64 `json:"1m"`
+	M5  float64 `json:"5m"`
+	M15 float64 `json:"15m"`
+}
+
+// Rates are exponentially weighted moving averages of how fast events arrive.
+type Rates struct {
+	EventsPerSec  RateWindows `json:"events_per_sec"`
+	BotsPerSec    RateWindows `json:"bots_per_sec"`
+	NonBotsPerSec RateWindows `json:"non_bots_per_sec"`
+	// BotRatio is the share of events from bots in each window.
+	BotRatio RateWindows `json:"bot_ratio"`
+	// BotRatioTrend is the 1m bot ratio minus the 15m one, positive while bots are picking up.
+	BotRatioTrend float64 `json:"bot_ratio_trend"`
+	// PeakPerSec is the highest 1m events/sec seen since startup, reached at PeakAt.
+	PeakPerSec float64    `json:"peak_events_per_sec"`
+	PeakAt     *time.Time `json:"peak_at,omitempty"`
+}
+
+// rateTracker counts events into rateTick buckets and folds each finished bucket into the
+// averages. Callers hold Service.Mu.
+type rateTracker struct {
+	now     func() time.Time
+	start   time.Time
+	bots    int
+	nonBots int
+	// botRates and nonBotRates are events/sec per window. The overall rate is their sum.
+	botRates    [3]float64
+	nonBotRates [3]float64
+	peak        float64
+	peakAt      time.Time
+}
+
+func newRateTracker(now func() time.Time) *rateTracker {
+	return &rateTracker{
+		now:         now,
+		start:       now(),
+		bots:        0,
+		nonBots:     0,
+		botRates:    [3]float64{},
+		nonBotRates: [3]float64{},
+		peak:        0,
+		peakAt:      time.Time{},
+	}
+}
+
+// add counts a batch in the current bucket, call advance first.
+func (t *rateTracker) add(batch []shared.RecentChange) {
+	for _, rc := range batch {
+		if rc.Bot {
+			t.bots++
+		} else {
+			t.nonBots++
+		}
+	}
+}
+
+// advance closes every bucket that has ended and reports whether any did. After the first one
+// they are empty, so a long gap decays the averages in one step instead of one per bucket.
+func (t *rateTracker) advance() bool {
+	elapsed := t.now().Sub(t.start)
+	if elapsed < rateTick {
+		return false
+	}
+
+	ticks := int(elapsed / rateTick)
+	secs := rateTick.Seconds()
+
+	for i, window := range rateWindows {
+		alpha := 1 - math.Exp(-secs/window.Seconds())
+		t.botRates[i] += alpha * (float64(t.bots)/secs - t.botRates[i])
+		t.nonBotRates[i] += alpha * (float64(t.nonBots)/secs - t.nonBotRates[i])
+
+		if ticks > 1 {
+			decay := math.Exp(-float64(ticks-1) * secs / window.Seconds())
+			t.botRates[i] *= decay
+			t.nonBotRates[i] *= decay
+		}
+	}
+
+	t.start = t.start.Add(time.Duration(ticks) * rateTick)
+	t.bots, t.nonBots = 0, 0
+
+	if rate := t.botRates[0] + t.nonBotRates[0]; rate > t.peak {
+		t.peak = rate
+		t.peakAt = t.start
+	}
+
+	return true
+}
+
+func (t *rateTracker) rates() Rates {
+	r := Rates{
+		EventsPerSec:  RateWindows{},
+		BotsPerSec:    windows(t.botRates),
+		NonBotsPerSec: windows(t.nonBotRates),
+		BotRatio:      RateWindows{},
+		BotRatioTrend: 0,
+		PeakPerSec:    t.peak,
+		PeakAt:        nil,
+	}
+
+	var total, ratio [3]float64
+
+	for i := range rateWindows {
+		total[i] = t.botRates[i] + t.nonBotRates[i]
+		if total[i] > 0 {
+			ratio[i] = t.botRates[i] / total[i]
+		}
+	}
+
+	r.EventsPerSec = windows(total)
+	r.BotRatio = windows(ratio)
+	r.BotRatioTrend = ratio[0] - ratio[2]
+
+	if !t.peakAt.IsZero() {
+		at := t.peakAt
+		r.PeakAt = &at
+	}
+
+	return r
+}
+
+func windows(v [3]float64) RateWindows {
+	return RateWindows{M1: v[0], M5: v[1], M15: v[2]}
+}
+
+// setRateMetrics copies the averages to the gauges.
+func setRateMetrics(m *metrics.StatsMetrics, r Rates) {
+	for kind, w := range map[string]RateWindows{"all": r.EventsPerSec, "bot": r.BotsPerSec, "non_bot": r.NonBotsPerSec} {
+		m.EventRate.WithLabelValues(kind, "1m").Set(w.M1)
+		m.EventRate.WithLabelValues(kind, "5m").Set(w.M5)
+		m.EventRate.WithLabelValues(kind, "15m").Set(w.M15)
+	}
+
+	m.BotRatio.WithLabelValues("1m").Set(r.BotRatio.M1)
+	m.BotRatio.WithLabelValues("5m").Set(r.BotRatio.M5)
+	m.BotRatio.WithLabelValues("15m").Set(r.BotRatio.M15)
+	m.PeakEventRate.Set(r.PeakPerSec)
+}
+
+// tickRates closes finished rate buckets and updates the gauges. Callers hold Mu.
+func (s *Service) tickRates() {
+	if s.rates.advance() && s.opts.Metrics != nil {
+		setRateMetrics(s.opts.Metrics, s.rates.rates())
+	}
+}
+
+// Rates returns the current moving averages.
+func (s *Service) Rates() Rates {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	s.tickRates()
+
+	return s.rates.rates()
+}
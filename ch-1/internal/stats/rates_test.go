@@ -0,0 +1,108 @@
+package stats_test
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/metrics"
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+	"github.com/codyonesock/backend_learning/ch-1/internal/stats"
+	"github.com/codyonesock/backend_learning/ch-1/internal/storage"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func batchOf(bots, nonBots int) []shared.RecentChange {
+	batch := make([]shared.RecentChange, 0, bots+nonBots)
+	for range bots {
+		batch = append(batch, shared.RecentChange{User: "bot", Bot: true, ServerURL: "https://en.wiki.org"})
+	}
+
+	for range nonBots {
+		batch = append(batch, shared.RecentChange{User: "human", ServerURL: "https://en.wiki.org"})
+	}
+
+	return batch
+}
+
+// TestRates verifies the moving averages converge on a steady rate, split by bots, track the
+// peak and decay once events stop.
+func TestRates(t *testing.T) {
+	t.Parallel()
+
+	clock := &fakeClock{mu: sync.Mutex{}, now: time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)}
+
+	opts := stats.DefaultOptions()
+	opts.Metrics = metrics.NewStatsMetrics(prometheus.NewRegistry())
+	opts.Clock = clock.Now
+
+	service, err := stats.NewStatsServiceWithOptions(zap.NewNop(), storage.NewMemoryStorage(), opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 8 events/sec, a quarter of them bots, for two hours.
+	for range 1440 {
+		service.ApplyBatch(batchOf(10, 30))
+		clock.Advance(5 * time.Second)
+	}
+
+	rates := service.Rates()
+
+	near := func(name string, got, want float64) {
+		t.Helper()
+
+		if math.Abs(got-want) > 0.05 {
+			t.Errorf("%s: got %.3f, want %.3f", name, got, want)
+		}
+	}
+
+	near("events 1m", rates.EventsPerSec.M1, 8)
+	near("events 15m", rates.EventsPerSec.M15, 8)
+	near("bots 5m", rates.BotsPerSec.M5, 2)
+	near("non-bots 5m", rates.NonBotsPerSec.M5, 6)
+	near("bot ratio 1m", rates.BotRatio.M1, 0.25)
+	near("trend", rates.BotRatioTrend, 0)
+
+	if rates.PeakAt == nil || rates.PeakPerSec < 7.9 {
+		t.Errorf("expected a peak near 8/s, got %.3f at %v", rates.PeakPerSec, rates.PeakAt)
+	}
+
+	// Only bots for the next minute: the short window sees them first.
+	for range 12 {
+		service.ApplyBatch(batchOf(40, 0))
+		clock.Advance(5 * time.Second)
+	}
+
+	if r := service.Rates(); r.BotRatioTrend <= 0.2 {
+		t.Errorf("expected a rising bot trend, got %.3f", r.BotRatioTrend)
+	}
+
+	// An hour of silence decays the 1m rate to nothing in one step.
+	clock.Advance(time.Hour)
+
+	if r := service.Rates(); r.EventsPerSec.M1 > 0.001 || r.EventsPerSec.M15 > 0.2 {
+		t.Errorf("expected rates to decay, got %+v", r.EventsPerSec)
+	}
+}
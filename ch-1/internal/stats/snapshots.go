@@ -0,0 +1,232 @@
+package stats
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+	"github.com/codyonesock/backend_learning/ch-1/internal/storage"
+)
+
+var (
+	errSnapshotsDisabled = errors.New("stats snapshots are not enabled")
+	errBadSnapshotRef    = errors.New("snapshot ref must be a snapshot id or an RFC3339 time")
+)
+
+// Diff is how the stats changed from one snapshot to another.
+type Diff struct {
+	From                   storage.SnapshotInfo `json:"from"`
+	To                     storage.SnapshotInfo `json:"to"`
+	MessagesConsumed       int                  `json:"messages_consumed"`
+	DistinctUsersCount     int                  `json:"distinct_users"`
+	BotsCount              int                  `json:"bots_count"`
+	NonBotsCount           int                  `json:"non_bots_count"`
+	DistinctServerURLCount int                  `json:"distinct_server_urls"`
+	// NewUsers counts users in To that were not in From.
+	NewUsers int `json:"new_users"`
+	// ServerURLEdits holds the change in edits for every server URL that changed.
+	ServerURLEdits map[string]int `json:"server_url_edits"`
+}
+
+// NewDiff compares two snapshots.
+func NewDiff(fromInfo storage.SnapshotInfo, from *shared.Stats, toInfo storage.SnapshotInfo, to *shared.Stats) Diff {
+	d := Diff{
+		From:                   fromInfo,
+		To:                     toInfo,
+		MessagesConsumed:       to.MessagesConsumed - from.MessagesConsumed,
+		DistinctUsersCount:     len(to.DistinctUsers) - len(from.DistinctUsers),
+		BotsCount:              to.BotsCount - from.BotsCount,
+		NonBotsCount:           to.NonBotsCount - from.NonBotsCount,
+		DistinctServerURLCount: len(to.DistinctServerURLs) - len(from.DistinctServerURLs),
+		NewUsers:               0,
+		ServerURLEdits:         map[string]int{},
+	}
+
+	for user := range to.DistinctUsers {
+		if _, ok := from.DistinctUsers[user]; !ok {
+			d.NewUsers++
+		}
+	}
+
+	for url, edits := range to.DistinctServerURLs {
+		if delta := edits - from.DistinctServerURLs[url]; delta != 0 {
+			d.ServerURLEdits[url] = delta
+		}
+	}
+
+	for url, edits := range from.DistinctServerURLs {
+		if _, ok := to.DistinctServerURLs[url]; !ok {
+			d.ServerURLEdits[url] = -edits
+		}
+	}
+
+	return d
+}
+
+// TakeSnapshot adds the current global stats to the history.
+func (s *Service) TakeSnapshot() (storage.SnapshotInfo, error) {
+	if s.opts.Snapshots == nil {
+		return storage.SnapshotInfo{}, errSnapshotsDisabled
+	}
+
+	global, err := s.GlobalStats()
+	if err != nil {
+		return storage.SnapshotInfo{}, err
+	}
+
+	// Every snapshot would otherwise copy the per wiki users, and history reads never use them.
+	global.WikiUsers = map[string]int{}
+
+	info, err := s.opts.Snapshots.SaveSnapshot(global, time.Now())
+	if err != nil {
+		return storage.SnapshotInfo{}, fmt.Errorf("failed to save stats snapshot: %w", err)
+	}
+
+	return info, nil
+}
+
+func (s *Service) snapshotLoop() {
+	ticker := time.NewTicker(s.opts.SnapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if _, err := s.TakeSnapshot(); err != nil {
+				s.Logger.Error("Failed to take stats snapshot", zap.Error(err))
+			}
+		}
+	}
+}
+
+// loadSnapshot resolves ref as a snapshot ID, or as an RFC3339 time for the newest snapshot
+// taken at or before it.
+func (s *Service) loadSnapshot(ref string) (*shared.Stats, storage.SnapshotInfo, error) {
+	var (
+		stats *shared.Stats
+		info  storage.SnapshotInfo
+		err   error
+	)
+
+	if at, parseErr := time.Parse(time.RFC3339, ref); parseErr == nil {
+		stats, info, err = storage.LoadSnapshotAt(s.opts.Snapshots, at)
+	} else if _, parseErr := strconv.ParseInt(ref, 10, 64); parseErr != nil {
+		return nil, storage.SnapshotInfo{}, fmt.Errorf("%w, got %q", errBadSnapshotRef, ref)
+	} else if info, err = storage.ParseSnapshotID(ref); err == nil {
+		stats, err = s.opts.Snapshots.LoadSnapshot(ref)
+	}
+
+	if err != nil {
+		return nil, storage.SnapshotInfo{}, fmt.Errorf("failed to load stats snapshot: %w", err)
+	}
+
+	return stats, info, nil
+}
+
+// snapshotError maps snapshot errors to a status code.
+func (s *Service) snapshotError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errBadSnapshotRef):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, storage.ErrSnapshotNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		s.Logger.Error("Error reading stats snapshots", zap.Error(err))
+		http.Error(w, "Error reading stats snapshots", http.StatusInternalServerError)
+	}
+}
+
+// snapshotsEnabled answers 404 when there is no history to read.
+func (s *Service) snapshotsEnabled(w http.ResponseWriter) bool {
+	if s.opts.Snapshots == nil {
+		http.Error(w, errSnapshotsDisabled.Error(), http.StatusNotFound)
+		return false
+	}
+
+	return true
+}
+
+// handleStatsAt serves GET /stats?at=<RFC3339> from the newest snapshot at or before then.
+// The snapshot used is named in the X-Snapshot-Id and X-Snapshot-Time headers.
+func (s *Service) handleStatsAt(w http.ResponseWriter, at string, format Format) {
+	if !s.snapshotsEnabled(w) {
+		return
+	}
+
+	t, err := time.Parse(time.RFC3339, at)
+	if err != nil {
+		http.Error(w, "at must be an RFC3339 time", http.StatusBadRequest)
+		return
+	}
+
+	stats, info, err := storage.LoadSnapshotAt(s.opts.Snapshots, t)
+	if err != nil {
+		s.snapshotError(w, err)
+		return
+	}
+
+	w.Header().Set("X-Snapshot-Id", info.ID)
+	w.Header().Set("X-Snapshot-Time", info.CreatedAt.Format(time.RFC3339Nano))
+
+	if err := s.writeResponse(w, newResponse(stats), format); err != nil {
+		http.Error(w, "Error getting stats", http.StatusInternalServerError)
+	}
+}
+
+// handleListSnapshots serves GET /stats/snapshots, newest first.
+func (s *Service) handleListSnapshots(w http.ResponseWriter, _ *http.Request) {
+	if !s.snapshotsEnabled(w) {
+		return
+	}
+
+	infos, err := s.opts.Snapshots.ListSnapshots()
+	if err != nil {
+		s.snapshotError(w, err)
+		return
+	}
+
+	if infos == nil {
+		infos = []storage.SnapshotInfo{}
+	}
+
+	if err := s.writeJSON(w, infos); err != nil {
+		http.Error(w, "Error listing snapshots", http.StatusInternalServerError)
+	}
+}
+
+// handleDiffSnapshots serves GET /stats/snapshots/diff?from=&to=, each a snapshot ID or an
+// RFC3339 time.
+func (s *Service) handleDiffSnapshots(w http.ResponseWriter, r *http.Request) {
+	if !s.snapshotsEnabled(w) {
+		return
+	}
+
+	fromRef, toRef := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	if fromRef == "" || toRef == "" {
+		http.Error(w, "from and to are required", http.StatusBadRequest)
+		return
+	}
+
+	from, fromInfo, err := s.loadSnapshot(fromRef)
+	if err != nil {
+		s.snapshotError(w, err)
+		return
+	}
+
+	to, toInfo, err := s.loadSnapshot(toRef)
+	if err != nil {
+		s.snapshotError(w, err)
+		return
+	}
+
+	if err := s.writeJSON(w, NewDiff(fromInfo, from, toInfo, to)); err != nil {
+		http.Error(w, "Error diffing snapshots", http.StatusInternalServerError)
+	}
+}
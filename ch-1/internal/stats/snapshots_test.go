@@ -0,0 +1,181 @@
+package stats_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/metrics"
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+	"github.com/codyonesock/backend_learning/ch-1/internal/stats"
+	"github.com/codyonesock/backend_learning/ch-1/internal/storage"
+)
+
+func get(t *testing.T, h http.Handler, target string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+
+	return rec
+}
+
+func decode[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+
+	var v T
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("failed to decode %q: %v", rec.Body.String(), err)
+	}
+
+	return v
+}
+
+// TestSnapshotRoutes verifies listing, time-travel reads and diffs over the stats history.
+func TestSnapshotRoutes(t *testing.T) {
+	t.Parallel()
+
+	backend := storage.NewMemoryStorage()
+
+	opts := stats.DefaultOptions()
+	opts.Metrics = metrics.NewStatsMetrics(prometheus.NewRegistry())
+	opts.Snapshots = backend
+
+	service, err := stats.NewStatsServiceWithOptions(zap.NewNop(), backend, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	h := service.Handler(service)
+
+	service.ApplyBatch([]shared.RecentChange{{User: "a", ServerURL: "https://en.wiki.org"}})
+
+	first, err := service.TakeSnapshot()
+	if err != nil {
+		t.Fatalf("failed to take snapshot: %v", err)
+	}
+
+	service.ApplyBatch([]shared.RecentChange{
+		{User: "a", ServerURL: "https://en.wiki.org"},
+		{User: "b", ServerURL: "https://de.wiki.org", Bot: true},
+	})
+
+	second, err := service.TakeSnapshot()
+	if err != nil {
+		t.Fatalf("failed to take snapshot: %v", err)
+	}
+
+	if kept, err := backend.LoadSnapshot(first.ID); err != nil || len(kept.WikiUsers) != 0 {
+		t.Errorf("expected snapshots without per wiki users, got %v, %v", kept, err)
+	}
+
+	rec := get(t, h, "/snapshots")
+	if infos := decode[[]storage.SnapshotInfo](t, rec); len(infos) != 2 || infos[0].ID != second.ID {
+		t.Errorf("expected both snapshots newest first, got %v", infos)
+	}
+
+	rec = get(t, h, "/?at="+url.QueryEscape(first.CreatedAt.Format(time.RFC3339Nano)))
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Snapshot-Id") != first.ID {
+		t.Fatalf("expected the first snapshot, got %d %q %s", rec.Code, rec.Header().Get("X-Snapshot-Id"), rec.Body.String())
+	}
+
+	if resp := decode[stats.Response](t, rec); resp.MessagesConsumed != 1 || resp.DistinctUsersCount != 1 {
+		t.Errorf("expected the stats as of the first snapshot, got %+v", resp)
+	}
+
+	rec = get(t, h, "/snapshots/diff?from="+first.ID+"&to="+second.ID)
+	diff := decode[stats.Diff](t, rec)
+
+	if diff.MessagesConsumed != 2 || diff.BotsCount != 1 || diff.NewUsers != 1 || diff.DistinctServerURLCount != 1 {
+		t.Errorf("unexpected diff %+v", diff)
+	}
+
+	if diff.ServerURLEdits["https://en.wiki.org"] != 1 || diff.ServerURLEdits["https://de.wiki.org"] != 1 {
+		t.Errorf("unexpected server url edits %v", diff.ServerURLEdits)
+	}
+
+	for target, want := range map[string]int{
+		"/?at=yesterday":                            http.StatusBadRequest,
+		"/?at=2000-01-01T00:00:00Z":                 http.StatusNotFound,
+		"/snapshots/diff?from=" + first.ID:          http.StatusBadRequest,
+		"/snapshots/diff?from=1&to=" + first.ID:     http.StatusNotFound,
+		"/snapshots/diff?from=bogus&to=" + first.ID: http.StatusBadRequest,
+	} {
+		if rec := get(t, h, target); rec.Code != want {
+			t.Errorf("%s: expected %d, got %d", target, want, rec.Code)
+		}
+	}
+}
+
+// TestSnapshotRoutesDisabled verifies the history routes answer 404 without a snapshot store.
+func TestSnapshotRoutesDisabled(t *testing.T) {
+	t.Parallel()
+
+	service := newTestService(&MockStorage{})
+	h := service.Handler(service)
+
+	for _, target := range []string{"/snapshots", "/snapshots/diff?from=1&to=2", "/?at=2000-01-01T00:00:00Z"} {
+		if rec := get(t, h, target); rec.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", target, rec.Code)
+		}
+	}
+
+	if _, err := service.TakeSnapshot(); err == nil {
+		t.Error("expected TakeSnapshot to fail without a snapshot store")
+	}
+}
+
+// TestSnapshotLoopStopsOnClose verifies Close stops the periodic snapshots.
+func TestSnapshotLoopStopsOnClose(t *testing.T) {
+	t.Parallel()
+
+	backend := storage.NewMemoryStorage()
+
+	opts := stats.DefaultOptions()
+	opts.Metrics = metrics.NewStatsMetrics(prometheus.NewRegistry())
+	opts.Snapshots = backend
+	opts.SnapshotInterval = 5 * time.Millisecond
+
+	service, err := stats.NewStatsServiceWithOptions(zap.NewNop(), backend, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	count := func() int {
+		infos, err := backend.ListSnapshots()
+		if err != nil {
+			t.Fatalf("failed to list snapshots: %v", err)
+		}
+
+		return len(infos)
+	}
+
+	for deadline := time.Now().Add(time.Second); count() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the loop to take a snapshot")
+		}
+	}
+
+	if err := service.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	// A tick already in flight may still land.
+	time.Sleep(20 * time.Millisecond)
+	before := count()
+	time.Sleep(50 * time.Millisecond)
+
+	if after := count(); after != before {
+		t.Errorf("expected no snapshots after Close, went from %d to %d", before, after)
+	}
+
+	if err := service.Close(); err != nil {
+		t.Errorf("expected a second Close to be a no-op, got %v", err)
+	}
+}
@@ -3,8 +3,10 @@ package stats
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"sync"
 	"time"
 
@@ -22,6 +24,8 @@ type Response struct {
 	BotsCount              int `json:"bots_count"`
 	NonBotsCount           int `json:"non_bots_count"`
 	DistinctServerURLCount int `json:"distinct_server_urls"`
+	// Rates is only set for the live stats, not history reads.
+	Rates *Rates `json:"rates,omitempty"`
 }
 
 // ServiceInterface will be used to update the stats.
@@ -37,10 +41,45 @@ type Service struct {
 	Stats    *shared.Stats
 	Storage  storage.Storage
 	updateCh chan shared.RecentChange
+	flushCh  chan chan error
+	opts     Options
+	spill    *spiller
+	dirty    dirtySet
+	stream   *broadcaster
+	rates    *rateTracker
+	// wikiUsers counts the distinct users in Stats.WikiUsers per server URL. Guarded by Mu.
+	wikiUsers map[string]int
+	// persistMu keeps persists in order so a WAL segment is never released ahead of its save.
+	persistMu sync.Mutex
+	// drops rate limits the dropped update warning.
+	drops dropLog
+	// done is closed by Close to stop the snapshot and stream loops.
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-// NewStatsService create a new instance of Service.
+// NewStatsService create a new instance of Service with DefaultOptions.
 func NewStatsService(l *zap.Logger, storage storage.Storage) *Service {
+	s, _ := NewStatsServiceWithOptions(l, storage, DefaultOptions())
+	return s
+}
+
+// NewStatsServiceWithOptions creates a Service with a tuned update queue.
+// It only fails when the spill policy can't use its dir.
+func NewStatsServiceWithOptions(l *zap.Logger, storage storage.Storage, opts Options) (*Service, error) {
+	var spill *spiller
+
+	if opts.Clock == nil {
+		opts.Clock = time.Now
+	}
+
+	if opts.Overflow == OverflowSpill {
+		var err error
+		if spill, err = newSpiller(opts.SpillDir); err != nil {
+			return nil, err
+		}
+	}
+
 	s := &Service{
 		Logger: l,
 		Mu:     sync.Mutex{},
@@ -50,27 +89,59 @@ func NewStatsService(l *zap.Logger, storage storage.Storage) *Service {
 			BotsCount:          0,
 			NonBotsCount:       0,
 			DistinctServerURLs: map[string]int{},
+			WikiBots:           map[string]int{},
+			WikiUsers:          map[string]int{},
 		},
 		Storage:  storage,
-		updateCh: make(chan shared.RecentChange, 1000),
+		updateCh: make(chan shared.RecentChange, opts.QueueSize),
+		flushCh:  make(chan chan error),
+		opts:     opts,
+		spill:    spill,
+		dirty:    newDirtySet(),
+		stream:   newBroadcaster(),
+		rates:    newRateTracker(opts.Clock),
+
+		wikiUsers: map[string]int{},
+		persistMu: sync.Mutex{},
+		drops:     dropLog{mu: sync.Mutex{}, last: time.Time{}, count: 0},
+		done:      make(chan struct{}),
+		closeOnce: sync.Once{},
 	}
 	go s.batchUpdater()
-	return s
+
+	if opts.Snapshots != nil && opts.SnapshotInterval > 0 {
+		go s.snapshotLoop()
+	}
+
+	if opts.StreamInterval > 0 {
+		go s.streamLoop()
+	}
+
+	return s, nil
 }
 
-// SaveStats saves the current stats.
+// SaveStats saves the full current stats, whether or not anything changed.
 func (s *Service) SaveStats() error {
+	s.persistMu.Lock()
+	defer s.persistMu.Unlock()
+
 	s.Mu.Lock()
 	defer s.Mu.Unlock()
 
+	seq, sealed := s.checkpoint()
+
 	if err := s.Storage.SaveStats(s.Stats); err != nil {
 		return fmt.Errorf("failed to save stats: %w", err)
 	}
 
+	s.dirty = newDirtySet()
+	s.release(seq, sealed)
+
 	return nil
 }
 
-// LoadStats loads the current stats.
+// LoadStats loads the current stats, then replays the WAL on top of them. Replayed updates
+// count as changed, so the next persist saves them.
 func (s *Service) LoadStats() error {
 	stats, err := s.Storage.LoadStats()
 	if err != nil {
@@ -81,119 +152,336 @@ func (s *Service) LoadStats() error {
 	defer s.Mu.Unlock()
 
 	s.Stats = stats
+	s.dirty = newDirtySet()
+	s.wikiUsers = countWikiUsers(stats.WikiUsers)
+
+	if s.opts.WAL == nil {
+		return nil
+	}
+
+	replayed, err := s.opts.WAL.Replay(s.apply)
+	if err != nil {
+		return fmt.Errorf("failed to replay stats wal: %w", err)
+	}
+
+	if replayed > 0 {
+		s.Logger.Info("Replayed stats updates from the wal", zap.Int("updates", replayed))
+	}
 
 	return nil
 }
 
-// StartPeriodicSave will peridically save stats data.
-func (s *Service) StartPeriodicSave(interval time.Duration) {
-	go func() {
-		ticker := time.NewTicker(interval)
-		defer ticker.Stop()
+// Close stops the snapshot and stream loops and the anomaly detector, then closes the WAL, if any.
+func (s *Service) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	s.opts.Anomalies.Close()
 
-		for range ticker.C {
-			if err := s.SaveStats(); err != nil {
-				s.Logger.Error("Failed to save stats periodically", zap.Error(err))
-			}
-		}
-	}()
+	if s.opts.WAL == nil {
+		return nil
+	}
+
+	if err := s.opts.WAL.Close(); err != nil {
+		return fmt.Errorf("failed to close stats wal: %w", err)
+	}
+
+	return nil
 }
 
-// Handler returns the router for /stats routes.
+// Handler returns the router for /stats routes. GET /?at=<RFC3339> reads the stats from the
+// history instead, see snapshots.go for the /snapshots routes and stream.go for /stream.
+// GET /anomalies lists the active anomalies when a detector is set, wikis.go serves /wikis
+// and GET /users/{name} returns a user's activity profile.
 func (s *Service) Handler(statsService *Service) http.Handler {
 	r := chi.NewRouter()
-	r.Get("/", func(w http.ResponseWriter, _ *http.Request) {
-		if err := statsService.GetStats(w); err != nil {
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		format, err := NegotiateFormat(r)
+		if errors.Is(err, errNotAcceptable) {
+			http.Error(w, err.Error(), http.StatusNotAcceptable)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if at := r.URL.Query().Get("at"); at != "" {
+			statsService.handleStatsAt(w, at, format)
+			return
+		}
+
+		if err := statsService.GetStatsFormat(w, format); err != nil {
 			s.Logger.Error("Error getting stats", zap.Error(err))
 			http.Error(w, "Error getting stats", http.StatusInternalServerError)
 		}
 	})
+	r.Get("/stream", statsService.handleStream)
+	r.Get("/snapshots", statsService.handleListSnapshots)
+	r.Get("/snapshots/diff", statsService.handleDiffSnapshots)
+	r.Get("/anomalies", statsService.handleAnomalies)
+	r.Get("/wikis", statsService.handleWikis)
+	r.Get("/wikis/{server}", statsService.handleWiki)
+	r.Get("/users/{name}", statsService.handleUser)
 
 	return r
 }
 
-// batchUpdater batches updates and saves them periodically or when batchSize is reached.
+// handleAnomalies lists the wikis currently out of line with their baseline.
+func (s *Service) handleAnomalies(w http.ResponseWriter, _ *http.Request) {
+	if s.opts.Anomalies == nil {
+		http.Error(w, "anomaly detection is not enabled", http.StatusNotFound)
+		return
+	}
+
+	if err := s.writeJSON(w, s.opts.Anomalies.Active()); err != nil {
+		http.Error(w, "Error listing anomalies", http.StatusInternalServerError)
+	}
+}
+
+// handleUser serves a user's profile, 404 when profiles are off or the user isn't held.
+// Profiles are kept per replica and aren't persisted, so they only cover what this replica has
+// consumed since it started.
+func (s *Service) handleUser(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Profiles == nil {
+		http.Error(w, "user profiles are not enabled", http.StatusNotFound)
+		return
+	}
+
+	name, err := pathParam(r, "name")
+	if err != nil {
+		http.Error(w, "invalid user name", http.StatusBadRequest)
+		return
+	}
+
+	profile, ok := s.opts.Profiles.Get(name)
+	if !ok {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	if err := s.writeJSON(w, profile); err != nil {
+		http.Error(w, "Error getting user", http.StatusInternalServerError)
+	}
+}
+
+// pathParam returns a route parameter decoded. chi matches on the raw path only when the
+// request has one, so only then is the parameter still escaped.
+func pathParam(r *http.Request, key string) (string, error) {
+	param := chi.URLParam(r, key)
+	if r.URL.RawPath == "" {
+		return param, nil
+	}
+
+	decoded, err := url.PathUnescape(param)
+	if err != nil {
+		return "", fmt.Errorf("failed to unescape %s: %w", key, err)
+	}
+
+	return decoded, nil
+}
+
+// batchUpdater applies updates in batches and persists the changes every PersistInterval.
 func (s *Service) batchUpdater() {
-	const (
-		batchSize   = 100
-		flushPeriod = time.Second
-	)
-	ticker := time.NewTicker(flushPeriod)
+	ticker := time.NewTicker(s.opts.FlushPeriod)
 	defer ticker.Stop()
 
-	batch := make([]shared.RecentChange, 0, batchSize)
+	// A nil channel never fires, so a zero PersistInterval never persists on its own.
+	var persistC <-chan time.Time
+
+	if s.opts.PersistInterval > 0 {
+		persistTicker := time.NewTicker(s.opts.PersistInterval)
+		defer persistTicker.Stop()
+
+		persistC = persistTicker.C
+	}
+
+	batch := make([]shared.RecentChange, 0, s.opts.BatchSize)
 	for {
 		select {
 		case rc := <-s.updateCh:
 			batch = append(batch, rc)
-			if len(batch) >= batchSize {
-				s.applyBatch(batch)
+			if len(batch) >= s.opts.BatchSize {
+				s.ApplyBatch(batch)
 				batch = batch[:0]
 			}
 		case <-ticker.C:
+			s.setQueueDepth()
+			batch = s.applySpilled(batch)
 			if len(batch) > 0 {
-				s.applyBatch(batch)
+				s.ApplyBatch(batch)
 				batch = batch[:0]
+			} else {
+				// Keep the rates decaying while nothing arrives.
+				s.Mu.Lock()
+				s.tickRates()
+				s.Mu.Unlock()
 			}
+		case <-persistC:
+			if err := s.Persist(); err != nil {
+				s.Logger.Error("Failed to persist stats", zap.Error(err))
+			}
+		case done := <-s.flushCh:
+			batch = s.drainUpdates(batch)
+			batch = s.applySpilled(batch)
+			s.ApplyBatch(batch)
+			batch = batch[:0]
+			done <- s.Persist()
 		}
 	}
 }
 
-// applyBatch applies a batch of updates and saves once.
-func (s *Service) applyBatch(batch []shared.RecentChange) {
+// drainUpdates appends whatever is already queued without waiting for more.
+func (s *Service) drainUpdates(batch []shared.RecentChange) []shared.RecentChange {
+	for {
+		select {
+		case rc := <-s.updateCh:
+			batch = append(batch, rc)
+		default:
+			return batch
+		}
+	}
+}
+
+// Flush applies any queued updates and saves the stats right away.
+// The consumer calls it before giving up partitions so committed offsets are never ahead of saved stats.
+func (s *Service) Flush() error {
+	done := make(chan error, 1)
+	s.flushCh <- done
+
+	return <-done
+}
+
+// ApplyBatch adds a batch of updates to the in-memory stats without saving.
+// Replays use it directly and save once at the end. With a WAL the batch is logged first,
+// under the same lock, so a checkpoint always matches the stats it is taken with.
+func (s *Service) ApplyBatch(batch []shared.RecentChange) {
 	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	if s.opts.WAL != nil {
+		if err := s.opts.WAL.Append(batch); err != nil {
+			s.Logger.Error("Failed to log stats batch to the wal", zap.Error(err))
+		}
+	}
+
+	s.apply(batch)
+	s.tickRates()
+	s.rates.add(batch)
+	s.opts.Anomalies.Observe(batch)
+	s.opts.Profiles.Observe(batch)
+	s.stream.changed.Store(true)
+}
+
+// apply adds updates to the stats. Callers hold Mu.
+func (s *Service) apply(batch []shared.RecentChange) {
 	for _, rc := range batch {
 		s.Stats.MessagesConsumed++
 		s.Stats.DistinctUsers[rc.User]++
 		s.Stats.DistinctServerURLs[rc.ServerURL]++
+		s.dirty.mark(rc, s.addWikiUser(rc))
 		if rc.Bot {
 			s.Stats.BotsCount++
+			s.Stats.WikiBots[rc.ServerURL]++
 		} else {
 			s.Stats.NonBotsCount++
 		}
 	}
-	s.Mu.Unlock()
-	if err := s.SaveStats(); err != nil {
-		s.Logger.Error("Failed to save stats after batch update", zap.Error(err))
+}
+
+// addWikiUser counts rc's edit for its user on its wiki, unless it would be a new user on a wiki
+// already holding Options.WikiMaxUsers. It reports whether the edit was counted. Callers hold Mu.
+func (s *Service) addWikiUser(rc shared.RecentChange) bool {
+	key := shared.WikiUserKey(rc.ServerURL, rc.User)
+
+	if _, ok := s.Stats.WikiUsers[key]; !ok {
+		if s.opts.WikiMaxUsers > 0 && s.wikiUsers[rc.ServerURL] >= s.opts.WikiMaxUsers {
+			return false
+		}
+
+		s.wikiUsers[rc.ServerURL]++
 	}
+
+	s.Stats.WikiUsers[key]++
+
+	return true
 }
 
-// UpdateStats now enqueues updates for batching.
+// UpdateStats now enqueues updates for batching, see OverflowPolicy for when the queue is full.
 func (s *Service) UpdateStats(rc shared.RecentChange) {
-	select {
-	case s.updateCh <- rc:
-	default:
-		s.Logger.Warn("Stats update channel full, dropping update")
+	s.enqueue(rc)
+}
+
+// GlobalStats returns a copy of the stats across every replica. With a storage.ShardStorage
+// it merges all stored shards with this replica's live one, otherwise it is the local stats.
+func (s *Service) GlobalStats() (*shared.Stats, error) {
+	s.Mu.Lock()
+	local := s.Stats.Clone()
+	s.Mu.Unlock()
+
+	ss, ok := s.Storage.(storage.ShardStorage)
+	if !ok {
+		return local, nil
 	}
+
+	shards, err := ss.LoadShards()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load stats shards: %w", err)
+	}
+
+	shards.Merge(shared.Shards{ss.ReplicaID(): local})
+
+	return shards.Total(), nil
 }
 
-// GetStats returns the current StatsResponse.
+// GetStats returns the current StatsResponse as JSON.
 func (s *Service) GetStats(w http.ResponseWriter) error {
-	s.Mu.Lock()
-	defer s.Mu.Unlock()
+	return s.GetStatsFormat(w, FormatJSON)
+}
 
-	response := Response{
-		MessagesConsumed:       s.Stats.MessagesConsumed,
-		DistinctUsersCount:     len(s.Stats.DistinctUsers),
-		BotsCount:              s.Stats.BotsCount,
-		NonBotsCount:           s.Stats.NonBotsCount,
-		DistinctServerURLCount: len(s.Stats.DistinctServerURLs),
+// GetStatsFormat returns the current StatsResponse in format.
+func (s *Service) GetStatsFormat(w http.ResponseWriter, format Format) error {
+	global, err := s.GlobalStats()
+	if err != nil {
+		s.Logger.Error("Failed to merge stats", zap.Error(err))
+		return err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	rates := s.Rates()
+
+	response := newResponse(global)
+	response.Rates = &rates
+
+	if err := s.writeResponse(w, response, format); err != nil {
+		return err
+	}
+
+	s.Logger.Debug("Current stats", zap.Any("response", response))
+
+	return nil
+}
 
-	statsJSON, err := json.Marshal(response)
+func newResponse(stats *shared.Stats) Response {
+	return Response{
+		MessagesConsumed:       stats.MessagesConsumed,
+		DistinctUsersCount:     len(stats.DistinctUsers),
+		BotsCount:              stats.BotsCount,
+		NonBotsCount:           stats.NonBotsCount,
+		DistinctServerURLCount: len(stats.DistinctServerURLs),
+		Rates:                  nil,
+	}
+}
 
+// writeJSON only fails when v can't be marshalled, nothing is written then.
+func (s *Service) writeJSON(w http.ResponseWriter, v any) error {
+	body, err := json.Marshal(v)
 	if err != nil {
 		s.Logger.Error("Failed to marshal response", zap.Error(err))
 		return fmt.Errorf("failed to marshal response %w", err)
 	}
 
-	if _, err := w.Write(statsJSON); err != nil {
+	w.Header().Set("Content-Type", "application/json")
+
+	if _, err := w.Write(body); err != nil {
 		s.Logger.Error("Failed to write stats response", zap.Error(err))
 	}
 
-	s.Logger.Info("Current stats", zap.Any("response", response))
-
 	return nil
 }
@@ -8,10 +8,14 @@ import (
 	"sync"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 
+	"github.com/codyonesock/backend_learning/ch-1/internal/metrics"
+	"github.com/codyonesock/backend_learning/ch-1/internal/profiles"
 	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
 	"github.com/codyonesock/backend_learning/ch-1/internal/stats"
+	"github.com/codyonesock/backend_learning/ch-1/internal/storage"
 )
 
 // MockStorage is a mock implementation of the shared.Storage interface.
@@ -43,6 +47,8 @@ func (m *MockStorage) LoadStats() (*shared.Stats, error) {
 			BotsCount:          0,
 			NonBotsCount:       0,
 			DistinctServerURLs: map[string]int{},
+			WikiBots:           map[string]int{},
+			WikiUsers:          map[string]int{},
 		}
 	}
 
@@ -68,6 +74,8 @@ func TestUpdateStats(t *testing.T) {
 			BotsCount:          0,
 			NonBotsCount:       0,
 			DistinctServerURLs: map[string]int{},
+			WikiBots:           map[string]int{},
+			WikiUsers:          map[string]int{},
 		},
 	}
 	service := newTestService(mockStorage)
@@ -117,6 +125,8 @@ func TestGetStats(t *testing.T) {
 			BotsCount:          4,
 			NonBotsCount:       6,
 			DistinctServerURLs: map[string]int{"https://blub.com": 3},
+			WikiBots:           map[string]int{},
+			WikiUsers:          map[string]int{},
 		},
 	}
 
@@ -141,6 +151,7 @@ func TestGetStats(t *testing.T) {
 		BotsCount:              4,
 		NonBotsCount:           6,
 		DistinctServerURLCount: 1,
+		Rates:                  nil,
 	}
 
 	var actualResponse stats.Response
@@ -148,6 +159,13 @@ func TestGetStats(t *testing.T) {
 		t.Fatalf("failed to unmarshal response: %v", err)
 	}
 
+	// Loaded stats were never applied, so the rates are there but zero.
+	if actualResponse.Rates == nil || actualResponse.Rates.EventsPerSec.M1 != 0 {
+		t.Errorf("expected zero rates, got %+v", actualResponse.Rates)
+	}
+
+	actualResponse.Rates = nil
+
 	if expectedResponse != actualResponse {
 		t.Errorf("expected response %+v, got %+v", expectedResponse, actualResponse)
 	}
@@ -178,3 +196,88 @@ func TestUpdateStatsConcurrent(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+// TestFlush verifies queued updates are applied and saved without waiting for the batch timer.
+func TestFlush(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu    sync.Mutex
+		saved *shared.Stats
+	)
+
+	mockStorage := &MockStorage{
+		SaveStatsFunc: func(s *shared.Stats) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			saved = s
+
+			return nil
+		},
+		LoadStatsFunc: nil,
+		Stats:         nil,
+	}
+	service := newTestService(mockStorage)
+
+	service.UpdateStats(shared.RecentChange{User: "blub", Bot: true, ServerURL: "https://blub.com"})
+
+	if err := service.Flush(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if saved == nil || saved.BotsCount != 1 {
+		t.Errorf("expected flushed stats with 1 bot, got %+v", saved)
+	}
+}
+
+// TestUserRoute verifies applied batches build profiles served at /users/{name}.
+func TestUserRoute(t *testing.T) {
+	t.Parallel()
+
+	disabled, _ := newPersistService(t, storage.NewMemoryStorage())
+	if rec := get(t, disabled.Handler(disabled), "/users/alice"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without profiles, got %d", rec.Code)
+	}
+
+	opts := stats.DefaultOptions()
+	opts.Metrics = metrics.NewStatsMetrics(prometheus.NewRegistry())
+	opts.Profiles = profiles.New(100, nil)
+
+	service, err := stats.NewStatsServiceWithOptions(zap.NewNop(), storage.NewMemoryStorage(), opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	service.ApplyBatch([]shared.RecentChange{
+		{User: "Some User", ServerURL: "https://en.wikipedia.org"},
+		{User: "Some User", ServerURL: "https://de.wikipedia.org"},
+		{User: "50%off"},
+		{User: "A%2B"},
+		{User: "A/B"},
+	})
+
+	h := service.Handler(service)
+
+	got := decode[profiles.Profile](t, get(t, h, "/users/Some%20User"))
+	if got.User != "Some User" || got.Edits != 2 || got.Bot || len(got.Wikis) != 2 || got.FirstSeen.IsZero() {
+		t.Errorf("unexpected profile: %+v", got)
+	}
+
+	for target, user := range map[string]string{
+		"/users/50%25off": "50%off",
+		"/users/A%252B":   "A%2B",
+		"/users/A%2FB":    "A/B",
+	} {
+		if got := decode[profiles.Profile](t, get(t, h, target)); got.User != user {
+			t.Errorf("%s: expected %q's profile, got %+v", target, user, got)
+		}
+	}
+
+	if rec := get(t, h, "/users/nobody"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown user, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,300 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/sse"
+	"github.com/codyonesock/backend_learning/ch-1/internal/storage"
+)
+
+// Stream event kinds. A delta holds the change in every count since the previous event.
+const (
+	EventSnapshot = "snapshot"
+	EventDelta    = "delta"
+)
+
+var errStreamDisabled = errors.New("stats stream is not enabled")
+
+// StreamEvent is a WebSocket message. SSE sends the kind as the event name and Stats as data.
+type StreamEvent struct {
+	Type  string   `json:"type"`
+	Stats Response `json:"stats"`
+}
+
+// broadcaster fans the stats out to stream subscribers. Each subscriber gets a one slot
+// channel that only ever holds the newest stats, so a slow one skips updates instead of
+// holding up the others.
+type broadcaster struct {
+	mu      sync.Mutex
+	subs    map[chan Response]struct{}
+	changed atomic.Bool
+}
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{
+		mu:      sync.Mutex{},
+		subs:    map[chan Response]struct{}{},
+		changed: atomic.Bool{},
+	}
+}
+
+func (b *broadcaster) subscribe() chan Response {
+	ch := make(chan Response, 1)
+
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch
+}
+
+func (b *broadcaster) unsubscribe(ch chan Response) {
+	b.mu.Lock()
+	delete(b.subs, ch)
+	b.mu.Unlock()
+}
+
+func (b *broadcaster) subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.subs)
+}
+
+// publish replaces whatever each subscriber has not read yet. Only publish sends, under mu,
+// so the send after emptying the slot never blocks.
+func (b *broadcaster) publish(resp Response) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs {
+		select {
+		case <-ch:
+		default:
+		}
+
+		ch <- resp
+	}
+}
+
+// streamLoop publishes the stats every StreamInterval while anyone is subscribed and
+// something changed. Shards from other replicas can change any time, so those always publish.
+func (s *Service) streamLoop() {
+	ticker := time.NewTicker(s.opts.StreamInterval)
+	defer ticker.Stop()
+
+	_, sharded := s.Storage.(storage.ShardStorage)
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		if s.stream.subscribers() == 0 {
+			continue
+		}
+
+		if !s.stream.changed.Swap(false) && !sharded {
+			continue
+		}
+
+		global, err := s.GlobalStats()
+		if err != nil {
+			s.Logger.Error("Failed to merge stats for the stream", zap.Error(err))
+			continue
+		}
+
+		s.stream.publish(newResponse(global))
+	}
+}
+
+// streamWriter sends events over SSE or a WebSocket.
+type streamWriter interface {
+	event(kind string, resp Response) error
+	keepAlive() error
+}
+
+// handleStream serves GET /stats/stream. It pushes a snapshot straight away, then a snapshot,
+// or with ?mode=delta the changes, every StreamInterval the stats change. A WebSocket upgrade
+// request gets the same events as JSON messages, anything else gets Server-Sent Events.
+func (s *Service) handleStream(w http.ResponseWriter, r *http.Request) {
+	if s.opts.StreamInterval <= 0 {
+		http.Error(w, errStreamDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = EventSnapshot
+	}
+
+	if mode != EventSnapshot && mode != EventDelta {
+		http.Error(w, "mode must be snapshot or delta", http.StatusBadRequest)
+		return
+	}
+
+	global, err := s.GlobalStats()
+	if err != nil {
+		s.Logger.Error("Failed to merge stats", zap.Error(err))
+		http.Error(w, "Error getting stats", http.StatusInternalServerError)
+
+		return
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		s.serveWebSocket(w, r, mode, newResponse(global))
+		return
+	}
+
+	s.runStream(r.Context(), mode, newResponse(global), sseWriter{sse.NewWriter(w)})
+}
+
+// runStream writes the first snapshot, then every published update until ctx is done or a
+// write fails.
+func (s *Service) runStream(ctx context.Context, mode string, first Response, sw streamWriter) {
+	sub := s.stream.subscribe()
+	defer s.stream.unsubscribe(sub)
+
+	if err := sw.event(EventSnapshot, first); err != nil {
+		return
+	}
+
+	last := first
+
+	keepAlive := time.NewTicker(sse.KeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		var err error
+
+		select {
+		case <-ctx.Done():
+			return
+		case resp := <-sub:
+			if mode == EventDelta {
+				err = sw.event(EventDelta, resp.sub(last))
+			} else {
+				err = sw.event(EventSnapshot, resp)
+			}
+
+			last = resp
+		case <-keepAlive.C:
+			err = sw.keepAlive()
+		}
+
+		if err != nil {
+			s.Logger.Debug("Stats stream closed", zap.Error(err))
+			return
+		}
+	}
+}
+
+// sub returns the change in every count from prev to r.
+func (r Response) sub(prev Response) Response {
+	return Response{
+		MessagesConsumed:       r.MessagesConsumed - prev.MessagesConsumed,
+		DistinctUsersCount:     r.DistinctUsersCount - prev.DistinctUsersCount,
+		BotsCount:              r.BotsCount - prev.BotsCount,
+		NonBotsCount:           r.NonBotsCount - prev.NonBotsCount,
+		DistinctServerURLCount: r.DistinctServerURLCount - prev.DistinctServerURLCount,
+		Rates:                  nil,
+	}
+}
+
+type sseWriter struct {
+	*sse.Writer
+}
+
+func (sw sseWriter) event(kind string, resp Response) error {
+	if err := sw.Event(kind, resp); err != nil {
+		return fmt.Errorf("failed to send stream event: %w", err)
+	}
+
+	return nil
+}
+
+func (sw sseWriter) keepAlive() error {
+	if err := sw.KeepAlive(); err != nil {
+		return fmt.Errorf("failed to send stream keepalive: %w", err)
+	}
+
+	return nil
+}
+
+var upgrader = websocket.Upgrader{
+	HandshakeTimeout:  sse.WriteTimeout,
+	ReadBufferSize:    0,
+	WriteBufferSize:   0,
+	WriteBufferPool:   nil,
+	Subprotocols:      nil,
+	Error:             nil,
+	CheckOrigin:       nil,
+	EnableCompression: false,
+}
+
+// serveWebSocket upgrades the request and streams events as JSON messages until the client
+// goes away. Messages from the client are read and dropped.
+func (s *Service) serveWebSocket(w http.ResponseWriter, r *http.Request, mode string, first Response) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already answered the client.
+		s.Logger.Debug("Stats stream upgrade failed", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	// The server's read deadline still applies after the upgrade. Pongs to the keepalive
+	// pings push it back, so a client that vanishes without closing is noticed.
+	_ = conn.SetReadDeadline(time.Now().Add(2 * sse.KeepAlive))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * sse.KeepAlive))
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		defer cancel()
+
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	s.runStream(ctx, mode, first, &wsWriter{conn: conn})
+}
+
+type wsWriter struct {
+	conn *websocket.Conn
+}
+
+func (ww *wsWriter) event(kind string, resp Response) error {
+	_ = ww.conn.SetWriteDeadline(time.Now().Add(sse.WriteTimeout))
+
+	if err := ww.conn.WriteJSON(StreamEvent{Type: kind, Stats: resp}); err != nil {
+		return fmt.Errorf("failed to write stream event: %w", err)
+	}
+
+	return nil
+}
+
+func (ww *wsWriter) keepAlive() error {
+	if err := ww.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(sse.WriteTimeout)); err != nil {
+		return fmt.Errorf("failed to ping stream: %w", err)
+	}
+
+	return nil
+}
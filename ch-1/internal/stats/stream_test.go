@@ -0,0 +1,167 @@
+package stats_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/metrics"
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+	"github.com/codyonesock/backend_learning/ch-1/internal/stats"
+	"github.com/codyonesock/backend_learning/ch-1/internal/storage"
+)
+
+func newStreamServer(t *testing.T) (*stats.Service, *httptest.Server) {
+	t.Helper()
+
+	opts := stats.DefaultOptions()
+	opts.Metrics = metrics.NewStatsMetrics(prometheus.NewRegistry())
+	opts.StreamInterval = 10 * time.Millisecond
+
+	service, err := stats.NewStatsServiceWithOptions(zap.NewNop(), storage.NewMemoryStorage(), opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	srv := httptest.NewServer(service.Handler(service))
+	t.Cleanup(srv.Close)
+
+	return service, srv
+}
+
+// readSSE returns the next event name and data, skipping keepalive comments.
+func readSSE(t *testing.T, r *bufio.Reader) (string, stats.Response) {
+	t.Helper()
+
+	var (
+		kind string
+		resp stats.Response
+	)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read event: %v", err)
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			kind = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &resp); err != nil {
+				t.Fatalf("failed to decode %q: %v", line, err)
+			}
+		case line == "" && kind != "":
+			return kind, resp
+		}
+	}
+}
+
+// TestStreamSSE verifies a subscriber gets the current stats, then every change as a snapshot.
+func TestStreamSSE(t *testing.T) {
+	t.Parallel()
+
+	service, srv := newStreamServer(t)
+	service.ApplyBatch([]shared.RecentChange{{User: "a", ServerURL: "https://en.wiki.org"}})
+
+	res, err := http.Get(srv.URL + "/stream") //nolint:noctx // the server closes the stream on cleanup
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer res.Body.Close()
+
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %q", ct)
+	}
+
+	r := bufio.NewReader(res.Body)
+
+	if kind, resp := readSSE(t, r); kind != stats.EventSnapshot || resp.MessagesConsumed != 1 {
+		t.Fatalf("first event: got %s %+v", kind, resp)
+	}
+
+	service.ApplyBatch([]shared.RecentChange{
+		{User: "b", ServerURL: "https://en.wiki.org"},
+		{User: "b", ServerURL: "https://de.wiki.org", Bot: true},
+	})
+
+	kind, resp := readSSE(t, r)
+	if kind != stats.EventSnapshot || resp.MessagesConsumed != 3 || resp.DistinctUsersCount != 2 || resp.BotsCount != 1 {
+		t.Errorf("update: got %s %+v", kind, resp)
+	}
+}
+
+// TestStreamWebSocketDeltas verifies the WebSocket variant and delta mode.
+func TestStreamWebSocketDeltas(t *testing.T) {
+	t.Parallel()
+
+	service, srv := newStreamServer(t)
+	service.ApplyBatch([]shared.RecentChange{{User: "a", ServerURL: "https://en.wiki.org"}})
+
+	conn, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/stream?mode=delta", nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	defer res.Body.Close()
+
+	var first stats.StreamEvent
+	if err := conn.ReadJSON(&first); err != nil || first.Type != stats.EventSnapshot || first.Stats.MessagesConsumed != 1 {
+		t.Fatalf("first event: got %+v, %v", first, err)
+	}
+
+	service.ApplyBatch([]shared.RecentChange{
+		{User: "a", ServerURL: "https://en.wiki.org"},
+		{User: "b", ServerURL: "https://de.wiki.org"},
+	})
+
+	var delta stats.StreamEvent
+	if err := conn.ReadJSON(&delta); err != nil {
+		t.Fatalf("failed to read delta: %v", err)
+	}
+
+	want := stats.Response{
+		MessagesConsumed:       2,
+		DistinctUsersCount:     1,
+		BotsCount:              0,
+		NonBotsCount:           2,
+		DistinctServerURLCount: 1,
+		Rates:                  nil,
+	}
+	if delta.Type != stats.EventDelta || delta.Stats != want {
+		t.Errorf("delta: got %+v, want %+v", delta, want)
+	}
+}
+
+// TestStreamDisabled verifies the stream is off without a StreamInterval and modes are checked.
+func TestStreamDisabled(t *testing.T) {
+	t.Parallel()
+
+	service, _ := newPersistService(t, storage.NewMemoryStorage())
+
+	if rec := get(t, service.Handler(service), "/stream"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+
+	_, srv := newStreamServer(t)
+
+	res, err := http.Get(srv.URL + "/stream?mode=sideways") //nolint:noctx // plain request in a test
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,246 @@
+package stats
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+	"github.com/codyonesock/backend_learning/ch-1/internal/storage"
+)
+
+const (
+	defaultWikiLimit = 50
+	maxWikiLimit     = 500
+)
+
+var (
+	errInvalidWikiSort  = errors.New("sort must be messages, bots, non_bots, users or server_url")
+	errInvalidWikiOrder = errors.New("order must be asc or desc")
+	errInvalidWikiPage  = errors.New("limit must be 1 to 500 and offset can't be negative")
+)
+
+// WikiStats are the counts for one server URL.
+type WikiStats struct {
+	ServerURL          string `json:"server_url"`
+	MessagesConsumed   int    `json:"messages_consumed"`
+	BotsCount          int    `json:"bots_count"`
+	NonBotsCount       int    `json:"non_bots_count"`
+	DistinctUsersCount int    `json:"distinct_users"`
+}
+
+// WikiPage is one page of GET /stats/wikis. Total counts every wiki, not just this page.
+type WikiPage struct {
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+	Wikis  []WikiStats `json:"wikis"`
+}
+
+// Wikis breaks the stats down by server URL, with users the distinct users per server URL.
+func Wikis(stats *shared.Stats, users map[string]int) map[string]*WikiStats {
+	wikis := make(map[string]*WikiStats, len(stats.DistinctServerURLs))
+
+	wiki := func(url string) *WikiStats {
+		w, ok := wikis[url]
+		if !ok {
+			w = &WikiStats{ServerURL: url, MessagesConsumed: 0, BotsCount: 0, NonBotsCount: 0, DistinctUsersCount: 0}
+			wikis[url] = w
+		}
+
+		return w
+	}
+
+	for url, n := range stats.DistinctServerURLs {
+		wiki(url).MessagesConsumed = n
+	}
+
+	for url, n := range stats.WikiBots {
+		wiki(url).BotsCount = n
+	}
+
+	for url, n := range users {
+		wiki(url).DistinctUsersCount = n
+	}
+
+	for _, w := range wikis {
+		w.NonBotsCount = w.MessagesConsumed - w.BotsCount
+	}
+
+	return wikis
+}
+
+// countWikiUsers counts the distinct users per server URL in Stats.WikiUsers.
+func countWikiUsers(wikiUsers map[string]int) map[string]int {
+	counts := map[string]int{}
+
+	for key := range wikiUsers {
+		url, _ := shared.SplitWikiUserKey(key)
+		counts[url]++
+	}
+
+	return counts
+}
+
+// wikis breaks the stats down by server URL across every replica. Without shards it reads the
+// live stats and per-wiki user counts under Mu, so nothing is cloned or scanned.
+func (s *Service) wikis() (map[string]*WikiStats, error) {
+	if _, ok := s.Storage.(storage.ShardStorage); ok {
+		global, err := s.GlobalStats()
+		if err != nil {
+			return nil, err
+		}
+
+		return Wikis(global, countWikiUsers(global.WikiUsers)), nil
+	}
+
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	return Wikis(s.Stats, s.wikiUsers), nil
+}
+
+// wikiQuery is how GET /stats/wikis sorts and pages.
+type wikiQuery struct {
+	sort   string
+	desc   bool
+	limit  int
+	offset int
+}
+
+// parseWikiQuery reads ?sort=&order=&limit=&offset=. Counts sort descending by default,
+// server_url ascending.
+func parseWikiQuery(q url.Values) (wikiQuery, error) {
+	wq := wikiQuery{sort: cmp.Or(q.Get("sort"), "messages"), desc: true, limit: defaultWikiLimit, offset: 0}
+
+	switch wq.sort {
+	case "messages", "bots", "non_bots", "users":
+	case "server_url":
+		wq.desc = false
+	default:
+		return wq, fmt.Errorf("%w: got %q", errInvalidWikiSort, wq.sort)
+	}
+
+	switch order := q.Get("order"); order {
+	case "":
+	case "asc", "desc":
+		wq.desc = order == "desc"
+	default:
+		return wq, fmt.Errorf("%w: got %q", errInvalidWikiOrder, order)
+	}
+
+	var err error
+
+	if v := q.Get("limit"); v != "" {
+		if wq.limit, err = strconv.Atoi(v); err != nil || wq.limit < 1 || wq.limit > maxWikiLimit {
+			return wq, fmt.Errorf("%w: got limit %q", errInvalidWikiPage, v)
+		}
+	}
+
+	if v := q.Get("offset"); v != "" {
+		if wq.offset, err = strconv.Atoi(v); err != nil || wq.offset < 0 {
+			return wq, fmt.Errorf("%w: got offset %q", errInvalidWikiPage, v)
+		}
+	}
+
+	return wq, nil
+}
+
+// page sorts the wikis and cuts out the requested page. Ties go by server URL, A to Z.
+func (wq wikiQuery) page(wikis map[string]*WikiStats) WikiPage {
+	all := make([]WikiStats, 0, len(wikis))
+	for _, w := range wikis {
+		all = append(all, *w)
+	}
+
+	key := func(w WikiStats) int {
+		switch wq.sort {
+		case "bots":
+			return w.BotsCount
+		case "non_bots":
+			return w.NonBotsCount
+		case "users":
+			return w.DistinctUsersCount
+		default:
+			return w.MessagesConsumed
+		}
+	}
+
+	slices.SortFunc(all, func(a, b WikiStats) int {
+		c := cmp.Compare(key(a), key(b))
+		if wq.sort == "server_url" {
+			c = strings.Compare(a.ServerURL, b.ServerURL)
+		}
+
+		if wq.desc {
+			c = -c
+		}
+
+		return cmp.Or(c, strings.Compare(a.ServerURL, b.ServerURL))
+	})
+
+	start := min(wq.offset, len(all))
+	end := min(start+wq.limit, len(all))
+
+	return WikiPage{Total: len(all), Offset: wq.offset, Limit: wq.limit, Wikis: all[start:end]}
+}
+
+// handleWikis serves GET /stats/wikis.
+func (s *Service) handleWikis(w http.ResponseWriter, r *http.Request) {
+	wq, err := parseWikiQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	wikis, err := s.wikis()
+	if err != nil {
+		s.Logger.Error("Failed to merge stats", zap.Error(err))
+		http.Error(w, "Error getting stats", http.StatusInternalServerError)
+
+		return
+	}
+
+	if err := s.writeJSON(w, wq.page(wikis)); err != nil {
+		http.Error(w, "Error listing wikis", http.StatusInternalServerError)
+	}
+}
+
+// handleWiki serves GET /stats/wikis/{server}, where server is a full server URL or just
+// its host, e.g. en.wikipedia.org for https://en.wikipedia.org.
+func (s *Service) handleWiki(w http.ResponseWriter, r *http.Request) {
+	server, err := pathParam(r, "server")
+	if err != nil {
+		http.Error(w, "invalid server", http.StatusBadRequest)
+		return
+	}
+
+	wikis, err := s.wikis()
+	if err != nil {
+		s.Logger.Error("Failed to merge stats", zap.Error(err))
+		http.Error(w, "Error getting stats", http.StatusInternalServerError)
+
+		return
+	}
+
+	wiki, ok := wikis[server]
+	if !ok {
+		wiki, ok = wikis["https://"+server]
+	}
+
+	if !ok {
+		http.Error(w, "wiki not found", http.StatusNotFound)
+		return
+	}
+
+	if err := s.writeJSON(w, wiki); err != nil {
+		http.Error(w, "Error getting wiki", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,152 @@
+package stats_test
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/metrics"
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+	"github.com/codyonesock/backend_learning/ch-1/internal/stats"
+	"github.com/codyonesock/backend_learning/ch-1/internal/storage"
+)
+
+// TestWikiRoutes verifies the per-wiki breakdown, its sorting and paging, and single wiki lookups.
+func TestWikiRoutes(t *testing.T) {
+	t.Parallel()
+
+	service, _ := newPersistService(t, storage.NewMemoryStorage())
+	service.ApplyBatch([]shared.RecentChange{
+		{User: "alice", ServerURL: "https://en.wikipedia.org"},
+		{User: "alice", ServerURL: "https://en.wikipedia.org"},
+		{User: "bob", ServerURL: "https://en.wikipedia.org"},
+		{User: "CommonsBot", Bot: true, ServerURL: "https://commons.wikimedia.org"},
+		{User: "CommonsBot", Bot: true, ServerURL: "https://commons.wikimedia.org"},
+		{User: "alice", ServerURL: "https://commons.wikimedia.org"},
+		{User: "carol", ServerURL: "https://de.wikipedia.org"},
+	})
+
+	h := service.Handler(service)
+
+	page := decode[stats.WikiPage](t, get(t, h, "/wikis"))
+	if page.Total != 3 || page.Limit != 50 || len(page.Wikis) != 3 {
+		t.Fatalf("unexpected page: %+v", page)
+	}
+
+	want := stats.WikiStats{
+		ServerURL:          "https://commons.wikimedia.org",
+		MessagesConsumed:   3,
+		BotsCount:          2,
+		NonBotsCount:       1,
+		DistinctUsersCount: 2,
+	}
+	if page.Wikis[0] != want {
+		t.Errorf("expected commons first, then en by name on the tie, got %+v", page.Wikis)
+	}
+
+	cases := map[string][]string{
+		"/wikis?sort=bots&limit=1":                  {"https://commons.wikimedia.org"},
+		"/wikis?sort=users&order=asc":               {"https://de.wikipedia.org", "https://commons.wikimedia.org", "https://en.wikipedia.org"},
+		"/wikis?sort=server_url&offset=1":           {"https://de.wikipedia.org", "https://en.wikipedia.org"},
+		"/wikis?sort=non_bots&limit=2&offset=1":     {"https://commons.wikimedia.org", "https://de.wikipedia.org"},
+		"/wikis?sort=server_url&order=desc&limit=1": {"https://en.wikipedia.org"},
+		"/wikis?offset=10":                          {},
+	}
+
+	for target, urls := range cases {
+		got := decode[stats.WikiPage](t, get(t, h, target))
+		if len(got.Wikis) != len(urls) {
+			t.Errorf("%s: expected %v, got %+v", target, urls, got.Wikis)
+			continue
+		}
+
+		for i, u := range urls {
+			if got.Wikis[i].ServerURL != u {
+				t.Errorf("%s: expected %v, got %+v", target, urls, got.Wikis)
+				break
+			}
+		}
+	}
+
+	for _, target := range []string{"/wikis/en.wikipedia.org", "/wikis/" + url.PathEscape("https://en.wikipedia.org")} {
+		got := decode[stats.WikiStats](t, get(t, h, target))
+		if got.MessagesConsumed != 3 || got.NonBotsCount != 3 || got.DistinctUsersCount != 2 {
+			t.Errorf("%s: unexpected stats %+v", target, got)
+		}
+	}
+
+	for target, code := range map[string]int{
+		"/wikis/fr.wikipedia.org": http.StatusNotFound,
+		"/wikis?sort=edits":       http.StatusBadRequest,
+		"/wikis?order=up":         http.StatusBadRequest,
+		"/wikis?limit=0":          http.StatusBadRequest,
+		"/wikis?offset=-1":        http.StatusBadRequest,
+	} {
+		if rec := get(t, h, target); rec.Code != code {
+			t.Errorf("%s: expected %d, got %d", target, code, rec.Code)
+		}
+	}
+
+	escaped, _ := newPersistService(t, storage.NewMemoryStorage())
+	escaped.ApplyBatch([]shared.RecentChange{{User: "dave", ServerURL: "https://50%.wiki.org"}})
+
+	if got := decode[stats.WikiStats](t, get(t, escaped.Handler(escaped), "/wikis/50%25.wiki.org")); got.MessagesConsumed != 1 {
+		t.Errorf("expected the escaped server to be decoded once, got %+v", got)
+	}
+}
+
+// TestWikiMaxUsers verifies new users past the cap aren't tracked or persisted, while known users
+// and the other counts keep going.
+func TestWikiMaxUsers(t *testing.T) {
+	t.Parallel()
+
+	backend := storage.NewMemoryStorage()
+
+	opts := stats.DefaultOptions()
+	opts.Metrics = metrics.NewStatsMetrics(prometheus.NewRegistry())
+	opts.WikiMaxUsers = 2
+
+	service, err := stats.NewStatsServiceWithOptions(zap.NewNop(), backend, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	service.ApplyBatch([]shared.RecentChange{
+		{User: "alice", ServerURL: "https://en.wikipedia.org"},
+		{User: "bob", ServerURL: "https://en.wikipedia.org"},
+		{User: "carol", ServerURL: "https://en.wikipedia.org"},
+		{User: "alice", ServerURL: "https://en.wikipedia.org"},
+		{User: "carol", ServerURL: "https://de.wikipedia.org"},
+	})
+
+	got := decode[stats.WikiStats](t, get(t, service.Handler(service), "/wikis/en.wikipedia.org"))
+	if got.MessagesConsumed != 4 || got.DistinctUsersCount != 2 {
+		t.Errorf("expected 4 messages from 2 tracked users, got %+v", got)
+	}
+
+	if err := service.Persist(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	saved, err := backend.LoadStats()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(saved.WikiUsers) != 3 || saved.WikiUsers[shared.WikiUserKey("https://en.wikipedia.org", "alice")] != 2 {
+		t.Errorf("expected alice, bob and carol on de only, got %v", saved.WikiUsers)
+	}
+
+	if err := service.LoadStats(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	service.ApplyBatch([]shared.RecentChange{{User: "dave", ServerURL: "https://en.wikipedia.org"}})
+
+	if got := decode[stats.WikiStats](t, get(t, service.Handler(service), "/wikis/en.wikipedia.org")); got.DistinctUsersCount != 2 {
+		t.Errorf("expected the cap to hold after a reload, got %+v", got)
+	}
+}
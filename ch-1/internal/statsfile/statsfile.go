@@ -0,0 +1,306 @@
+// Package statsfile reads and writes a full copy of the stats as JSON, CSV or protobuf, for
+// backups, moving stats between backends and test fixtures.
+package statsfile
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+	wikimedia "github.com/codyonesock/backend_learning/ch-6/proto"
+)
+
+// Format is a stats file encoding.
+type Format string
+
+const (
+	// JSON is one object with the totals and the maps.
+	JSON Format = "json"
+	// CSV has a kind,key,value row per total, user, server URL and per-wiki count.
+	CSV Format = "csv"
+	// Proto is a wikimedia.Stats message.
+	Proto Format = "proto"
+)
+
+// jsonVersion is bumped when the JSON layout changes incompatibly.
+const jsonVersion = 1
+
+// CSV row kinds.
+const (
+	kindTotal     = "total"
+	kindUser      = "user"
+	kindServerURL = "server_url"
+	kindWikiBots  = "wiki_bots"
+	// kindWikiUser rows are keyed by shared.WikiUserKey.
+	kindWikiUser = "wiki_user"
+)
+
+var (
+	errInvalidFormat  = errors.New("format must be json, csv or proto")
+	errUnknownVersion = errors.New("unsupported stats file version")
+	errBadRow         = errors.New("bad csv row")
+)
+
+// ParseFormat validates a format name.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case JSON, CSV, Proto:
+		return f, nil
+	default:
+		return "", fmt.Errorf("%w: got %q", errInvalidFormat, s)
+	}
+}
+
+// FormatFor guesses the format from a file extension: .json, .csv, or .pb for protobuf.
+func FormatFor(path string) (Format, error) {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		return JSON, nil
+	case ".csv":
+		return CSV, nil
+	case ".pb", ".binpb":
+		return Proto, nil
+	default:
+		return "", fmt.Errorf("%w: can't tell from extension %q", errInvalidFormat, ext)
+	}
+}
+
+// document is the JSON layout. shared.Stats hides its maps from JSON.
+type document struct {
+	Version            int            `json:"version"`
+	MessagesConsumed   int            `json:"messages_consumed"`
+	BotsCount          int            `json:"bots_count"`
+	NonBotsCount       int            `json:"non_bots_count"`
+	DistinctUsers      map[string]int `json:"distinct_users"`
+	DistinctServerURLs map[string]int `json:"distinct_server_urls"`
+	WikiBots           map[string]int `json:"wiki_bots,omitempty"`
+	WikiUsers          map[string]int `json:"wiki_users,omitempty"`
+}
+
+// Write encodes stats to w.
+func Write(w io.Writer, stats *shared.Stats, format Format) error {
+	switch format {
+	case JSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		if err := enc.Encode(document{
+			Version:            jsonVersion,
+			MessagesConsumed:   stats.MessagesConsumed,
+			BotsCount:          stats.BotsCount,
+			NonBotsCount:       stats.NonBotsCount,
+			DistinctUsers:      stats.DistinctUsers,
+			DistinctServerURLs: stats.DistinctServerURLs,
+			WikiBots:           stats.WikiBots,
+			WikiUsers:          stats.WikiUsers,
+		}); err != nil {
+			return fmt.Errorf("failed to write json stats: %w", err)
+		}
+
+		return nil
+	case CSV:
+		return writeCSV(w, stats)
+	case Proto:
+		data, err := proto.Marshal(ToProto(stats))
+		if err != nil {
+			return fmt.Errorf("failed to marshal proto stats: %w", err)
+		}
+
+		if _, err := w.Write(data); err != nil {
+			return fmt.Errorf("failed to write proto stats: %w", err)
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("%w: got %q", errInvalidFormat, format)
+	}
+}
+
+// Read decodes stats from r. The maps are never nil.
+func Read(r io.Reader, format Format) (*shared.Stats, error) {
+	switch format {
+	case JSON:
+		var doc document
+		if err := json.NewDecoder(r).Decode(&doc); err != nil {
+			return nil, fmt.Errorf("failed to read json stats: %w", err)
+		}
+
+		if doc.Version != jsonVersion {
+			return nil, fmt.Errorf("%w: %d", errUnknownVersion, doc.Version)
+		}
+
+		stats := shared.NewStats()
+		stats.MessagesConsumed = doc.MessagesConsumed
+		stats.BotsCount = doc.BotsCount
+		stats.NonBotsCount = doc.NonBotsCount
+		maps.Copy(stats.DistinctUsers, doc.DistinctUsers)
+		maps.Copy(stats.DistinctServerURLs, doc.DistinctServerURLs)
+		maps.Copy(stats.WikiBots, doc.WikiBots)
+		maps.Copy(stats.WikiUsers, doc.WikiUsers)
+
+		return stats, nil
+	case CSV:
+		return readCSV(r)
+	case Proto:
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read proto stats: %w", err)
+		}
+
+		var msg wikimedia.Stats
+		if err := proto.Unmarshal(data, &msg); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal proto stats: %w", err)
+		}
+
+		return FromProto(&msg), nil
+	default:
+		return nil, fmt.Errorf("%w: got %q", errInvalidFormat, format)
+	}
+}
+
+// ToProto converts stats to their protobuf message.
+func ToProto(stats *shared.Stats) *wikimedia.Stats {
+	return &wikimedia.Stats{
+		MessagesConsumed:   int64(stats.MessagesConsumed),
+		DistinctUsers:      toInt64s(stats.DistinctUsers),
+		BotsCount:          int64(stats.BotsCount),
+		NonBotsCount:       int64(stats.NonBotsCount),
+		DistinctServerUrls: toInt64s(stats.DistinctServerURLs),
+		WikiBots:           toInt64s(stats.WikiBots),
+		WikiUsers:          toInt64s(stats.WikiUsers),
+	}
+}
+
+// FromProto converts a protobuf message back to stats.
+func FromProto(msg *wikimedia.Stats) *shared.Stats {
+	stats := shared.NewStats()
+	stats.MessagesConsumed = int(msg.GetMessagesConsumed())
+	stats.BotsCount = int(msg.GetBotsCount())
+	stats.NonBotsCount = int(msg.GetNonBotsCount())
+
+	for k, v := range msg.GetDistinctUsers() {
+		stats.DistinctUsers[k] = int(v)
+	}
+
+	for k, v := range msg.GetDistinctServerUrls() {
+		stats.DistinctServerURLs[k] = int(v)
+	}
+
+	for k, v := range msg.GetWikiBots() {
+		stats.WikiBots[k] = int(v)
+	}
+
+	for k, v := range msg.GetWikiUsers() {
+		stats.WikiUsers[k] = int(v)
+	}
+
+	return stats
+}
+
+func toInt64s(m map[string]int) map[string]int64 {
+	out := make(map[string]int64, len(m))
+	for k, v := range m {
+		out[k] = int64(v)
+	}
+
+	return out
+}
+
+func writeCSV(w io.Writer, stats *shared.Stats) error {
+	cw := csv.NewWriter(w)
+
+	rows := [][]string{
+		{"kind", "key", "value"},
+		{kindTotal, "messages_consumed", strconv.Itoa(stats.MessagesConsumed)},
+		{kindTotal, "bots_count", strconv.Itoa(stats.BotsCount)},
+		{kindTotal, "non_bots_count", strconv.Itoa(stats.NonBotsCount)},
+	}
+
+	for user, n := range stats.DistinctUsers {
+		rows = append(rows, []string{kindUser, user, strconv.Itoa(n)})
+	}
+
+	for url, n := range stats.DistinctServerURLs {
+		rows = append(rows, []string{kindServerURL, url, strconv.Itoa(n)})
+	}
+
+	for url, n := range stats.WikiBots {
+		rows = append(rows, []string{kindWikiBots, url, strconv.Itoa(n)})
+	}
+
+	for key, n := range stats.WikiUsers {
+		rows = append(rows, []string{kindWikiUser, key, strconv.Itoa(n)})
+	}
+
+	if err := cw.WriteAll(rows); err != nil {
+		return fmt.Errorf("failed to write csv stats: %w", err)
+	}
+
+	return nil
+}
+
+func readCSV(r io.Reader) (*shared.Stats, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 3
+
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read csv stats: %w", err)
+	}
+
+	stats := shared.NewStats()
+
+	for i, row := range rows {
+		if i == 0 && row[0] == "kind" {
+			continue
+		}
+
+		n, err := strconv.Atoi(row[2])
+		if err != nil {
+			return nil, fmt.Errorf("%w %d: value %q is not a number", errBadRow, i+1, row[2])
+		}
+
+		switch row[0] {
+		case kindUser:
+			stats.DistinctUsers[row[1]] += n
+		case kindServerURL:
+			stats.DistinctServerURLs[row[1]] += n
+		case kindWikiBots:
+			stats.WikiBots[row[1]] += n
+		case kindWikiUser:
+			stats.WikiUsers[row[1]] += n
+		case kindTotal:
+			if err := setTotal(stats, row[1], n); err != nil {
+				return nil, fmt.Errorf("%w %d: %w", errBadRow, i+1, err)
+			}
+		default:
+			return nil, fmt.Errorf("%w %d: unknown kind %q", errBadRow, i+1, row[0])
+		}
+	}
+
+	return stats, nil
+}
+
+func setTotal(stats *shared.Stats, name string, n int) error {
+	switch name {
+	case "messages_consumed":
+		stats.MessagesConsumed = n
+	case "bots_count":
+		stats.BotsCount = n
+	case "non_bots_count":
+		stats.NonBotsCount = n
+	default:
+		return fmt.Errorf("%w: unknown total %q", errBadRow, name)
+	}
+
+	return nil
+}
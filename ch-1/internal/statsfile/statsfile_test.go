@@ -0,0 +1,116 @@
+package statsfile_test
+
+import (
+	"bytes"
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+	"github.com/codyonesock/backend_learning/ch-1/internal/statsfile"
+)
+
+func sample() *shared.Stats {
+	return &shared.Stats{
+		MessagesConsumed:   7,
+		DistinctUsers:      map[string]int{"alice": 4, "bob, jr.": 2, "Ünïcode": 1},
+		BotsCount:          3,
+		NonBotsCount:       4,
+		DistinctServerURLs: map[string]int{"https://en.wikipedia.org": 5, "https://de.wikipedia.org": 2},
+		WikiBots:           map[string]int{"https://en.wikipedia.org": 3},
+		WikiUsers: map[string]int{
+			shared.WikiUserKey("https://en.wikipedia.org", "alice"):    3,
+			shared.WikiUserKey("https://de.wikipedia.org", "alice"):    1,
+			shared.WikiUserKey("https://en.wikipedia.org", "bob, jr."): 2,
+			shared.WikiUserKey("https://de.wikipedia.org", "Ünïcode"):  1,
+		},
+	}
+}
+
+func equal(a, b *shared.Stats) bool {
+	return a.MessagesConsumed == b.MessagesConsumed &&
+		a.BotsCount == b.BotsCount &&
+		a.NonBotsCount == b.NonBotsCount &&
+		maps.Equal(a.DistinctUsers, b.DistinctUsers) &&
+		maps.Equal(a.DistinctServerURLs, b.DistinctServerURLs) &&
+		maps.Equal(a.WikiBots, b.WikiBots) &&
+		maps.Equal(a.WikiUsers, b.WikiUsers)
+}
+
+// TestRoundTrip verifies every format reads back what it wrote, maps included.
+func TestRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	for _, format := range []statsfile.Format{statsfile.JSON, statsfile.CSV, statsfile.Proto} {
+		t.Run(string(format), func(t *testing.T) {
+			t.Parallel()
+
+			for _, want := range []*shared.Stats{sample(), shared.NewStats()} {
+				var buf bytes.Buffer
+				if err := statsfile.Write(&buf, want, format); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+
+				got, err := statsfile.Read(&buf, format)
+				if err != nil {
+					t.Fatalf("read: %v", err)
+				}
+
+				if !equal(got, want) {
+					t.Errorf("got %+v, want %+v", got, want)
+				}
+
+				if got.DistinctUsers == nil || got.DistinctServerURLs == nil {
+					t.Error("expected non-nil maps")
+				}
+			}
+		})
+	}
+}
+
+// TestReadRejectsBadInput verifies malformed files are errors rather than partial stats.
+func TestReadRejectsBadInput(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		format statsfile.Format
+		input  string
+	}{
+		"json version": {statsfile.JSON, `{"version":99}`},
+		"json syntax":  {statsfile.JSON, `{"version":`},
+		"csv kind":     {statsfile.CSV, "kind,key,value\nwiki,x,1\n"},
+		"csv total":    {statsfile.CSV, "kind,key,value\ntotal,edits,1\n"},
+		"csv value":    {statsfile.CSV, "kind,key,value\nuser,alice,lots\n"},
+		"csv columns":  {statsfile.CSV, "kind,key,value\nuser,alice\n"},
+		"proto":        {statsfile.Proto, "\xff\xff\xff"},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := statsfile.Read(strings.NewReader(tc.input), tc.format); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+// TestFormatFor verifies formats are inferred from extensions.
+func TestFormatFor(t *testing.T) {
+	t.Parallel()
+
+	for path, want := range map[string]statsfile.Format{
+		"stats.json": statsfile.JSON,
+		"a/b.CSV":    statsfile.CSV,
+		"stats.pb":   statsfile.Proto,
+	} {
+		if got, err := statsfile.FormatFor(path); err != nil || got != want {
+			t.Errorf("FormatFor(%q) = %q, %v, want %q", path, got, err, want)
+		}
+	}
+
+	if _, err := statsfile.FormatFor("stats.txt"); err == nil {
+		t.Error("expected an error for .txt")
+	}
+}
@@ -17,18 +17,37 @@ import (
 	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 
+	"github.com/codyonesock/backend_learning/ch-1/internal/dedup"
+	"github.com/codyonesock/backend_learning/ch-1/internal/filter"
 	"github.com/codyonesock/backend_learning/ch-1/internal/metrics"
+	"github.com/codyonesock/backend_learning/ch-1/internal/recording"
 	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
 	"github.com/codyonesock/backend_learning/ch-1/internal/stats"
+	"github.com/codyonesock/backend_learning/ch-1/internal/tail"
 	wikimedia "github.com/codyonesock/backend_learning/ch-6/proto"
 )
 
+// LineRecorder captures raw stream lines, see recording.Recorder.
+type LineRecorder interface {
+	Record(line string) error
+}
+
 // Service handles dependencies and config.
 type Service struct {
 	Logger         *zap.Logger
 	StatsInterface stats.ServiceInterface
 	SleepTime      time.Duration
 	ContextTimeout time.Duration
+	// Recorder, when set, gets a copy of every raw stream line.
+	Recorder LineRecorder
+	// ReplaySpeed paces file:// stream sources, see recording.ParseSpeed.
+	ReplaySpeed float64
+	// Filter, when set, drops events before they reach the stats.
+	Filter *filter.Filter
+	// Dedup, when set, drops events already seen, e.g. replayed after a reconnect.
+	Dedup *dedup.Cache
+	// Tail, when set, gets every event that reaches the stats, for /events/tail.
+	Tail *tail.Hub
 }
 
 // NewStatusService create a new instance of Service.
@@ -38,6 +57,11 @@ func NewStatusService(l *zap.Logger, si stats.ServiceInterface, st, ct time.Dura
 		StatsInterface: si,
 		SleepTime:      st,
 		ContextTimeout: ct,
+		Recorder:       nil,
+		ReplaySpeed:    1,
+		Filter:         nil,
+		Dedup:          nil,
+		Tail:           nil,
 	}
 }
 
@@ -65,13 +89,13 @@ func (s *Service) ProcessStream(ctx context.Context, streamURL string) error {
 	ctx, cancel := context.WithTimeout(ctx, s.ContextTimeout)
 	defer cancel()
 
-	res, err := s.fetchStream(ctx, parsedURL)
+	body, err := s.openStream(ctx, parsedURL)
 	if err != nil {
 		return err
 	}
 
 	defer func() {
-		if err := res.Body.Close(); err != nil {
+		if err := body.Close(); err != nil {
 			s.Logger.Error("Error closing response body", zap.Error(err))
 		}
 	}()
@@ -80,7 +104,27 @@ func (s *Service) ProcessStream(ctx context.Context, streamURL string) error {
 		return s.handleStreamData(line)
 	}
 
-	return streamReader(ctx, res.Body, processFunc)
+	return streamReader(ctx, body, recordLines(s.Recorder, s.Logger, processFunc))
+}
+
+// openStream opens either a recording for file:// URLs or the live stream.
+func (s *Service) openStream(ctx context.Context, parsedURL *url.URL) (io.ReadCloser, error) {
+	if recording.IsFileURL(parsedURL.String()) {
+		body, err := recording.Open(ctx, parsedURL.String(), s.ReplaySpeed)
+		if err != nil {
+			s.Logger.Error("Error opening recording", zap.String("stream_url", parsedURL.String()), zap.Error(err))
+			return nil, fmt.Errorf("failed to open recording: %w", err)
+		}
+
+		return body, nil
+	}
+
+	res, err := s.fetchStream(ctx, parsedURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Body, nil
 }
 
 // validateStreamURL will validate a url.
@@ -122,6 +166,15 @@ func (s *Service) handleStreamData(line string) error {
 		return fmt.Errorf("error parsing JSON: %w", err)
 	}
 
+	if !s.Filter.Allow(rc) {
+		return nil
+	}
+
+	if s.Dedup.Seen(dedup.Key(rc, []byte(jsonData))) {
+		return nil
+	}
+
+	s.Tail.Publish(rc)
 	s.StatsInterface.UpdateStats(rc)
 	time.Sleep(s.SleepTime) // Spam annoying :(
 
@@ -133,30 +186,52 @@ type Producer interface {
 	Produce(ctx context.Context, record *kgo.Record, cb func(*kgo.Record, error))
 }
 
+// ProduceOptions tunes StreamAndProduce.
+type ProduceOptions struct {
+	// MaxInFlight caps records waiting on an ack. Zero or less disables the limit.
+	MaxInFlight int
+	// Recorder, when set, gets a copy of every raw stream line.
+	Recorder LineRecorder
+	// ReplaySpeed paces file:// stream sources, see recording.ParseSpeed.
+	ReplaySpeed float64
+	// Filter, when set, drops events before they are produced.
+	Filter *filter.Filter
+}
+
 // StreamAndProduce reads the wikimedia stream and produces each event to Redpanda.
+//
+// Backpressure note:
+// At most opts.MaxInFlight records may be waiting on an ack. Once that limit is hit we stop
+// reading from Wikimedia until Redpanda catches up, rather than letting the client buffer grow.
+//
+// Cancelling ctx only stops reading. Records are produced without its cancellation, so the
+// ones still buffered survive for the caller's flush on shutdown.
 func StreamAndProduce(
 	ctx context.Context,
 	streamURL string,
 	producer Producer,
 	logger *zap.Logger,
 	metrics *metrics.ProducerMetrics,
+	opts ProduceOptions,
 ) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, streamURL, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create HTTP request: %w", err)
-	}
-
-	resp, err := http.DefaultClient.Do(req)
+	body, err := openProducerStream(ctx, streamURL, opts.ReplaySpeed)
 	if err != nil {
-		return fmt.Errorf("failed to fetch stream from URL %s: %w", streamURL, err)
+		return err
 	}
 
 	defer func() {
-		if err := resp.Body.Close(); err != nil {
+		if err := body.Close(); err != nil {
 			logger.Error("Error closing response body", zap.Error(err))
 		}
 	}()
 
+	produceCtx := context.WithoutCancel(ctx)
+
+	var inFlight chan struct{}
+	if opts.MaxInFlight > 0 {
+		inFlight = make(chan struct{}, opts.MaxInFlight)
+	}
+
 	processFunc := func(line string) error {
 		var rc shared.RecentChange
 		if err := json.Unmarshal([]byte(line[5:]), &rc); err != nil {
@@ -166,6 +241,10 @@ func StreamAndProduce(
 
 		metrics.EventsConsumed.Inc()
 
+		if !opts.Filter.Allow(rc) {
+			return nil
+		}
+
 		pb := &wikimedia.RecentChange{
 			User:      rc.User,
 			Bot:       rc.Bot,
@@ -178,20 +257,116 @@ func StreamAndProduce(
 			return nil
 		}
 
+		// Keying by meta.id lets consumers drop the same edit if it is produced twice.
 		record := &kgo.Record{
 			Value: eventBytes,
 		}
+		if rc.Meta.ID != "" {
+			record.Key = []byte(rc.Meta.ID)
+		}
+
+		if err := acquireInFlight(ctx, inFlight, logger, metrics); err != nil {
+			return err
+		}
+
+		start := time.Now()
+
+		metrics.RecordsInFlight.Inc()
+		producer.Produce(produceCtx, record, func(_ *kgo.Record, err error) {
+			releaseInFlight(inFlight)
+			metrics.RecordsInFlight.Dec()
+			metrics.ProduceLatency.Observe(time.Since(start).Seconds())
 
-		producer.Produce(ctx, record, func(_ *kgo.Record, err error) {
 			if err != nil {
+				metrics.EventsFailed.Inc()
 				logger.Warn("failed to produce to Redpanda", zap.Error(err))
+
+				return
 			}
+
+			metrics.EventsPersisted.Inc()
 		})
 
 		return nil
 	}
 
-	return streamReader(ctx, resp.Body, processFunc)
+	return streamReader(ctx, body, recordLines(opts.Recorder, logger, processFunc))
+}
+
+// openProducerStream opens either a recording for file:// URLs or the live stream.
+func openProducerStream(ctx context.Context, streamURL string, speed float64) (io.ReadCloser, error) {
+	if recording.IsFileURL(streamURL) {
+		body, err := recording.Open(ctx, streamURL, speed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open recording: %w", err)
+		}
+
+		return body, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, streamURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch stream from URL %s: %w", streamURL, err)
+	}
+
+	return resp.Body, nil
+}
+
+// recordLines tees each line to the recorder before processing it. Recording failures are
+// logged and never stop ingestion.
+func recordLines(rec LineRecorder, logger *zap.Logger, processFunc func(line string) error) func(line string) error {
+	if rec == nil {
+		return processFunc
+	}
+
+	return func(line string) error {
+		if err := rec.Record(line); err != nil {
+			logger.Warn("failed to record stream line", zap.Error(err))
+		}
+
+		return processFunc(line)
+	}
+}
+
+// acquireInFlight takes an in-flight slot, blocking the stream reader while none are free.
+func acquireInFlight(
+	ctx context.Context,
+	inFlight chan struct{},
+	logger *zap.Logger,
+	metrics *metrics.ProducerMetrics,
+) error {
+	if inFlight == nil {
+		return nil
+	}
+
+	select {
+	case inFlight <- struct{}{}:
+		return nil
+	default:
+	}
+
+	metrics.BackpressurePauses.Inc()
+	logger.Warn("Too many records in flight, pausing stream", zap.Int("max_in_flight", cap(inFlight)))
+
+	select {
+	case inFlight <- struct{}{}:
+		logger.Info("Records acknowledged, resuming stream")
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for in-flight records: %w", ctx.Err())
+	}
+}
+
+// releaseInFlight frees an in-flight slot once a record is acked or failed.
+func releaseInFlight(inFlight chan struct{}) {
+	if inFlight != nil {
+		<-inFlight
+	}
 }
 
 // streamReader is a helper function that reads a stream and processes each line.
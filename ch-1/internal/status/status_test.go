@@ -2,16 +2,23 @@ package status_test
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/twmb/franz-go/pkg/kgo"
 	"go.uber.org/zap"
 
+	"github.com/codyonesock/backend_learning/ch-1/internal/dedup"
+	"github.com/codyonesock/backend_learning/ch-1/internal/filter"
 	"github.com/codyonesock/backend_learning/ch-1/internal/metrics"
+	"github.com/codyonesock/backend_learning/ch-1/internal/recording"
 	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
 	"github.com/codyonesock/backend_learning/ch-1/internal/status"
 )
@@ -77,6 +84,119 @@ func TestProcessStream(t *testing.T) {
 	}
 }
 
+// TestProcessStreamFromRecording verifies a file:// source is played back through the normal stream path,
+// and that a recorder sees every line.
+func TestProcessStreamFromRecording(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	rec, err := recording.NewRecorder(dir, true, 0, 0)
+	if err != nil {
+		t.Fatalf("failed to create recorder: %v", err)
+	}
+
+	if err := rec.Record("data: {\"user\":\"blub_user\",\"bot\":true,\"server_url\":\"https://blub.com\"}\n"); err != nil {
+		t.Fatalf("failed to record: %v", err)
+	}
+
+	if err := rec.Close(); err != nil {
+		t.Fatalf("failed to close recorder: %v", err)
+	}
+
+	mockStats := &MockStatsInterface{UpdatedChanges: []shared.RecentChange{}}
+	tee := &lineCollector{lines: nil}
+
+	service := status.NewStatusService(zap.NewNop(), mockStats, 0, 5*time.Second)
+	service.ReplaySpeed = recording.MaxSpeed
+	service.Recorder = tee
+
+	if err := service.ProcessStream(t.Context(), "file://"+dir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(mockStats.UpdatedChanges) != 1 || !mockStats.UpdatedChanges[0].Bot {
+		t.Fatalf("expected 1 bot update, got %+v", mockStats.UpdatedChanges)
+	}
+
+	if len(tee.lines) != 1 {
+		t.Errorf("expected the recorder to see 1 line, got %d", len(tee.lines))
+	}
+}
+
+// TestProcessStreamFilter verifies denied events never reach the stats.
+func TestProcessStreamFilter(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "data: {\"user\":\"Blub\",\"bot\":true,\"wiki\":\"enwiki\"}\n"+
+			"data: {\"user\":\"Blub\",\"bot\":false,\"wiki\":\"enwiki\"}\n"+
+			"data: {\"user\":\"Blub\",\"bot\":false,\"wiki\":\"dewiki\"}\n")
+	}))
+	defer server.Close()
+
+	yes := true
+
+	f, err := filter.New(filter.Rules{
+		Default: filter.Deny,
+		Rules: []filter.Rule{
+			{Name: "no-bots", Action: filter.Deny, Bot: &yes},
+			{Name: "enwiki", Action: filter.Allow, Wikis: []string{"enwiki"}},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	mockStats := &MockStatsInterface{UpdatedChanges: []shared.RecentChange{}}
+	service := status.NewStatusService(zap.NewNop(), mockStats, 0, 5*time.Second)
+	service.Filter = f
+
+	if err := service.ProcessStream(t.Context(), server.URL); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(mockStats.UpdatedChanges) != 1 || mockStats.UpdatedChanges[0].Bot || mockStats.UpdatedChanges[0].Wiki != "enwiki" {
+		t.Errorf("expected only the human enwiki edit, got %+v", mockStats.UpdatedChanges)
+	}
+}
+
+// TestProcessStreamDedup verifies an event delivered twice, e.g. after a reconnect, is counted once.
+func TestProcessStreamDedup(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "data: {\"user\":\"Blub\",\"meta\":{\"id\":\"a\"}}\n"+
+			"data: {\"user\":\"Blub\",\"meta\":{\"id\":\"a\"}}\n"+
+			"data: {\"user\":\"Blub\",\"meta\":{\"id\":\"b\"}}\n"+
+			"data: {\"user\":\"NoID\"}\n"+
+			"data: {\"user\":\"NoID\"}\n")
+	}))
+	defer server.Close()
+
+	mockStats := &MockStatsInterface{UpdatedChanges: []shared.RecentChange{}}
+	service := status.NewStatusService(zap.NewNop(), mockStats, 0, 5*time.Second)
+	service.Dedup = dedup.New(dedup.Config{TTL: time.Minute, MaxEntries: 100, BloomBits: 0, BloomHashes: 0}, nil)
+
+	if err := service.ProcessStream(t.Context(), server.URL); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(mockStats.UpdatedChanges) != 3 {
+		t.Errorf("expected 3 unique updates, got %d", len(mockStats.UpdatedChanges))
+	}
+}
+
+// lineCollector is a LineRecorder that keeps lines in memory.
+type lineCollector struct {
+	lines []string
+}
+
+func (c *lineCollector) Record(line string) error {
+	c.lines = append(c.lines, line)
+	return nil
+}
+
 type mockProducer struct {
 	produced [][]byte
 }
@@ -113,13 +233,22 @@ func TestStreamAndProduce(t *testing.T) {
 
 	defer cancel()
 
-	m := metrics.NewProducerMetrics()
+	m := metrics.NewProducerMetrics(prometheus.NewRegistry())
 
-	err := status.StreamAndProduce(ctx, ts.URL, mp, logger, m)
+	err := status.StreamAndProduce(ctx, ts.URL, mp, logger, m, status.ProduceOptions{
+		MaxInFlight: 10,
+		Recorder:    nil,
+		ReplaySpeed: 1,
+		Filter:      nil,
+	})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
+	if got := counterValue(t, m.EventsPersisted); got != 1 {
+		t.Errorf("expected EventsPersisted to be 1, got %v", got)
+	}
+
 	// if len(mp.produced) == 0 {
 	// 	t.Errorf("expected at least one message produced")
 	// }
@@ -136,3 +265,166 @@ func TestStreamAndProduce(t *testing.T) {
 	// 	t.Errorf("expected EventsPersisted to be incremented")
 	// }
 }
+
+// heldProducer keeps produce callbacks around so a test can ack them later.
+type heldProducer struct {
+	mu        sync.Mutex
+	callbacks []func()
+}
+
+func (h *heldProducer) Produce(_ context.Context, record *kgo.Record, cb func(*kgo.Record, error)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.callbacks = append(h.callbacks, func() { cb(record, nil) })
+}
+
+func (h *heldProducer) produced() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.callbacks)
+}
+
+// TestStreamAndProduceBackpressure verifies that reading pauses once
+// maxInFlight records are waiting on an ack.
+func TestStreamAndProduceBackpressure(t *testing.T) {
+	t.Parallel()
+
+	server := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		for range 3 {
+			if _, err := io.WriteString(
+				w,
+				"data: {\"user\":\"blub\",\"bot\":false,\"server_url\":\"https://blub.com\"}\n"); err != nil {
+				t.Errorf("unexpected write error: %v", err)
+			}
+		}
+	})
+	ts := httptest.NewServer(server)
+
+	defer ts.Close()
+
+	hp := &heldProducer{mu: sync.Mutex{}, callbacks: nil}
+	ctx, cancel := context.WithTimeout(t.Context(), 200*time.Millisecond)
+
+	defer cancel()
+
+	m := metrics.NewProducerMetrics(prometheus.NewRegistry())
+
+	err := status.StreamAndProduce(ctx, ts.URL, hp, zap.NewNop(), m, status.ProduceOptions{
+		MaxInFlight: 1,
+		Recorder:    nil,
+		ReplaySpeed: 1,
+		Filter:      nil,
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected stream to block until the deadline, got %v", err)
+	}
+
+	if got := hp.produced(); got != 1 {
+		t.Errorf("expected 1 record produced while paused, got %d", got)
+	}
+
+	if got := counterValue(t, m.BackpressurePauses); got != 1 {
+		t.Errorf("expected 1 backpressure pause, got %v", got)
+	}
+}
+
+// counterValue reads the current value of a counter.
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+
+	var out dto.Metric
+	if err := c.Write(&out); err != nil {
+		t.Fatalf("failed to read counter: %v", err)
+	}
+
+	return out.GetCounter().GetValue()
+}
+
+// bufferedProducer holds records until flush, then fails the ones whose produce ctx was
+// cancelled, like the franz-go client does.
+type bufferedProducer struct {
+	mu      sync.Mutex
+	pending []func()
+}
+
+func (b *bufferedProducer) Produce(ctx context.Context, record *kgo.Record, cb func(*kgo.Record, error)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pending = append(b.pending, func() { cb(record, ctx.Err()) })
+}
+
+func (b *bufferedProducer) buffered() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.pending)
+}
+
+func (b *bufferedProducer) flush() {
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+
+	for _, deliver := range pending {
+		deliver()
+	}
+}
+
+// TestStreamAndProduceShutdown verifies records buffered when the stream is cancelled are
+// still delivered by a flush afterwards.
+func TestStreamAndProduceShutdown(t *testing.T) {
+	t.Parallel()
+
+	server := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for range 2 {
+			if _, err := io.WriteString(
+				w,
+				"data: {\"user\":\"blub\",\"bot\":false,\"server_url\":\"https://blub.com\"}\n"); err != nil {
+				t.Errorf("unexpected write error: %v", err)
+			}
+		}
+
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	ts := httptest.NewServer(server)
+
+	defer ts.Close()
+
+	bp := &bufferedProducer{mu: sync.Mutex{}, pending: nil}
+	ctx, cancel := context.WithCancel(t.Context())
+
+	go func() {
+		for bp.buffered() < 2 {
+			time.Sleep(time.Millisecond)
+		}
+
+		cancel()
+	}()
+
+	m := metrics.NewProducerMetrics(prometheus.NewRegistry())
+
+	err := status.StreamAndProduce(ctx, ts.URL, bp, zap.NewNop(), m, status.ProduceOptions{
+		MaxInFlight: 10,
+		Recorder:    nil,
+		ReplaySpeed: 1,
+		Filter:      nil,
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the stream to stop on cancel, got %v", err)
+	}
+
+	bp.flush()
+
+	if got := counterValue(t, m.EventsPersisted); got != 2 {
+		t.Errorf("expected both buffered records delivered after the flush, got %v", got)
+	}
+
+	if got := counterValue(t, m.EventsFailed); got != 0 {
+		t.Errorf("expected no failed records, got %v", got)
+	}
+}
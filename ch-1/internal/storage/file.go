@@ -0,0 +1,362 @@
+// Package storage - file implementation.
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+)
+
+const (
+	snapshotVersion = 1
+	snapshotPrefix  = "stats-"
+	snapshotExt     = ".json"
+	gzipExt         = ".gz"
+)
+
+var (
+	errChecksumMismatch   = errors.New("checksum mismatch")
+	errUnsupportedVersion = errors.New("unsupported snapshot version")
+	errAllCorrupt         = errors.New("every stats snapshot is corrupt")
+)
+
+// snapshotEnvelope is what a snapshot file holds. The checksum covers Payload as written.
+type snapshotEnvelope struct {
+	Version    int             `json:"version"`
+	Generation uint64          `json:"generation"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Checksum   string          `json:"checksum"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// snapshotPayload spells out the stats fields, shared.Stats hides the maps from JSON.
+type snapshotPayload struct {
+	MessagesConsumed   int            `json:"messages_consumed"`
+	DistinctUsers      map[string]int `json:"distinct_users"`
+	BotsCount          int            `json:"bots_count"`
+	NonBotsCount       int            `json:"non_bots_count"`
+	DistinctServerURLs map[string]int `json:"distinct_server_urls"`
+	// Snapshots from before the per-wiki counts load without them.
+	WikiBots  map[string]int `json:"wiki_bots,omitempty"`
+	WikiUsers map[string]int `json:"wiki_users,omitempty"`
+}
+
+// FileStorage keeps stats as numbered snapshot files in a directory. Each save writes a new
+// generation to a temp file and renames it into place, so a crash never leaves a half
+// written snapshot, and the last Keep generations are kept to fall back on if one is corrupt.
+type FileStorage struct {
+	mu         sync.Mutex
+	Dir        string
+	Compress   bool
+	Keep       int
+	Logger     *zap.Logger
+	generation uint64
+	// HistoryKeep is how many snapshots are kept in the history dir, see DefaultHistoryKeep.
+	HistoryKeep int
+}
+
+// NewFileStorage creates dir and its history dir if needed and picks up the latest generation in it.
+func NewFileStorage(dir string, compress bool, keep int, logger *zap.Logger) (*FileStorage, error) {
+	if err := os.MkdirAll(filepath.Join(dir, historyDir), 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create stats dir: %w", err)
+	}
+
+	f := &FileStorage{
+		mu:         sync.Mutex{},
+		Dir:        dir,
+		Compress:   compress,
+		Keep:       max(keep, 1),
+		Logger:     logger,
+		generation: 0,
+
+		HistoryKeep: DefaultHistoryKeep,
+	}
+
+	gens, err := f.generations()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(gens) > 0 {
+		f.generation = gens[0].generation
+	}
+
+	return f, nil
+}
+
+// SaveStats writes the stats as the next generation and prunes old ones.
+func (f *FileStorage) SaveStats(stats *shared.Stats) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	generation := f.generation + 1
+
+	data, err := f.encode(stats, generation, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if err := writeAtomic(f.Dir, f.fileName(generation), data); err != nil {
+		f.Logger.Error("Failed to save stats snapshot", zap.Error(err))
+		return err
+	}
+
+	f.generation = generation
+	f.prune()
+
+	return nil
+}
+
+// encode wraps the stats in a checksummed envelope, compressed if configured.
+func (f *FileStorage) encode(stats *shared.Stats, generation uint64, at time.Time) ([]byte, error) {
+	payload, err := json.Marshal(snapshotPayload{
+		MessagesConsumed:   stats.MessagesConsumed,
+		DistinctUsers:      stats.DistinctUsers,
+		BotsCount:          stats.BotsCount,
+		NonBotsCount:       stats.NonBotsCount,
+		DistinctServerURLs: stats.DistinctServerURLs,
+		WikiBots:           stats.WikiBots,
+		WikiUsers:          stats.WikiUsers,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal stats: %w", err)
+	}
+
+	sum := sha256.Sum256(payload)
+	env := snapshotEnvelope{
+		Version:    snapshotVersion,
+		Generation: generation,
+		CreatedAt:  at.UTC(),
+		Checksum:   hex.EncodeToString(sum[:]),
+		Payload:    payload,
+	}
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+
+	if f.Compress {
+		return gzipBytes(data)
+	}
+
+	return data, nil
+}
+
+// LoadStats returns the newest snapshot that passes its checks, falling back to older
+// generations when one is corrupt. An empty dir loads empty stats.
+func (f *FileStorage) LoadStats() (*shared.Stats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	gens, err := f.generations()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(gens) == 0 {
+		return shared.NewStats(), nil
+	}
+
+	for _, g := range gens {
+		stats, err := readSnapshot(filepath.Join(f.Dir, g.name))
+		if err != nil {
+			f.Logger.Warn("Skipping corrupt stats snapshot", zap.String("file", g.name), zap.Error(err))
+			continue
+		}
+
+		f.Logger.Info("Stats loaded from file", zap.String("file", g.name))
+
+		return stats, nil
+	}
+
+	return nil, fmt.Errorf("%w in %s", errAllCorrupt, f.Dir)
+}
+
+type generationFile struct {
+	generation uint64
+	name       string
+}
+
+// generations lists snapshot files, newest first.
+func (f *FileStorage) generations() ([]generationFile, error) {
+	entries, err := os.ReadDir(f.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list stats dir: %w", err)
+	}
+
+	var gens []generationFile
+
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, snapshotPrefix) {
+			continue
+		}
+
+		num := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), gzipExt), snapshotExt)
+
+		g, err := strconv.ParseUint(num, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		gens = append(gens, generationFile{generation: g, name: name})
+	}
+
+	slices.SortFunc(gens, func(a, b generationFile) int {
+		switch {
+		case a.generation > b.generation:
+			return -1
+		case a.generation < b.generation:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	return gens, nil
+}
+
+// prune removes all but the newest Keep generations. Failures are only logged.
+func (f *FileStorage) prune() {
+	gens, err := f.generations()
+	if err != nil {
+		f.Logger.Warn("Failed to list old stats snapshots", zap.Error(err))
+		return
+	}
+
+	for _, g := range gens[min(f.Keep, len(gens)):] {
+		if err := os.Remove(filepath.Join(f.Dir, g.name)); err != nil {
+			f.Logger.Warn("Failed to remove old stats snapshot", zap.String("file", g.name), zap.Error(err))
+		}
+	}
+}
+
+func (f *FileStorage) fileName(generation uint64) string {
+	name := fmt.Sprintf("%s%020d%s", snapshotPrefix, generation, snapshotExt)
+	if f.Compress {
+		name += gzipExt
+	}
+
+	return name
+}
+
+// readSnapshot reads and verifies one snapshot file.
+func readSnapshot(path string) (*shared.Stats, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- path comes from listing the stats dir
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	if strings.HasSuffix(path, gzipExt) {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open gzip snapshot: %w", err)
+		}
+
+		if data, err = io.ReadAll(zr); err != nil {
+			return nil, fmt.Errorf("failed to decompress snapshot: %w", err)
+		}
+	}
+
+	var env snapshotEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot: %w", err)
+	}
+
+	if env.Version != snapshotVersion {
+		return nil, fmt.Errorf("%w: %d", errUnsupportedVersion, env.Version)
+	}
+
+	sum := sha256.Sum256(env.Payload)
+	if hex.EncodeToString(sum[:]) != env.Checksum {
+		return nil, errChecksumMismatch
+	}
+
+	var p snapshotPayload
+	if err := json.Unmarshal(env.Payload, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot payload: %w", err)
+	}
+
+	stats := &shared.Stats{
+		MessagesConsumed:   p.MessagesConsumed,
+		DistinctUsers:      p.DistinctUsers,
+		BotsCount:          p.BotsCount,
+		NonBotsCount:       p.NonBotsCount,
+		DistinctServerURLs: p.DistinctServerURLs,
+		WikiBots:           p.WikiBots,
+		WikiUsers:          p.WikiUsers,
+	}
+	fillMaps(stats)
+
+	return stats, nil
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to compress snapshot: %w", err)
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress snapshot: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writeAtomic writes data to a temp file in dir, syncs it and renames it to name.
+func writeAtomic(dir, name string, data []byte) error {
+	tmp, err := os.CreateTemp(dir, ".tmp-"+name+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp snapshot: %w", err)
+	}
+
+	defer func() {
+		_ = os.Remove(tmp.Name()) // no-op once renamed
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write temp snapshot: %w", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to sync temp snapshot: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp snapshot: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		return fmt.Errorf("failed to rename snapshot into place: %w", err)
+	}
+
+	// Sync the dir so the rename itself survives a crash.
+	if d, err := os.Open(dir); err == nil { // #nosec G304 -- dir comes from config
+		_ = d.Sync()
+		_ = d.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,132 @@
+// Package storage - file snapshot history.
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+)
+
+const (
+	historyDir     = "history"
+	historyPrefix  = "snapshot-"
+	historyPattern = "snapshot-%s.json"
+)
+
+// SaveSnapshot writes the stats to the history dir and prunes it to HistoryKeep.
+func (f *FileStorage) SaveSnapshot(stats *shared.Stats, at time.Time) (SnapshotInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	infos, err := f.history()
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	info := snapshotInfo(at)
+
+	// IDs are milliseconds, keep them unique and in order when snapshots come faster.
+	if len(infos) > 0 && !info.CreatedAt.After(infos[0].CreatedAt) {
+		info = snapshotInfo(infos[0].CreatedAt.Add(time.Millisecond))
+	}
+
+	data, err := f.encode(stats, uint64(info.CreatedAt.UnixMilli()), info.CreatedAt) // #nosec G115 -- snapshot times are after 1970
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	if err := writeAtomic(filepath.Join(f.Dir, historyDir), f.historyName(info.ID), data); err != nil {
+		f.Logger.Error("Failed to save stats history snapshot", zap.Error(err))
+		return SnapshotInfo{}, err
+	}
+
+	kept := append([]SnapshotInfo{info}, infos...)
+	for _, old := range kept[min(max(f.HistoryKeep, 1), len(kept)):] {
+		if err := os.Remove(f.historyPath(old.ID)); err != nil {
+			f.Logger.Warn("Failed to remove old stats history snapshot", zap.String("id", old.ID), zap.Error(err))
+		}
+	}
+
+	return info, nil
+}
+
+// ListSnapshots returns the kept snapshots, newest first.
+func (f *FileStorage) ListSnapshots() ([]SnapshotInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.history()
+}
+
+// LoadSnapshot reads and verifies one kept snapshot.
+func (f *FileStorage) LoadSnapshot(id string) (*shared.Stats, error) {
+	if _, err := ParseSnapshotID(id); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := f.historyPath(id)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrSnapshotNotFound, id)
+	}
+
+	return readSnapshot(path)
+}
+
+// history lists the history dir, newest first. Times come from the file names.
+func (f *FileStorage) history() ([]SnapshotInfo, error) {
+	entries, err := os.ReadDir(filepath.Join(f.Dir, historyDir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list stats history: %w", err)
+	}
+
+	infos := make([]SnapshotInfo, 0, len(entries))
+
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, historyPrefix) {
+			continue
+		}
+
+		id := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(name, historyPrefix), gzipExt), snapshotExt)
+
+		ms, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		infos = append(infos, SnapshotInfo{ID: id, CreatedAt: time.UnixMilli(ms).UTC()})
+	}
+
+	newestFirst(infos)
+
+	return infos, nil
+}
+
+// historyPath finds a snapshot whether or not it was compressed.
+func (f *FileStorage) historyPath(id string) string {
+	plain := filepath.Join(f.Dir, historyDir, fmt.Sprintf(historyPattern, id))
+	if _, err := os.Stat(plain + gzipExt); err == nil {
+		return plain + gzipExt
+	}
+
+	return plain
+}
+
+func (f *FileStorage) historyName(id string) string {
+	name := fmt.Sprintf(historyPattern, id)
+	if f.Compress {
+		name += gzipExt
+	}
+
+	return name
+}
@@ -0,0 +1,248 @@
+package storage_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+	"github.com/codyonesock/backend_learning/ch-1/internal/storage"
+	"github.com/codyonesock/backend_learning/ch-1/internal/storage/storagetest"
+)
+
+func statsWith(messages int) *shared.Stats {
+	s := shared.NewStats()
+	s.MessagesConsumed = messages
+	s.NonBotsCount = messages
+	s.DistinctUsers["blub"] = messages
+	s.DistinctServerURLs["https://blub.com"] = messages
+
+	return s
+}
+
+func snapshots(t *testing.T, dir string) []string {
+	t.Helper()
+
+	matches, err := filepath.Glob(filepath.Join(dir, "stats-*"))
+	if err != nil {
+		t.Fatalf("failed to list snapshots: %v", err)
+	}
+
+	return matches
+}
+
+// TestFileStorageRoundTrip verifies saves survive a restart and only Keep generations remain.
+func TestFileStorageRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	for _, compress := range []bool{false, true} {
+		dir := t.TempDir()
+
+		fs, err := storage.NewFileStorage(dir, compress, 2, zap.NewNop())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		empty, err := fs.LoadStats()
+		if err != nil || empty.MessagesConsumed != 0 || empty.DistinctUsers == nil {
+			t.Fatalf("expected empty stats from an empty dir, got %+v, %v", empty, err)
+		}
+
+		for i := 1; i <= 3; i++ {
+			if err := fs.SaveStats(statsWith(i)); err != nil {
+				t.Fatalf("failed to save: %v", err)
+			}
+		}
+
+		files := snapshots(t, dir)
+		if len(files) != 2 {
+			t.Errorf("expected 2 generations kept, got %v", files)
+		}
+
+		if compress && !strings.HasSuffix(files[0], ".gz") {
+			t.Errorf("expected compressed snapshots, got %v", files)
+		}
+
+		reopened, err := storage.NewFileStorage(dir, compress, 2, zap.NewNop())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		loaded, err := reopened.LoadStats()
+		if err != nil {
+			t.Fatalf("failed to load: %v", err)
+		}
+
+		if loaded.MessagesConsumed != 3 || loaded.DistinctUsers["blub"] != 3 || loaded.DistinctServerURLs["https://blub.com"] != 3 {
+			t.Errorf("expected the latest generation, got %+v", loaded)
+		}
+
+		if err := reopened.SaveStats(statsWith(4)); err != nil {
+			t.Fatalf("failed to save: %v", err)
+		}
+
+		if files := snapshots(t, dir); !strings.Contains(files[len(files)-1], "00000000000000000004") {
+			t.Errorf("expected the reopened storage to continue at generation 4, got %v", files)
+		}
+	}
+}
+
+// TestFileStorageCorruption verifies a corrupt newest snapshot falls back to the one before,
+// and that a dir of only corrupt snapshots is an error instead of empty stats.
+func TestFileStorageCorruption(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	fs, err := storage.NewFileStorage(dir, false, 3, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		if err := fs.SaveStats(statsWith(i)); err != nil {
+			t.Fatalf("failed to save: %v", err)
+		}
+	}
+
+	files := snapshots(t, dir)
+	newest := files[len(files)-1]
+
+	data, err := os.ReadFile(newest)
+	if err != nil {
+		t.Fatalf("failed to read snapshot: %v", err)
+	}
+
+	// Flip a count inside the payload so the JSON still parses but the checksum does not match.
+	tampered := strings.Replace(string(data), `"messages_consumed":2`, `"messages_consumed":9`, 1)
+	if tampered == string(data) {
+		t.Fatal("failed to tamper with the snapshot")
+	}
+
+	if err := os.WriteFile(newest, []byte(tampered), 0o600); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+
+	loaded, err := fs.LoadStats()
+	if err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+
+	if loaded.MessagesConsumed != 1 {
+		t.Errorf("expected to fall back to generation 1, got %+v", loaded)
+	}
+
+	if err := os.WriteFile(files[0], []byte("{not json"), 0o600); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+
+	if _, err := fs.LoadStats(); err == nil {
+		t.Error("expected an error when every snapshot is corrupt")
+	}
+}
+
+func TestFileStorageConformance(t *testing.T) {
+	t.Parallel()
+
+	for _, compress := range []bool{false, true} {
+		newStorage := func(t *testing.T) storage.Storage {
+			t.Helper()
+
+			fs, err := storage.NewFileStorage(t.TempDir(), compress, 3, zap.NewNop())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			return fs
+		}
+
+		// A file where the dir should be makes every read and write fail.
+		broken := func(t *testing.T) storage.Storage {
+			t.Helper()
+
+			dir := filepath.Join(t.TempDir(), "stats")
+
+			fs, err := storage.NewFileStorage(dir, compress, 3, zap.NewNop())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if err := os.RemoveAll(dir); err != nil {
+				t.Fatalf("failed to remove dir: %v", err)
+			}
+
+			if err := os.WriteFile(dir, nil, 0o600); err != nil {
+				t.Fatalf("failed to write file: %v", err)
+			}
+
+			return fs
+		}
+
+		t.Run(fmt.Sprintf("gzip=%v", compress), func(t *testing.T) {
+			t.Parallel()
+			storagetest.Run(t, newStorage, storagetest.Options{SingleWriter: false, Broken: broken, LargeMapSize: 0})
+		})
+	}
+}
+
+func TestFileStorageSnapshots(t *testing.T) {
+	t.Parallel()
+
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("gzip=%v", compress), func(t *testing.T) {
+			t.Parallel()
+
+			storagetest.RunSnapshots(t, func(t *testing.T) storage.SnapshotStorage {
+				t.Helper()
+
+				fs, err := storage.NewFileStorage(t.TempDir(), compress, 3, zap.NewNop())
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				return fs
+			})
+		})
+	}
+}
+
+// TestFileStorageHistoryKeep verifies the history is pruned separately from the stats generations.
+func TestFileStorageHistoryKeep(t *testing.T) {
+	t.Parallel()
+
+	fs, err := storage.NewFileStorage(t.TempDir(), false, 1, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	fs.HistoryKeep = 2
+
+	for i := 1; i <= 4; i++ {
+		if _, err := fs.SaveSnapshot(statsWith(i), time.Now().Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatalf("failed to save snapshot: %v", err)
+		}
+
+		if err := fs.SaveStats(statsWith(i)); err != nil {
+			t.Fatalf("failed to save: %v", err)
+		}
+	}
+
+	infos, err := fs.ListSnapshots()
+	if err != nil || len(infos) != 2 {
+		t.Fatalf("expected 2 snapshots kept, got %v, %v", infos, err)
+	}
+
+	latest, err := fs.LoadSnapshot(infos[0].ID)
+	if err != nil || latest.MessagesConsumed != 4 {
+		t.Errorf("expected the newest snapshot, got %+v, %v", latest, err)
+	}
+
+	if loaded, err := fs.LoadStats(); err != nil || loaded.MessagesConsumed != 4 {
+		t.Errorf("expected the snapshots not to disturb the stats, got %+v, %v", loaded, err)
+	}
+}
@@ -2,45 +2,99 @@
 package storage
 
 import (
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
 )
 
+type memorySnapshot struct {
+	info  SnapshotInfo
+	stats *shared.Stats
+}
+
 // MemoryStorage is an in-memory implementation of the Storage interface.
 type MemoryStorage struct {
-	mu    sync.Mutex
-	stats *shared.Stats
+	mu      sync.Mutex
+	stats   *shared.Stats
+	history []memorySnapshot
+	// HistoryKeep is how many snapshots are kept, see DefaultHistoryKeep.
+	HistoryKeep int
 }
 
 // NewMemoryStorage creates a new MemoryStorage instance.
 func NewMemoryStorage() *MemoryStorage {
 	return &MemoryStorage{
-		mu: sync.Mutex{},
-		stats: &shared.Stats{
-			MessagesConsumed:   0,
-			DistinctUsers:      map[string]int{},
-			BotsCount:          0,
-			NonBotsCount:       0,
-			DistinctServerURLs: map[string]int{},
-		},
+		mu:          sync.Mutex{},
+		stats:       shared.NewStats(),
+		history:     nil,
+		HistoryKeep: DefaultHistoryKeep,
 	}
 }
 
-// SaveStats saves stats data in memory.
+// SaveStats saves a copy of the stats in memory, so later changes by the caller don't leak in.
 func (m *MemoryStorage) SaveStats(stat *shared.Stats) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	m.stats = stat
+	m.stats = stat.Clone()
 
 	return nil
 }
 
-// LoadStats loads stats data from memory.
+// LoadStats returns a copy of the stats saved in memory.
 func (m *MemoryStorage) LoadStats() (*shared.Stats, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	return m.stats, nil
+	return m.stats.Clone(), nil
+}
+
+// SaveSnapshot keeps a copy of the stats in the history, dropping the oldest past HistoryKeep.
+func (m *MemoryStorage) SaveSnapshot(stats *shared.Stats, at time.Time) (SnapshotInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	info := snapshotInfo(at)
+
+	// IDs are milliseconds, keep them unique and in order when snapshots come faster.
+	if n := len(m.history); n > 0 && !info.CreatedAt.After(m.history[n-1].info.CreatedAt) {
+		info = snapshotInfo(m.history[n-1].info.CreatedAt.Add(time.Millisecond))
+	}
+
+	m.history = append(m.history, memorySnapshot{info: info, stats: stats.Clone()})
+
+	if over := len(m.history) - max(m.HistoryKeep, 1); over > 0 {
+		m.history = append([]memorySnapshot(nil), m.history[over:]...)
+	}
+
+	return info, nil
+}
+
+// ListSnapshots returns the kept snapshots, newest first.
+func (m *MemoryStorage) ListSnapshots() ([]SnapshotInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	infos := make([]SnapshotInfo, 0, len(m.history))
+	for i := len(m.history) - 1; i >= 0; i-- {
+		infos = append(infos, m.history[i].info)
+	}
+
+	return infos, nil
+}
+
+// LoadSnapshot returns a copy of one kept snapshot.
+func (m *MemoryStorage) LoadSnapshot(id string) (*shared.Stats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range m.history {
+		if s.info.ID == id {
+			return s.stats.Clone(), nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrSnapshotNotFound, id)
 }
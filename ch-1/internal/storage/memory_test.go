@@ -0,0 +1,24 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/storage"
+	"github.com/codyonesock/backend_learning/ch-1/internal/storage/storagetest"
+)
+
+func TestMemoryStorageConformance(t *testing.T) {
+	t.Parallel()
+
+	storagetest.Run(t, func(_ *testing.T) storage.Storage {
+		return storage.NewMemoryStorage()
+	}, storagetest.Options{SingleWriter: false, Broken: nil, LargeMapSize: 0})
+}
+
+func TestMemoryStorageSnapshots(t *testing.T) {
+	t.Parallel()
+
+	storagetest.RunSnapshots(t, func(_ *testing.T) storage.SnapshotStorage {
+		return storage.NewMemoryStorage()
+	})
+}
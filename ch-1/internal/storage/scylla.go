@@ -2,6 +2,7 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
@@ -11,7 +12,16 @@ import (
 	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
 )
 
-// ScyllaStorage handles dependencies and config.
+// statsRowID is the single row stats are written to, so deltas can update it in place.
+var statsRowID = gocql.UUID{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}
+
+// ScyllaStorage handles dependencies and config. Stats live in one row of the stats table,
+// apart from the per wiki users, which get a row each in stats_wiki_users:
+//
+//	CREATE TABLE stats_wiki_users (
+//	  server_url text, username text, edits int,
+//	  PRIMARY KEY (server_url, username)
+//	);
 type ScyllaStorage struct {
 	Session *gocql.Session
 	Logger  *zap.Logger
@@ -57,13 +67,42 @@ func NewScyllaStorage(hosts []string, keyspace string, logger *zap.Logger) (*Scy
 	}, nil
 }
 
-// SaveStats saves stats data.
+// Close closes the session.
+func (s *ScyllaStorage) Close() {
+	s.Session.Close()
+}
+
+func (s *ScyllaStorage) wikiUsers() wikiUserTable {
+	return wikiUserTable{session: s.Session, table: "stats_wiki_users", keys: nil, values: nil}
+}
+
+// SaveStats overwrites the stats row and the per wiki users with the full stats.
 func (s *ScyllaStorage) SaveStats(data *shared.Stats) error {
-	query := `INSERT INTO stats (id, messages_consumed, distinct_users, bots_count, non_bots_count, distinct_server_urls)
-                VALUES (?, ?, ?, ?, ?, ?)`
+	query := `INSERT INTO stats
+                (id, messages_consumed, distinct_users, bots_count, non_bots_count, distinct_server_urls, wiki_bots)
+                VALUES (?, ?, ?, ?, ?, ?, ?)`
 
-	id := gocql.TimeUUID()
-	err := s.Session.Query(
+	// Clear the stored wikis first, so users missing from data don't linger.
+	var stored map[string]int
+
+	err := s.Session.Query(`SELECT distinct_server_urls FROM stats WHERE id = ?`, statsRowID).Scan(&stored)
+	if err != nil && !errors.Is(err, gocql.ErrNotFound) {
+		s.Logger.Error("Failed to save stats to Scylla", zap.Error(err))
+		return fmt.Errorf("failed to read the stored server urls: %w", err)
+	}
+
+	if err := s.wikiUsers().clear(stored); err != nil {
+		s.Logger.Error("Failed to save stats to Scylla", zap.Error(err))
+		return err
+	}
+
+	if err := s.wikiUsers().save(data.WikiUsers); err != nil {
+		s.Logger.Error("Failed to save stats to Scylla", zap.Error(err))
+		return err
+	}
+
+	id := statsRowID
+	err = s.Session.Query(
 		query,
 		id,
 		data.MessagesConsumed,
@@ -71,6 +110,7 @@ func (s *ScyllaStorage) SaveStats(data *shared.Stats) error {
 		data.BotsCount,
 		data.NonBotsCount,
 		data.DistinctServerURLs,
+		data.WikiBots,
 	).Exec()
 
 	if err != nil {
@@ -83,6 +123,46 @@ func (s *ScyllaStorage) SaveStats(data *shared.Stats) error {
 	return nil
 }
 
+// SaveDelta sets the counters and merges only the changed map entries into the stats row,
+// and upserts the changed per wiki users.
+func (s *ScyllaStorage) SaveDelta(delta *Delta) error {
+	query := `UPDATE stats SET
+                messages_consumed = ?,
+                bots_count = ?,
+                non_bots_count = ?,
+                distinct_users = distinct_users + ?,
+                distinct_server_urls = distinct_server_urls + ?,
+                wiki_bots = wiki_bots + ?
+              WHERE id = ?`
+
+	if err := s.wikiUsers().save(delta.WikiUsers); err != nil {
+		s.Logger.Error("Failed to save stats delta to Scylla", zap.Error(err))
+		return err
+	}
+
+	err := s.Session.Query(
+		query,
+		delta.MessagesConsumed,
+		delta.BotsCount,
+		delta.NonBotsCount,
+		delta.DistinctUsers,
+		delta.DistinctServerURLs,
+		delta.WikiBots,
+		statsRowID,
+	).Exec()
+	if err != nil {
+		s.Logger.Error("Failed to save stats delta to Scylla", zap.Error(err))
+		return fmt.Errorf("failed to execute query to save stats delta: %w", err)
+	}
+
+	s.Logger.Debug("Stats delta saved to Scylla",
+		zap.Int("users", len(delta.DistinctUsers)),
+		zap.Int("server_urls", len(delta.DistinctServerURLs)),
+	)
+
+	return nil
+}
+
 // LoadStats returns stats.
 func (s *ScyllaStorage) LoadStats() (*shared.Stats, error) {
 	query := `SELECT
@@ -90,7 +170,18 @@ func (s *ScyllaStorage) LoadStats() (*shared.Stats, error) {
 							distinct_users,
 							bots_count,
 							non_bots_count,
-							distinct_server_urls
+							distinct_server_urls,
+							wiki_bots
+						FROM stats WHERE id = ?`
+
+	// Rows written before stats lived in a single row used random IDs.
+	const legacyQuery = `SELECT
+							messages_consumed,
+							distinct_users,
+							bots_count,
+							non_bots_count,
+							distinct_server_urls,
+							wiki_bots
 						FROM stats LIMIT 1`
 
 	stats := &shared.Stats{
@@ -99,21 +190,31 @@ func (s *ScyllaStorage) LoadStats() (*shared.Stats, error) {
 		BotsCount:          0,
 		NonBotsCount:       0,
 		DistinctServerURLs: make(map[string]int),
+		WikiBots:           make(map[string]int),
+		WikiUsers:          make(map[string]int),
+	}
+	scan := func(q *gocql.Query) error {
+		return q.Scan(
+			&stats.MessagesConsumed,
+			&stats.DistinctUsers,
+			&stats.BotsCount,
+			&stats.NonBotsCount,
+			&stats.DistinctServerURLs,
+			&stats.WikiBots,
+		)
 	}
-	err := s.Session.Query(query).Scan(
-		&stats.MessagesConsumed,
-		&stats.DistinctUsers,
-		&stats.BotsCount,
-		&stats.NonBotsCount,
-		&stats.DistinctServerURLs,
-	)
 
-	if stats.DistinctUsers == nil {
-		stats.DistinctUsers = make(map[string]int)
+	err := scan(s.Session.Query(query, statsRowID))
+	if errors.Is(err, gocql.ErrNotFound) {
+		err = scan(s.Session.Query(legacyQuery))
 	}
 
-	if stats.DistinctServerURLs == nil {
-		stats.DistinctServerURLs = make(map[string]int)
+	fillMaps(stats)
+
+	// Nothing saved yet is empty stats, like the other backends.
+	if errors.Is(err, gocql.ErrNotFound) {
+		s.Logger.Info("No stats in Scylla yet")
+		return stats, nil
 	}
 
 	if err != nil {
@@ -121,6 +222,11 @@ func (s *ScyllaStorage) LoadStats() (*shared.Stats, error) {
 		return nil, fmt.Errorf("failed to scan query result: %w", err)
 	}
 
+	if err := s.wikiUsers().load(stats.DistinctServerURLs, stats.WikiUsers); err != nil {
+		s.Logger.Error("Failed to load stats from Scylla", zap.Error(err))
+		return nil, err
+	}
+
 	s.Logger.Info("Stats loaded from Scylla")
 
 	return stats, nil
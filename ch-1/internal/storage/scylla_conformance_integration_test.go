@@ -0,0 +1,173 @@
+//go:build integration
+// +build integration
+
+package storage_test
+
+import (
+	"os"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/storage"
+	"github.com/codyonesock/backend_learning/ch-1/internal/storage/storagetest"
+)
+
+var scyllaHosts = []string{"localhost:9042"}
+
+const scyllaKeyspace = "stats_data"
+
+// The conformance tests share tables, so they don't run in parallel.
+
+func skipWithoutScylla(t *testing.T) {
+	t.Helper()
+
+	if os.Getenv("INTEGRATION") != "1" {
+		t.Skip("skipping integration test; set INTEGRATION=1 to run")
+	}
+}
+
+func TestScyllaStorageConformance(t *testing.T) { //nolint:paralleltest // shares the stats table
+	skipWithoutScylla(t)
+
+	connect := func(t *testing.T) *storage.ScyllaStorage {
+		t.Helper()
+
+		s, err := storage.NewScyllaStorage(scyllaHosts, scyllaKeyspace, zap.NewNop())
+		if err != nil {
+			t.Fatalf("failed to connect to Scylla: %v", err)
+		}
+
+		return s
+	}
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		t.Helper()
+
+		s := connect(t)
+		t.Cleanup(s.Close)
+
+		for _, table := range []string{"stats", "stats_wiki_users"} {
+			if err := s.Session.Query("TRUNCATE " + table).Exec(); err != nil {
+				t.Fatalf("failed to truncate %s: %v", table, err)
+			}
+		}
+
+		return s
+	}, storagetest.Options{
+		SingleWriter: false,
+		Broken: func(t *testing.T) storage.Storage {
+			t.Helper()
+
+			s := connect(t)
+			s.Close()
+
+			return s
+		},
+		LargeMapSize: 0,
+	})
+}
+
+func TestScyllaCounterStorageConformance(t *testing.T) { //nolint:paralleltest // shares the counter tables
+	skipWithoutScylla(t)
+
+	connect := func(t *testing.T) *storage.ScyllaCounterStorage {
+		t.Helper()
+
+		s, err := storage.NewScyllaCounterStorage(scyllaHosts, scyllaKeyspace, zap.NewNop())
+		if err != nil {
+			t.Fatalf("failed to connect to Scylla: %v", err)
+		}
+
+		return s
+	}
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		t.Helper()
+
+		s := connect(t)
+		t.Cleanup(s.Close)
+
+		for _, table := range []string{"stats_totals", "stats_user_counts", "stats_server_url_counts"} {
+			if err := s.Session.Query("TRUNCATE " + table).Exec(); err != nil {
+				t.Fatalf("failed to truncate %s: %v", table, err)
+			}
+		}
+
+		return s
+	}, storagetest.Options{
+		// SaveStats reads then adds the difference, and loads read three tables.
+		SingleWriter: true,
+		Broken: func(t *testing.T) storage.Storage {
+			t.Helper()
+
+			s := connect(t)
+			s.Close()
+
+			return s
+		},
+		LargeMapSize: 0,
+	})
+}
+
+func TestScyllaShardStorageConformance(t *testing.T) { //nolint:paralleltest // shares the stats_shards table
+	skipWithoutScylla(t)
+
+	connect := func(t *testing.T) *storage.ScyllaShardStorage {
+		t.Helper()
+
+		s, err := storage.NewScyllaShardStorage(scyllaHosts, scyllaKeyspace, "conformance", zap.NewNop())
+		if err != nil {
+			t.Fatalf("failed to connect to Scylla: %v", err)
+		}
+
+		return s
+	}
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		t.Helper()
+
+		s := connect(t)
+		t.Cleanup(s.Close)
+
+		for _, table := range []string{"stats_shards", "stats_shard_wiki_users"} {
+			if err := s.Session.Query("TRUNCATE " + table).Exec(); err != nil {
+				t.Fatalf("failed to truncate %s: %v", table, err)
+			}
+		}
+
+		return s
+	}, storagetest.Options{
+		SingleWriter: false,
+		Broken: func(t *testing.T) storage.Storage {
+			t.Helper()
+
+			s := connect(t)
+			s.Close()
+
+			return s
+		},
+		LargeMapSize: 0,
+	})
+}
+
+func TestScyllaSnapshotStorageConformance(t *testing.T) { //nolint:paralleltest // shares the stats_snapshots table
+	skipWithoutScylla(t)
+
+	storagetest.RunSnapshots(t, func(t *testing.T) storage.SnapshotStorage {
+		t.Helper()
+
+		s, err := storage.NewScyllaStorage(scyllaHosts, scyllaKeyspace, zap.NewNop())
+		if err != nil {
+			t.Fatalf("failed to connect to Scylla: %v", err)
+		}
+
+		t.Cleanup(s.Close)
+
+		if err := s.Session.Query("TRUNCATE stats_snapshots").Exec(); err != nil {
+			t.Fatalf("failed to truncate stats_snapshots: %v", err)
+		}
+
+		return storage.NewScyllaSnapshotStorage(s.Session, 0, zap.NewNop())
+	})
+}
@@ -0,0 +1,277 @@
+// Package storage - scylla counter table implementation.
+package storage
+
+import (
+	"fmt"
+
+	"github.com/gocql/gocql"
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+)
+
+// Names of the rows in stats_totals.
+const (
+	totalMessages = "messages_consumed"
+	totalBots     = "bots_count"
+	totalNonBots  = "non_bots_count"
+)
+
+// counterBatchSize keeps counter batches well under Scylla's batch size warning.
+const counterBatchSize = 200
+
+// ScyllaCounterStorage keeps stats in counter tables, so any number of consumers can add
+// their batches to the same store without overwriting each other.
+//
+// Schema:
+//
+//	CREATE TABLE stats_totals (name text PRIMARY KEY, value counter);
+//	CREATE TABLE stats_user_counts (username text PRIMARY KEY, edits counter);
+//	CREATE TABLE stats_server_url_counts (server_url text PRIMARY KEY, edits counter);
+//	CREATE TABLE stats_wiki_bot_counts (server_url text PRIMARY KEY, edits counter);
+//	CREATE TABLE stats_wiki_user_counts (wiki_user text PRIMARY KEY, edits counter);
+type ScyllaCounterStorage struct {
+	Session *gocql.Session
+	Logger  *zap.Logger
+}
+
+// NewScyllaCounterStorage connects like NewScyllaStorage but stores stats in counter tables.
+func NewScyllaCounterStorage(hosts []string, keyspace string, logger *zap.Logger) (*ScyllaCounterStorage, error) {
+	s, err := NewScyllaStorage(hosts, keyspace, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ScyllaCounterStorage{
+		Session: s.Session,
+		Logger:  logger,
+	}, nil
+}
+
+// SaveIncrements adds the increments to the counters, counterBatchSize at a time. Counter
+// batches aren't idempotent, so when one fails the ones already applied are returned in a
+// *PartialIncrementsError for the retry to leave out. The failed batch itself may still have
+// landed, e.g. on a timeout, and is then counted twice by the retry.
+func (s *ScyllaCounterStorage) SaveIncrements(inc *Increments) error {
+	var (
+		batch   = s.Session.NewBatch(gocql.CounterBatch)
+		chunk   = NewIncrements()
+		applied = NewIncrements()
+		batches int
+	)
+
+	flush := func() error {
+		if batch.Size() == 0 {
+			return nil
+		}
+
+		if err := s.Session.ExecuteBatch(batch); err != nil {
+			err = fmt.Errorf("failed to execute counter batch: %w", err)
+			if batches == 0 {
+				return err
+			}
+
+			return &PartialIncrementsError{Applied: applied, Err: err}
+		}
+
+		applied.Add(chunk)
+		batches++
+		batch, chunk = s.Session.NewBatch(gocql.CounterBatch), NewIncrements()
+
+		return nil
+	}
+
+	// add queues one counter update, record notes it in chunk so it counts as applied once
+	// its batch is.
+	add := func(record func(*Increments), stmt string, args ...any) error {
+		batch.Query(stmt, args...)
+		record(chunk)
+
+		if batch.Size() >= counterBatchSize {
+			return flush()
+		}
+
+		return nil
+	}
+
+	const (
+		totalsStmt   = `UPDATE stats_totals SET value = value + ? WHERE name = ?`
+		usersStmt    = `UPDATE stats_user_counts SET edits = edits + ? WHERE username = ?`
+		serverStmt   = `UPDATE stats_server_url_counts SET edits = edits + ? WHERE server_url = ?`
+		wikiBotStmt  = `UPDATE stats_wiki_bot_counts SET edits = edits + ? WHERE server_url = ?`
+		wikiUserStmt = `UPDATE stats_wiki_user_counts SET edits = edits + ? WHERE wiki_user = ?`
+	)
+
+	totals := []struct {
+		name  string
+		value int
+		field func(*Increments) *int
+	}{
+		{totalMessages, inc.MessagesConsumed, func(c *Increments) *int { return &c.MessagesConsumed }},
+		{totalBots, inc.BotsCount, func(c *Increments) *int { return &c.BotsCount }},
+		{totalNonBots, inc.NonBotsCount, func(c *Increments) *int { return &c.NonBotsCount }},
+	}
+
+	for _, total := range totals {
+		if total.value == 0 {
+			continue
+		}
+
+		record := func(c *Increments) { *total.field(c) += total.value }
+		if err := add(record, totalsStmt, int64(total.value), total.name); err != nil {
+			return s.fail(err)
+		}
+	}
+
+	counts := []struct {
+		stmt   string
+		values map[string]int
+		field  func(*Increments) map[string]int
+	}{
+		{usersStmt, inc.DistinctUsers, func(c *Increments) map[string]int { return c.DistinctUsers }},
+		{serverStmt, inc.DistinctServerURLs, func(c *Increments) map[string]int { return c.DistinctServerURLs }},
+		{wikiBotStmt, inc.WikiBots, func(c *Increments) map[string]int { return c.WikiBots }},
+		{wikiUserStmt, inc.WikiUsers, func(c *Increments) map[string]int { return c.WikiUsers }},
+	}
+
+	for _, m := range counts {
+		for key, v := range m.values {
+			record := func(c *Increments) { m.field(c)[key] += v }
+			if err := add(record, m.stmt, int64(v), key); err != nil {
+				return s.fail(err)
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return s.fail(err)
+	}
+
+	s.Logger.Debug("Stats increments saved to Scylla",
+		zap.Int("messages", inc.MessagesConsumed),
+		zap.Int("users", len(inc.DistinctUsers)),
+		zap.Int("server_urls", len(inc.DistinctServerURLs)),
+	)
+
+	return nil
+}
+
+// Close closes the session.
+func (s *ScyllaCounterStorage) Close() {
+	s.Session.Close()
+}
+
+func (s *ScyllaCounterStorage) fail(err error) error {
+	s.Logger.Error("Failed to save stats increments to Scylla", zap.Error(err))
+	return err
+}
+
+// SaveStats makes the counters match data by adding the difference to what is stored.
+// It reads before writing, so it is only safe while no other writer is active, e.g. after a replay.
+func (s *ScyllaCounterStorage) SaveStats(data *shared.Stats) error {
+	current, err := s.LoadStats()
+	if err != nil {
+		return err
+	}
+
+	inc := &Increments{
+		MessagesConsumed:   data.MessagesConsumed - current.MessagesConsumed,
+		BotsCount:          data.BotsCount - current.BotsCount,
+		NonBotsCount:       data.NonBotsCount - current.NonBotsCount,
+		DistinctUsers:      diffCounts(data.DistinctUsers, current.DistinctUsers),
+		DistinctServerURLs: diffCounts(data.DistinctServerURLs, current.DistinctServerURLs),
+		WikiBots:           diffCounts(data.WikiBots, current.WikiBots),
+		WikiUsers:          diffCounts(data.WikiUsers, current.WikiUsers),
+	}
+
+	return s.SaveIncrements(inc)
+}
+
+// diffCounts returns want - have for every key whose count differs.
+func diffCounts(want, have map[string]int) map[string]int {
+	out := map[string]int{}
+
+	for k, v := range want {
+		if d := v - have[k]; d != 0 {
+			out[k] = d
+		}
+	}
+
+	for k, v := range have {
+		if _, ok := want[k]; !ok && v != 0 {
+			out[k] = -v
+		}
+	}
+
+	return out
+}
+
+// LoadStats rebuilds the stats from the counter tables.
+func (s *ScyllaCounterStorage) LoadStats() (*shared.Stats, error) {
+	stats := &shared.Stats{
+		MessagesConsumed:   0,
+		DistinctUsers:      make(map[string]int),
+		BotsCount:          0,
+		NonBotsCount:       0,
+		DistinctServerURLs: make(map[string]int),
+		WikiBots:           make(map[string]int),
+		WikiUsers:          make(map[string]int),
+	}
+
+	totals, err := s.scanCounts(`SELECT name, value FROM stats_totals`)
+	if err != nil {
+		return nil, err
+	}
+
+	stats.MessagesConsumed = totals[totalMessages]
+	stats.BotsCount = totals[totalBots]
+	stats.NonBotsCount = totals[totalNonBots]
+
+	if stats.DistinctUsers, err = s.scanCounts(`SELECT username, edits FROM stats_user_counts`); err != nil {
+		return nil, err
+	}
+
+	if stats.DistinctServerURLs, err = s.scanCounts(`SELECT server_url, edits FROM stats_server_url_counts`); err != nil {
+		return nil, err
+	}
+
+	if stats.WikiBots, err = s.scanCounts(`SELECT server_url, edits FROM stats_wiki_bot_counts`); err != nil {
+		return nil, err
+	}
+
+	if stats.WikiUsers, err = s.scanCounts(`SELECT wiki_user, edits FROM stats_wiki_user_counts`); err != nil {
+		return nil, err
+	}
+
+	s.Logger.Info("Stats loaded from Scylla counters",
+		zap.Int("users", len(stats.DistinctUsers)),
+		zap.Int("server_urls", len(stats.DistinctServerURLs)),
+	)
+
+	return stats, nil
+}
+
+// scanCounts pages through a key, counter table.
+func (s *ScyllaCounterStorage) scanCounts(query string) (map[string]int, error) {
+	out := make(map[string]int)
+
+	var (
+		key   string
+		count int64
+	)
+
+	iter := s.Session.Query(query).Iter()
+	for iter.Scan(&key, &count) {
+		// SaveStats can take a counter back to zero, that key no longer counts as seen.
+		if count != 0 {
+			out[key] = int(count)
+		}
+	}
+
+	if err := iter.Close(); err != nil {
+		s.Logger.Error("Failed to load stats counters from Scylla", zap.Error(err))
+		return nil, fmt.Errorf("failed to scan counters: %w", err)
+	}
+
+	return out, nil
+}
@@ -57,3 +57,165 @@ func TestScyllaStorage_SaveAndLoadStats(t *testing.T) {
 		t.Errorf("expected %d, got %d", stats.MessagesConsumed, loaded.MessagesConsumed)
 	}
 }
+
+func TestScyllaStorage_SaveDelta(t *testing.T) {
+	t.Parallel()
+
+	if os.Getenv("INTEGRATION") != "1" {
+		t.Skip("skipping integration test; set INTEGRATION=1 to run")
+	}
+
+	storage, err := NewScyllaStorage([]string{"localhost:9042"}, "stats_data", zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to connect to Scylla: %v", err)
+	}
+	defer storage.Session.Close()
+
+	if err := storage.Session.Query("TRUNCATE stats").Exec(); err != nil {
+		t.Fatalf("failed to truncate stats table: %v", err)
+	}
+
+	if err := storage.SaveStats(&shared.Stats{
+		MessagesConsumed:   1,
+		DistinctUsers:      map[string]int{"blub": 1},
+		BotsCount:          0,
+		NonBotsCount:       1,
+		DistinctServerURLs: map[string]int{"https://blub.com": 1},
+	}); err != nil {
+		t.Fatalf("failed to save stats: %v", err)
+	}
+
+	if err := storage.SaveDelta(&Delta{
+		MessagesConsumed:   2,
+		BotsCount:          1,
+		NonBotsCount:       1,
+		DistinctUsers:      map[string]int{"bot": 1},
+		DistinctServerURLs: map[string]int{"https://blub.com": 2},
+	}); err != nil {
+		t.Fatalf("failed to save delta: %v", err)
+	}
+
+	loaded, err := storage.LoadStats()
+	if err != nil {
+		t.Fatalf("failed to load stats: %v", err)
+	}
+
+	if loaded.MessagesConsumed != 2 || len(loaded.DistinctUsers) != 2 || loaded.DistinctServerURLs["https://blub.com"] != 2 {
+		t.Errorf("expected the delta merged into the saved row, got %+v", loaded)
+	}
+}
+
+func TestScyllaCounterStorage_SaveIncrementsAndLoad(t *testing.T) {
+	t.Parallel()
+
+	if os.Getenv("INTEGRATION") != "1" {
+		t.Skip("skipping integration test; set INTEGRATION=1 to run")
+	}
+
+	storage, err := NewScyllaCounterStorage([]string{"localhost:9042"}, "stats_data", zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to connect to Scylla: %v", err)
+	}
+	defer storage.Close()
+
+	for _, table := range []string{"stats_totals", "stats_user_counts", "stats_server_url_counts"} {
+		if err := storage.Session.Query("TRUNCATE " + table).Exec(); err != nil {
+			t.Fatalf("failed to truncate %s: %v", table, err)
+		}
+	}
+
+	// Two replicas adding their own batches.
+	for range 2 {
+		if err := storage.SaveIncrements(&Increments{
+			MessagesConsumed:   2,
+			BotsCount:          1,
+			NonBotsCount:       1,
+			DistinctUsers:      map[string]int{"blub": 1, "bot": 1},
+			DistinctServerURLs: map[string]int{"https://blub.com": 2},
+		}); err != nil {
+			t.Fatalf("failed to save increments: %v", err)
+		}
+	}
+
+	loaded, err := storage.LoadStats()
+	if err != nil {
+		t.Fatalf("failed to load stats: %v", err)
+	}
+
+	if loaded.MessagesConsumed != 4 || loaded.DistinctUsers["blub"] != 2 || loaded.DistinctServerURLs["https://blub.com"] != 4 {
+		t.Errorf("expected the increments to add up, got %+v", loaded)
+	}
+
+	if err := storage.SaveStats(&shared.Stats{
+		MessagesConsumed:   1,
+		DistinctUsers:      map[string]int{"blub": 1},
+		BotsCount:          0,
+		NonBotsCount:       1,
+		DistinctServerURLs: map[string]int{"https://blub.com": 1},
+	}); err != nil {
+		t.Fatalf("failed to save stats: %v", err)
+	}
+
+	if loaded, err = storage.LoadStats(); err != nil {
+		t.Fatalf("failed to load stats: %v", err)
+	}
+
+	if loaded.MessagesConsumed != 1 || len(loaded.DistinctUsers) != 1 {
+		t.Errorf("expected SaveStats to reset the counters to the given stats, got %+v", loaded)
+	}
+}
+
+func TestScyllaShardStorage_LoadShards(t *testing.T) {
+	t.Parallel()
+
+	if os.Getenv("INTEGRATION") != "1" {
+		t.Skip("skipping integration test; set INTEGRATION=1 to run")
+	}
+
+	a, err := NewScyllaShardStorage([]string{"localhost:9042"}, "stats_data", "replica-a", zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to connect to Scylla: %v", err)
+	}
+	defer a.Close()
+
+	for _, table := range []string{"stats_shards", "stats_shard_wiki_users"} {
+		if err := a.Session.Query("TRUNCATE " + table).Exec(); err != nil {
+			t.Fatalf("failed to truncate %s: %v", table, err)
+		}
+	}
+
+	b := &ScyllaShardStorage{Session: a.Session, Logger: zap.NewNop(), Replica: "replica-b"}
+
+	for i, s := range []*ScyllaShardStorage{a, b} {
+		if err := s.SaveStats(&shared.Stats{
+			MessagesConsumed:   i + 1,
+			DistinctUsers:      map[string]int{"blub": i + 1},
+			BotsCount:          0,
+			NonBotsCount:       i + 1,
+			DistinctServerURLs: map[string]int{"https://blub.com": i + 1},
+			WikiUsers:          map[string]int{shared.WikiUserKey("https://blub.com", "blub"): i + 1},
+		}); err != nil {
+			t.Fatalf("failed to save shard: %v", err)
+		}
+	}
+
+	own, err := b.LoadStats()
+	if err != nil {
+		t.Fatalf("failed to load own shard: %v", err)
+	}
+
+	if own.MessagesConsumed != 2 || own.WikiUsers[shared.WikiUserKey("https://blub.com", "blub")] != 2 {
+		t.Errorf("expected only replica-b's shard, got %+v", own)
+	}
+
+	shards, err := a.LoadShards()
+	if err != nil {
+		t.Fatalf("failed to load shards: %v", err)
+	}
+
+	total := shards.Total()
+	if total.MessagesConsumed != 3 || total.DistinctUsers["blub"] != 3 ||
+		total.WikiUsers[shared.WikiUserKey("https://blub.com", "blub")] != 3 {
+		t.Errorf("expected the shards to sum, got %+v", total)
+	}
+}
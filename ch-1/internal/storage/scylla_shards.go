@@ -0,0 +1,266 @@
+// Package storage - scylla per replica shard implementation.
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gocql/gocql"
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+)
+
+// ScyllaShardStorage gives every replica its own row in stats_shards. Replicas never write
+// each other's rows, and readers merge all rows with shared.Shards. Per wiki users get a row
+// each in stats_shard_wiki_users instead of a map in the shard row.
+//
+// Schema:
+//
+//	CREATE TABLE stats_shards (
+//	  replica_id text PRIMARY KEY,
+//	  messages_consumed int,
+//	  distinct_users map<text, int>,
+//	  bots_count int,
+//	  non_bots_count int,
+//	  distinct_server_urls map<text, int>,
+//	  wiki_bots map<text, int>
+//	);
+//	CREATE TABLE stats_shard_wiki_users (
+//	  replica_id text, server_url text, username text, edits int,
+//	  PRIMARY KEY ((replica_id, server_url), username)
+//	);
+type ScyllaShardStorage struct {
+	Session *gocql.Session
+	Logger  *zap.Logger
+	Replica string
+}
+
+// NewScyllaShardStorage connects like NewScyllaStorage and writes to replica's shard.
+func NewScyllaShardStorage(hosts []string, keyspace, replica string, logger *zap.Logger) (*ScyllaShardStorage, error) {
+	s, err := NewScyllaStorage(hosts, keyspace, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ScyllaShardStorage{
+		Session: s.Session,
+		Logger:  logger,
+		Replica: replica,
+	}, nil
+}
+
+// Close closes the session.
+func (s *ScyllaShardStorage) Close() {
+	s.Session.Close()
+}
+
+// ReplicaID returns the shard this storage writes to.
+func (s *ScyllaShardStorage) ReplicaID() string {
+	return s.Replica
+}
+
+func (s *ScyllaShardStorage) wikiUsers() wikiUserTable {
+	return wikiUserTable{
+		session: s.Session,
+		table:   "stats_shard_wiki_users",
+		keys:    []string{"replica_id"},
+		values:  []any{s.Replica},
+	}
+}
+
+// SaveStats overwrites this replica's shard.
+func (s *ScyllaShardStorage) SaveStats(data *shared.Stats) error {
+	query := `INSERT INTO stats_shards
+                (replica_id, messages_consumed, distinct_users, bots_count, non_bots_count, distinct_server_urls,
+                 wiki_bots)
+                VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+	// Clear the shard's stored wikis first, so users missing from data don't linger.
+	var stored map[string]int
+
+	err := s.Session.Query(`SELECT distinct_server_urls FROM stats_shards WHERE replica_id = ?`, s.Replica).
+		Scan(&stored)
+	if err != nil && !errors.Is(err, gocql.ErrNotFound) {
+		s.Logger.Error("Failed to save stats shard to Scylla", zap.Error(err))
+		return fmt.Errorf("failed to read the stored server urls: %w", err)
+	}
+
+	if err := s.wikiUsers().clear(stored); err != nil {
+		s.Logger.Error("Failed to save stats shard to Scylla", zap.Error(err))
+		return err
+	}
+
+	if err := s.wikiUsers().save(data.WikiUsers); err != nil {
+		s.Logger.Error("Failed to save stats shard to Scylla", zap.Error(err))
+		return err
+	}
+
+	err = s.Session.Query(
+		query,
+		s.Replica,
+		data.MessagesConsumed,
+		data.DistinctUsers,
+		data.BotsCount,
+		data.NonBotsCount,
+		data.DistinctServerURLs,
+		data.WikiBots,
+	).Exec()
+	if err != nil {
+		s.Logger.Error("Failed to save stats shard to Scylla", zap.Error(err))
+		return fmt.Errorf("failed to execute query to save stats shard: %w", err)
+	}
+
+	return nil
+}
+
+// SaveDelta merges the changed keys into this replica's shard.
+func (s *ScyllaShardStorage) SaveDelta(delta *Delta) error {
+	query := `UPDATE stats_shards SET
+                messages_consumed = ?,
+                bots_count = ?,
+                non_bots_count = ?,
+                distinct_users = distinct_users + ?,
+                distinct_server_urls = distinct_server_urls + ?,
+                wiki_bots = wiki_bots + ?
+              WHERE replica_id = ?`
+
+	if err := s.wikiUsers().save(delta.WikiUsers); err != nil {
+		s.Logger.Error("Failed to save stats shard delta to Scylla", zap.Error(err))
+		return err
+	}
+
+	err := s.Session.Query(
+		query,
+		delta.MessagesConsumed,
+		delta.BotsCount,
+		delta.NonBotsCount,
+		delta.DistinctUsers,
+		delta.DistinctServerURLs,
+		delta.WikiBots,
+		s.Replica,
+	).Exec()
+	if err != nil {
+		s.Logger.Error("Failed to save stats shard delta to Scylla", zap.Error(err))
+		return fmt.Errorf("failed to execute query to save stats shard delta: %w", err)
+	}
+
+	return nil
+}
+
+// LoadStats returns this replica's shard, or empty stats for a new replica.
+func (s *ScyllaShardStorage) LoadStats() (*shared.Stats, error) {
+	query := `SELECT messages_consumed, distinct_users, bots_count, non_bots_count, distinct_server_urls,
+                wiki_bots
+                FROM stats_shards WHERE replica_id = ?`
+
+	stats := shared.NewStats()
+
+	err := s.Session.Query(query, s.Replica).Scan(
+		&stats.MessagesConsumed,
+		&stats.DistinctUsers,
+		&stats.BotsCount,
+		&stats.NonBotsCount,
+		&stats.DistinctServerURLs,
+		&stats.WikiBots,
+	)
+	if err != nil && !errors.Is(err, gocql.ErrNotFound) {
+		s.Logger.Error("Failed to load stats shard from Scylla", zap.Error(err))
+		return nil, fmt.Errorf("failed to scan query result: %w", err)
+	}
+
+	fillMaps(stats)
+
+	if err := s.wikiUsers().load(stats.DistinctServerURLs, stats.WikiUsers); err != nil {
+		s.Logger.Error("Failed to load stats shard from Scylla", zap.Error(err))
+		return nil, err
+	}
+
+	s.Logger.Info("Stats shard loaded from Scylla", zap.String("replica_id", s.Replica))
+
+	return stats, nil
+}
+
+// LoadShards returns every replica's shard.
+func (s *ScyllaShardStorage) LoadShards() (shared.Shards, error) {
+	query := `SELECT replica_id, messages_consumed, distinct_users, bots_count, non_bots_count, distinct_server_urls,
+                wiki_bots
+                FROM stats_shards`
+
+	shards := shared.Shards{}
+
+	iter := s.Session.Query(query).Iter()
+
+	for {
+		var replica string
+
+		stats := shared.NewStats()
+		if !iter.Scan(
+			&replica,
+			&stats.MessagesConsumed,
+			&stats.DistinctUsers,
+			&stats.BotsCount,
+			&stats.NonBotsCount,
+			&stats.DistinctServerURLs,
+			&stats.WikiBots,
+		) {
+			break
+		}
+
+		fillMaps(stats)
+		shards[replica] = stats
+	}
+
+	if err := iter.Close(); err != nil {
+		s.Logger.Error("Failed to load stats shards from Scylla", zap.Error(err))
+		return nil, fmt.Errorf("failed to scan stats shards: %w", err)
+	}
+
+	if err := s.loadShardWikiUsers(shards); err != nil {
+		s.Logger.Error("Failed to load stats shards from Scylla", zap.Error(err))
+		return nil, err
+	}
+
+	return shards, nil
+}
+
+// loadShardWikiUsers reads every replica's per wiki users in one pass over the table.
+func (s *ScyllaShardStorage) loadShardWikiUsers(shards shared.Shards) error {
+	var (
+		replica, url, user string
+		edits              int
+	)
+
+	iter := s.Session.Query(`SELECT replica_id, server_url, username, edits FROM stats_shard_wiki_users`).Iter()
+	for iter.Scan(&replica, &url, &user, &edits) {
+		// Rows can outlive their shard row, e.g. while a save is half done.
+		if stats, ok := shards[replica]; ok {
+			stats.WikiUsers[shared.WikiUserKey(url, user)] = edits
+		}
+	}
+
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("failed to scan stats shard wiki users: %w", err)
+	}
+
+	return nil
+}
+
+// fillMaps replaces the nil maps gocql scans empty map columns into.
+func fillMaps(stats *shared.Stats) {
+	if stats.DistinctUsers == nil {
+		stats.DistinctUsers = map[string]int{}
+	}
+
+	if stats.DistinctServerURLs == nil {
+		stats.DistinctServerURLs = map[string]int{}
+	}
+
+	if stats.WikiBots == nil {
+		stats.WikiBots = map[string]int{}
+	}
+
+	if stats.WikiUsers == nil {
+		stats.WikiUsers = map[string]int{}
+	}
+}
@@ -0,0 +1,138 @@
+// Package storage - scylla snapshot history.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gocql/gocql"
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+)
+
+const (
+	snapshotDayFormat  = "2006-01-02"
+	defaultSnapshotTTL = 24 * time.Hour
+)
+
+// ScyllaSnapshotStorage keeps the stats history in its own table next to whichever Scylla
+// mode holds the current stats. Rows expire after TTL, which also bounds how many day
+// partitions ListSnapshots reads. Per wiki users aren't kept, see SnapshotStorage.
+//
+// Schema:
+//
+//	CREATE TABLE stats_snapshots (
+//	  day text, taken_at timestamp,
+//	  messages_consumed int, distinct_users map<text, int>, bots_count int, non_bots_count int,
+//	  distinct_server_urls map<text, int>, wiki_bots map<text, int>,
+//	  PRIMARY KEY (day, taken_at)
+//	) WITH CLUSTERING ORDER BY (taken_at DESC);
+type ScyllaSnapshotStorage struct {
+	Session *gocql.Session
+	Logger  *zap.Logger
+	TTL     time.Duration
+}
+
+// NewScyllaSnapshotStorage shares an existing session. A ttl of zero keeps a day.
+func NewScyllaSnapshotStorage(session *gocql.Session, ttl time.Duration, logger *zap.Logger) *ScyllaSnapshotStorage {
+	if ttl <= 0 {
+		ttl = defaultSnapshotTTL
+	}
+
+	return &ScyllaSnapshotStorage{
+		Session: session,
+		Logger:  logger,
+		TTL:     ttl,
+	}
+}
+
+// SaveSnapshot writes one history row.
+func (s *ScyllaSnapshotStorage) SaveSnapshot(stats *shared.Stats, at time.Time) (SnapshotInfo, error) {
+	query := `INSERT INTO stats_snapshots
+                (day, taken_at, messages_consumed, distinct_users, bots_count, non_bots_count, distinct_server_urls,
+                 wiki_bots)
+                VALUES (?, ?, ?, ?, ?, ?, ?, ?) USING TTL ?`
+
+	info := snapshotInfo(at)
+
+	err := s.Session.Query(
+		query,
+		info.CreatedAt.Format(snapshotDayFormat),
+		info.CreatedAt,
+		stats.MessagesConsumed,
+		stats.DistinctUsers,
+		stats.BotsCount,
+		stats.NonBotsCount,
+		stats.DistinctServerURLs,
+		stats.WikiBots,
+		int(s.TTL.Seconds()),
+	).Exec()
+	if err != nil {
+		s.Logger.Error("Failed to save stats snapshot to Scylla", zap.Error(err))
+		return SnapshotInfo{}, fmt.Errorf("failed to execute query to save stats snapshot: %w", err)
+	}
+
+	return info, nil
+}
+
+// ListSnapshots reads every day partition the TTL can still hold, newest first.
+func (s *ScyllaSnapshotStorage) ListSnapshots() ([]SnapshotInfo, error) {
+	now := time.Now().UTC()
+
+	var infos []SnapshotInfo
+
+	for day := now; !day.Before(now.Add(-s.TTL).Truncate(24 * time.Hour)); day = day.Add(-24 * time.Hour) {
+		var takenAt time.Time
+
+		iter := s.Session.Query(`SELECT taken_at FROM stats_snapshots WHERE day = ?`, day.Format(snapshotDayFormat)).Iter()
+		for iter.Scan(&takenAt) {
+			infos = append(infos, snapshotInfo(takenAt))
+		}
+
+		if err := iter.Close(); err != nil {
+			s.Logger.Error("Failed to list stats snapshots from Scylla", zap.Error(err))
+			return nil, fmt.Errorf("failed to list stats snapshots: %w", err)
+		}
+	}
+
+	newestFirst(infos)
+
+	return infos, nil
+}
+
+// LoadSnapshot reads one history row.
+func (s *ScyllaSnapshotStorage) LoadSnapshot(id string) (*shared.Stats, error) {
+	info, err := ParseSnapshotID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT messages_consumed, distinct_users, bots_count, non_bots_count, distinct_server_urls,
+                wiki_bots
+                FROM stats_snapshots WHERE day = ? AND taken_at = ?`
+
+	stats := shared.NewStats()
+
+	err = s.Session.Query(query, info.CreatedAt.Format(snapshotDayFormat), info.CreatedAt).Scan(
+		&stats.MessagesConsumed,
+		&stats.DistinctUsers,
+		&stats.BotsCount,
+		&stats.NonBotsCount,
+		&stats.DistinctServerURLs,
+		&stats.WikiBots,
+	)
+	if errors.Is(err, gocql.ErrNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrSnapshotNotFound, id)
+	}
+
+	if err != nil {
+		s.Logger.Error("Failed to load stats snapshot from Scylla", zap.Error(err))
+		return nil, fmt.Errorf("failed to scan stats snapshot: %w", err)
+	}
+
+	fillMaps(stats)
+
+	return stats, nil
+}
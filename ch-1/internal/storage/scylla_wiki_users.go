@@ -0,0 +1,115 @@
+// Package storage - scylla per wiki users.
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gocql/gocql"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+)
+
+// wikiUserBatchSize keeps the per wiki batches well under Scylla's batch size warning.
+const wikiUserBatchSize = 200
+
+// wikiUserTable keeps Stats.WikiUsers as one row per user, partitioned by wiki, instead of a
+// map cell that grows with every user. keys are the partition key columns ahead of server_url
+// and values what this writer puts in them, e.g. replica_id for shards.
+type wikiUserTable struct {
+	session *gocql.Session
+	table   string
+	keys    []string
+	values  []any
+}
+
+// partition is the WHERE clause picking one wiki's partition.
+func (t wikiUserTable) partition() string {
+	cols := make([]string, 0, len(t.keys)+1)
+	for _, k := range t.keys {
+		cols = append(cols, k+" = ?")
+	}
+
+	return strings.Join(append(cols, "server_url = ?"), " AND ")
+}
+
+func (t wikiUserTable) args(url string) []any {
+	return append(append(make([]any, 0, len(t.values)+1), t.values...), url)
+}
+
+// save upserts the given users. Counts are absolute, so saving the same entries twice is harmless.
+func (t wikiUserTable) save(wikiUsers map[string]int) error {
+	byURL := map[string]map[string]int{}
+
+	for key, edits := range wikiUsers {
+		url, user := shared.SplitWikiUserKey(key)
+		if byURL[url] == nil {
+			byURL[url] = map[string]int{}
+		}
+
+		byURL[url][user] = edits
+	}
+
+	stmt := fmt.Sprintf(`UPDATE %s SET edits = ? WHERE %s AND username = ?`, t.table, t.partition())
+
+	// Batches stay within one partition, so they don't fan out across the cluster.
+	for url, users := range byURL {
+		batch := t.session.NewBatch(gocql.UnloggedBatch)
+
+		for user, edits := range users {
+			batch.Query(stmt, append(append([]any{edits}, t.args(url)...), user)...)
+
+			if batch.Size() >= wikiUserBatchSize {
+				if err := t.session.ExecuteBatch(batch); err != nil {
+					return fmt.Errorf("failed to save wiki users: %w", err)
+				}
+
+				batch = t.session.NewBatch(gocql.UnloggedBatch)
+			}
+		}
+
+		if batch.Size() > 0 {
+			if err := t.session.ExecuteBatch(batch); err != nil {
+				return fmt.Errorf("failed to save wiki users: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// clear deletes the users of every wiki in urls.
+func (t wikiUserTable) clear(urls map[string]int) error {
+	stmt := fmt.Sprintf(`DELETE FROM %s WHERE %s`, t.table, t.partition())
+
+	for url := range urls {
+		if err := t.session.Query(stmt, t.args(url)...).Exec(); err != nil {
+			return fmt.Errorf("failed to clear wiki users: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// load reads the users of every wiki in urls into wikiUsers.
+func (t wikiUserTable) load(urls map[string]int, wikiUsers map[string]int) error {
+	stmt := fmt.Sprintf(`SELECT username, edits FROM %s WHERE %s`, t.table, t.partition())
+
+	for url := range urls {
+		var (
+			user  string
+			edits int
+		)
+
+		iter := t.session.Query(stmt, t.args(url)...).Iter()
+		for iter.Scan(&user, &edits) {
+			wikiUsers[shared.WikiUserKey(url, user)] = edits
+		}
+
+		if err := iter.Close(); err != nil {
+			return fmt.Errorf("failed to load wiki users: %w", err)
+		}
+	}
+
+	return nil
+}
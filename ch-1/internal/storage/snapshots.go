@@ -0,0 +1,81 @@
+// Package storage - snapshot history.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+)
+
+// DefaultHistoryKeep is how many snapshots the memory and file backends keep, a day at the
+// default five minute interval.
+const DefaultHistoryKeep = 288
+
+// ErrSnapshotNotFound is returned for an unknown ID or a time before the first snapshot.
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+// SnapshotInfo identifies one stats snapshot. IDs are the snapshot time in Unix
+// milliseconds, so they sort by age.
+type SnapshotInfo struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SnapshotStorage keeps a history of full stats snapshots next to the current stats.
+// Backends may drop WikiUsers, history reads never break stats down by wiki user.
+type SnapshotStorage interface {
+	SaveSnapshot(stats *shared.Stats, at time.Time) (SnapshotInfo, error)
+	// ListSnapshots returns the kept snapshots, newest first.
+	ListSnapshots() ([]SnapshotInfo, error)
+	LoadSnapshot(id string) (*shared.Stats, error)
+}
+
+// LoadSnapshotAt loads the newest snapshot taken at or before at.
+func LoadSnapshotAt(ss SnapshotStorage, at time.Time) (*shared.Stats, SnapshotInfo, error) {
+	infos, err := ss.ListSnapshots()
+	if err != nil {
+		return nil, SnapshotInfo{}, err
+	}
+
+	for _, info := range infos {
+		if info.CreatedAt.After(at) {
+			continue
+		}
+
+		stats, err := ss.LoadSnapshot(info.ID)
+		if err != nil {
+			return nil, SnapshotInfo{}, err
+		}
+
+		return stats, info, nil
+	}
+
+	return nil, SnapshotInfo{}, fmt.Errorf("%w at %s", ErrSnapshotNotFound, at.Format(time.RFC3339))
+}
+
+func snapshotInfo(at time.Time) SnapshotInfo {
+	at = at.UTC().Truncate(time.Millisecond)
+
+	return SnapshotInfo{ID: strconv.FormatInt(at.UnixMilli(), 10), CreatedAt: at}
+}
+
+// ParseSnapshotID turns an ID back into its SnapshotInfo. It doesn't check the snapshot exists.
+func ParseSnapshotID(id string) (SnapshotInfo, error) {
+	ms, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return SnapshotInfo{}, fmt.Errorf("%w: bad id %q", ErrSnapshotNotFound, id)
+	}
+
+	return snapshotInfo(time.UnixMilli(ms)), nil
+}
+
+// newestFirst sorts snapshot infos by time, newest first.
+func newestFirst(infos []SnapshotInfo) {
+	slices.SortFunc(infos, func(a, b SnapshotInfo) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+}
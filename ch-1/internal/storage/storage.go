@@ -8,3 +8,100 @@ type Storage interface {
 	SaveStats(stat *shared.Stats) error
 	LoadStats() (*shared.Stats, error)
 }
+
+// Closer is implemented by backends holding a connection.
+type Closer interface {
+	Close()
+}
+
+// Delta holds the counters and only the map entries that changed since the last save.
+// Map values are absolute counts, not increments, so replaying a delta is harmless.
+type Delta struct {
+	MessagesConsumed   int
+	BotsCount          int
+	NonBotsCount       int
+	DistinctUsers      map[string]int
+	DistinctServerURLs map[string]int
+	WikiBots           map[string]int
+	WikiUsers          map[string]int
+}
+
+// DeltaStorage is a Storage that can write just the changed keys instead of the whole stats.
+type DeltaStorage interface {
+	Storage
+	SaveDelta(delta *Delta) error
+}
+
+// Increments holds what was added since the last save, for backends that keep counters.
+// Unlike Delta, applying the same Increments twice counts them twice.
+type Increments struct {
+	MessagesConsumed   int
+	BotsCount          int
+	NonBotsCount       int
+	DistinctUsers      map[string]int
+	DistinctServerURLs map[string]int
+	WikiBots           map[string]int
+	WikiUsers          map[string]int
+}
+
+// NewIncrements returns empty increments.
+func NewIncrements() *Increments {
+	return &Increments{
+		MessagesConsumed:   0,
+		BotsCount:          0,
+		NonBotsCount:       0,
+		DistinctUsers:      map[string]int{},
+		DistinctServerURLs: map[string]int{},
+		WikiBots:           map[string]int{},
+		WikiUsers:          map[string]int{},
+	}
+}
+
+// Add adds other to inc.
+func (inc *Increments) Add(other *Increments) {
+	inc.MessagesConsumed += other.MessagesConsumed
+	inc.BotsCount += other.BotsCount
+	inc.NonBotsCount += other.NonBotsCount
+
+	for _, m := range [][2]map[string]int{
+		{inc.DistinctUsers, other.DistinctUsers},
+		{inc.DistinctServerURLs, other.DistinctServerURLs},
+		{inc.WikiBots, other.WikiBots},
+		{inc.WikiUsers, other.WikiUsers},
+	} {
+		for k, v := range m[1] {
+			m[0][k] += v
+		}
+	}
+}
+
+// IncrementStorage is a Storage that adds increments to shared counters, so several
+// writers can share it without overwriting each other. A save that fails after writing
+// part of the increments returns a *PartialIncrementsError.
+type IncrementStorage interface {
+	Storage
+	SaveIncrements(inc *Increments) error
+}
+
+// PartialIncrementsError is a failed SaveIncrements that still saved Applied, so a retry
+// must leave those out or count them twice.
+type PartialIncrementsError struct {
+	Applied *Increments
+	Err     error
+}
+
+func (e *PartialIncrementsError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PartialIncrementsError) Unwrap() error {
+	return e.Err
+}
+
+// ShardStorage keeps one shard of stats per replica. LoadStats and saves only touch this
+// replica's shard, LoadShards returns every replica's so readers can merge them.
+type ShardStorage interface {
+	Storage
+	ReplicaID() string
+	LoadShards() (shared.Shards, error)
+}
@@ -0,0 +1,143 @@
+package storagetest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+	"github.com/codyonesock/backend_learning/ch-1/internal/storage"
+)
+
+// SnapshotFactory returns an empty snapshot history.
+type SnapshotFactory func(t *testing.T) storage.SnapshotStorage
+
+// RunSnapshots runs the snapshot history cases against histories from newHistory.
+func RunSnapshots(t *testing.T, newHistory SnapshotFactory) {
+	t.Helper()
+
+	t.Run("ListAndLoad", func(t *testing.T) { testListAndLoad(t, newHistory(t)) })
+	t.Run("LoadAt", func(t *testing.T) { testLoadAt(t, newHistory(t)) })
+	t.Run("UniqueIDs", func(t *testing.T) { testUniqueIDs(t, newHistory(t)) })
+}
+
+// snapshot is consistent(n) without the per wiki users, which snapshots may drop.
+func snapshot(n int) *shared.Stats {
+	stats := consistent(n)
+	stats.WikiUsers = map[string]int{}
+
+	return stats
+}
+
+func saveSnapshot(t *testing.T, ss storage.SnapshotStorage, n int, at time.Time) storage.SnapshotInfo {
+	t.Helper()
+
+	info, err := ss.SaveSnapshot(snapshot(n), at)
+	if err != nil {
+		t.Fatalf("failed to save snapshot: %v", err)
+	}
+
+	return info
+}
+
+func testListAndLoad(t *testing.T, ss storage.SnapshotStorage) {
+	t.Helper()
+
+	infos, err := ss.ListSnapshots()
+	if err != nil || len(infos) != 0 {
+		t.Fatalf("expected an empty history, got %v, %v", infos, err)
+	}
+
+	base := time.Now().Add(-time.Hour)
+	first := saveSnapshot(t, ss, 1, base)
+	second := saveSnapshot(t, ss, 2, base.Add(time.Minute))
+
+	if infos, err = ss.ListSnapshots(); err != nil {
+		t.Fatalf("failed to list snapshots: %v", err)
+	}
+
+	if len(infos) != 2 || infos[0] != second || infos[1] != first {
+		t.Fatalf("expected [%v %v] newest first, got %v", second, first, infos)
+	}
+
+	got, err := ss.LoadSnapshot(first.ID)
+	if err != nil {
+		t.Fatalf("failed to load snapshot: %v", err)
+	}
+
+	if d := diff(snapshot(1), got); d != "" {
+		t.Errorf("snapshot differs from saved, %s", d)
+	}
+
+	// Changing a loaded snapshot doesn't change the history.
+	got.DistinctUsers["intruder"] = 1
+
+	if again, err := ss.LoadSnapshot(first.ID); err != nil || diff(snapshot(1), again) != "" {
+		t.Errorf("expected the stored snapshot unchanged, got %+v, %v", again, err)
+	}
+
+	if _, err := ss.LoadSnapshot("12345"); !errors.Is(err, storage.ErrSnapshotNotFound) {
+		t.Errorf("expected ErrSnapshotNotFound for an unknown id, got %v", err)
+	}
+
+	if _, err := ss.LoadSnapshot("not-an-id"); !errors.Is(err, storage.ErrSnapshotNotFound) {
+		t.Errorf("expected ErrSnapshotNotFound for a bad id, got %v", err)
+	}
+}
+
+func testLoadAt(t *testing.T, ss storage.SnapshotStorage) {
+	t.Helper()
+
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i := range 3 {
+		saveSnapshot(t, ss, i+1, base.Add(time.Duration(i)*10*time.Minute))
+	}
+
+	cases := []struct {
+		at   time.Time
+		want int
+	}{
+		{base, 1},
+		{base.Add(15 * time.Minute), 2},
+		{base.Add(20 * time.Minute), 3},
+		{time.Now(), 3},
+	}
+
+	for _, c := range cases {
+		got, info, err := storage.LoadSnapshotAt(ss, c.at)
+		if err != nil {
+			t.Fatalf("failed to load snapshot at %s: %v", c.at, err)
+		}
+
+		if got.MessagesConsumed != c.want || info.CreatedAt.After(c.at) {
+			t.Errorf("at %s expected snapshot %d, got %d from %s", c.at, c.want, got.MessagesConsumed, info.CreatedAt)
+		}
+	}
+
+	if _, _, err := storage.LoadSnapshotAt(ss, base.Add(-time.Minute)); !errors.Is(err, storage.ErrSnapshotNotFound) {
+		t.Errorf("expected ErrSnapshotNotFound before the first snapshot, got %v", err)
+	}
+}
+
+func testUniqueIDs(t *testing.T, ss storage.SnapshotStorage) {
+	t.Helper()
+
+	at := time.Now().Add(-time.Minute)
+	a := saveSnapshot(t, ss, 1, at)
+	b := saveSnapshot(t, ss, 2, at)
+
+	if a.ID == b.ID {
+		// Backends that overwrite instead must still keep the latest.
+		got, err := ss.LoadSnapshot(b.ID)
+		if err != nil || got.MessagesConsumed != 2 {
+			t.Errorf("expected the latest snapshot under a reused id, got %+v, %v", got, err)
+		}
+
+		return
+	}
+
+	infos, err := ss.ListSnapshots()
+	if err != nil || len(infos) != 2 || infos[0] != b {
+		t.Errorf("expected the second snapshot listed first, got %v, %v", infos, err)
+	}
+}
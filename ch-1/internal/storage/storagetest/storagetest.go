@@ -0,0 +1,344 @@
+// Package storagetest is a conformance suite any storage.Storage implementation can run,
+// so backends agree on what saving and loading stats means.
+package storagetest
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+	"testing"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+	"github.com/codyonesock/backend_learning/ch-1/internal/storage"
+)
+
+var errTornLoad = errors.New("loaded stats mix two saves")
+
+// Factory returns an empty backend. Cases run one after another, so backends sharing a
+// database can reset it here.
+type Factory func(t *testing.T) storage.Storage
+
+// Options describes what a backend supports.
+type Options struct {
+	// SingleWriter is for backends that neither serialise concurrent saves nor load
+	// atomically, like counter tables. The concurrency case then uses one writer and only
+	// checks that concurrent loads don't fail.
+	SingleWriter bool
+	// Broken returns a backend whose operations fail, e.g. with its connection closed.
+	// Nil skips the error propagation case, for backends that can't fail.
+	Broken Factory
+	// LargeMapSize is how many users the large maps case saves, defaults to 10000.
+	LargeMapSize int
+}
+
+// Run runs every case against backends from newStorage.
+func Run(t *testing.T, newStorage Factory, opts Options) {
+	t.Helper()
+
+	if opts.LargeMapSize == 0 {
+		opts.LargeMapSize = 10000
+	}
+
+	t.Run("EmptyStore", func(t *testing.T) { testEmptyStore(t, newStorage(t)) })
+	t.Run("RoundTrip", func(t *testing.T) { testRoundTrip(t, newStorage(t)) })
+	t.Run("Overwrite", func(t *testing.T) { testOverwrite(t, newStorage(t)) })
+	t.Run("Isolation", func(t *testing.T) { testIsolation(t, newStorage(t)) })
+	t.Run("LargeMaps", func(t *testing.T) { testLargeMaps(t, newStorage(t), opts.LargeMapSize) })
+	t.Run("Concurrent", func(t *testing.T) { testConcurrent(t, newStorage(t), opts.SingleWriter) })
+	t.Run("ErrorPropagation", func(t *testing.T) {
+		if opts.Broken == nil {
+			t.Skip("backend can't fail")
+		}
+
+		testErrorPropagation(t, opts.Broken(t))
+	})
+}
+
+// sample covers every field with keys that need escaping in most encodings.
+func sample() *shared.Stats {
+	return &shared.Stats{
+		MessagesConsumed: 7,
+		DistinctUsers: map[string]int{
+			"blub":             3,
+			"Bot User":         2,
+			"ユーザー":             1,
+			`quote"and\\slash`: 1,
+		},
+		BotsCount:    2,
+		NonBotsCount: 5,
+		DistinctServerURLs: map[string]int{
+			"https://blub.com":         6,
+			"https://commons.wiki.org": 1,
+		},
+		WikiBots: map[string]int{"https://blub.com": 2},
+		WikiUsers: map[string]int{
+			shared.WikiUserKey("https://blub.com", "blub"):                     3,
+			shared.WikiUserKey("https://blub.com", "Bot User"):                 2,
+			shared.WikiUserKey("https://blub.com", "ユーザー"):                     1,
+			shared.WikiUserKey("https://commons.wiki.org", `quote"and\\slash`): 1,
+		},
+	}
+}
+
+// consistent stats for concurrency checks, every count is derived from n. Zero is the empty store.
+func consistent(n int) *shared.Stats {
+	if n == 0 {
+		return shared.NewStats()
+	}
+
+	return &shared.Stats{
+		MessagesConsumed:   n,
+		DistinctUsers:      map[string]int{"user": n, fmt.Sprintf("user-%d", n): n},
+		BotsCount:          n,
+		NonBotsCount:       n,
+		DistinctServerURLs: map[string]int{"https://blub.com": n},
+		WikiBots:           map[string]int{"https://blub.com": n},
+		WikiUsers:          map[string]int{shared.WikiUserKey("https://blub.com", "user"): n},
+	}
+}
+
+func save(t *testing.T, s storage.Storage, stats *shared.Stats) {
+	t.Helper()
+
+	if err := s.SaveStats(stats); err != nil {
+		t.Fatalf("failed to save stats: %v", err)
+	}
+}
+
+func load(t *testing.T, s storage.Storage) *shared.Stats {
+	t.Helper()
+
+	stats, err := s.LoadStats()
+	if err != nil {
+		t.Fatalf("failed to load stats: %v", err)
+	}
+
+	if stats == nil {
+		t.Fatal("expected stats, got nil")
+	}
+
+	return stats
+}
+
+// diff describes how got differs from want, empty when they match.
+func diff(want, got *shared.Stats) string {
+	switch {
+	case want.MessagesConsumed != got.MessagesConsumed:
+		return fmt.Sprintf("messages consumed: want %d, got %d", want.MessagesConsumed, got.MessagesConsumed)
+	case want.BotsCount != got.BotsCount:
+		return fmt.Sprintf("bots: want %d, got %d", want.BotsCount, got.BotsCount)
+	case want.NonBotsCount != got.NonBotsCount:
+		return fmt.Sprintf("non-bots: want %d, got %d", want.NonBotsCount, got.NonBotsCount)
+	case !maps.Equal(want.DistinctUsers, got.DistinctUsers):
+		return fmt.Sprintf("users: want %d entries, got %d: %v", len(want.DistinctUsers), len(got.DistinctUsers), truncate(got.DistinctUsers))
+	case !maps.Equal(want.DistinctServerURLs, got.DistinctServerURLs):
+		return fmt.Sprintf("server urls: want %v, got %v", truncate(want.DistinctServerURLs), truncate(got.DistinctServerURLs))
+	case !maps.Equal(want.WikiBots, got.WikiBots):
+		return fmt.Sprintf("wiki bots: want %v, got %v", truncate(want.WikiBots), truncate(got.WikiBots))
+	case !maps.Equal(want.WikiUsers, got.WikiUsers):
+		return fmt.Sprintf("wiki users: want %v, got %v", truncate(want.WikiUsers), truncate(got.WikiUsers))
+	default:
+		return ""
+	}
+}
+
+// truncate keeps failure messages readable for the large maps case.
+func truncate(m map[string]int) string {
+	const limit = 10
+	if len(m) <= limit {
+		return fmt.Sprint(m)
+	}
+
+	return fmt.Sprintf("%d entries", len(m))
+}
+
+func testEmptyStore(t *testing.T, s storage.Storage) {
+	t.Helper()
+
+	got := load(t, s)
+	if d := diff(shared.NewStats(), got); d != "" {
+		t.Errorf("expected empty stats from an empty store, %s", d)
+	}
+
+	// Callers add to the loaded maps straight away.
+	if got.DistinctUsers == nil || got.DistinctServerURLs == nil || got.WikiBots == nil || got.WikiUsers == nil {
+		t.Error("expected empty maps, got nil")
+	}
+}
+
+func testRoundTrip(t *testing.T, s storage.Storage) {
+	t.Helper()
+
+	save(t, s, sample())
+
+	if d := diff(sample(), load(t, s)); d != "" {
+		t.Errorf("loaded stats differ from saved, %s", d)
+	}
+}
+
+func testOverwrite(t *testing.T, s storage.Storage) {
+	t.Helper()
+
+	save(t, s, sample())
+
+	next := &shared.Stats{
+		MessagesConsumed:   1,
+		DistinctUsers:      map[string]int{"newcomer": 1},
+		BotsCount:          0,
+		NonBotsCount:       1,
+		DistinctServerURLs: map[string]int{"https://blub.com": 1},
+		WikiBots:           map[string]int{},
+		WikiUsers:          map[string]int{shared.WikiUserKey("https://blub.com", "newcomer"): 1},
+	}
+	save(t, s, next)
+
+	if d := diff(next, load(t, s)); d != "" {
+		t.Errorf("expected a save to replace the stats, not merge into them, %s", d)
+	}
+}
+
+func testIsolation(t *testing.T, s storage.Storage) {
+	t.Helper()
+
+	saved := sample()
+	save(t, s, saved)
+
+	saved.MessagesConsumed++
+	saved.DistinctUsers["blub"] = 99
+	saved.DistinctUsers["intruder"] = 1
+	delete(saved.DistinctServerURLs, "https://blub.com")
+
+	loaded := load(t, s)
+	if d := diff(sample(), loaded); d != "" {
+		t.Errorf("changing saved stats changed the store, %s", d)
+	}
+
+	loaded.BotsCount++
+	loaded.DistinctUsers["intruder"] = 1
+	delete(loaded.DistinctServerURLs, "https://blub.com")
+
+	if d := diff(sample(), load(t, s)); d != "" {
+		t.Errorf("changing loaded stats changed the store, %s", d)
+	}
+}
+
+func testLargeMaps(t *testing.T, s storage.Storage, size int) {
+	t.Helper()
+
+	big := shared.NewStats()
+
+	for i := range size {
+		big.DistinctUsers[fmt.Sprintf("user-%06d", i)] = i%7 + 1
+		big.WikiUsers[shared.WikiUserKey("https://wiki-00000.org", fmt.Sprintf("user-%06d", i))] = i%7 + 1
+		big.MessagesConsumed += i%7 + 1
+	}
+
+	for i := range max(size/10, 1) {
+		big.DistinctServerURLs[fmt.Sprintf("https://wiki-%05d.org", i)] = i%3 + 1
+	}
+
+	big.NonBotsCount = big.MessagesConsumed
+
+	save(t, s, big)
+
+	if d := diff(big, load(t, s)); d != "" {
+		t.Errorf("large maps did not round trip, %s", d)
+	}
+}
+
+func testConcurrent(t *testing.T, s storage.Storage, singleWriter bool) {
+	t.Helper()
+
+	const (
+		writers = 4
+		readers = 4
+		saves   = 10
+	)
+
+	if singleWriter {
+		save(t, s, consistent(1))
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		errs    []error
+		written = writers
+	)
+
+	if singleWriter {
+		written = 1
+	}
+
+	record := func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	}
+
+	for w := range written {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := range saves {
+				if err := s.SaveStats(consistent(w*saves + i + 1)); err != nil {
+					record(fmt.Errorf("save: %w", err))
+				}
+			}
+		}()
+	}
+
+	for range readers {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for range saves {
+				got, err := s.LoadStats()
+				if err != nil {
+					record(fmt.Errorf("load: %w", err))
+					continue
+				}
+
+				if !singleWriter {
+					if d := diff(consistent(got.MessagesConsumed), got); d != "" {
+						record(fmt.Errorf("%w: %s", errTornLoad, d))
+					}
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		t.Error(err)
+	}
+
+	final := load(t, s)
+
+	want := consistent(final.MessagesConsumed)
+	if singleWriter {
+		want = consistent(saves)
+	}
+
+	if d := diff(want, final); d != "" {
+		t.Errorf("expected the store to end on one of the saved stats, %s", d)
+	}
+}
+
+func testErrorPropagation(t *testing.T, s storage.Storage) {
+	t.Helper()
+
+	if err := s.SaveStats(sample()); err == nil {
+		t.Error("expected SaveStats on a broken backend to fail")
+	}
+
+	if stats, err := s.LoadStats(); err == nil {
+		t.Errorf("expected LoadStats on a broken backend to fail, got %+v", stats)
+	}
+}
@@ -0,0 +1,186 @@
+// Package tail streams ingested events to debugging clients as they arrive.
+package tail
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+	"github.com/codyonesock/backend_learning/ch-1/internal/sse"
+)
+
+var errTooManySubscribers = errors.New("too many tail subscribers")
+
+// Filter picks the events a subscriber wants. Empty fields match everything.
+type Filter struct {
+	ServerURL string
+	User      string
+	Bot       *bool
+}
+
+// ParseFilter reads server_url, user and bot from query params.
+func ParseFilter(r *http.Request) (Filter, error) {
+	q := r.URL.Query()
+
+	f := Filter{
+		ServerURL: q.Get("server_url"),
+		User:      q.Get("user"),
+		Bot:       nil,
+	}
+
+	if v := q.Get("bot"); v != "" {
+		bot, err := strconv.ParseBool(v)
+		if err != nil {
+			return Filter{}, fmt.Errorf("bot must be true or false: %w", err)
+		}
+
+		f.Bot = &bot
+	}
+
+	return f, nil
+}
+
+// Match reports whether rc passes the filter.
+func (f Filter) Match(rc shared.RecentChange) bool {
+	return (f.ServerURL == "" || f.ServerURL == rc.ServerURL) &&
+		(f.User == "" || f.User == rc.User) &&
+		(f.Bot == nil || *f.Bot == rc.Bot)
+}
+
+type subscriber struct {
+	filter Filter
+	events chan shared.RecentChange
+	// dropped is closed when the subscriber fell behind and was removed.
+	dropped chan struct{}
+}
+
+// Hub fans events out to tail subscribers. Publish never blocks: each subscriber has a
+// bounded buffer and is dropped once it is full. A nil *Hub drops every event.
+type Hub struct {
+	mu         sync.Mutex
+	subs       map[*subscriber]struct{}
+	bufferSize int
+	maxSubs    int
+	logger     *zap.Logger
+}
+
+// NewHub creates a Hub that buffers bufferSize events per subscriber and allows up to
+// maxSubs subscribers at once, zero means no limit.
+func NewHub(bufferSize, maxSubs int, logger *zap.Logger) *Hub {
+	return &Hub{
+		mu:         sync.Mutex{},
+		subs:       map[*subscriber]struct{}{},
+		bufferSize: max(bufferSize, 1),
+		maxSubs:    maxSubs,
+		logger:     logger,
+	}
+}
+
+// Publish hands rc to every subscriber whose filter matches.
+func (h *Hub) Publish(rc shared.RecentChange) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subs {
+		if !sub.filter.Match(rc) {
+			continue
+		}
+
+		select {
+		case sub.events <- rc:
+		default:
+			delete(h.subs, sub)
+			close(sub.dropped)
+			h.logger.Warn("Dropping slow tail subscriber", zap.Int("buffer", h.bufferSize))
+		}
+	}
+}
+
+// Subscribers returns the number of connected subscribers.
+func (h *Hub) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.subs)
+}
+
+func (h *Hub) subscribe(f Filter) (*subscriber, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.maxSubs > 0 && len(h.subs) >= h.maxSubs {
+		return nil, errTooManySubscribers
+	}
+
+	sub := &subscriber{
+		filter:  f,
+		events:  make(chan shared.RecentChange, h.bufferSize),
+		dropped: make(chan struct{}),
+	}
+	h.subs[sub] = struct{}{}
+
+	return sub, nil
+}
+
+func (h *Hub) unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	delete(h.subs, sub)
+	h.mu.Unlock()
+}
+
+// ServeHTTP streams matching events as Server-Sent Events until the client goes away or
+// falls behind. A dropped client gets a final "dropped" event if it can still take one.
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f, err := ParseFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sub, err := h.subscribe(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer h.unsubscribe(sub)
+
+	sw := sse.NewWriter(w)
+
+	if err := sw.Comment("tailing"); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(sse.KeepAlive)
+	defer ticker.Stop()
+
+	for {
+		var err error
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-sub.dropped:
+			_ = sw.Event("dropped", map[string]string{"reason": "buffer full"})
+			return
+		case event := <-sub.events:
+			err = sw.Event("", event)
+		case <-ticker.C:
+			err = sw.KeepAlive()
+		}
+
+		if err != nil {
+			h.logger.Debug("Tail subscriber gone", zap.Error(err))
+			return
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package tail_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+	"github.com/codyonesock/backend_learning/ch-1/internal/tail"
+)
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestTailFilters verifies a subscriber only gets the events matching its filter.
+func TestTailFilters(t *testing.T) {
+	t.Parallel()
+
+	hub := tail.NewHub(16, 0, zap.NewNop())
+	srv := httptest.NewServer(hub)
+	t.Cleanup(srv.Close)
+
+	res, err := http.Get(srv.URL + "?server_url=https://en.wiki.org&bot=false") //nolint:noctx // the server closes the stream on cleanup
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer res.Body.Close()
+
+	waitFor(t, func() bool { return hub.Subscribers() == 1 })
+
+	hub.Publish(shared.RecentChange{User: "bot", Bot: true, ServerURL: "https://en.wiki.org"})
+	hub.Publish(shared.RecentChange{User: "de", ServerURL: "https://de.wiki.org"})
+	hub.Publish(shared.RecentChange{User: "alice", ServerURL: "https://en.wiki.org"})
+
+	r := bufio.NewReader(res.Body)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+
+		var rc shared.RecentChange
+		if err := json.Unmarshal([]byte(data), &rc); err != nil {
+			t.Fatalf("failed to decode %q: %v", data, err)
+		}
+
+		if rc.User != "alice" {
+			t.Errorf("expected only alice's edit, got %+v", rc)
+		}
+
+		return
+	}
+}
+
+// stuckWriter lets the first write through, then blocks until released.
+type stuckWriter struct {
+	*httptest.ResponseRecorder
+
+	mu      sync.Mutex
+	writes  int
+	release chan struct{}
+}
+
+func (w *stuckWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	w.writes++
+	n := w.writes
+	w.mu.Unlock()
+
+	if n == 2 {
+		<-w.release
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.ResponseRecorder.Write(p)
+}
+
+func (w *stuckWriter) body() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.Body.String()
+}
+
+// TestSlowSubscriberDropped verifies Publish never blocks on a stuck client and drops it
+// once its buffer is full.
+func TestSlowSubscriberDropped(t *testing.T) {
+	t.Parallel()
+
+	hub := tail.NewHub(2, 0, zap.NewNop())
+	w := &stuckWriter{
+		ResponseRecorder: httptest.NewRecorder(),
+		mu:               sync.Mutex{},
+		writes:           0,
+		release:          make(chan struct{}),
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		hub.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	}()
+
+	waitFor(t, func() bool { return hub.Subscribers() == 1 })
+
+	// One event is stuck in Write, two fill the buffer, the fourth overflows it.
+	for range 4 {
+		hub.Publish(shared.RecentChange{User: "a", ServerURL: "https://en.wiki.org"})
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := hub.Subscribers(); n != 0 {
+		t.Fatalf("expected the slow subscriber to be dropped, got %d subscribers", n)
+	}
+
+	close(w.release)
+	<-done
+
+	if !strings.Contains(w.body(), "event: dropped") {
+		t.Errorf("expected a dropped event, got %q", w.body())
+	}
+}
+
+// TestTailLimits verifies bad filters and the subscriber cap are refused.
+func TestTailLimits(t *testing.T) {
+	t.Parallel()
+
+	hub := tail.NewHub(1, 1, zap.NewNop())
+
+	rec := httptest.NewRecorder()
+	hub.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?bot=maybe", nil))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("bad bot filter: expected 400, got %d", rec.Code)
+	}
+
+	srv := httptest.NewServer(hub)
+	t.Cleanup(srv.Close)
+
+	first, err := http.Get(srv.URL) //nolint:noctx // the server closes the stream on cleanup
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer first.Body.Close()
+
+	waitFor(t, func() bool { return hub.Subscribers() == 1 })
+
+	second, err := http.Get(srv.URL) //nolint:noctx // plain request in a test
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer second.Body.Close()
+
+	if second.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("over the cap: expected 503, got %d", second.StatusCode)
+	}
+}
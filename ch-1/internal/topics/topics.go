@@ -0,0 +1,196 @@
+// Package topics makes sure the Redpanda topics the app relies on exist with the expected settings.
+package topics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/config"
+)
+
+// Admin is the subset of kadm.Client used to provision topics.
+type Admin interface {
+	ListTopics(ctx context.Context, topics ...string) (kadm.TopicDetails, error)
+	DescribeTopicConfigs(ctx context.Context, topics ...string) (kadm.ResourceConfigs, error)
+	CreateTopic(
+		ctx context.Context,
+		partitions int32,
+		replicationFactor int16,
+		configs map[string]*string,
+		topic string,
+	) (kadm.CreateTopicResponse, error)
+}
+
+// Spec is a topic we expect to exist.
+type Spec struct {
+	Name              string
+	Partitions        int32
+	ReplicationFactor int16
+	Configs           map[string]string
+}
+
+// Drift is a setting on an existing topic that differs from its Spec.
+type Drift struct {
+	Topic   string
+	Setting string
+	Want    string
+	Got     string
+}
+
+// Result reports what Ensure did.
+type Result struct {
+	Created []string
+	Drift   []Drift
+}
+
+// Specs builds the main, DLQ and snapshot topic specs from config.
+// Snapshot topics only need the latest value per key so they are compacted.
+func Specs(cfg *config.Config) []Spec {
+	base := map[string]string{
+		"compression.type": cfg.TopicCompression,
+		"retention.ms":     strconv.FormatInt(cfg.TopicRetention.Milliseconds(), 10),
+		"cleanup.policy":   "delete",
+	}
+
+	specs := []Spec{
+		newSpec(cfg, cfg.RedpandaTopic, base),
+		newSpec(cfg, cfg.RedpandaDLQTopic, base),
+	}
+
+	for _, name := range cfg.RedpandaSnapshotTopics {
+		snapshot := map[string]string{
+			"compression.type": cfg.TopicCompression,
+			"cleanup.policy":   "compact",
+		}
+		specs = append(specs, newSpec(cfg, name, snapshot))
+	}
+
+	return specs
+}
+
+func newSpec(cfg *config.Config, name string, configs map[string]string) Spec {
+	return Spec{
+		Name:              name,
+		Partitions:        cfg.TopicPartitions,
+		ReplicationFactor: cfg.TopicReplicationFactor,
+		Configs:           configs,
+	}
+}
+
+// Ensure creates any missing topics and logs a warning for every setting that has drifted.
+// Existing topics are never altered, since changing partitions or retention should be a deliberate step.
+func Ensure(ctx context.Context, admin Admin, specs []Spec, logger *zap.Logger) (*Result, error) {
+	names := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		names = append(names, spec.Name)
+	}
+
+	details, err := admin.ListTopics(ctx, names...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list topics: %w", err)
+	}
+
+	result := &Result{Created: []string{}, Drift: []Drift{}}
+
+	for _, spec := range specs {
+		if !details.Has(spec.Name) {
+			if err := create(ctx, admin, spec); err != nil {
+				return result, err
+			}
+
+			logger.Info("Created topic",
+				zap.String("topic", spec.Name),
+				zap.Int32("partitions", spec.Partitions),
+				zap.Int16("replication_factor", spec.ReplicationFactor),
+			)
+			result.Created = append(result.Created, spec.Name)
+
+			continue
+		}
+
+		drift, err := checkDrift(ctx, admin, spec, details[spec.Name])
+		if err != nil {
+			return result, err
+		}
+
+		for _, d := range drift {
+			logger.Warn("Topic setting drifted from config",
+				zap.String("topic", d.Topic),
+				zap.String("setting", d.Setting),
+				zap.String("want", d.Want),
+				zap.String("got", d.Got),
+			)
+		}
+
+		result.Drift = append(result.Drift, drift...)
+	}
+
+	return result, nil
+}
+
+func create(ctx context.Context, admin Admin, spec Spec) error {
+	configs := make(map[string]*string, len(spec.Configs))
+	for k, v := range spec.Configs {
+		configs[k] = kadm.StringPtr(v)
+	}
+
+	_, err := admin.CreateTopic(ctx, spec.Partitions, spec.ReplicationFactor, configs, spec.Name)
+	if err != nil && !errors.Is(err, kerr.TopicAlreadyExists) {
+		return fmt.Errorf("failed to create topic %s: %w", spec.Name, err)
+	}
+
+	return nil
+}
+
+// checkDrift compares an existing topic's layout and configs against its spec.
+func checkDrift(ctx context.Context, admin Admin, spec Spec, detail kadm.TopicDetail) ([]Drift, error) {
+	var drift []Drift
+
+	if got := int32(len(detail.Partitions)); got != spec.Partitions {
+		drift = append(drift, newDrift(spec.Name, "partitions", spec.Partitions, got))
+	}
+
+	if len(detail.Partitions) > 0 {
+		if got := int16(len(detail.Partitions.Sorted()[0].Replicas)); got != spec.ReplicationFactor {
+			drift = append(drift, newDrift(spec.Name, "replication_factor", spec.ReplicationFactor, got))
+		}
+	}
+
+	configs, err := admin.DescribeTopicConfigs(ctx, spec.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe topic %s: %w", spec.Name, err)
+	}
+
+	rc, err := configs.On(spec.Name, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe topic %s: %w", spec.Name, err)
+	}
+
+	current := make(map[string]string, len(rc.Configs))
+	for _, c := range rc.Configs {
+		current[c.Key] = c.MaybeValue()
+	}
+
+	for key, want := range spec.Configs {
+		if got := current[key]; got != want {
+			drift = append(drift, Drift{Topic: spec.Name, Setting: key, Want: want, Got: got})
+		}
+	}
+
+	return drift, nil
+}
+
+func newDrift[T int16 | int32](topic, setting string, want, got T) Drift {
+	return Drift{
+		Topic:   topic,
+		Setting: setting,
+		Want:    strconv.Itoa(int(want)),
+		Got:     strconv.Itoa(int(got)),
+	}
+}
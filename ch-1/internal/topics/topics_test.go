@@ -0,0 +1,139 @@
+package topics_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kadm"
+	"go.uber.org/zap"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/config"
+	"github.com/codyonesock/backend_learning/ch-1/internal/topics"
+)
+
+// mockAdmin serves canned topic details and records created topics.
+type mockAdmin struct {
+	details kadm.TopicDetails
+	configs kadm.ResourceConfigs
+	created map[string]int32
+}
+
+func (m *mockAdmin) ListTopics(_ context.Context, _ ...string) (kadm.TopicDetails, error) {
+	return m.details, nil
+}
+
+func (m *mockAdmin) DescribeTopicConfigs(_ context.Context, _ ...string) (kadm.ResourceConfigs, error) {
+	return m.configs, nil
+}
+
+func (m *mockAdmin) CreateTopic(
+	_ context.Context,
+	partitions int32,
+	_ int16,
+	_ map[string]*string,
+	topic string,
+) (kadm.CreateTopicResponse, error) {
+	m.created[topic] = partitions
+
+	//nolint:exhaustruct
+	return kadm.CreateTopicResponse{Topic: topic}, nil
+}
+
+//nolint:exhaustruct
+func testConfig() *config.Config {
+	return &config.Config{
+		RedpandaTopic:          "wikimedia-changes-proto",
+		RedpandaDLQTopic:       "wikimedia-changes-dlq",
+		RedpandaSnapshotTopics: []string{"stats-snapshots"},
+		TopicPartitions:        3,
+		TopicReplicationFactor: 1,
+		TopicCompression:       "lz4",
+		TopicRetention:         24 * time.Hour,
+	}
+}
+
+// TestEnsureCreatesMissingTopics verifies every missing topic gets created.
+func TestEnsureCreatesMissingTopics(t *testing.T) {
+	t.Parallel()
+
+	admin := &mockAdmin{details: kadm.TopicDetails{}, configs: nil, created: map[string]int32{}}
+
+	result, err := topics.Ensure(t.Context(), admin, topics.Specs(testConfig()), zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(result.Created) != 3 {
+		t.Fatalf("expected 3 topics created, got %v", result.Created)
+	}
+
+	if admin.created["wikimedia-changes-proto"] != 3 {
+		t.Errorf("expected main topic with 3 partitions, got %d", admin.created["wikimedia-changes-proto"])
+	}
+}
+
+// TestEnsureReportsDrift verifies existing topics are compared against config and left alone.
+//
+//nolint:exhaustruct
+func TestEnsureReportsDrift(t *testing.T) {
+	t.Parallel()
+
+	cfg := testConfig()
+	cfg.RedpandaSnapshotTopics = nil
+
+	existing := func(name string) kadm.TopicDetail {
+		return kadm.TopicDetail{
+			Topic: name,
+			Partitions: kadm.PartitionDetails{
+				0: {Topic: name, Partition: 0, Replicas: []int32{1}},
+			},
+		}
+	}
+
+	admin := &mockAdmin{
+		details: kadm.TopicDetails{
+			"wikimedia-changes-proto": existing("wikimedia-changes-proto"),
+			"wikimedia-changes-dlq":   existing("wikimedia-changes-dlq"),
+		},
+		configs: kadm.ResourceConfigs{
+			{
+				Name: "wikimedia-changes-proto",
+				Configs: []kadm.Config{
+					{Key: "compression.type", Value: kadm.StringPtr("producer")},
+					{Key: "retention.ms", Value: kadm.StringPtr("86400000")},
+					{Key: "cleanup.policy", Value: kadm.StringPtr("delete")},
+				},
+			},
+			{
+				Name: "wikimedia-changes-dlq",
+				Configs: []kadm.Config{
+					{Key: "compression.type", Value: kadm.StringPtr("lz4")},
+					{Key: "retention.ms", Value: kadm.StringPtr("86400000")},
+					{Key: "cleanup.policy", Value: kadm.StringPtr("delete")},
+				},
+			},
+		},
+		created: map[string]int32{},
+	}
+
+	result, err := topics.Ensure(t.Context(), admin, topics.Specs(cfg), zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(admin.created) != 0 {
+		t.Errorf("expected no topics created, got %v", admin.created)
+	}
+
+	// Both topics have 1 partition instead of 3, and the main topic has the wrong compression.
+	if len(result.Drift) != 3 {
+		t.Fatalf("expected 3 drifted settings, got %+v", result.Drift)
+	}
+
+	for _, d := range result.Drift {
+		if d.Setting == "compression.type" && (d.Topic != "wikimedia-changes-proto" || d.Got != "producer") {
+			t.Errorf("unexpected compression drift %+v", d)
+		}
+	}
+}
@@ -0,0 +1,530 @@
+// Package wal is an append-only write-ahead log of stats update batches, so updates applied
+// since the last snapshot survive a crash.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+)
+
+// SyncPolicy decides when appended batches are fsynced.
+type SyncPolicy string
+
+const (
+	// SyncAlways fsyncs every append before it returns.
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval fsyncs in the background every sync interval, a crash loses at most that much.
+	SyncInterval SyncPolicy = "interval"
+	// SyncNever leaves flushing to the OS, which survives a process crash but not a power loss.
+	SyncNever SyncPolicy = "never"
+)
+
+const (
+	segmentPrefix = "wal-"
+	segmentExt    = ".log"
+	// releasedName holds the last released sequence, see Release.
+	releasedName = "released"
+	// headerSize is a big-endian payload length followed by its CRC-32C.
+	headerSize = 8
+	// maxRecordSize guards replay against a garbage length in a torn header.
+	maxRecordSize = 64 << 20
+)
+
+var (
+	errInvalidSyncPolicy = errors.New("sync policy must be always, interval or never")
+	errClosed            = errors.New("wal is closed")
+	errTornRecord        = errors.New("torn record")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// ParseSyncPolicy validates a policy name.
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch p := SyncPolicy(s); p {
+	case SyncAlways, SyncInterval, SyncNever:
+		return p, nil
+	default:
+		return "", fmt.Errorf("%w: got %q", errInvalidSyncPolicy, s)
+	}
+}
+
+// Log appends batches to numbered segment files in a directory. Checkpoint seals the active
+// segment when a snapshot is taken and Release removes sealed segments once it is saved, so
+// the log only ever holds what the latest saved snapshot is missing.
+type Log struct {
+	mu       sync.Mutex
+	dir      string
+	policy   SyncPolicy
+	file     *os.File
+	seq      uint64
+	size     int64
+	unsynced bool
+	closed   bool
+	stop     chan struct{}
+	done     chan struct{}
+	// released is the last sequence Release was called with. Replay skips segments up to it
+	// even when a crash left them behind.
+	released uint64
+}
+
+// Open creates dir if needed, cuts off a torn record left at the end of the newest segment by
+// a crash, and appends to that segment. syncInterval only applies to SyncInterval.
+func Open(dir string, policy SyncPolicy, syncInterval time.Duration) (*Log, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create wal dir: %w", err)
+	}
+
+	l := &Log{
+		mu:       sync.Mutex{},
+		dir:      dir,
+		policy:   policy,
+		file:     nil,
+		seq:      1,
+		size:     0,
+		unsynced: false,
+		closed:   false,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		released: 0,
+	}
+
+	released, err := readReleased(filepath.Join(dir, releasedName))
+	if err != nil {
+		return nil, err
+	}
+
+	l.released = released
+
+	segs, err := l.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(segs) > 0 {
+		l.seq = segs[len(segs)-1]
+
+		if err := repairTail(l.path(l.seq)); err != nil {
+			return nil, err
+		}
+	}
+
+	// New segments must come after the released ones, or Replay would skip them.
+	l.seq = max(l.seq, released+1)
+
+	if err := l.openSegment(); err != nil {
+		return nil, err
+	}
+
+	if policy == SyncInterval && syncInterval > 0 {
+		go l.syncLoop(syncInterval)
+	} else {
+		close(l.done)
+	}
+
+	return l, nil
+}
+
+// Append writes one batch as a single record.
+func (l *Log) Append(batch []shared.RecentChange) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("failed to marshal wal batch: %w", err)
+	}
+
+	record := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload))) // #nosec G115 -- batches are far below 4GiB
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	copy(record[headerSize:], payload)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return errClosed
+	}
+
+	if _, err := l.file.Write(record); err != nil {
+		// Cut off whatever part of the record made it so later appends stay readable.
+		_ = l.file.Truncate(l.size)
+		return fmt.Errorf("failed to write wal record: %w", err)
+	}
+
+	l.size += int64(len(record))
+
+	if l.policy == SyncAlways {
+		if err := l.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync wal: %w", err)
+		}
+
+		return nil
+	}
+
+	l.unsynced = true
+
+	return nil
+}
+
+// Replay calls fn with every logged batch, oldest first, skipping released segments. It returns
+// the number of updates replayed.
+func (l *Log) Replay(fn func([]shared.RecentChange)) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	segs, err := l.segments()
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+
+	for _, seq := range segs {
+		if seq <= l.released {
+			continue
+		}
+
+		n, err := replaySegment(l.path(seq), fn)
+		total += n
+
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+// Checkpoint seals the active segment and starts a new one. Everything appended before it is
+// covered by the snapshot taken alongside, pass the returned sequence to Release once that
+// snapshot is saved.
+func (l *Log) Checkpoint() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return 0, errClosed
+	}
+
+	sealed := l.seq
+
+	if err := l.file.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync wal: %w", err)
+	}
+
+	if err := l.file.Close(); err != nil {
+		return 0, fmt.Errorf("failed to close wal segment: %w", err)
+	}
+
+	l.seq++
+	l.unsynced = false
+
+	if err := l.openSegment(); err != nil {
+		return 0, err
+	}
+
+	return sealed, nil
+}
+
+// Release removes sealed segments up to and including seq. It first records seq in one atomic
+// rename, so a crash while removing them can't replay what the saved snapshot already holds.
+// A crash between the save and Release still replays the sealed segments on top of it.
+func (l *Log) Release(seq uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if seq > l.released {
+		if err := writeReleased(filepath.Join(l.dir, releasedName), seq); err != nil {
+			return err
+		}
+
+		l.released = seq
+	}
+
+	segs, err := l.segments()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+
+	for _, s := range segs {
+		if s > seq || s == l.seq {
+			continue
+		}
+
+		if err := os.Remove(l.path(s)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("failed to remove wal segments: %w", err)
+	}
+
+	return nil
+}
+
+// Close syncs and closes the active segment.
+func (l *Log) Close() error {
+	l.mu.Lock()
+
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+
+	l.closed = true
+	close(l.stop)
+	l.mu.Unlock()
+
+	<-l.done
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := errors.Join(l.file.Sync(), l.file.Close()); err != nil {
+		return fmt.Errorf("failed to close wal: %w", err)
+	}
+
+	return nil
+}
+
+func (l *Log) syncLoop(interval time.Duration) {
+	defer close(l.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			if l.unsynced && !l.closed {
+				// A failed sync is retried on the next tick.
+				if err := l.file.Sync(); err == nil {
+					l.unsynced = false
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+func (l *Log) openSegment() error {
+	f, err := os.OpenFile(l.path(l.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open wal segment: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to stat wal segment: %w", err)
+	}
+
+	l.file = f
+	l.size = info.Size()
+
+	return nil
+}
+
+func (l *Log) path(seq uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%s%020d%s", segmentPrefix, seq, segmentExt))
+}
+
+// segments lists segment sequence numbers, oldest first.
+func (l *Log) segments() ([]uint64, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list wal dir: %w", err)
+	}
+
+	var segs []uint64
+
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		segs = append(segs, seq)
+	}
+
+	slices.Sort(segs)
+
+	return segs, nil
+}
+
+// readReleased reads the released sequence, zero when nothing was released yet.
+func readReleased(path string) (uint64, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- path is inside the wal dir
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to read released wal sequence: %w", err)
+	}
+
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse released wal sequence: %w", err)
+	}
+
+	return seq, nil
+}
+
+// writeReleased replaces the released sequence through a synced temp file and a rename.
+func writeReleased(path string, seq uint64) error {
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600) // #nosec G304 -- path is inside the wal dir
+	if err != nil {
+		return fmt.Errorf("failed to write released wal sequence: %w", err)
+	}
+
+	_, err = f.WriteString(strconv.FormatUint(seq, 10))
+	if err := errors.Join(err, f.Sync(), f.Close()); err != nil {
+		return fmt.Errorf("failed to write released wal sequence: %w", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write released wal sequence: %w", err)
+	}
+
+	return nil
+}
+
+// replaySegment applies every whole record. A torn record ends the segment quietly, it can only
+// be the last write before a crash and was never acknowledged.
+func replaySegment(path string, fn func([]shared.RecentChange)) (int, error) {
+	f, err := os.Open(path) // #nosec G304 -- path comes from listing the wal dir
+	if err != nil {
+		return 0, fmt.Errorf("failed to open wal segment: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	total := 0
+
+	for {
+		batch, _, err := readRecord(r)
+		if errors.Is(err, io.EOF) || errors.Is(err, errTornRecord) {
+			return total, nil
+		}
+
+		if err != nil {
+			return total, err
+		}
+
+		fn(batch)
+		total += len(batch)
+	}
+}
+
+// repairTail truncates a segment after its last whole record so new appends are readable.
+func repairTail(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0o600) // #nosec G304 -- path comes from listing the wal dir
+	if err != nil {
+		return fmt.Errorf("failed to open wal segment: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	var good int64
+
+	for {
+		_, n, err := readRecord(r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if errors.Is(err, errTornRecord) {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		good += n
+	}
+
+	if err := f.Truncate(good); err != nil {
+		return fmt.Errorf("failed to truncate torn wal record: %w", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync wal segment: %w", err)
+	}
+
+	return nil
+}
+
+// readRecord reads one record and its size on disk. A clean end of file is io.EOF, anything
+// short or failing its checksum is errTornRecord.
+func readRecord(r *bufio.Reader) ([]shared.RecentChange, int64, error) {
+	var header [headerSize]byte
+
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, 0, io.EOF
+		}
+
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, 0, errTornRecord
+		}
+
+		return nil, 0, fmt.Errorf("failed to read wal record: %w", err)
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > maxRecordSize {
+		return nil, 0, errTornRecord
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, 0, errTornRecord
+		}
+
+		return nil, 0, fmt.Errorf("failed to read wal record: %w", err)
+	}
+
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errTornRecord
+	}
+
+	var batch []shared.RecentChange
+	if err := json.Unmarshal(payload, &batch); err != nil {
+		return nil, 0, errTornRecord
+	}
+
+	return batch, int64(headerSize) + int64(size), nil
+}
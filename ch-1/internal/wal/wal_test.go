@@ -0,0 +1,319 @@
+package wal_test
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/codyonesock/backend_learning/ch-1/internal/shared"
+	"github.com/codyonesock/backend_learning/ch-1/internal/wal"
+)
+
+const (
+	crashDirEnv = "WAL_CRASH_DIR"
+	batchSize   = 10
+)
+
+func batch(n int) []shared.RecentChange {
+	out := make([]shared.RecentChange, batchSize)
+	for i := range out {
+		out[i] = shared.RecentChange{User: fmt.Sprintf("user-%d", n), ServerURL: "https://blub.com", Bot: i%2 == 0}
+	}
+
+	return out
+}
+
+func open(t *testing.T, dir string) *wal.Log {
+	t.Helper()
+
+	l, err := wal.Open(dir, wal.SyncAlways, 0)
+	if err != nil {
+		t.Fatalf("failed to open wal: %v", err)
+	}
+
+	t.Cleanup(func() { _ = l.Close() })
+
+	return l
+}
+
+// replay returns every logged batch, failing on any that did not come back whole and in
+// order starting from batch first.
+func replay(t *testing.T, l *wal.Log, first int) [][]shared.RecentChange {
+	t.Helper()
+
+	var batches [][]shared.RecentChange
+
+	n, err := l.Replay(func(b []shared.RecentChange) {
+		batches = append(batches, b)
+	})
+	if err != nil {
+		t.Fatalf("failed to replay wal: %v", err)
+	}
+
+	if n != len(batches)*batchSize {
+		t.Errorf("expected %d updates, got %d", len(batches)*batchSize, n)
+	}
+
+	for i, b := range batches {
+		if len(b) != batchSize || b[0].User != fmt.Sprintf("user-%d", first+i) {
+			t.Fatalf("batch %d came back wrong: %+v", i, b)
+		}
+	}
+
+	return batches
+}
+
+func segments(t *testing.T, dir string) []string {
+	t.Helper()
+
+	matches, err := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if err != nil {
+		t.Fatalf("failed to list segments: %v", err)
+	}
+
+	return matches
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	t.Parallel()
+
+	for _, s := range []string{"always", "interval", "never"} {
+		if _, err := wal.ParseSyncPolicy(s); err != nil {
+			t.Errorf("expected %q to parse, got %v", s, err)
+		}
+	}
+
+	if _, err := wal.ParseSyncPolicy("sometimes"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
+
+// TestCheckpointRelease verifies released segments are gone and later appends are kept.
+func TestCheckpointRelease(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	l := open(t, dir)
+
+	for i := range 2 {
+		if err := l.Append(batch(i)); err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+	}
+
+	seq, err := l.Checkpoint()
+	if err != nil {
+		t.Fatalf("failed to checkpoint: %v", err)
+	}
+
+	if err := l.Append(batch(2)); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+
+	if got := len(replay(t, l, 0)); got != 3 {
+		t.Fatalf("expected 3 batches before release, got %d", got)
+	}
+
+	if err := l.Release(seq); err != nil {
+		t.Fatalf("failed to release: %v", err)
+	}
+
+	if got := len(replay(t, l, 2)); got != 1 {
+		t.Errorf("expected only the batch after the checkpoint, got %d", got)
+	}
+
+	if got := len(segments(t, dir)); got != 1 {
+		t.Errorf("expected 1 segment left, got %d", got)
+	}
+}
+
+// TestReleaseInterrupted verifies segments a crash left behind during Release aren't replayed
+// after a restart, and segments opened after it still are.
+func TestReleaseInterrupted(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	l, err := wal.Open(dir, wal.SyncAlways, 0)
+	if err != nil {
+		t.Fatalf("failed to open wal: %v", err)
+	}
+
+	if err := l.Append(batch(0)); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+
+	seq, err := l.Checkpoint()
+	if err != nil {
+		t.Fatalf("failed to checkpoint: %v", err)
+	}
+
+	sealed := segments(t, dir)[0]
+
+	data, err := os.ReadFile(sealed)
+	if err != nil {
+		t.Fatalf("failed to read segment: %v", err)
+	}
+
+	if err := l.Release(seq); err != nil {
+		t.Fatalf("failed to release: %v", err)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatalf("failed to close wal: %v", err)
+	}
+
+	// Put the sealed segment back as if the crash came before it was removed, and drop the
+	// empty active one so nothing newer is left on disk.
+	for _, seg := range segments(t, dir) {
+		if err := os.Remove(seg); err != nil {
+			t.Fatalf("failed to remove segment: %v", err)
+		}
+	}
+
+	if err := os.WriteFile(sealed, data, 0o600); err != nil {
+		t.Fatalf("failed to restore segment: %v", err)
+	}
+
+	l = open(t, dir)
+
+	if got := len(replay(t, l, 1)); got != 0 {
+		t.Fatalf("expected the released segment skipped, got %d batches", got)
+	}
+
+	if err := l.Append(batch(1)); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+
+	if got := len(replay(t, l, 1)); got != 1 {
+		t.Errorf("expected the batch appended after the restart, got %d", got)
+	}
+}
+
+// TestTornTail verifies a record cut short by a crash is dropped and appends after it replay.
+func TestTornTail(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	l, err := wal.Open(dir, wal.SyncNever, 0)
+	if err != nil {
+		t.Fatalf("failed to open wal: %v", err)
+	}
+
+	for i := range 2 {
+		if err := l.Append(batch(i)); err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatalf("failed to close wal: %v", err)
+	}
+
+	path := segments(t, dir)[0]
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat segment: %v", err)
+	}
+
+	if err := os.Truncate(path, info.Size()-5); err != nil {
+		t.Fatalf("failed to tear the last record: %v", err)
+	}
+
+	reopened := open(t, dir)
+	if got := len(replay(t, reopened, 0)); got != 1 {
+		t.Fatalf("expected the torn batch to be dropped, got %d batches", got)
+	}
+
+	if err := reopened.Append(batch(1)); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+
+	if got := len(replay(t, reopened, 0)); got != 2 {
+		t.Errorf("expected the batch appended after repair to replay, got %d batches", got)
+	}
+}
+
+// TestRecoveryAfterKill kills a process appending as fast as it can and checks every
+// acknowledged batch survives, nothing half written is replayed, and the log takes appends again.
+func TestRecoveryAfterKill(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCrashHelper$") // #nosec G204 -- re-runs this test binary
+	cmd.Env = append(os.Environ(), crashDirEnv+"="+dir)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("failed to pipe helper output: %v", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start helper: %v", err)
+	}
+
+	const killAfter = 50
+
+	acked := 0
+
+	sc := bufio.NewScanner(stdout)
+	for acked < killAfter && sc.Scan() {
+		if sc.Text() == "ok" {
+			acked++
+		}
+	}
+
+	if err := cmd.Process.Kill(); err != nil {
+		t.Fatalf("failed to kill helper: %v", err)
+	}
+
+	_ = cmd.Wait()
+
+	if acked < killAfter {
+		t.Fatalf("helper stopped early after %d appends", acked)
+	}
+
+	l := open(t, dir)
+
+	batches := replay(t, l, 0)
+	if len(batches) < acked {
+		t.Fatalf("expected at least the %d acknowledged batches, got %d", acked, len(batches))
+	}
+
+	if err := l.Append(batch(len(batches))); err != nil {
+		t.Fatalf("failed to append after recovery: %v", err)
+	}
+
+	if got := len(replay(t, l, 0)); got != len(batches)+1 {
+		t.Errorf("expected %d batches after appending, got %d", len(batches)+1, got)
+	}
+}
+
+// TestCrashHelper appends until it is killed. It only runs as TestRecoveryAfterKill's child.
+func TestCrashHelper(t *testing.T) {
+	t.Parallel()
+
+	dir := os.Getenv(crashDirEnv)
+	if dir == "" {
+		t.Skip("only runs as a child of TestRecoveryAfterKill")
+	}
+
+	l, err := wal.Open(dir, wal.SyncAlways, 0)
+	if err != nil {
+		t.Fatalf("failed to open wal: %v", err)
+	}
+
+	for i := 0; ; i++ {
+		if err := l.Append(batch(i)); err != nil {
+			t.Fatalf("failed to append: %v", err)
+		}
+
+		fmt.Println("ok") //nolint:forbidigo // acknowledges the append to the parent
+	}
+}
@@ -0,0 +1,474 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        v6.31.1
+// source: ch-6/proto/stats.proto
+
+package proto
+
+import (
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// Stats is a full copy of the stats, as statsctl exports them.
+type Stats struct {
+	state              protoimpl.MessageState `protogen:"open.v1"`
+	MessagesConsumed   int64                  `protobuf:"varint,1,opt,name=messages_consumed,json=messagesConsumed,proto3" json:"messages_consumed,omitempty"`
+	DistinctUsers      map[string]int64       `protobuf:"bytes,2,rep,name=distinct_users,json=distinctUsers,proto3" json:"distinct_users,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	BotsCount          int64                  `protobuf:"varint,3,opt,name=bots_count,json=botsCount,proto3" json:"bots_count,omitempty"`
+	NonBotsCount       int64                  `protobuf:"varint,4,opt,name=non_bots_count,json=nonBotsCount,proto3" json:"non_bots_count,omitempty"`
+	DistinctServerUrls map[string]int64       `protobuf:"bytes,5,rep,name=distinct_server_urls,json=distinctServerUrls,proto3" json:"distinct_server_urls,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	// wiki_bots counts bot edits per server URL.
+	WikiBots map[string]int64 `protobuf:"bytes,6,rep,name=wiki_bots,json=wikiBots,proto3" json:"wiki_bots,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	// wiki_users counts edits per "server_url|user".
+	WikiUsers     map[string]int64 `protobuf:"bytes,7,rep,name=wiki_users,json=wikiUsers,proto3" json:"wiki_users,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Stats) Reset() {
+	*x = Stats{}
+	mi := &file_ch_6_proto_stats_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Stats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Stats) ProtoMessage() {}
+
+func (x *Stats) ProtoReflect() protoreflect.Message {
+	mi := &file_ch_6_proto_stats_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Stats.ProtoReflect.Descriptor instead.
+func (*Stats) Descriptor() ([]byte, []int) {
+	return file_ch_6_proto_stats_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Stats) GetMessagesConsumed() int64 {
+	if x != nil {
+		return x.MessagesConsumed
+	}
+	return 0
+}
+
+func (x *Stats) GetDistinctUsers() map[string]int64 {
+	if x != nil {
+		return x.DistinctUsers
+	}
+	return nil
+}
+
+func (x *Stats) GetBotsCount() int64 {
+	if x != nil {
+		return x.BotsCount
+	}
+	return 0
+}
+
+func (x *Stats) GetNonBotsCount() int64 {
+	if x != nil {
+		return x.NonBotsCount
+	}
+	return 0
+}
+
+func (x *Stats) GetDistinctServerUrls() map[string]int64 {
+	if x != nil {
+		return x.DistinctServerUrls
+	}
+	return nil
+}
+
+func (x *Stats) GetWikiBots() map[string]int64 {
+	if x != nil {
+		return x.WikiBots
+	}
+	return nil
+}
+
+func (x *Stats) GetWikiUsers() map[string]int64 {
+	if x != nil {
+		return x.WikiUsers
+	}
+	return nil
+}
+
+// StatsResponse is the GET /stats body for protobuf clients, the same counts as the JSON.
+type StatsResponse struct {
+	state              protoimpl.MessageState `protogen:"open.v1"`
+	MessagesConsumed   int64                  `protobuf:"varint,1,opt,name=messages_consumed,json=messagesConsumed,proto3" json:"messages_consumed,omitempty"`
+	DistinctUsers      int64                  `protobuf:"varint,2,opt,name=distinct_users,json=distinctUsers,proto3" json:"distinct_users,omitempty"`
+	BotsCount          int64                  `protobuf:"varint,3,opt,name=bots_count,json=botsCount,proto3" json:"bots_count,omitempty"`
+	NonBotsCount       int64                  `protobuf:"varint,4,opt,name=non_bots_count,json=nonBotsCount,proto3" json:"non_bots_count,omitempty"`
+	DistinctServerUrls int64                  `protobuf:"varint,5,opt,name=distinct_server_urls,json=distinctServerUrls,proto3" json:"distinct_server_urls,omitempty"`
+	// rates is only set for the live stats, not history reads.
+	Rates         *Rates `protobuf:"bytes,6,opt,name=rates,proto3" json:"rates,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StatsResponse) Reset() {
+	*x = StatsResponse{}
+	mi := &file_ch_6_proto_stats_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatsResponse) ProtoMessage() {}
+
+func (x *StatsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_ch_6_proto_stats_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatsResponse.ProtoReflect.Descriptor instead.
+func (*StatsResponse) Descriptor() ([]byte, []int) {
+	return file_ch_6_proto_stats_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *StatsResponse) GetMessagesConsumed() int64 {
+	if x != nil {
+		return x.MessagesConsumed
+	}
+	return 0
+}
+
+func (x *StatsResponse) GetDistinctUsers() int64 {
+	if x != nil {
+		return x.DistinctUsers
+	}
+	return 0
+}
+
+func (x *StatsResponse) GetBotsCount() int64 {
+	if x != nil {
+		return x.BotsCount
+	}
+	return 0
+}
+
+func (x *StatsResponse) GetNonBotsCount() int64 {
+	if x != nil {
+		return x.NonBotsCount
+	}
+	return 0
+}
+
+func (x *StatsResponse) GetDistinctServerUrls() int64 {
+	if x != nil {
+		return x.DistinctServerUrls
+	}
+	return 0
+}
+
+func (x *StatsResponse) GetRates() *Rates {
+	if x != nil {
+		return x.Rates
+	}
+	return nil
+}
+
+// RateWindows holds one value per moving average window.
+type RateWindows struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	M1            float64                `protobuf:"fixed64,1,opt,name=m1,proto3" json:"m1,omitempty"`
+	M5            float64                `protobuf:"fixed64,2,opt,name=m5,proto3" json:"m5,omitempty"`
+	M15           float64                `protobuf:"fixed64,3,opt,name=m15,proto3" json:"m15,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RateWindows) Reset() {
+	*x = RateWindows{}
+	mi := &file_ch_6_proto_stats_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RateWindows) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RateWindows) ProtoMessage() {}
+
+func (x *RateWindows) ProtoReflect() protoreflect.Message {
+	mi := &file_ch_6_proto_stats_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RateWindows.ProtoReflect.Descriptor instead.
+func (*RateWindows) Descriptor() ([]byte, []int) {
+	return file_ch_6_proto_stats_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *RateWindows) GetM1() float64 {
+	if x != nil {
+		return x.M1
+	}
+	return 0
+}
+
+func (x *RateWindows) GetM5() float64 {
+	if x != nil {
+		return x.M5
+	}
+	return 0
+}
+
+func (x *RateWindows) GetM15() float64 {
+	if x != nil {
+		return x.M15
+	}
+	return 0
+}
+
+// Rates are exponentially weighted moving averages of how fast events arrive.
+type Rates struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	EventsPerSec  *RateWindows           `protobuf:"bytes,1,opt,name=events_per_sec,json=eventsPerSec,proto3" json:"events_per_sec,omitempty"`
+	BotsPerSec    *RateWindows           `protobuf:"bytes,2,opt,name=bots_per_sec,json=botsPerSec,proto3" json:"bots_per_sec,omitempty"`
+	NonBotsPerSec *RateWindows           `protobuf:"bytes,3,opt,name=non_bots_per_sec,json=nonBotsPerSec,proto3" json:"non_bots_per_sec,omitempty"`
+	// bot_ratio is the share of events from bots in each window.
+	BotRatio *RateWindows `protobuf:"bytes,4,opt,name=bot_ratio,json=botRatio,proto3" json:"bot_ratio,omitempty"`
+	// bot_ratio_trend is the 1m bot ratio minus the 15m one.
+	BotRatioTrend    float64 `protobuf:"fixed64,5,opt,name=bot_ratio_trend,json=botRatioTrend,proto3" json:"bot_ratio_trend,omitempty"`
+	PeakEventsPerSec float64 `protobuf:"fixed64,6,opt,name=peak_events_per_sec,json=peakEventsPerSec,proto3" json:"peak_events_per_sec,omitempty"`
+	// peak_at_unix_ms is when the peak was reached, zero before any events.
+	PeakAtUnixMs  int64 `protobuf:"varint,7,opt,name=peak_at_unix_ms,json=peakAtUnixMs,proto3" json:"peak_at_unix_ms,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Rates) Reset() {
+	*x = Rates{}
+	mi := &file_ch_6_proto_stats_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Rates) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Rates) ProtoMessage() {}
+
+func (x *Rates) ProtoReflect() protoreflect.Message {
+	mi := &file_ch_6_proto_stats_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Rates.ProtoReflect.Descriptor instead.
+func (*Rates) Descriptor() ([]byte, []int) {
+	return file_ch_6_proto_stats_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Rates) GetEventsPerSec() *RateWindows {
+	if x != nil {
+		return x.EventsPerSec
+	}
+	return nil
+}
+
+func (x *Rates) GetBotsPerSec() *RateWindows {
+	if x != nil {
+		return x.BotsPerSec
+	}
+	return nil
+}
+
+func (x *Rates) GetNonBotsPerSec() *RateWindows {
+	if x != nil {
+		return x.NonBotsPerSec
+	}
+	return nil
+}
+
+func (x *Rates) GetBotRatio() *RateWindows {
+	if x != nil {
+		return x.BotRatio
+	}
+	return nil
+}
+
+func (x *Rates) GetBotRatioTrend() float64 {
+	if x != nil {
+		return x.BotRatioTrend
+	}
+	return 0
+}
+
+func (x *Rates) GetPeakEventsPerSec() float64 {
+	if x != nil {
+		return x.PeakEventsPerSec
+	}
+	return 0
+}
+
+func (x *Rates) GetPeakAtUnixMs() int64 {
+	if x != nil {
+		return x.PeakAtUnixMs
+	}
+	return 0
+}
+
+var File_ch_6_proto_stats_proto protoreflect.FileDescriptor
+
+const file_ch_6_proto_stats_proto_rawDesc = "" +
+	"\n" +
+	"\x16ch-6/proto/stats.proto\x12\twikimedia\"\xa2\x05\n" +
+	"\x05Stats\x12+\n" +
+	"\x11messages_consumed\x18\x01 \x01(\x03R\x10messagesConsumed\x12J\n" +
+	"\x0edistinct_users\x18\x02 \x03(\v2#.wikimedia.Stats.DistinctUsersEntryR\rdistinctUsers\x12\x1d\n" +
+	"\n" +
+	"bots_count\x18\x03 \x01(\x03R\tbotsCount\x12$\n" +
+	"\x0enon_bots_count\x18\x04 \x01(\x03R\fnonBotsCount\x12Z\n" +
+	"\x14distinct_server_urls\x18\x05 \x03(\v2(.wikimedia.Stats.DistinctServerUrlsEntryR\x12distinctServerUrls\x12;\n" +
+	"\twiki_bots\x18\x06 \x03(\v2\x1e.wikimedia.Stats.WikiBotsEntryR\bwikiBots\x12>\n" +
+	"\n" +
+	"wiki_users\x18\a \x03(\v2\x1f.wikimedia.Stats.WikiUsersEntryR\twikiUsers\x1a@\n" +
+	"\x12DistinctUsersEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x03R\x05value:\x028\x01\x1aE\n" +
+	"\x17DistinctServerUrlsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x03R\x05value:\x028\x01\x1a;\n" +
+	"\rWikiBotsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x03R\x05value:\x028\x01\x1a<\n" +
+	"\x0eWikiUsersEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x03R\x05value:\x028\x01\"\x82\x02\n" +
+	"\rStatsResponse\x12+\n" +
+	"\x11messages_consumed\x18\x01 \x01(\x03R\x10messagesConsumed\x12%\n" +
+	"\x0edistinct_users\x18\x02 \x01(\x03R\rdistinctUsers\x12\x1d\n" +
+	"\n" +
+	"bots_count\x18\x03 \x01(\x03R\tbotsCount\x12$\n" +
+	"\x0enon_bots_count\x18\x04 \x01(\x03R\fnonBotsCount\x120\n" +
+	"\x14distinct_server_urls\x18\x05 \x01(\x03R\x12distinctServerUrls\x12&\n" +
+	"\x05rates\x18\x06 \x01(\v2\x10.wikimedia.RatesR\x05rates\"?\n" +
+	"\vRateWindows\x12\x0e\n" +
+	"\x02m1\x18\x01 \x01(\x01R\x02m1\x12\x0e\n" +
+	"\x02m5\x18\x02 \x01(\x01R\x02m5\x12\x10\n" +
+	"\x03m15\x18\x03 \x01(\x01R\x03m15\"\xf3\x02\n" +
+	"\x05Rates\x12<\n" +
+	"\x0eevents_per_sec\x18\x01 \x01(\v2\x16.wikimedia.RateWindowsR\feventsPerSec\x128\n" +
+	"\fbots_per_sec\x18\x02 \x01(\v2\x16.wikimedia.RateWindowsR\n" +
+	"botsPerSec\x12?\n" +
+	"\x10non_bots_per_sec\x18\x03 \x01(\v2\x16.wikimedia.RateWindowsR\rnonBotsPerSec\x123\n" +
+	"\tbot_ratio\x18\x04 \x01(\v2\x16.wikimedia.RateWindowsR\bbotRatio\x12&\n" +
+	"\x0fbot_ratio_trend\x18\x05 \x01(\x01R\rbotRatioTrend\x12-\n" +
+	"\x13peak_events_per_sec\x18\x06 \x01(\x01R\x10peakEventsPerSec\x12%\n" +
+	"\x0fpeak_at_unix_ms\x18\a \x01(\x03R\fpeakAtUnixMsB:Z8github.com/codyonesock/backend_learning/ch-6/proto;protob\x06proto3"
+
+var (
+	file_ch_6_proto_stats_proto_rawDescOnce sync.Once
+	file_ch_6_proto_stats_proto_rawDescData []byte
+)
+
+func file_ch_6_proto_stats_proto_rawDescGZIP() []byte {
+	file_ch_6_proto_stats_proto_rawDescOnce.Do(func() {
+		file_ch_6_proto_stats_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_ch_6_proto_stats_proto_rawDesc), len(file_ch_6_proto_stats_proto_rawDesc)))
+	})
+	return file_ch_6_proto_stats_proto_rawDescData
+}
+
+var file_ch_6_proto_stats_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
+var file_ch_6_proto_stats_proto_goTypes = []any{
+	(*Stats)(nil),         // 0: wikimedia.Stats
+	(*StatsResponse)(nil), // 1: wikimedia.StatsResponse
+	(*RateWindows)(nil),   // 2: wikimedia.RateWindows
+	(*Rates)(nil),         // 3: wikimedia.Rates
+	nil,                   // 4: wikimedia.Stats.DistinctUsersEntry
+	nil,                   // 5: wikimedia.Stats.DistinctServerUrlsEntry
+	nil,                   // 6: wikimedia.Stats.WikiBotsEntry
+	nil,                   // 7: wikimedia.Stats.WikiUsersEntry
+}
+var file_ch_6_proto_stats_proto_depIdxs = []int32{
+	4, // 0: wikimedia.Stats.distinct_users:type_name -> wikimedia.Stats.DistinctUsersEntry
+	5, // 1: wikimedia.Stats.distinct_server_urls:type_name -> wikimedia.Stats.DistinctServerUrlsEntry
+	6, // 2: wikimedia.Stats.wiki_bots:type_name -> wikimedia.Stats.WikiBotsEntry
+	7, // 3: wikimedia.Stats.wiki_users:type_name -> wikimedia.Stats.WikiUsersEntry
+	3, // 4: wikimedia.StatsResponse.rates:type_name -> wikimedia.Rates
+	2, // 5: wikimedia.Rates.events_per_sec:type_name -> wikimedia.RateWindows
+	2, // 6: wikimedia.Rates.bots_per_sec:type_name -> wikimedia.RateWindows
+	2, // 7: wikimedia.Rates.non_bots_per_sec:type_name -> wikimedia.RateWindows
+	2, // 8: wikimedia.Rates.bot_ratio:type_name -> wikimedia.RateWindows
+	9, // [9:9] is the sub-list for method output_type
+	9, // [9:9] is the sub-list for method input_type
+	9, // [9:9] is the sub-list for extension type_name
+	9, // [9:9] is the sub-list for extension extendee
+	0, // [0:9] is the sub-list for field type_name
+}
+
+func init() { file_ch_6_proto_stats_proto_init() }
+func file_ch_6_proto_stats_proto_init() {
+	if File_ch_6_proto_stats_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_ch_6_proto_stats_proto_rawDesc), len(file_ch_6_proto_stats_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   8,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_ch_6_proto_stats_proto_goTypes,
+		DependencyIndexes: file_ch_6_proto_stats_proto_depIdxs,
+		MessageInfos:      file_ch_6_proto_stats_proto_msgTypes,
+	}.Build()
+	File_ch_6_proto_stats_proto = out.File
+	file_ch_6_proto_stats_proto_goTypes = nil
+	file_ch_6_proto_stats_proto_depIdxs = nil
+}